@@ -0,0 +1,202 @@
+package proxyfs
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/danielthatcher/fusebox"
+	"github.com/elazarl/goproxy"
+)
+
+// maxObserved is the number of out of scope requests remembered.
+const maxObserved = 10000
+
+// observedRequest is the metadata of an out of scope request, which is passed
+// on without being intercepted or recorded in the history.
+type observedRequest struct {
+	Time   time.Time
+	Client string
+	Method string
+	URL    string
+	Status int
+	Length int64
+}
+
+// String returns the request as a tab separated line of its time, client,
+// method, URL, response status and response length. Tunnelled connections
+// have no status or length.
+func (r *observedRequest) String() string {
+	status, length := "-", "-"
+	if r.Status != 0 {
+		status = strconv.Itoa(r.Status)
+		length = strconv.FormatInt(r.Length, 10)
+	}
+	return fmt.Sprintf("%s\t%s\t%s\t%s\t%s\t%s\n", r.Time.Format(time.RFC3339), r.Client, r.Method, r.URL, status, length)
+}
+
+// observedHost is a summary of the out of scope requests to a host.
+type observedHost struct {
+	Host     string
+	Count    int
+	LastSeen time.Time
+}
+
+// observedTraffic holds the metadata of traffic outside of the scope, so that
+// hosts that should be in scope can be noticed without intercepting
+// everything. Bodies aren't kept, and queries are stripped from URLs.
+type observedTraffic struct {
+	mu       sync.RWMutex
+	requests []*observedRequest
+	hosts    map[string]*observedHost
+	modified time.Time
+	Feed     chan []byte
+}
+
+func newObservedTraffic() *observedTraffic {
+	return &observedTraffic{
+		hosts: make(map[string]*observedHost),
+		Feed:  make(chan []byte, 100),
+	}
+}
+
+// Record records an out of scope request to the given host, returning it so
+// that its response can be filled in.
+func (o *observedTraffic) Record(client, method, host, url string) *observedRequest {
+	r := &observedRequest{Time: time.Now(), Client: client, Method: method, URL: url}
+
+	o.mu.Lock()
+	o.requests = append(o.requests, r)
+	if len(o.requests) > maxObserved {
+		o.requests = o.requests[len(o.requests)-maxObserved:]
+	}
+	h, ok := o.hosts[host]
+	if !ok {
+		h = &observedHost{Host: host}
+		o.hosts[host] = h
+	}
+	h.Count++
+	h.LastSeen = r.Time
+	o.modified = r.Time
+	o.mu.Unlock()
+
+	// Tunnels never have a response, so are sent to the feed straight away
+	if method == http.MethodConnect {
+		o.send(r)
+	}
+	return r
+}
+
+// SetResponse fills in the response to a recorded request, and sends the
+// request to the feed.
+func (o *observedTraffic) SetResponse(r *observedRequest, resp *http.Response) {
+	o.mu.Lock()
+	r.Status = resp.StatusCode
+	r.Length = resp.ContentLength
+	o.modified = time.Now()
+	o.mu.Unlock()
+	o.send(r)
+}
+
+// send sends a request to the feed. If nothing is reading the feed and its
+// buffer is full, the request is dropped from the feed.
+func (o *observedTraffic) send(r *observedRequest) {
+	o.mu.RLock()
+	line := r.String()
+	o.mu.RUnlock()
+	select {
+	case o.Feed <- []byte(line):
+	default:
+	}
+}
+
+// Stat returns the number of requests remembered, and when they last changed.
+func (o *observedTraffic) Stat() (int, time.Time) {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	return len(o.requests), o.modified
+}
+
+// Index returns a line for each request remembered, oldest first.
+func (o *observedTraffic) Index() []byte {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	buf := new(bytes.Buffer)
+	for _, r := range o.requests {
+		buf.WriteString(r.String())
+	}
+	return buf.Bytes()
+}
+
+// HostList returns a summary of each host seen, most requested first.
+func (o *observedTraffic) HostList() []observedHost {
+	o.mu.RLock()
+	ret := make([]observedHost, 0, len(o.hosts))
+	for _, h := range o.hosts {
+		ret = append(ret, *h)
+	}
+	o.mu.RUnlock()
+
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].Count != ret[j].Count {
+			return ret[i].Count > ret[j].Count
+		}
+		return ret[i].Host < ret[j].Host
+	})
+	return ret
+}
+
+// Hosts returns a tab separated line for each host seen, giving its name, the
+// number of requests to it and when it was last seen, most requested first.
+func (o *observedTraffic) Hosts() []byte {
+	buf := new(bytes.Buffer)
+	for _, h := range o.HostList() {
+		fmt.Fprintf(buf, "%s\t%d\t%s\n", h.Host, h.Count, h.LastSeen.Format(time.RFC3339))
+	}
+	return buf.Bytes()
+}
+
+// observeRequest records an out of scope request, keeping track of it so its
+// response can be recorded too.
+func (p *Proxy) observeRequest(r *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	u := *r.URL
+	u.RawQuery = ""
+	u.Fragment = ""
+	ctx.UserData = p.All.Record(r.RemoteAddr, r.Method, r.URL.Hostname(), u.String())
+	ctx.RoundTripper = goproxy.RoundTripperFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Response, error) {
+		return p.transportRoundTrip(req)
+	})
+	return r, nil
+}
+
+// observeResponse records the response to an out of scope request.
+func (p *Proxy) observeResponse(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+	if or, ok := ctx.UserData.(*observedRequest); ok && resp != nil {
+		p.All.SetResponse(or, resp)
+	}
+	return resp
+}
+
+// observeConnect records a connection that is tunnelled without being
+// intercepted, since it's out of scope.
+func (p *Proxy) observeConnect(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+	if req := ctx.Req; req != nil {
+		p.All.Record(req.RemoteAddr, http.MethodConnect, req.URL.Hostname(), host)
+	}
+	return goproxy.OkConnect, host
+}
+
+// newAllDir returns a Dir exposing the metadata of out of scope traffic.
+func newAllDir(o *observedTraffic) *fusebox.Dir {
+	ret, d := newNodeDir()
+	d.add("index", newReadOnlyFile(o.Index))
+	d.add("hosts", newReadOnlyFile(o.Hosts))
+	feed := fusebox.NewBytePipeFile(o.Feed)
+	feed.Mode = 0444
+	d.add("feed", feed)
+	return ret
+}
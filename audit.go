@@ -0,0 +1,201 @@
+package proxyfs
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"bazil.org/fuse"
+	"github.com/danielthatcher/fusebox"
+)
+
+// defaultHeaderBaseline is the baseline used until another is written.
+const defaultHeaderBaseline = `# Required headers, with an optional regexp their value must match
+Strict-Transport-Security max-age=[1-9]
+X-Content-Type-Options (?i)^nosniff$
+X-Frame-Options (?i)^(deny|sameorigin)$
+Content-Security-Policy
+Referrer-Policy
+# Forbidden headers
+!Server
+!X-Powered-By
+`
+
+// headerRule is a single line of a header baseline.
+type headerRule struct {
+	Header    string
+	Value     *regexp.Regexp
+	Forbidden bool
+}
+
+// Check returns the way in which the given headers violate the rule, or an
+// empty string if they don't.
+func (r headerRule) Check(h http.Header) string {
+	vals, ok := h[http.CanonicalHeaderKey(r.Header)]
+	switch {
+	case r.Forbidden && ok:
+		return "forbidden " + r.Header
+	case r.Forbidden:
+		return ""
+	case !ok:
+		return "missing " + r.Header
+	case r.Value != nil && !r.Value.MatchString(strings.Join(vals, ", ")):
+		return fmt.Sprintf("invalid %s: %s", r.Header, strings.Join(vals, ", "))
+	}
+	return ""
+}
+
+// headerBaseline is the set of security headers responses are expected to
+// have, which can be read and replaced as a file. Each line of the file is a
+// header that must be present, optionally followed by a regexp its value must
+// match, e.g.
+//
+//	X-Content-Type-Options ^nosniff$
+//
+// Headers prefixed with '!' must not be present. Blank lines and lines
+// starting with '#' are ignored.
+type headerBaseline struct {
+	mu    sync.RWMutex
+	src   []byte
+	rules []headerRule
+}
+
+func newHeaderBaseline() *headerBaseline {
+	rules, err := parseHeaderBaseline(defaultHeaderBaseline)
+	if err != nil {
+		panic(err)
+	}
+	return &headerBaseline{src: []byte(defaultHeaderBaseline), rules: rules}
+}
+
+// parseHeaderBaseline parses rules in the format described for
+// headerBaseline.
+func parseHeaderBaseline(src string) ([]headerRule, error) {
+	ret := make([]headerRule, 0)
+	for _, line := range strings.Split(src, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		parts := strings.SplitN(line, " ", 2)
+		r := headerRule{Header: parts[0]}
+		if strings.HasPrefix(r.Header, "!") {
+			r.Header = r.Header[1:]
+			r.Forbidden = true
+		}
+		if r.Header == "" {
+			return nil, fmt.Errorf("missing header name")
+		}
+		if len(parts) == 2 {
+			if r.Forbidden {
+				return nil, fmt.Errorf("forbidden header %s can't have a value", r.Header)
+			}
+			re, err := regexp.Compile(strings.TrimSpace(parts[1]))
+			if err != nil {
+				return nil, err
+			}
+			r.Value = re
+		}
+		ret = append(ret, r)
+	}
+
+	return ret, nil
+}
+
+// Violations returns the ways the given response violates the baseline.
+func (b *headerBaseline) Violations(resp *http.Response) []string {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	ret := make([]string, 0)
+	for _, r := range b.rules {
+		if v := r.Check(resp.Header); v != "" {
+			ret = append(ret, v)
+		}
+	}
+	return ret
+}
+
+func (b *headerBaseline) ValRead(ctx context.Context) ([]byte, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.src, nil
+}
+
+func (b *headerBaseline) ValWrite(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+	rules, err := parseHeaderBaseline(string(req.Data))
+	if err != nil {
+		return errInvalid
+	}
+
+	b.mu.Lock()
+	b.src = append([]byte(nil), req.Data...)
+	b.rules = rules
+	b.mu.Unlock()
+
+	resp.Size = len(req.Data)
+	return nil
+}
+
+func (b *headerBaseline) Size(ctx context.Context) (uint64, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return uint64(len(b.src)), nil
+}
+
+// headerReport checks the responses in the history against the baseline,
+// returning a line for each way each host and path violates it, followed by
+// the IDs of the entries it was seen in. Redirects and errors are skipped, as
+// they're rarely rendered.
+func (p *Proxy) headerReport() []byte {
+	type violation struct {
+		Target string
+		Detail string
+	}
+	seen := make(map[violation][]int)
+	order := make([]violation, 0)
+	for _, e := range p.History.Entries() {
+		resp := e.Response()
+		if resp == nil || resp.StatusCode >= 300 && resp.StatusCode < 400 || resp.StatusCode >= 500 {
+			continue
+		}
+
+		target := e.Req.URL.Host + e.Req.URL.Path
+		for _, v := range p.Baseline.Violations(resp) {
+			k := violation{target, v}
+			if _, ok := seen[k]; !ok {
+				order = append(order, k)
+			}
+			seen[k] = append(seen[k], e.ID)
+		}
+	}
+
+	sort.SliceStable(order, func(i, j int) bool { return order[i].Target < order[j].Target })
+	buf := new(bytes.Buffer)
+	for _, v := range order {
+		ids := make([]string, len(seen[v]))
+		for i, id := range seen[v] {
+			ids[i] = strconv.Itoa(id)
+		}
+		fmt.Fprintf(buf, "%s\t%s\t%s\n", v.Target, v.Detail, strings.Join(ids, ","))
+	}
+	return buf.Bytes()
+}
+
+// newAuditDir returns a Dir holding the header baseline and the report of
+// the responses in the history that violate it, and the log of changes made
+// through the filesystem.
+func newAuditDir(p *Proxy) *fusebox.Dir {
+	ret, d := newNodeDir()
+	d.add("baseline", newHandleFile(p.Baseline))
+	d.add("report", newReadOnlyFile(p.headerReport))
+	d.add("log", newReadOnlyFile(p.Audit.Bytes))
+	return ret
+}
@@ -0,0 +1,304 @@
+package proxyfs
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"github.com/danielthatcher/fusebox"
+)
+
+// auditFS serves the proxy's filesystem through one mount or socket,
+// recording the changes made through it in the audit log. It's served to
+// users through a roleFS, so only the changes their roles allow reach it.
+type auditFS struct {
+	fs    fs.FS
+	audit *auditLog
+
+	// Where the filesystem is served, e.g. the mountpoint
+	via string
+
+	// Whether requests carry the user making them, which they don't over SFTP
+	uids bool
+
+	// Marks the proxy as degraded when writing through a handle panics
+	degrade func(format string, args ...interface{})
+}
+
+// newAuditFS returns the proxy's filesystem as it's served through the given
+// mountpoint or socket.
+func newAuditFS(p *Proxy, via string, uids bool) *auditFS {
+	return &auditFS{fs: p.FS, audit: p.Audit, via: via, uids: uids, degrade: p.degrade}
+}
+
+func (f *auditFS) Root() (fs.Node, error) {
+	root, err := f.fs.Root()
+	if err != nil {
+		return nil, err
+	}
+	return &auditNode{Node: root, fs: f}, nil
+}
+
+// record adds a change made by the user in the given request header to the
+// audit log.
+func (f *auditFS) record(h fuse.Header, action string, path []string, old, new []byte) {
+	r := &auditRecord{
+		Time:   time.Now(),
+		Via:    f.via,
+		Action: action,
+		Path:   strings.Join(path, "/"),
+		Old:    truncateAudit(old),
+		New:    truncateAudit(new),
+	}
+	if f.uids {
+		uid := h.Uid
+		r.UID = &uid
+	}
+	f.audit.Append(r)
+}
+
+// auditNode wraps a node, recording changes to it and its children. Nodes
+// looked up through it are wrapped in turn. Opening it for reading returns
+// the wrapped node's own handle, so reads behave exactly as they would without
+// the wrapper, and opening it for writing returns an auditHandle.
+type auditNode struct {
+	fs.Node
+	fs   *auditFS
+	path []string
+}
+
+// child returns the path of the child with the given name.
+func (n *auditNode) child(name string) []string {
+	return append(append([]string(nil), n.path...), name)
+}
+
+// wrap returns the given child node wrapped.
+func (n *auditNode) wrap(node fs.Node, name string) *auditNode {
+	return &auditNode{Node: node, fs: n.fs, path: n.child(name)}
+}
+
+func (n *auditNode) Lookup(ctx context.Context, name string) (fs.Node, error) {
+	dir, ok := n.Node.(fs.NodeStringLookuper)
+	if !ok {
+		return nil, fuse.Errno(syscall.ENOTDIR)
+	}
+	node, err := dir.Lookup(ctx, name)
+	if err != nil || node == nil {
+		return node, err
+	}
+	return n.wrap(node, name), nil
+}
+
+func (n *auditNode) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	dir, ok := n.Node.(fs.HandleReadDirAller)
+	if !ok {
+		return nil, fuse.Errno(syscall.ENOTDIR)
+	}
+	return dir.ReadDirAll(ctx)
+}
+
+func (n *auditNode) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (fs.Handle, error) {
+	write := !req.Flags.IsReadOnly() || req.Flags&fuse.OpenTruncate != 0
+	var old []byte
+	if write {
+		old = nodeValue(ctx, n.Node)
+	}
+	var h fs.Handle = n.Node
+	if o, ok := n.Node.(fs.NodeOpener); ok {
+		var err error
+		if h, err = o.Open(ctx, req, resp); err != nil {
+			return nil, err
+		}
+	}
+	if !write {
+		return h, nil
+	}
+	return &auditHandle{Handle: h, node: n, header: req.Header, old: old, written: req.Flags&fuse.OpenTruncate != 0}, nil
+}
+
+func (n *auditNode) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse.SetattrResponse) error {
+	if s, ok := n.Node.(fs.NodeSetattrer); ok {
+		return s.Setattr(ctx, req, resp)
+	}
+	return nil
+}
+
+func (n *auditNode) Fsync(ctx context.Context, req *fuse.FsyncRequest) error {
+	if s, ok := n.Node.(fs.NodeFsyncer); ok {
+		return s.Fsync(ctx, req)
+	}
+	return nil
+}
+
+func (n *auditNode) Mkdir(ctx context.Context, req *fuse.MkdirRequest) (fs.Node, error) {
+	m, ok := n.Node.(fs.NodeMkdirer)
+	if !ok {
+		return nil, fuse.EPERM
+	}
+	node, err := m.Mkdir(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	n.fs.record(req.Header, "mkdir", n.child(req.Name), nil, nil)
+	return n.wrap(node, req.Name), nil
+}
+
+func (n *auditNode) Create(ctx context.Context, req *fuse.CreateRequest, resp *fuse.CreateResponse) (fs.Node, fs.Handle, error) {
+	c, ok := n.Node.(fs.NodeCreater)
+	if !ok {
+		return nil, nil, fuse.EPERM
+	}
+	node, h, err := c.Create(ctx, req, resp)
+	if err != nil {
+		return nil, nil, err
+	}
+	n.fs.record(req.Header, "create", n.child(req.Name), nil, nil)
+	child := n.wrap(node, req.Name)
+	return child, &auditHandle{Handle: h, node: child, header: req.Header}, nil
+}
+
+func (n *auditNode) Remove(ctx context.Context, req *fuse.RemoveRequest) error {
+	r, ok := n.Node.(fs.NodeRemover)
+	if !ok {
+		return fuse.EPERM
+	}
+
+	// What a removed file held is kept
+	var old []byte
+	if dir, ok := n.Node.(fs.NodeStringLookuper); ok && !req.Dir {
+		if node, err := dir.Lookup(ctx, req.Name); err == nil && node != nil {
+			old = nodeValue(ctx, node)
+		}
+	}
+	if err := r.Remove(ctx, req); err != nil {
+		return err
+	}
+	n.fs.record(req.Header, "remove", n.child(req.Name), old, nil)
+	return nil
+}
+
+func (n *auditNode) Rename(ctx context.Context, req *fuse.RenameRequest, newDir fs.Node) error {
+	to, ok := newDir.(*auditNode)
+	if !ok {
+		return fuse.EPERM
+	}
+	r, ok := n.Node.(fs.NodeRenamer)
+	if !ok {
+		return fuse.EPERM
+	}
+	if err := r.Rename(ctx, req, to.Node); err != nil {
+		return err
+	}
+	newPath := strings.Join(to.child(req.NewName), "/")
+	n.fs.record(req.Header, "rename", n.child(req.OldName), nil, []byte(newPath))
+	return nil
+}
+
+// nodeValue returns the value of a file, or nothing if it isn't one whose
+// value can be read without side effects, such as a pipe.
+func nodeValue(ctx context.Context, node fs.Node) []byte {
+	var f *fusebox.File
+	switch n := node.(type) {
+	case *handleFile:
+		f = n.File
+	case *fusebox.File:
+		f = n
+	}
+
+	// Pipes and other files that can't be written to are left alone
+	if f == nil || f.Element == nil || f.Mode&0222 == 0 {
+		return nil
+	}
+	data, err := f.Element.ValRead(ctx)
+	if err != nil {
+		return nil
+	}
+	return append([]byte(nil), data...)
+}
+
+// auditHandle is a handle opened for writing through an auditNode. Once
+// what's written has been committed, which is when the handle is flushed,
+// the change is recorded in the audit log along with the file's previous
+// value.
+type auditHandle struct {
+	fs.Handle
+	node   *auditNode
+	header fuse.Header
+	old    []byte
+
+	mu      sync.Mutex
+	written bool
+}
+
+func (h *auditHandle) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
+	if r, ok := h.Handle.(fs.HandleReader); ok {
+		return r.Read(ctx, req, resp)
+	}
+	r, ok := h.Handle.(fs.HandleReadAller)
+	if !ok {
+		return fuse.EPERM
+	}
+	data, err := r.ReadAll(ctx)
+	if err != nil {
+		return err
+	}
+	if req.Offset < int64(len(data)) {
+		data = data[req.Offset:]
+		if len(data) > req.Size {
+			data = data[:req.Size]
+		}
+		resp.Data = data
+	}
+	return nil
+}
+
+func (h *auditHandle) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) (err error) {
+	defer catchPanic(h.node.fs.degrade, "write", h.node.path, &err)
+	w, ok := h.Handle.(fs.HandleWriter)
+	if !ok {
+		return fuse.EPERM
+	}
+	if err := w.Write(ctx, req, resp); err != nil {
+		return err
+	}
+	h.mu.Lock()
+	h.written = true
+	h.mu.Unlock()
+	return nil
+}
+
+func (h *auditHandle) Flush(ctx context.Context, req *fuse.FlushRequest) (err error) {
+	defer catchPanic(h.node.fs.degrade, "flush", h.node.path, &err)
+	if f, ok := h.Handle.(fs.HandleFlusher); ok {
+		if err := f.Flush(ctx, req); err != nil {
+			return err
+		}
+	}
+	h.commit(ctx)
+	return nil
+}
+
+func (h *auditHandle) Release(ctx context.Context, req *fuse.ReleaseRequest) error {
+	if r, ok := h.Handle.(fs.HandleReleaser); ok {
+		return r.Release(ctx, req)
+	}
+	return nil
+}
+
+// commit records what's been written since the handle was last flushed.
+func (h *auditHandle) commit(ctx context.Context) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.written {
+		return
+	}
+	h.written = false
+
+	new := nodeValue(ctx, h.node.Node)
+	h.node.fs.record(h.header, "write", h.node.path, h.old, new)
+	h.old = new
+}
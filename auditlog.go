@@ -0,0 +1,152 @@
+package proxyfs
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// auditValueMax is the most of a value that's kept in an audit record, so
+// that rewriting a large body doesn't copy it into the log.
+const auditValueMax = 4096
+
+// auditRecord is a change made through the filesystem.
+type auditRecord struct {
+	Time time.Time `json:"time"`
+
+	// Where the change was made, e.g. the mountpoint, and the user that made
+	// it, if known
+	Via string  `json:"via"`
+	UID *uint32 `json:"uid,omitempty"`
+
+	// What was done, e.g. write or remove, and to which path
+	Action string `json:"action"`
+	Path   string `json:"path"`
+
+	// The value of the file before and after the change, where it has one
+	Old []byte `json:"old,omitempty"`
+	New []byte `json:"new,omitempty"`
+}
+
+// truncateAudit returns as much of a value as is kept in an audit record.
+func truncateAudit(val []byte) []byte {
+	if len(val) > auditValueMax {
+		val = val[:auditValueMax]
+	}
+	return val
+}
+
+// String returns the record as a line of the audit log.
+func (r *auditRecord) String() string {
+	user := "-"
+	if r.UID != nil {
+		user = strconv.FormatUint(uint64(*r.UID), 10)
+	}
+	ret := fmt.Sprintf("%s uid=%s via=%s %s %s", r.Time.UTC().Format(time.RFC3339), user, r.Via, r.Action, r.Path)
+	switch r.Action {
+	case "write", "remove":
+		ret += fmt.Sprintf(" %q -> %q", r.Old, r.New)
+	case "rename":
+		ret += " -> " + string(r.New)
+	}
+	return ret
+}
+
+// auditLog is the append-only record of every change made through the
+// filesystem, for engagements where what the tester altered has to be
+// traceable. It's kept in the store if there is one, and otherwise in the
+// project's audit file.
+type auditLog struct {
+	mu      sync.RWMutex
+	records []*auditRecord
+	store   historyStore
+	file    *os.File
+}
+
+func newAuditLog() *auditLog {
+	return &auditLog{records: make([]*auditRecord, 0)}
+}
+
+// Append adds a record to the end of the log.
+func (l *auditLog) Append(r *auditRecord) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.records = append(l.records, r)
+
+	if l.store != nil {
+		if err := l.store.AppendAudit(r); err != nil {
+			log.Printf("Failed to save audit record: %v\n", err)
+		}
+	} else if l.file != nil {
+		data, err := json.Marshal(r)
+		if err == nil {
+			_, err = l.file.Write(append(data, '\n'))
+		}
+		if err != nil {
+			log.Printf("Failed to save audit record: %v\n", err)
+		}
+	}
+}
+
+// SetStore makes the log be kept in the given store, taking up the records
+// already saved in it.
+func (l *auditLog) SetStore(s historyStore) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.store = s
+	return s.LoadAudit(func(r *auditRecord) {
+		l.records = append(l.records, r)
+	})
+}
+
+// SetFile makes the log be appended to the file at the given path, taking up
+// the records already in it.
+func (l *auditLog) SetFile(path string) error {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+
+	loaded := make([]*auditRecord, 0)
+	s := bufio.NewScanner(f)
+	s.Buffer(nil, 1<<20)
+	for s.Scan() {
+		r := &auditRecord{}
+		if err := json.Unmarshal(s.Bytes(), r); err != nil {
+			f.Close()
+			return fmt.Errorf("loading audit log: %v", err)
+		}
+		loaded = append(loaded, r)
+	}
+	if err := s.Err(); err != nil {
+		f.Close()
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file != nil {
+		l.file.Close()
+	}
+	l.records = append(loaded, l.records...)
+	l.file = f
+	return nil
+}
+
+// Bytes returns the log, a line per record.
+func (l *auditLog) Bytes() []byte {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	buf := new(bytes.Buffer)
+	for _, r := range l.records {
+		buf.WriteString(r.String())
+		buf.WriteString("\n")
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,217 @@
+package proxyfs
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/danielthatcher/fusebox"
+)
+
+// samlParams are the parameters that carry SAML messages in the HTTP POST and
+// redirect bindings.
+var samlParams = []string{"SAMLRequest", "SAMLResponse"}
+
+// requestParams returns the parameters of the request from both its query
+// string and, for URL encoded forms, its body.
+func requestParams(req *http.Request) url.Values {
+	ret := req.URL.Query()
+	ct, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if ct != "application/x-www-form-urlencoded" {
+		return ret
+	}
+
+	form, err := url.ParseQuery(string(peekBody(&req.Body)))
+	if err != nil {
+		return ret
+	}
+	for k, v := range form {
+		ret[k] = append(ret[k], v...)
+	}
+
+	return ret
+}
+
+// isSAML returns whether the request carries a SAML message.
+func isSAML(req *http.Request) bool {
+	params := requestParams(req)
+	for _, p := range samlParams {
+		if params.Get(p) != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// decodeSAML decodes a SAML message parameter. Messages are base64 encoded,
+// and in the redirect binding are also DEFLATE compressed.
+func decodeSAML(v string) []byte {
+	data, err := base64.StdEncoding.DecodeString(strings.TrimSpace(v))
+	if err != nil {
+		return nil
+	}
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("<")) {
+		return data
+	}
+
+	inflated, err := ioutil.ReadAll(flate.NewReader(bytes.NewReader(data)))
+	if err != nil {
+		return data
+	}
+	return inflated
+}
+
+// newSAMLDir returns a Dir with the decoded XML of each SAML message in the
+// request, along with the RelayState if there is one.
+func newSAMLDir(req *http.Request) *fusebox.Dir {
+	ret, d := newNodeDir()
+	params := requestParams(req)
+	for _, p := range samlParams {
+		if v := params.Get(p); v != "" {
+			d.add(p, newReadOnlyFile(func() []byte {
+				return decodeSAML(v)
+			}))
+		}
+	}
+	if v := params.Get("RelayState"); v != "" {
+		d.add("RelayState", newReadOnlyFile(func() []byte {
+			return []byte(v)
+		}))
+	}
+
+	return ret
+}
+
+// oauthRequestKind returns the stage of an OAuth flow that the request
+// belongs to, or an empty string if it doesn't look like part of one.
+func oauthRequestKind(req *http.Request) string {
+	params := requestParams(req)
+	switch {
+	case params.Get("grant_type") != "" && req.Method == http.MethodPost:
+		return "token-request"
+	case params.Get("response_type") != "" && params.Get("client_id") != "":
+		return "authorization-request"
+	case params.Get("code") != "" && params.Get("state") != "":
+		return "authorization-response"
+	case params.Get("error") != "" && params.Get("state") != "":
+		return "authorization-error"
+	}
+
+	return ""
+}
+
+// newOAuthReqDir returns a Dir describing the OAuth stage of a request, with
+// a file for each of its parameters.
+func newOAuthReqDir(req *http.Request) *fusebox.Dir {
+	ret, d := newNodeDir()
+	d.add("type", newReadOnlyFile(func() []byte {
+		return []byte(oauthRequestKind(req))
+	}))
+
+	params := requestParams(req)
+	keys := make([]string, 0, len(params))
+	for k := range params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		v := params.Get(k)
+		d.add(k, newReadOnlyFile(func() []byte {
+			return []byte(v)
+		}))
+	}
+
+	return ret
+}
+
+// oauthTokenResponse returns the fields of an OAuth token response, or nil if
+// the response isn't one.
+func oauthTokenResponse(resp *http.Response) map[string]interface{} {
+	ct, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if !strings.HasSuffix(ct, "json") {
+		return nil
+	}
+
+	var ret map[string]interface{}
+	if err := json.Unmarshal(peekBody(&resp.Body), &ret); err != nil {
+		return nil
+	}
+	if _, ok := ret["access_token"]; !ok {
+		if _, ok := ret["id_token"]; !ok {
+			return nil
+		}
+	}
+
+	return ret
+}
+
+// newOAuthRespDir returns a Dir with a file for each field of a token
+// response. Tokens that are JWTs also get a file with their decoded claims.
+func newOAuthRespDir(fields map[string]interface{}) *fusebox.Dir {
+	ret, d := newNodeDir()
+	d.add("type", newReadOnlyFile(func() []byte {
+		return []byte("token-response")
+	}))
+
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		v, ok := fields[k].(string)
+		if !ok {
+			b, _ := json.Marshal(fields[k])
+			v = string(b)
+		}
+		d.add(k, newReadOnlyFile(func() []byte {
+			return []byte(v)
+		}))
+
+		if j, err := parseJWT(v); err == nil {
+			d.add(k+".claims", newReadOnlyFile(func() []byte {
+				buf := new(bytes.Buffer)
+				if err := json.Indent(buf, j.Claims, "", "  "); err != nil {
+					return j.Claims
+				}
+				return buf.Bytes()
+			}))
+		}
+	}
+
+	return ret
+}
+
+// addReqFlowNodes adds saml and oauth directories to a request directory if
+// the request is part of a SAML or OAuth flow.
+func addReqFlowNodes(e *reqDirElement) {
+	req := e.Data
+	if isSAML(req) {
+		e.addNode("saml", true, func() fusebox.VarNode {
+			return newSAMLDir(req)
+		})
+	}
+	if oauthRequestKind(req) != "" {
+		e.addNode("oauth", true, func() fusebox.VarNode {
+			return newOAuthReqDir(req)
+		})
+	}
+}
+
+// addRespFlowNodes adds an oauth directory to a response directory if the
+// response is an OAuth token response.
+func addRespFlowNodes(e *respDirElement) {
+	resp := e.Data
+	if oauthTokenResponse(resp) != nil {
+		e.addNode("oauth", true, func() fusebox.VarNode {
+			return newOAuthRespDir(oauthTokenResponse(resp))
+		})
+	}
+}
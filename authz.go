@@ -0,0 +1,192 @@
+package proxyfs
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+)
+
+// authzTolerance is how much the length of a replayed response's body can
+// differ from the original's, as a fraction of it, for the two to be similar.
+const authzTolerance = 0.1
+
+// authzMinSimilarity is the least similarity, from 0 to 100, a replayed
+// response's body can have to the original's for the two to be similar.
+const authzMinSimilarity = 80
+
+// authzAnonymous is the session given to replay a request without any
+// identity.
+const authzAnonymous = "-"
+
+// authzIdentityHeaders are the headers carrying the identity a request was
+// sent with, which are removed from every replay so that the only identity it
+// carries is its session's.
+var authzIdentityHeaders = []string{"Cookie", "Authorization", "Proxy-Authorization"}
+
+// authzVerdict returns what a replayed response suggests about the access
+// control of a request, given the status and body length of the original
+// response and of the replay, and the similarity of their bodies: "denied" if
+// the replay was refused, "similar" if it got much the same response as the
+// original, which suggests that access isn't being controlled, and "different"
+// otherwise.
+func authzVerdict(origStatus, origLen, status, length, score int) string {
+	if status == http.StatusUnauthorized || status == http.StatusForbidden {
+		return "denied"
+	}
+	diff := length - origLen
+	if diff < 0 {
+		diff = -diff
+	}
+	if status == origStatus && float64(diff) <= authzTolerance*float64(origLen) && score >= authzMinSimilarity {
+		return "similar"
+	}
+	return "different"
+}
+
+// authzCheck is a run of replaying a request as another session, comparing
+// the response with the one the original got.
+type authzCheck struct {
+	mu       sync.Mutex
+	Session  string
+	Started  time.Time
+	Finished time.Time
+	status   int
+	length   int
+	score    int
+	verdict  string
+	err      error
+}
+
+// Running returns whether the check is still in progress.
+func (c *authzCheck) Running() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.Finished.IsZero()
+}
+
+// run replays the entry's request as the check's session, adding a finding to
+// the list if the response is similar to the original. The replay keeps none
+// of the original's identity, only the session's cookies and headers.
+func (c *authzCheck) run(p *Proxy, e *historyEntry, orig *http.Response, l *findingList) {
+	r := prepareResend(e.Req)
+	for _, h := range authzIdentityHeaders {
+		r.Header.Del(h)
+	}
+	if s := p.Sessions.Find(c.Session); s != nil {
+		s.Apply(r, p.Vars)
+	}
+
+	origBody := peekBody(&orig.Body)
+	origLen := len(origBody)
+	resp, err := p.send(r)
+	status, length, score, verdict := 0, 0, 0, ""
+	if err == nil {
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if s := p.Sessions.Find(c.Session); s != nil {
+			s.Jar.Update(resp)
+		}
+		status, length = resp.StatusCode, len(body)
+		score = bodySimilarity(origBody, body)
+		verdict = authzVerdict(orig.StatusCode, origLen, status, length, score)
+	}
+
+	c.mu.Lock()
+	c.status, c.length, c.score, c.verdict, c.err = status, length, score, verdict, err
+	c.Finished = time.Now()
+	c.mu.Unlock()
+
+	if verdict == "similar" {
+		target := e.Req.Method + " " + e.Req.URL.String()
+		who := "as " + c.Session
+		if c.Session == authzAnonymous {
+			who = "without an identity"
+		}
+		detail := fmt.Sprintf("%s: %s got %d with %d bytes, %d%% similar to the original's %d with %d", target, who, status, length, score, orig.StatusCode, origLen)
+		l.Add(verdict, c.Session+":"+target, detail, fmt.Sprintf("history/%d", e.ID))
+	}
+}
+
+// Report returns the session the request was replayed as, the status and
+// body length of the original response and the replay, the similarity of their
+// bodies, and the verdict.
+func (c *authzCheck) Report(orig *http.Response) []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	buf := new(bytes.Buffer)
+	state := "finished"
+	if c.Finished.IsZero() {
+		state = "running"
+	}
+	fmt.Fprintf(buf, "state: %s\n", state)
+	fmt.Fprintf(buf, "session: %s\n", c.Session)
+	fmt.Fprintf(buf, "original: %d\t%d\n", orig.StatusCode, len(peekBody(&orig.Body)))
+	if c.err != nil {
+		fmt.Fprintf(buf, "error: %v\n", c.err)
+	} else if !c.Finished.IsZero() {
+		fmt.Fprintf(buf, "replay: %d\t%d\n", c.status, c.length)
+		fmt.Fprintf(buf, "similarity: %d\n", c.score)
+		fmt.Fprintf(buf, "verdict: %s\n", c.verdict)
+	}
+	return buf.Bytes()
+}
+
+// authzFile starts an authorization check of a history entry's request when
+// the name of a session, or "-" for none, is written to it. Reading it gives
+// the report of the last check.
+type authzFile struct {
+	Proxy *Proxy
+	Entry *historyEntry
+}
+
+func (f *authzFile) ValRead(ctx context.Context) ([]byte, error) {
+	f.Entry.mu.RLock()
+	c := f.Entry.authz
+	f.Entry.mu.RUnlock()
+	orig := f.Entry.Response()
+	if c == nil || orig == nil {
+		return nil, nil
+	}
+
+	return c.Report(orig), nil
+}
+
+func (f *authzFile) ValWrite(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+	session := strings.TrimSpace(string(req.Data))
+	orig := f.Entry.Response()
+	if orig == nil || (session != authzAnonymous && f.Proxy.Sessions.Find(session) == nil) {
+		return errInvalid
+	}
+
+	if !f.Proxy.mayResend(f.Entry.Req, false) {
+		return errUnsafe
+	}
+
+	f.Entry.mu.Lock()
+	if f.Entry.authz != nil && f.Entry.authz.Running() {
+		f.Entry.mu.Unlock()
+		return fuse.Errno(syscall.EBUSY)
+	}
+	c := &authzCheck{Session: session, Started: time.Now()}
+	f.Entry.authz = c
+	f.Entry.mu.Unlock()
+
+	go c.run(f.Proxy, f.Entry, orig, f.Proxy.Findings.Category("authz"))
+
+	resp.Size = len(req.Data)
+	return nil
+}
+
+func (f *authzFile) Size(ctx context.Context) (uint64, error) {
+	data, _ := f.ValRead(ctx)
+	return uint64(len(data)), nil
+}
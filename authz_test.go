@@ -0,0 +1,57 @@
+package proxyfs
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"bazil.org/fuse"
+)
+
+// TestAuthzReplayIdentity checks that a request replayed as a session that
+// only has cookies is sent with the session's cookies and none of the
+// original's credentials.
+func TestAuthzReplayIdentity(t *testing.T) {
+	var got http.Header
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Clone()
+		w.Write([]byte("account details"))
+	}))
+	defer srv.Close()
+
+	p, err := NewProxy(".*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, _ := url.Parse(srv.URL)
+	jar := []byte(u.Hostname() + " / sid=bob\n")
+	if err := p.Sessions.Get("bob").Jar.ValWrite(context.Background(), &fuse.WriteRequest{Data: jar}, &fuse.WriteResponse{}); err != nil {
+		t.Fatal(err)
+	}
+
+	req, _ := http.NewRequest("GET", srv.URL+"/account", nil)
+	req.Header.Set("Authorization", "Bearer admin-token")
+	req.Header.Set("Proxy-Authorization", "Basic YWRtaW46YWRtaW4=")
+	req.Header.Set("Cookie", "sid=admin")
+	e := &historyEntry{Req: req}
+	orig := &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader("account details"))}
+
+	c := &authzCheck{Session: "bob"}
+	c.run(p, e, orig, p.Findings.Category("authz"))
+
+	if got == nil {
+		t.Fatalf("replay wasn't sent: %s", c.Report(orig))
+	}
+	for _, h := range []string{"Authorization", "Proxy-Authorization"} {
+		if v := got.Get(h); v != "" {
+			t.Errorf("replay was sent with %s: %s", h, v)
+		}
+	}
+	if v := got.Get("Cookie"); v != "sid=bob" {
+		t.Errorf("replay was sent with cookies %q, expected the session's", v)
+	}
+}
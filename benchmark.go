@@ -0,0 +1,219 @@
+package proxyfs
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+)
+
+// benchmark is a run of repeatedly sending a request, recording the latency
+// and status of each response.
+type benchmark struct {
+	mu          sync.Mutex
+	Count       int
+	Concurrency int
+	Started     time.Time
+	Finished    time.Time
+	latencies   []time.Duration
+	statuses    map[string]int
+}
+
+func newBenchmark(count, concurrency int) *benchmark {
+	return &benchmark{
+		Count:       count,
+		Concurrency: concurrency,
+		Started:     time.Now(),
+		statuses:    make(map[string]int),
+	}
+}
+
+// Running returns whether the benchmark is still in progress.
+func (b *benchmark) Running() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.Finished.IsZero()
+}
+
+// run sends the request Count times, with up to Concurrency requests in flight.
+func (b *benchmark) run(p *Proxy, req *http.Request) {
+	// Copying the request reads its body, so must only be done by one worker
+	// at a time
+	prepMu := &sync.Mutex{}
+	jobs := make(chan struct{})
+	wg := &sync.WaitGroup{}
+	for i := 0; i < b.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range jobs {
+				prepMu.Lock()
+				r := prepareResend(req)
+				prepMu.Unlock()
+
+				start := time.Now()
+				resp, err := p.send(r)
+				status := "error"
+				if err == nil {
+					io.Copy(ioutil.Discard, resp.Body)
+					resp.Body.Close()
+					status = strconv.Itoa(resp.StatusCode)
+				}
+				b.record(time.Since(start), status)
+			}
+		}()
+	}
+
+	for i := 0; i < b.Count; i++ {
+		jobs <- struct{}{}
+	}
+	close(jobs)
+	wg.Wait()
+
+	b.mu.Lock()
+	b.Finished = time.Now()
+	b.mu.Unlock()
+}
+
+func (b *benchmark) record(latency time.Duration, status string) {
+	b.mu.Lock()
+	b.latencies = append(b.latencies, latency)
+	b.statuses[status]++
+	b.mu.Unlock()
+}
+
+// Report returns a summary of the benchmark's progress or results, including
+// latency percentiles and the distribution of statuses.
+func (b *benchmark) Report() []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	buf := new(bytes.Buffer)
+	state := "finished"
+	elapsed := b.Finished.Sub(b.Started)
+	if b.Finished.IsZero() {
+		state = "running"
+		elapsed = time.Since(b.Started)
+	}
+	fmt.Fprintf(buf, "state: %s\n", state)
+	fmt.Fprintf(buf, "completed: %d/%d\n", len(b.latencies), b.Count)
+	fmt.Fprintf(buf, "concurrency: %d\n", b.Concurrency)
+	fmt.Fprintf(buf, "elapsed: %v\n", elapsed)
+
+	sorted := append([]time.Duration(nil), b.latencies...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	buf.Write(latencySummary(sorted))
+
+	statuses := make([]string, 0, len(b.statuses))
+	for s := range b.statuses {
+		statuses = append(statuses, s)
+	}
+	sort.Strings(statuses)
+	for _, s := range statuses {
+		fmt.Fprintf(buf, "status %s: %d\n", s, b.statuses[s])
+	}
+
+	return buf.Bytes()
+}
+
+// latencySummary returns the minimum, maximum, mean and common percentiles of
+// the given sorted latencies.
+func latencySummary(sorted []time.Duration) []byte {
+	if len(sorted) == 0 {
+		return nil
+	}
+
+	var total time.Duration
+	for _, l := range sorted {
+		total += l
+	}
+
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, "min: %v\n", sorted[0])
+	fmt.Fprintf(buf, "mean: %v\n", total/time.Duration(len(sorted)))
+	for _, q := range []int{50, 90, 95, 99} {
+		fmt.Fprintf(buf, "p%d: %v\n", q, sorted[percentileIndex(len(sorted), q)])
+	}
+	fmt.Fprintf(buf, "max: %v\n", sorted[len(sorted)-1])
+	return buf.Bytes()
+}
+
+// percentileIndex returns the index of the qth percentile in a sorted list of
+// n values, using the nearest rank method.
+func percentileIndex(n, q int) int {
+	i := (q*n+99)/100 - 1
+	if i < 0 {
+		return 0
+	}
+	return i
+}
+
+// benchmarkFile starts benchmarks of a history entry's request when written
+// to, with the number of requests to send and optionally the concurrency,
+// e.g. "100 10". Reading it gives the report of the last benchmark.
+type benchmarkFile struct {
+	Proxy *Proxy
+	Entry *historyEntry
+}
+
+func (f *benchmarkFile) ValRead(ctx context.Context) ([]byte, error) {
+	f.Entry.mu.RLock()
+	b := f.Entry.bench
+	f.Entry.mu.RUnlock()
+	if b == nil {
+		return nil, nil
+	}
+
+	return b.Report(), nil
+}
+
+func (f *benchmarkFile) ValWrite(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+	fields := strings.Fields(string(req.Data))
+	if len(fields) == 0 || len(fields) > 2 {
+		return errInvalid
+	}
+	count, err := strconv.Atoi(fields[0])
+	if err != nil || count <= 0 {
+		return errInvalid
+	}
+	concurrency := 1
+	if len(fields) == 2 {
+		concurrency, err = strconv.Atoi(fields[1])
+		if err != nil || concurrency <= 0 {
+			return errInvalid
+		}
+	}
+
+	if !f.Proxy.mayResend(f.Entry.Req, false) {
+		return errUnsafe
+	}
+
+	f.Entry.mu.Lock()
+	if f.Entry.bench != nil && f.Entry.bench.Running() {
+		f.Entry.mu.Unlock()
+		return fuse.Errno(syscall.EBUSY)
+	}
+	b := newBenchmark(count, concurrency)
+	f.Entry.bench = b
+	f.Entry.mu.Unlock()
+
+	go b.run(f.Proxy, f.Entry.Req)
+
+	resp.Size = len(req.Data)
+	return nil
+}
+
+func (f *benchmarkFile) Size(ctx context.Context) (uint64, error) {
+	data, _ := f.ValRead(ctx)
+	return uint64(len(data)), nil
+}
@@ -0,0 +1,103 @@
+package proxyfs
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/danielthatcher/fusebox"
+)
+
+// pooledBody is a body whose spool is shared with every other pooled body
+// with the same content, so that repeated payloads in the history are only
+// kept once.
+type pooledBody struct {
+	*spoolReader
+	sum [sha256.Size]byte
+}
+
+// restoreBody puts back a chunked or spooled body that was replaced while
+// being read, e.g. by httputil.DumpResponse.
+func restoreBody(body *io.ReadCloser, orig io.ReadCloser) {
+	if b, ok := orig.(interface{ Rewind() }); ok {
+		b.Rewind()
+		*body = orig
+	}
+}
+
+// pooledData is the spool of the pooled bodies with the same content, along
+// with the number of bodies using it.
+type pooledData struct {
+	spool *bodySpool
+	refs  int
+}
+
+// bodyPool keeps the spools of pooled bodies by their SHA-256 hash.
+type bodyPool struct {
+	mu     sync.Mutex
+	bodies map[[sha256.Size]byte]*pooledData
+}
+
+// bodies is the pool shared by everything that keeps bodies, so that the same
+// payload seen in different places is also only kept once.
+var bodies = &bodyPool{bodies: make(map[[sha256.Size]byte]*pooledData)}
+
+// Intern replaces the given body with a pooled body with the same content,
+// returning its hash. Empty bodies are left as they are, and return false.
+// Each body interned must be released once it's no longer kept.
+func (p *bodyPool) Intern(body *io.ReadCloser) ([sha256.Size]byte, bool) {
+	if *body == nil || *body == http.NoBody {
+		return [sha256.Size]byte{}, false
+	}
+	spool := spoolBody(body)
+	if spool.Size() == 0 {
+		return [sha256.Size]byte{}, false
+	}
+	sum := spool.Sum()
+
+	p.mu.Lock()
+	d, ok := p.bodies[sum]
+	if !ok {
+		d = &pooledData{spool: spool}
+		p.bodies[sum] = d
+	}
+	d.refs++
+	p.mu.Unlock()
+
+	*body = &pooledBody{d.spool.Reader(), sum}
+	return sum, true
+}
+
+// Release gives up a body interned with the given hash, dropping its spool
+// from the pool once nothing uses it.
+func (p *bodyPool) Release(sum [sha256.Size]byte) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if d, ok := p.bodies[sum]; ok {
+		d.refs--
+		if d.refs <= 0 {
+			delete(p.bodies, sum)
+		}
+	}
+}
+
+// bodyHash returns the hex encoded SHA-256 hash of the given body, which is
+// only worked out once for each spool.
+func bodyHash(body *io.ReadCloser) string {
+	if cb, ok := (*body).(*chunkedBody); ok {
+		sum := sha256.Sum256(cb.Bytes())
+		return hex.EncodeToString(sum[:])
+	}
+	sum := spoolBody(body).Sum()
+	return hex.EncodeToString(sum[:])
+}
+
+// newBodyHashFile returns a read-only file with the SHA-256 hash of a body,
+// so that bodies can be compared without reading them.
+func newBodyHashFile(body *io.ReadCloser) *fusebox.File {
+	return newReadOnlyFile(func() []byte {
+		return []byte(bodyHash(body))
+	})
+}
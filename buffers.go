@@ -0,0 +1,60 @@
+package proxyfs
+
+import (
+	"bytes"
+	"context"
+	"sync"
+)
+
+// bufferPoolMax is the capacity above which buffers aren't returned to the
+// pool, so that one large read doesn't keep its memory for good.
+const bufferPoolMax = 1 << 20
+
+// buffers are reused for reading the values of files, which scripts polling
+// the filesystem read over and over.
+var buffers = sync.Pool{
+	New: func() interface{} {
+		return new(bytes.Buffer)
+	},
+}
+
+// getBuffer returns an empty buffer from the pool, with room for at least the
+// given number of bytes.
+func getBuffer(sizeHint int) *bytes.Buffer {
+	ret := buffers.Get().(*bytes.Buffer)
+	ret.Reset()
+	if sizeHint > 0 {
+		ret.Grow(sizeHint)
+	}
+	return ret
+}
+
+// putBuffer returns a buffer to the pool. Nothing may use its contents once
+// it's been returned.
+func putBuffer(buf *bytes.Buffer) {
+	if buf == nil || buf.Cap() > bufferPoolMax {
+		return
+	}
+	buffers.Put(buf)
+}
+
+// valueAppender is an element that can write its value into a buffer, rather
+// than allocating a new slice for each read.
+type valueAppender interface {
+	AppendVal(ctx context.Context, buf *bytes.Buffer) error
+}
+
+// appendValue writes the value of the given element into a buffer.
+func appendValue(ctx context.Context, e interface {
+	ValRead(ctx context.Context) ([]byte, error)
+}, buf *bytes.Buffer) error {
+	if a, ok := e.(valueAppender); ok {
+		return a.AppendVal(ctx, buf)
+	}
+	data, err := e.ValRead(ctx)
+	if err != nil {
+		return err
+	}
+	buf.Write(data)
+	return nil
+}
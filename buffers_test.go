@@ -0,0 +1,83 @@
+package proxyfs
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"bazil.org/fuse"
+)
+
+// benchmarkValue is the value read by the benchmarks, about the size of a
+// typical header or small body.
+var benchmarkValue = strings.Repeat("x", 4<<10)
+
+// benchmarkPoll reads the file the way a script polling it does, opening it,
+// reading it whole and closing it each time.
+func benchmarkPoll(b *testing.B, f *handleFile) {
+	ctx := context.Background()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		h, err := f.Open(ctx, &fuse.OpenRequest{Flags: fuse.OpenReadOnly}, &fuse.OpenResponse{})
+		if err != nil {
+			b.Fatal(err)
+		}
+		fh := h.(*fileHandle)
+		resp := &fuse.ReadResponse{}
+		if err := fh.Read(ctx, &fuse.ReadRequest{Size: 2 * len(benchmarkValue)}, resp); err != nil {
+			b.Fatal(err)
+		}
+		if len(resp.Data) != len(benchmarkValue)+1 {
+			b.Fatalf("read %d bytes, expected %d", len(resp.Data), len(benchmarkValue)+1)
+		}
+		fh.Release(ctx, &fuse.ReleaseRequest{})
+	}
+}
+
+// BenchmarkReadPooled polls a value file, whose value is read into a pooled
+// buffer.
+func BenchmarkReadPooled(b *testing.B) {
+	s := benchmarkValue
+	benchmarkPoll(b, newStringFile(&s))
+}
+
+// BenchmarkReadUnpooled polls a value file whose value is read into a new
+// slice each time, as every file was before the pool, for comparison.
+func BenchmarkReadUnpooled(b *testing.B) {
+	s := benchmarkValue
+	f := newStringFile(&s)
+	f.SharedReads = true
+	benchmarkPoll(b, f)
+}
+
+// BenchmarkAttr gets the attributes of a value file, whose size includes the
+// newline added on reading, so its value is read into a pooled buffer.
+func BenchmarkAttr(b *testing.B) {
+	s := benchmarkValue
+	f := newStringFile(&s)
+	ctx := context.Background()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var a fuse.Attr
+		if err := f.Attr(ctx, &a); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkValueSize finds the size of a value, which is read into a pooled
+// buffer.
+func BenchmarkValueSize(b *testing.B) {
+	s := benchmarkValue
+	e := &valueElement{&stringValue{&s}}
+	ctx := context.Background()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := e.Size(ctx); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
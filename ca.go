@@ -0,0 +1,109 @@
+package proxyfs
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+// CA returns the CA that signs the certificates for intercepted HTTPS.
+func (p *Proxy) CA() tls.Certificate {
+	p.caMu.RLock()
+	defer p.caMu.RUnlock()
+	return p.ca
+}
+
+// SetCA sets the CA that signs the certificates for intercepted HTTPS. It's
+// kept by the proxy rather than set as goproxy's, so that proxies in the same
+// process can each have their own.
+func (p *Proxy) SetCA(ca tls.Certificate) {
+	p.caMu.Lock()
+	p.ca = ca
+	p.caMu.Unlock()
+}
+
+// parseCA parses a CA's PEM encoded certificate and private key, which may
+// be in the same data.
+func parseCA(cert, key []byte) (tls.Certificate, error) {
+	ca, err := tls.X509KeyPair(cert, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	ca.Leaf, err = x509.ParseCertificate(ca.Certificate[0])
+	return ca, err
+}
+
+// newInstanceCA generates a CA that's only used until the proxy exits, for
+// when no project or CA files are given.
+func newInstanceCA() (tls.Certificate, error) {
+	data, err := generateCA("proxyfs")
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return parseCA(data, data)
+}
+
+// loadCA returns the CA whose certificate and key are in the given files. If
+// neither file exists, a new CA is generated and saved to them, so that the
+// same files can be given each time to keep the CA that clients trust.
+func loadCA(certFile, keyFile string) (tls.Certificate, error) {
+	cert, certErr := ioutil.ReadFile(certFile)
+	key, keyErr := ioutil.ReadFile(keyFile)
+	if os.IsNotExist(certErr) && os.IsNotExist(keyErr) {
+		data, err := generateCA("proxyfs")
+		if err != nil {
+			return tls.Certificate{}, err
+		}
+		cert, key = splitPEM(data)
+		if err := ioutil.WriteFile(keyFile, key, 0600); err != nil {
+			return tls.Certificate{}, err
+		}
+		if err := ioutil.WriteFile(certFile, cert, 0644); err != nil {
+			return tls.Certificate{}, err
+		}
+	} else if certErr != nil {
+		return tls.Certificate{}, certErr
+	} else if keyErr != nil {
+		return tls.Certificate{}, keyErr
+	}
+
+	return parseCA(cert, key)
+}
+
+// readCACert returns the first certificate in the given file, for serving or
+// trusting a CA without needing its key.
+func readCACert(certFile string) (tls.Certificate, error) {
+	data, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	cert, _ := splitPEM(data)
+	block, _ := pem.Decode(cert)
+	if block == nil {
+		return tls.Certificate{}, fmt.Errorf("no certificate in %s", certFile)
+	}
+	return tls.Certificate{Certificate: [][]byte{block.Bytes}}, nil
+}
+
+// splitPEM splits PEM encoded data into its certificates and everything else,
+// which for a CA is its key.
+func splitPEM(data []byte) ([]byte, []byte) {
+	certs, rest := new(bytes.Buffer), new(bytes.Buffer)
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type == "CERTIFICATE" {
+			pem.Encode(certs, block)
+		} else {
+			pem.Encode(rest, block)
+		}
+	}
+	return certs.Bytes(), rest.Bytes()
+}
@@ -0,0 +1,98 @@
+package proxyfs
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+// maxCacheObservations is the number of responses remembered for each URL
+// when checking that validators are consistent.
+const maxCacheObservations = 8
+
+// cacheObservation is what was seen in a single response to a URL.
+type cacheObservation struct {
+	Hash         [sha256.Size]byte
+	ETag         string
+	LastModified string
+	Source       string
+}
+
+// cacheChecker passively checks that responses to the same URL have ETag and
+// Last-Modified headers that agree with their bodies. Validators that change
+// while the body stays the same defeat caching, and validators that stay the
+// same while the body changes lead to stale content being served.
+type cacheChecker struct {
+	mu       sync.Mutex
+	seen     map[string][]cacheObservation
+	findings *findingList
+}
+
+func newCacheChecker(l *findingList) *cacheChecker {
+	return &cacheChecker{
+		seen:     make(map[string][]cacheObservation),
+		findings: l,
+	}
+}
+
+// Check compares a successful response to a GET request, whose body has the
+// given hash, with those seen before for the same URL, adding findings for any
+// inconsistencies.
+func (c *cacheChecker) Check(req *http.Request, resp *http.Response, sum [sha256.Size]byte, source string) {
+	if req.Method != http.MethodGet || resp.StatusCode != http.StatusOK {
+		return
+	}
+	obs := cacheObservation{
+		Hash:         sum,
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+		Source:       source,
+	}
+	if obs.ETag == "" && obs.LastModified == "" {
+		return
+	}
+
+	u := *req.URL
+	u.Fragment = ""
+	key := u.String()
+
+	c.mu.Lock()
+	prev := c.seen[key]
+	list := append(prev, obs)
+	if len(list) > maxCacheObservations {
+		list = list[len(list)-maxCacheObservations:]
+	}
+	c.seen[key] = list
+	c.mu.Unlock()
+
+	for _, o := range prev {
+		same := o.Hash == obs.Hash
+		c.compare(key, "etag", o.ETag, obs.ETag, same, o.Source, source)
+		c.compare(key, "last-modified", o.LastModified, obs.LastModified, same, o.Source, source)
+	}
+}
+
+// compare adds a finding if the validator with the given name disagrees with
+// whether the bodies of two responses were the same.
+func (c *cacheChecker) compare(url, name, old, cur string, sameBody bool, oldSource, source string) {
+	if old == "" || cur == "" {
+		return
+	}
+
+	var kind, detail string
+	switch {
+	case sameBody && old != cur:
+		kind = name + "-varies"
+		detail = fmt.Sprintf("%s: identical bodies with %s %q and %q", url, name, old, cur)
+	case !sameBody && old == cur:
+		kind = name + "-stale"
+		detail = fmt.Sprintf("%s: different bodies with the same %s %q", url, name, cur)
+	default:
+		return
+	}
+
+	key := kind + ":" + url
+	c.findings.Add(kind, key, detail, oldSource)
+	c.findings.Add(kind, key, detail, source)
+}
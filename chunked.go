@@ -0,0 +1,355 @@
+package proxyfs
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"bazil.org/fuse"
+)
+
+// chunkedBody is a chunked body whose encoding is kept as it was received or
+// written, so that it can be sent on without being re-chunked. Reading it
+// gives the decoded data.
+type chunkedBody struct {
+	// The body as it appears on the wire, including chunk extensions and
+	// trailers
+	raw []byte
+
+	// The data of each chunk, and all of it together
+	chunks [][]byte
+	data   []byte
+
+	r *bytes.Reader
+}
+
+// parseChunked returns the chunked body with the given encoding, and whether
+// it's well formed. A malformed body is decoded as far as it can be, but is
+// still sent upstream as it is.
+func parseChunked(raw []byte) (*chunkedBody, bool) {
+	ret := &chunkedBody{raw: raw}
+	defer func() { ret.r = bytes.NewReader(ret.data) }()
+
+	rest := raw
+	for {
+		i := bytes.IndexByte(rest, '\n')
+		if i < 0 {
+			return ret, false
+		}
+		line := strings.TrimSuffix(string(rest[:i]), "\r")
+		rest = rest[i+1:]
+
+		if j := strings.IndexByte(line, ';'); j >= 0 {
+			line = line[:j]
+		}
+		size, err := strconv.ParseInt(strings.TrimSpace(line), 16, 64)
+		if err != nil || size < 0 || size > int64(len(rest)) {
+			return ret, false
+		}
+		if size == 0 {
+			return ret, bytes.HasSuffix(rest, []byte("\n"))
+		}
+
+		chunk := rest[:size]
+		ret.chunks = append(ret.chunks, chunk)
+		ret.data = append(ret.data, chunk...)
+		rest = rest[size:]
+		switch {
+		case bytes.HasPrefix(rest, []byte("\r\n")):
+			rest = rest[2:]
+		case bytes.HasPrefix(rest, []byte("\n")):
+			rest = rest[1:]
+		default:
+			return ret, false
+		}
+	}
+}
+
+// encodeChunked returns the encoding of data as a single chunk, which is how
+// a body that isn't already chunked would be sent as one.
+func encodeChunked(data []byte) []byte {
+	buf := new(bytes.Buffer)
+	if len(data) > 0 {
+		fmt.Fprintf(buf, "%x\r\n", len(data))
+		buf.Write(data)
+		buf.WriteString("\r\n")
+	}
+	buf.WriteString("0\r\n\r\n")
+	return buf.Bytes()
+}
+
+func (b *chunkedBody) Read(p []byte) (int, error) {
+	return b.r.Read(p)
+}
+
+func (b *chunkedBody) Close() error {
+	return nil
+}
+
+// Bytes returns the decoded body, without affecting what's left to be read.
+func (b *chunkedBody) Bytes() []byte {
+	return b.data
+}
+
+// Raw returns the body as it appears on the wire.
+func (b *chunkedBody) Raw() []byte {
+	return b.raw
+}
+
+// Rewind resets the body to be read again from the start.
+func (b *chunkedBody) Rewind() {
+	b.r = bytes.NewReader(b.data)
+}
+
+// WriteTo writes each chunk with a separate write, flushing after each if
+// possible, so that a writer that chunks its output, such as a
+// http.ResponseWriter, sends the same chunks on. Extensions and trailers
+// can't be passed on this way.
+func (b *chunkedBody) WriteTo(w io.Writer) (int64, error) {
+	if b.r.Len() != len(b.data) {
+		return b.r.WriteTo(w)
+	}
+
+	var ret int64
+	for _, chunk := range b.chunks {
+		n, err := w.Write(chunk)
+		ret += int64(n)
+		if err != nil {
+			return ret, err
+		}
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+	}
+	b.r.Seek(0, io.SeekEnd)
+	return ret, nil
+}
+
+// keepChunks returns whether a request has to be sent over a connection of
+// its own to keep the chunking of its body or its response.
+func (p *Proxy) keepChunks(req *http.Request) bool {
+	if !p.direct(req) {
+		return false
+	}
+	_, chunked := req.Body.(*chunkedBody)
+	return chunked || p.Settings.Get().Chunks == "preserve"
+}
+
+// roundTrip sends a request upstream, keeping the chunking of its body and
+// its response's if needed, and applying the transport settings for its host.
+func (p *Proxy) roundTrip(req *http.Request) (*http.Response, error) {
+	if p.keepChunks(req) {
+		t := p.Transport.Lookup(req.URL)
+		return p.connRoundTrip(req, t != nil && t.HTTP10)
+	}
+	return p.transportRoundTrip(req)
+}
+
+// recordingReader keeps a copy of everything read through it while record is
+// set.
+type recordingReader struct {
+	r      io.Reader
+	buf    []byte
+	record bool
+}
+
+func (r *recordingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if r.record {
+		r.buf = append(r.buf, p[:n]...)
+	}
+	return n, err
+}
+
+// connBody closes the connection a body is read from along with the body.
+type connBody struct {
+	io.ReadCloser
+	conn net.Conn
+}
+
+func (b *connBody) Close() error {
+	b.ReadCloser.Close()
+	return b.conn.Close()
+}
+
+// connRoundTrip sends a request upstream over a new connection, as HTTP/1.0
+// if http10 is set and HTTP/1.1 otherwise. A chunked request body is written
+// exactly as it is, unless it has to be sent as HTTP/1.0, in which case it's
+// read first to find its length, and a chunked
+// response body is read into a chunkedBody so that its chunks are kept.
+func (p *Proxy) connRoundTrip(req *http.Request, http10 bool) (*http.Response, error) {
+	conn, err := p.dialUpstream(req.Context(), req.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	bw := bufio.NewWriter(conn)
+	cb, chunked := req.Body.(*chunkedBody)
+	switch {
+	case http10 && streams(req.Body) && req.ContentLength > 0:
+		// A body of known length being streamed is passed on as it's read
+		h := req.Header.Clone()
+		h.Del("Transfer-Encoding")
+		h.Set("Connection", "close")
+		h.Set("Content-Length", strconv.FormatInt(req.ContentLength, 10))
+		writeRequestHead(bw, req, "HTTP/1.0", h)
+		_, err = io.Copy(bw, req.Body)
+		req.Body.Close()
+	case http10:
+		body := peekBody(&req.Body)
+		h := req.Header.Clone()
+		h.Del("Transfer-Encoding")
+		h.Set("Connection", "close")
+		h.Del("Content-Length")
+		if len(body) > 0 || req.ContentLength > 0 {
+			h.Set("Content-Length", strconv.Itoa(len(body)))
+		}
+		writeRequestHead(bw, req, "HTTP/1.0", h)
+		bw.Write(body)
+	case chunked:
+		h := req.Header.Clone()
+		h.Del("Content-Length")
+		h.Set("Transfer-Encoding", "chunked")
+		h.Set("Connection", "close")
+		writeRequestHead(bw, req, "HTTP/1.1", h)
+		bw.Write(cb.Raw())
+	default:
+		out := *req
+		out.Close = true
+		err = out.Write(bw)
+	}
+	if err == nil {
+		err = bw.Flush()
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	rec := &recordingReader{r: conn, record: true}
+	br := bufio.NewReader(rec)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if len(resp.TransferEncoding) == 0 {
+		rec.record = false
+		rec.buf = nil
+		resp.Body = &connBody{resp.Body, conn}
+		return resp, nil
+	}
+
+	// The body starts after the headers, which is where the buffered reader
+	// has got to, and ends at the end of the trailers
+	start := len(rec.buf) - br.Buffered()
+	_, err = io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	conn.Close()
+	if err != nil {
+		return nil, err
+	}
+	end := len(rec.buf) - br.Buffered()
+
+	resp.Body, _ = parseChunked(rec.buf[start:end])
+	return resp, nil
+}
+
+// writeRequestHead writes the request line of a request, with the given
+// protocol, followed by its Host and the given headers.
+func writeRequestHead(w io.Writer, req *http.Request, proto string, h http.Header) {
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	fmt.Fprintf(w, "%s %s %s\r\nHost: %s\r\n", req.Method, req.URL.RequestURI(), proto, host)
+	h.Write(w)
+	io.WriteString(w, "\r\n")
+}
+
+// dialUpstream dials the target of a URL, using TLS for HTTPS.
+func (p *Proxy) dialUpstream(ctx context.Context, u *url.URL) (net.Conn, error) {
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	conn, err := p.dialContext(ctx, "tcp", net.JoinHostPort(u.Hostname(), port))
+	if err != nil || u.Scheme != "https" {
+		return conn, err
+	}
+
+	var cfg *tls.Config
+	if p.Server.Tr.TLSClientConfig != nil {
+		cfg = p.Server.Tr.TLSClientConfig.Clone()
+	} else {
+		cfg = &tls.Config{InsecureSkipVerify: true}
+	}
+	cfg.ServerName = u.Hostname()
+	cfg.NextProtos = nil
+	tlsConn := tls.Client(conn, cfg)
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// chunksFile exposes the chunked encoding of a queued body, which is sent as
+// it is. Writes to a request's chunks are sent byte for byte even if they're
+// malformed, while a response's chunks have to be well formed.
+type chunksFile struct {
+	Header           http.Header
+	Body             *io.ReadCloser
+	ContentLength    *int64
+	TransferEncoding *[]string
+
+	// Whether written chunks have to be well formed
+	Strict bool
+}
+
+// newChunksFile returns a file exposing the chunks of the body of a request or
+// response, given its fields.
+func newChunksFile(h http.Header, body *io.ReadCloser, contentLength *int64, transferEncoding *[]string, strict bool) *handleFile {
+	ret := newHandleFile(&chunksFile{h, body, contentLength, transferEncoding, strict})
+	ret.OpenFlags = fuse.OpenDirectIO
+	return ret
+}
+
+func (f *chunksFile) ValRead(ctx context.Context) ([]byte, error) {
+	if cb, ok := (*f.Body).(*chunkedBody); ok {
+		return cb.Raw(), nil
+	}
+	return encodeChunked(peekBody(f.Body)), nil
+}
+
+func (f *chunksFile) ValWrite(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+	cb, ok := parseChunked(append([]byte(nil), req.Data...))
+	if !ok && f.Strict {
+		return errInvalid
+	}
+
+	*f.Body = cb
+	*f.ContentLength = -1
+	*f.TransferEncoding = []string{"chunked"}
+	f.Header.Del("Content-Length")
+	resp.Size = len(req.Data)
+	return nil
+}
+
+func (f *chunksFile) Size(ctx context.Context) (uint64, error) {
+	data, _ := f.ValRead(ctx)
+	return uint64(len(data)), nil
+}
@@ -0,0 +1,128 @@
+package proxyfs
+
+import (
+	"context"
+	"net"
+	"os"
+	"strconv"
+
+	"bazil.org/fuse"
+	"github.com/danielthatcher/fusebox"
+)
+
+// clientInfo describes the client connection that a request arrived on, and
+// the local process that owned it.
+type clientInfo struct {
+	Addr string
+	pid  int
+	name string
+}
+
+// newClientInfo returns the clientInfo for the given address, without a
+// process, e.g. for requests the proxy makes itself.
+func newClientInfo(addr string) *clientInfo {
+	return &clientInfo{Addr: addr}
+}
+
+// lookupClient returns the clientInfo for a connection from the given
+// address, looking up the local process that owns its client side. This has
+// to be done as the request arrives, while the connection is still open, as
+// afterwards the port may be closed or reused by another process.
+func lookupClient(addr string) *clientInfo {
+	ret := newClientInfo(addr)
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return ret
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil || !isLocalIP(ip) {
+		return ret
+	}
+
+	ret.pid, ret.name = lookupProcess(addr)
+	return ret
+}
+
+// Process returns the PID and name of the local process that owned the client
+// side of the connection when the request arrived. A PID of 0 is returned if
+// the client is not local, or the process could not be determined.
+func (c *clientInfo) Process() (int, string) {
+	return c.pid, c.name
+}
+
+// isLocalIP returns whether the given IP belongs to this machine.
+func isLocalIP(ip net.IP) bool {
+	if ip.IsLoopback() {
+		return true
+	}
+
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+
+	for _, a := range addrs {
+		if n, ok := a.(*net.IPNet); ok && n.IP.Equal(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+type clientDirElement struct {
+	Data *clientInfo
+}
+
+func (e *clientDirElement) GetNode(ctx context.Context, k string) (fusebox.VarNode, error) {
+	switch k {
+	case "addr":
+		return newReadOnlyFile(func() []byte {
+			return []byte(e.Data.Addr)
+		}), nil
+	case "pid":
+		return newReadOnlyFile(func() []byte {
+			pid, _ := e.Data.Process()
+			if pid == 0 {
+				return nil
+			}
+			return []byte(strconv.Itoa(pid))
+		}), nil
+	case "process":
+		return newReadOnlyFile(func() []byte {
+			_, name := e.Data.Process()
+			return []byte(name)
+		}), nil
+	}
+
+	return nil, fuse.ENOENT
+}
+
+func (e *clientDirElement) GetDirentType(ctx context.Context, k string) (fuse.DirentType, error) {
+	switch k {
+	case "addr", "pid", "process":
+		return fuse.DT_File, nil
+	}
+
+	return fuse.DT_Unknown, fuse.ENOENT
+}
+
+func (e *clientDirElement) GetKeys(ctx context.Context) []string {
+	return []string{"addr", "pid", "process"}
+}
+
+func (*clientDirElement) AddNode(name string, node interface{}) error {
+	return fuse.EPERM
+}
+
+func (*clientDirElement) RemoveNode(name string) error {
+	return fuse.EPERM
+}
+
+// newClientDir returns a read-only Dir describing the client a request came from.
+func newClientDir(c *clientInfo) *fusebox.Dir {
+	ret := fusebox.NewDir(&clientDirElement{c})
+	ret.Mode = os.ModeDir | 0555
+	return ret
+}
@@ -0,0 +1,171 @@
+package proxyfs
+
+import (
+	"bytes"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"unicode"
+
+	"github.com/danielthatcher/fusebox"
+)
+
+// simhash returns a 64 bit similarity hash of the words in the given data, such
+// that similar data has hashes differing in few bits.
+func simhash(data []byte) uint64 {
+	var weights [64]int
+	words := bytes.FieldsFunc(data, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	for _, w := range words {
+		h := fnv.New64a()
+		h.Write(w)
+		sum := h.Sum64()
+		for i := uint(0); i < 64; i++ {
+			if sum&(1<<i) != 0 {
+				weights[i]++
+			} else {
+				weights[i]--
+			}
+		}
+	}
+
+	var ret uint64
+	for i, w := range weights {
+		if w > 0 {
+			ret |= 1 << uint(i)
+		}
+	}
+	return ret
+}
+
+// Responses are in the same cluster if they have the same status, their
+// bodies have a similarity of at least clusterMinSimilarity, and their
+// lengths differ by at most clusterLengthSlack bytes or clusterLengthRatio of
+// the larger length.
+const (
+	clusterMinSimilarity = 90
+	clusterLengthSlack   = 16
+	clusterLengthRatio   = 0.1
+)
+
+// fuzzCluster is a group of fuzz results with similar responses.
+type fuzzCluster struct {
+	Status   string
+	Length   int
+	Hash     uint64
+	Members  []int
+	min, max int
+}
+
+// matches returns whether a response with the given status, length and hash
+// belongs in the cluster.
+func (c *fuzzCluster) matches(status string, length int, hash uint64) bool {
+	if status != c.Status || similarity(hash, c.Hash) < clusterMinSimilarity {
+		return false
+	}
+
+	diff, larger := length-c.Length, length
+	if diff < 0 {
+		diff, larger = -diff, c.Length
+	}
+	return diff <= clusterLengthSlack || float64(diff) <= clusterLengthRatio*float64(larger)
+}
+
+// Summary returns a single, tab separated line summarising the cluster.
+func (c *fuzzCluster) Summary(id int, j *fuzzJob) string {
+	return fmt.Sprintf("%d\t%d\t%s\t%d-%d\t%s\n", id, len(c.Members), c.Status, c.min, c.max,
+		j.Result(c.Members[0]).Payload)
+}
+
+// clusterFuzzResults groups the job's results by the similarity of their
+// responses. The clusters are ordered from smallest to largest, so outliers
+// come first.
+func clusterFuzzResults(j *fuzzJob) []*fuzzCluster {
+	ret := make([]*fuzzCluster, 0)
+	for _, n := range j.Results() {
+		r := j.Result(n)
+		status, length := "error", 0
+		if r.Resp != nil {
+			status = strconv.Itoa(r.Resp.StatusCode)
+			length = bodyLen(&r.Resp.Body)
+		}
+
+		var cluster *fuzzCluster
+		for _, c := range ret {
+			if c.matches(status, length, r.Hash) {
+				cluster = c
+				break
+			}
+		}
+		if cluster == nil {
+			cluster = &fuzzCluster{Status: status, Length: length, Hash: r.Hash, min: length, max: length}
+			ret = append(ret, cluster)
+		}
+
+		cluster.Members = append(cluster.Members, n)
+		if length < cluster.min {
+			cluster.min = length
+		}
+		if length > cluster.max {
+			cluster.max = length
+		}
+	}
+
+	sort.SliceStable(ret, func(a, b int) bool {
+		return len(ret[a].Members) < len(ret[b].Members)
+	})
+	return ret
+}
+
+// newFuzzClustersDir returns a Dir with a directory for each cluster of a fuzz
+// job's results, numbered from the smallest cluster, and an index summarising
+// them (number, size, status, length range and an example payload).
+func newFuzzClustersDir(j *fuzzJob) *fusebox.Dir {
+	keys := func() []string {
+		clusters := clusterFuzzResults(j)
+		ret := make([]string, 0, len(clusters)+1)
+		ret = append(ret, "index")
+		for i := range clusters {
+			ret = append(ret, strconv.Itoa(i))
+		}
+		return ret
+	}
+
+	node := func(k string) fusebox.VarNode {
+		if k == "index" {
+			return newReadOnlyFile(func() []byte {
+				buf := new(bytes.Buffer)
+				for i, c := range clusterFuzzResults(j) {
+					buf.WriteString(c.Summary(i, j))
+				}
+				return buf.Bytes()
+			})
+		}
+
+		i, err := strconv.Atoi(k)
+		if err != nil || i < 0 || i >= len(clusterFuzzResults(j)) {
+			return nil
+		}
+		return newFuzzResultsDir(j, func() []int {
+			clusters := clusterFuzzResults(j)
+			if i >= len(clusters) {
+				return nil
+			}
+			return clusters[i].Members
+		})
+	}
+
+	return newFuncDir(keys, node)
+}
+
+// containsInt returns whether the list contains the given int.
+func containsInt(list []int, i int) bool {
+	for _, x := range list {
+		if x == i {
+			return true
+		}
+	}
+	return false
+}
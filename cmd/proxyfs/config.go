@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	flag "github.com/spf13/pflag"
+)
+
+// configEnvPrefix is the prefix of the environment variables that set flags,
+// e.g. PROXYFS_SCOPE for --scope.
+const configEnvPrefix = "PROXYFS_"
+
+// configEnvName returns the environment variable that sets the given flag.
+func configEnvName(name string) string {
+	return configEnvPrefix + strings.ToUpper(strings.Replace(name, "-", "_", -1))
+}
+
+// applyConfig sets the flags that weren't given on the command line from the
+// environment, and then from the config file named by the given flag, if
+// any, so that the proxy can be configured without arguments, e.g. from a
+// mounted ConfigMap. Each line of the file is a flag's name and its value, separated
+// by "=" or whitespace, and flags that can be given more than once can be
+// repeated. Blank lines and lines starting with "#" are ignored. The
+// mountpoint is set by the name "mountpoint", and is returned.
+func applyConfig(fs *flag.FlagSet, configFlag string) (string, error) {
+	given := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if v, ok := os.LookupEnv(configEnvName(f.Name)); ok && !given[f.Name] && err == nil {
+			if err = fs.Set(f.Name, v); err != nil {
+				err = fmt.Errorf("%s: %v", configEnvName(f.Name), err)
+			}
+			given[f.Name] = true
+		}
+	})
+	if err != nil {
+		return "", err
+	}
+
+	mountpoint := os.Getenv(configEnvName("mountpoint"))
+	path := fs.Lookup(configFlag).Value.String()
+	if path == "" {
+		return mountpoint, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		name, val := line, ""
+		if i := strings.IndexAny(line, "= \t"); i >= 0 {
+			name, val = strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+1:])
+			val = strings.TrimSpace(strings.TrimPrefix(val, "="))
+		}
+		if name == "mountpoint" {
+			if mountpoint == "" {
+				mountpoint = val
+			}
+			continue
+		}
+		fl := fs.Lookup(name)
+		if fl == nil {
+			return "", fmt.Errorf("%s:%d: unknown setting %q", path, n, name)
+		}
+		if given[name] {
+			continue
+		}
+		if val == "" && fl.NoOptDefVal != "" {
+			val = fl.NoOptDefVal
+		}
+		if err := fs.Set(name, val); err != nil {
+			return "", fmt.Errorf("%s:%d: %v", path, n, err)
+		}
+	}
+	return mountpoint, s.Err()
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+
+	"github.com/danielthatcher/proxyfs"
+	flag "github.com/spf13/pflag"
+)
+
+func main() {
+	// Subcommands
+	if len(os.Args) > 1 && os.Args[1] == "container" {
+		if err := proxyfs.RunContainerCommand(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "setup-device" {
+		if err := proxyfs.RunSetupDeviceCommand(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	// Flag parsing
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage of %s:\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "%s [OPTIONS]... [MOUNTPOINT]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	bindHost := flag.StringP("listen", "l", "127.0.0.1", "The address to listen on, or unix:<path> for a unix socket. Defaults to loopback interface.")
+	bindPort := flag.IntP("port", "p", 8080, "The port to listen on.")
+	scope := flag.StringP("scope", "s", ".", "A regex defining the scope of what to intercept.")
+	includes := flag.StringArrayP("include", "i", nil, "A host or URL pattern to include in the scope, such as *.example.com or https://example.com/api/, or a regex matching full URLs prefixed with ~. Can be given more than once.")
+	excludes := flag.StringArrayP("exclude", "x", nil, "A host or URL pattern, or a ~ prefixed regex, to exclude from the scope. Can be given more than once.")
+	upstreams := flag.StringArrayP("upstream", "u", nil, "The address of an upstream proxy to use. Can be given more than once, to fail over to the next when one is down.")
+	reverse := flag.StringP("reverse", "r", "", "Act as a reverse proxy for the given URL, or unix:<path> for a unix socket, as well as a normal proxy.")
+	mirrors := flag.StringArray("mirror", nil, "Also mount a read-only copy of the filesystem at the given path. Can be given more than once.")
+	shares := flag.StringArray("share", nil, "Also mount the filesystem at the given path for users with the given role, observer, operator or admin, given as path=role. Can be given more than once.")
+	userRoles := flag.StringArray("user-role", nil, "Give the given user, by name or UID, the given role on shares in place of the share's role, given as user=role. Can be given more than once.")
+	allowOther := flag.Bool("allow-other", false, "Allow other users to access mirrors and shares. Requires user_allow_other in /etc/fuse.conf.")
+	projectName := flag.String("project", "", "Keep history, certificates and settings in the named project, resuming it if it exists.")
+	caCert := flag.String("ca-cert", "", "Sign intercepted HTTPS with the CA whose certificate is in the given file, generating one there along with --ca-key if neither exists.")
+	caKey := flag.String("ca-key", "", "The file holding the private key of the CA given by --ca-cert.")
+	forwards := flag.StringArray("forward", nil, "Forward connections from listen to target as raw streams, given as listen=target, with /tls, /smtp or /imap appended for TLS or STARTTLS. Can be given more than once.")
+	traceFuse := flag.String("trace-fuse", "", "Trace the filesystem's FUSE operations, with their latencies, as a line of JSON each to the given file, or stderr if none is given.")
+	flag.Lookup("trace-fuse").NoOptDefVal = "-"
+	responders := flag.Bool("responders", false, "Run the commands in queues/responders. Without it, responders, including those saved with a project, are kept but never run.")
+	keylog := flag.String("keylog", "", "Append the secrets of intercepted and upstream TLS connections to the given file, in NSS key log format.")
+	sftpSocket := flag.String("sftp", "", "Serve the filesystem over SFTP on a unix socket at the given path.")
+	sftpRole := flag.String("sftp-role", "admin", "The role of clients of the SFTP socket: observer, operator or admin.")
+	sftpRelay := flag.String("sftp-relay", "", "Relay stdin and stdout to the SFTP socket at the given path, for use as sshfs's sftp_server.")
+	bindOut := flag.IP("bind-out", nil, "The local address to make upstream connections from, to choose the interface they use.")
+	flag.String("config", "", "Read settings not given as options from the given file, with a line per option of its name and value.")
+	sidecar := flag.Bool("sidecar", false, "Run as a sidecar container, serving the filesystem over SFTP if FUSE isn't available.")
+	probes := flag.String("probes", "", "Serve liveness and readiness probes at /healthz and /readyz on the given address.")
+	storeSpec := flag.String("store", "", "Keep the history and findings in a database, given as bolt:<path> or sqlite:<path>, rather than in memory.")
+	storeKey := flag.String("store-key", "", "Encrypt the store with a key derived from the contents of the given file.")
+	storePassphrase := flag.String("store-passphrase", "", "Encrypt the store with a key derived from the given passphrase. Best given as PROXYFS_STORE_PASSPHRASE.")
+	flag.Parse()
+
+	// Options not given can be set by the environment or a config file
+	mountpoint, err := applyConfig(flag.CommandLine, "config")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if flag.NArg() > 0 {
+		mountpoint = flag.Arg(0)
+	}
+
+	// Relaying runs on behalf of sshfs, alongside a running proxy
+	if *sftpRelay != "" {
+		if err := proxyfs.RelaySFTP(*sftpRelay); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	// Sidecars in containers without FUSE are controlled over SFTP instead
+	if *sidecar && !proxyfs.FuseAvailable() {
+		mountpoint = ""
+		*mirrors = nil
+		*shares = nil
+		if *sftpSocket == "" {
+			*sftpSocket = proxyfs.SidecarSocket
+			if err := os.MkdirAll(filepath.Dir(proxyfs.SidecarSocket), 0700); err != nil {
+				log.Fatal(err)
+			}
+		}
+		log.Printf("FUSE isn't available, serving the filesystem over SFTP at %s\n", *sftpSocket)
+	}
+
+	// A mountpoint is only optional when serving over SFTP
+	if flag.NArg() > 1 || (mountpoint == "" && *sftpSocket == "") {
+		fmt.Println("Please supply a mountpoint!")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	opts := proxyfs.Options{
+		Listen:     *bindHost,
+		Port:       *bindPort,
+		Include:    *includes,
+		Exclude:    *excludes,
+		Upstreams:  *upstreams,
+		Reverse:    *reverse,
+		BindOut:    *bindOut,
+		Project:    *projectName,
+		CACert:     *caCert,
+		CAKey:      *caKey,
+		KeyLog:     *keylog,
+		Responders: *responders,
+		Forwards:   *forwards,
+		SFTP:       *sftpSocket,
+		SFTPRole:   *sftpRole,
+		Probes:     *probes,
+		Mirrors:    *mirrors,
+		Shares:     *shares,
+		UserRoles:  *userRoles,
+		AllowOther: *allowOther,
+	}
+
+	// A project's saved scope is used unless another is given
+	if flag.CommandLine.Changed("scope") {
+		opts.Scope = *scope
+	}
+
+	if *traceFuse == "-" {
+		opts.TraceFUSE = os.Stderr
+	} else if *traceFuse != "" {
+		f, err := os.OpenFile(*traceFuse, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			log.Fatalf("Failed to open FUSE trace: %v\n", err)
+		}
+		opts.TraceFUSE = f
+	}
+
+	if *storeSpec != "" {
+		switch {
+		case *storeKey != "" && *storePassphrase != "":
+			log.Fatal("Only one of --store-key and --store-passphrase can be given")
+		case *storeKey != "":
+			if opts.StoreSecret, err = ioutil.ReadFile(*storeKey); err != nil {
+				log.Fatalf("Failed to read store key: %v\n", err)
+			}
+			if len(opts.StoreSecret) == 0 {
+				log.Fatalf("The store key file %s is empty\n", *storeKey)
+			}
+		case *storePassphrase != "":
+			opts.StoreSecret = []byte(*storePassphrase)
+		}
+		opts.Store = *storeSpec
+	}
+
+	proxy, err := proxyfs.New(opts)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Handle ctrl-c
+	c := make(chan os.Signal)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-c
+		proxy.Close()
+		os.Exit(1)
+	}()
+
+	// Actually run, with the filesystem having to be mounted before the
+	// proxy is ready
+	if mountpoint != "" {
+		proxy.Readiness.Expect("filesystem")
+		go func() {
+			if err := proxy.Mount(mountpoint); err != nil {
+				log.Fatalf("Failed to mount: %v\n", err)
+			}
+		}()
+	}
+	log.Fatal(proxy.Serve())
+}
@@ -0,0 +1,111 @@
+package proxyfs
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// coalescedCall is a request being sent upstream on behalf of every identical
+// request that arrives while it's in flight.
+type coalescedCall struct {
+	done chan struct{}
+	resp *http.Response
+	err  error
+
+	// Whether the call failed because the client that made it went away, in
+	// which case the requests waiting on it are sent again
+	abandoned bool
+}
+
+// coalescer sends concurrent identical requests upstream once, and gives each
+// of them a copy of the response.
+type coalescer struct {
+	mu    sync.Mutex
+	calls map[string]*coalescedCall
+}
+
+func newCoalescer() *coalescer {
+	return &coalescer{calls: make(map[string]*coalescedCall)}
+}
+
+// canCoalesce returns whether a request is idempotent and has no body, so
+// that any identical request can safely share its response.
+func canCoalesce(req *http.Request) bool {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return false
+	}
+	return len(peekBody(&req.Body)) == 0
+}
+
+// coalesceKey returns a hash identifying a request by its method, URL and
+// headers, so that only requests the server can't tell apart are coalesced.
+func coalesceKey(req *http.Request) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s %s\n", req.Method, req.URL.String())
+
+	names := make([]string, 0, len(req.Header))
+	for k := range req.Header {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, k := range names {
+		for _, v := range req.Header[k] {
+			fmt.Fprintf(h, "%s: %s\n", k, v)
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Do sends a request with send, unless an identical request is already in
+// flight, in which case it waits for that request's response and returns a
+// copy of it. It also returns whether the response was shared.
+func (c *coalescer) Do(req *http.Request, send func(*http.Request) (*http.Response, error)) (*http.Response, bool, error) {
+	key := coalesceKey(req)
+	for {
+		c.mu.Lock()
+		call, ok := c.calls[key]
+		if !ok {
+			call = &coalescedCall{done: make(chan struct{})}
+			c.calls[key] = call
+			c.mu.Unlock()
+
+			resp, err := send(req)
+			c.finish(key, call, req, resp, err)
+			return resp, false, err
+		}
+		c.mu.Unlock()
+
+		select {
+		case <-call.done:
+		case <-req.Context().Done():
+			return nil, false, req.Context().Err()
+		}
+		if call.abandoned {
+			continue
+		}
+		if call.err != nil {
+			return nil, true, call.err
+		}
+		return snapshotResponse(call.resp, req), true, nil
+	}
+}
+
+// finish records the outcome of a call and releases the requests waiting on
+// it. Identical requests arriving from now on are sent again.
+func (c *coalescer) finish(key string, call *coalescedCall, req *http.Request, resp *http.Response, err error) {
+	if err == nil {
+		call.resp = snapshotResponse(resp, req)
+	} else {
+		call.err = err
+		call.abandoned = req.Context().Err() != nil
+	}
+
+	c.mu.Lock()
+	delete(c.calls, key)
+	c.mu.Unlock()
+	close(call.done)
+}
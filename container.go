@@ -0,0 +1,195 @@
+package proxyfs
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	flag "github.com/spf13/pflag"
+)
+
+// containerCAPath is where the CA bundle is mounted inside containers.
+const containerCAPath = "/etc/ssl/certs/proxyfs-bundle.pem"
+
+// systemCABundles are the usual locations of the system's CA bundle, which is
+// given to containers along with the proxy's CA so that connections that
+// aren't intercepted can still be verified.
+var systemCABundles = []string{
+	"/etc/ssl/certs/ca-certificates.crt",
+	"/etc/pki/tls/certs/ca-bundle.crt",
+	"/etc/ssl/ca-bundle.pem",
+	"/etc/ssl/cert.pem",
+}
+
+// containerConfig holds the settings that route a container's traffic
+// through the proxy.
+type containerConfig struct {
+	// The address of the proxy, as seen from inside the container
+	Host string
+	Port int
+
+	// The CA bundle on the host, which is mounted into the container
+	Bundle string
+}
+
+// Env returns the environment variables that point clients in the container
+// at the proxy and the CA bundle, as NAME=value.
+func (c *containerConfig) Env() []string {
+	proxy := "http://" + net.JoinHostPort(c.Host, strconv.Itoa(c.Port))
+	ret := make([]string, 0)
+	for _, name := range []string{"HTTP_PROXY", "HTTPS_PROXY", "http_proxy", "https_proxy"} {
+		ret = append(ret, name+"="+proxy)
+	}
+	ret = append(ret, "NO_PROXY=localhost,127.0.0.1", "no_proxy=localhost,127.0.0.1")
+	for _, name := range []string{"SSL_CERT_FILE", "REQUESTS_CA_BUNDLE", "CURL_CA_BUNDLE", "NODE_EXTRA_CA_CERTS", "GIT_SSL_CAINFO"} {
+		ret = append(ret, name+"="+containerCAPath)
+	}
+	return ret
+}
+
+// RunArgs returns the arguments to docker or podman run that apply the
+// settings to a container.
+func (c *containerConfig) RunArgs() []string {
+	ret := make([]string, 0)
+	if c.Host == "host.docker.internal" {
+		ret = append(ret, "--add-host", "host.docker.internal:host-gateway")
+	}
+	for _, env := range c.Env() {
+		ret = append(ret, "-e", env)
+	}
+	ret = append(ret, "-v", c.Bundle+":"+containerCAPath+":ro")
+	return ret
+}
+
+// Compose returns the settings as the fields of a service in a compose file.
+func (c *containerConfig) Compose() []byte {
+	buf := new(bytes.Buffer)
+	if c.Host == "host.docker.internal" {
+		buf.WriteString("extra_hosts:\n  - \"host.docker.internal:host-gateway\"\n")
+	}
+	buf.WriteString("environment:\n")
+	for _, env := range c.Env() {
+		fmt.Fprintf(buf, "  - %q\n", env)
+	}
+	fmt.Fprintf(buf, "volumes:\n  - %q\n", c.Bundle+":"+containerCAPath+":ro")
+	return buf.Bytes()
+}
+
+// writeCABundle writes the system's CA bundle, followed by the given CA
+// certificate, to the given path.
+func writeCABundle(path string, ca []byte) error {
+	buf := new(bytes.Buffer)
+	for _, p := range systemCABundles {
+		if data, err := ioutil.ReadFile(p); err == nil {
+			buf.Write(data)
+			buf.WriteString("\n")
+			break
+		}
+	}
+	buf.Write(ca)
+	return ioutil.WriteFile(path, buf.Bytes(), 0644)
+}
+
+// insertRunArgs returns a container runtime command line with the given
+// arguments inserted after its run or create subcommand.
+func insertRunArgs(cmd []string, args []string) ([]string, error) {
+	for i, arg := range cmd {
+		if i > 0 && (arg == "run" || arg == "create") {
+			ret := append([]string(nil), cmd[:i+1]...)
+			ret = append(ret, args...)
+			return append(ret, cmd[i+1:]...), nil
+		}
+	}
+	return nil, errors.New("the command has no run or create subcommand")
+}
+
+// RunContainerCommand runs the container subcommand, which prints the
+// settings that route a container's traffic through the proxy, or runs a
+// docker or podman command given after "--" with them applied.
+func RunContainerCommand(args []string) error {
+	fs := flag.NewFlagSet("container", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage of %s container:\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "%s container [OPTIONS]... [-- docker|podman run ARGS...]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	host := fs.String("host", "host.docker.internal", "The address of the proxy as seen from inside the container.")
+	port := fs.IntP("port", "p", 8080, "The port the proxy listens on.")
+	projectName := fs.String("project", "", "Trust the CA of the named project.")
+	caCert := fs.String("ca-cert", "", "Trust the CA whose certificate is in the given file, as given to the proxy's --ca-cert.")
+	bundle := fs.String("ca-bundle", "proxyfs-ca-bundle.pem", "Where to write the CA bundle that's mounted into the container.")
+	format := fs.String("format", "docker", "How to print the settings: docker for run arguments, env for an env file, or compose for a compose service.")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	// Proxies given neither generate a new CA each time they start, which
+	// can't be known in advance
+	var ca []byte
+	switch {
+	case *projectName != "" && *caCert != "":
+		return fmt.Errorf("only one of --project and --ca-cert can be given")
+	case *projectName != "":
+		pr, err := openProject(*projectName)
+		if err != nil {
+			return err
+		}
+		if _, err := pr.CA(); err != nil {
+			return fmt.Errorf("loading CA: %v", err)
+		}
+		ca = pr.CACert()
+	case *caCert != "":
+		data, err := ioutil.ReadFile(*caCert)
+		if err != nil {
+			return fmt.Errorf("loading CA: %v", err)
+		}
+		ca, _ = splitPEM(data)
+	default:
+		return fmt.Errorf("--project or --ca-cert must be given, to choose the CA to trust")
+	}
+
+	path, err := filepath.Abs(*bundle)
+	if err != nil {
+		return err
+	}
+	if err := writeCABundle(path, ca); err != nil {
+		return err
+	}
+	c := &containerConfig{Host: *host, Port: *port, Bundle: path}
+
+	// Apply the settings to a command if one is given
+	if fs.NArg() > 0 {
+		cmdline, err := insertRunArgs(fs.Args(), c.RunArgs())
+		if err != nil {
+			return err
+		}
+		cmd := exec.Command(cmdline[0], cmdline[1:]...)
+		cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+		return cmd.Run()
+	}
+
+	switch *format {
+	case "docker":
+		quoted := make([]string, 0)
+		for _, arg := range c.RunArgs() {
+			quoted = append(quoted, strconv.Quote(arg))
+		}
+		fmt.Println(strings.Join(quoted, " "))
+	case "env":
+		for _, env := range c.Env() {
+			fmt.Println(env)
+		}
+	case "compose":
+		os.Stdout.Write(c.Compose())
+	default:
+		return fmt.Errorf("unknown format %q", *format)
+	}
+	return nil
+}
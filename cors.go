@@ -0,0 +1,182 @@
+package proxyfs
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+)
+
+// corsProbe is an Origin sent by a CORS check, named after the kind of
+// misconfiguration that allowing it reveals.
+type corsProbe struct {
+	Kind   string
+	Origin func(scheme, host string) string
+}
+
+// corsProbes are the origins tried against each request by a CORS check.
+var corsProbes = []corsProbe{
+	{"arbitrary-origin", func(scheme, host string) string { return "https://proxyfs.example" }},
+	{"null-origin", func(scheme, host string) string { return "null" }},
+	{"suffix-origin", func(scheme, host string) string { return "https://" + host + ".proxyfs.example" }},
+	{"prefix-origin", func(scheme, host string) string { return "https://proxyfs" + host }},
+	{"subdomain-origin", func(scheme, host string) string { return scheme + "://proxyfs." + host }},
+	{"insecure-origin", func(scheme, host string) string {
+		if scheme != "https" {
+			return ""
+		}
+		return "http://" + host
+	}},
+}
+
+// corsResult is the response to a request sent with one of the probe origins.
+type corsResult struct {
+	Kind        string
+	Origin      string
+	Allowed     string
+	Credentials bool
+	Err         error
+}
+
+// Vulnerable returns whether the response allowed the probe origin.
+func (r corsResult) Vulnerable() bool {
+	return r.Err == nil && r.Allowed == r.Origin
+}
+
+// corsCheck is a run of re-sending a request with each of the probe origins,
+// recording whether the responses allow them.
+type corsCheck struct {
+	mu       sync.Mutex
+	Started  time.Time
+	Finished time.Time
+	results  []corsResult
+}
+
+// Running returns whether the check is still in progress.
+func (c *corsCheck) Running() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.Finished.IsZero()
+}
+
+// run sends the entry's request with each probe origin in turn, adding
+// findings to the list for those that are allowed.
+func (c *corsCheck) run(p *Proxy, e *historyEntry, l *findingList) {
+	scheme, host := e.Req.URL.Scheme, e.Req.URL.Hostname()
+	target := e.Req.URL.Scheme + "://" + e.Req.URL.Host + e.Req.URL.Path
+	for _, probe := range corsProbes {
+		origin := probe.Origin(scheme, host)
+		if origin == "" {
+			continue
+		}
+
+		r := prepareResend(e.Req)
+		r.Header.Set("Origin", origin)
+		res := corsResult{Kind: probe.Kind, Origin: origin}
+		resp, err := p.send(r)
+		if err == nil {
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+			res.Allowed = resp.Header.Get("Access-Control-Allow-Origin")
+			res.Credentials = strings.EqualFold(resp.Header.Get("Access-Control-Allow-Credentials"), "true")
+		}
+		res.Err = err
+
+		c.mu.Lock()
+		c.results = append(c.results, res)
+		c.mu.Unlock()
+
+		if res.Vulnerable() {
+			detail := fmt.Sprintf("%s: allows Origin %s", target, origin)
+			if res.Credentials {
+				detail += " with credentials"
+			}
+			l.Add(probe.Kind, probe.Kind+":"+target, detail, fmt.Sprintf("history/%d", e.ID))
+		}
+	}
+
+	c.mu.Lock()
+	c.Finished = time.Now()
+	c.mu.Unlock()
+}
+
+// Report returns the origin sent by each probe, and the
+// Access-Control-Allow-Origin and Access-Control-Allow-Credentials headers of
+// the response, with allowed origins marked.
+func (c *corsCheck) Report() []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	buf := new(bytes.Buffer)
+	state := "finished"
+	if c.Finished.IsZero() {
+		state = "running"
+	}
+	fmt.Fprintf(buf, "state: %s\n", state)
+	for _, r := range c.results {
+		if r.Err != nil {
+			fmt.Fprintf(buf, "%s\t%s\terror: %v\n", r.Kind, r.Origin, r.Err)
+			continue
+		}
+		mark := "-"
+		if r.Vulnerable() {
+			mark = "ALLOWED"
+		}
+		fmt.Fprintf(buf, "%s\t%s\t%s\tacao=%q\tacac=%v\n", r.Kind, r.Origin, mark, r.Allowed, r.Credentials)
+	}
+	return buf.Bytes()
+}
+
+// corsFile starts a CORS check of a history entry's request when 1 is
+// written to it. Reading it gives the report of the last check.
+type corsFile struct {
+	Proxy *Proxy
+	Entry *historyEntry
+}
+
+func (f *corsFile) ValRead(ctx context.Context) ([]byte, error) {
+	f.Entry.mu.RLock()
+	c := f.Entry.cors
+	f.Entry.mu.RUnlock()
+	if c == nil {
+		return nil, nil
+	}
+
+	return c.Report(), nil
+}
+
+func (f *corsFile) ValWrite(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+	if strings.TrimSpace(string(req.Data)) != "1" {
+		return errInvalid
+	}
+
+	if !f.Proxy.mayResend(f.Entry.Req, false) {
+		return errUnsafe
+	}
+
+	f.Entry.mu.Lock()
+	if f.Entry.cors != nil && f.Entry.cors.Running() {
+		f.Entry.mu.Unlock()
+		return fuse.Errno(syscall.EBUSY)
+	}
+	c := &corsCheck{Started: time.Now()}
+	f.Entry.cors = c
+	f.Entry.mu.Unlock()
+
+	go c.run(f.Proxy, f.Entry, f.Proxy.Findings.Category("cors"))
+
+	resp.Size = len(req.Data)
+	return nil
+}
+
+func (f *corsFile) Size(ctx context.Context) (uint64, error) {
+	data, _ := f.ValRead(ctx)
+	return uint64(len(data)), nil
+}
@@ -0,0 +1,411 @@
+package proxyfs
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+	"github.com/danielthatcher/fusebox"
+)
+
+// maxCrawlPages is the most requests a crawl job will make.
+const maxCrawlPages = 10000
+
+var (
+	// Attributes holding links to follow
+	crawlLinkRe = regexp.MustCompile(`(?i)\b(?:href|src)\s*=\s*(?:"([^"]*)"|'([^']*)'|([^\s>]+))`)
+
+	// Forms, and the inputs within them
+	crawlFormRe  = regexp.MustCompile(`(?is)<form\b([^>]*)>(.*?)</form>`)
+	crawlInputRe = regexp.MustCompile(`(?i)<(?:input|textarea|select)\b[^>]*>`)
+	crawlAttrRe  = regexp.MustCompile(`(?i)\b([a-z-]+)\s*=\s*(?:"([^"]*)"|'([^']*)'|([^\s>]+))`)
+)
+
+// crawlTarget is a request for the crawler to make.
+type crawlTarget struct {
+	Method string
+	URL    *url.URL
+	Body   string
+	Depth  int
+}
+
+// key identifies requests that are the same for the purposes of crawling.
+func (t crawlTarget) key() string {
+	return t.Method + " " + t.URL.String() + " " + t.Body
+}
+
+// crawlJob follows the links and forms of in scope pages, starting from a seed
+// URL, recording what it finds in the history and sitemap.
+type crawlJob struct {
+	mu      sync.RWMutex
+	URL     []byte
+	Depth   []byte
+	Rate    []byte
+	Headers []byte
+	Forms   []byte
+
+	concurrency int
+	started     time.Time
+	finished    time.Time
+	seen        map[string]bool
+	visited     []string
+	skipped     int
+	errors      int
+	stop        chan struct{}
+}
+
+// newCrawlJobs returns the set of crawl jobs.
+func newCrawlJobs(p *Proxy) *jobSet {
+	create := func() job {
+		return &crawlJob{Depth: []byte("2"), Forms: []byte("get")}
+	}
+	dir := func(j job) fusebox.VarNode { return newCrawlJobDir(p, j.(*crawlJob)) }
+	return newJobSet(p, create, dir)
+}
+
+// Start starts crawling from the seed URL in the background, with up to
+// concurrency requests in flight.
+func (j *crawlJob) Start(p *Proxy, concurrency int) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.stop != nil && j.finished.IsZero() {
+		return fuse.Errno(syscall.EBUSY)
+	}
+
+	seed, err := url.Parse(strings.TrimSpace(string(j.URL)))
+	if err != nil || !seed.IsAbs() || !p.inScope(seed) {
+		return errInvalid
+	}
+	depth, err := strconv.Atoi(strings.TrimSpace(string(j.Depth)))
+	if err != nil || depth < 0 {
+		return errInvalid
+	}
+	rate, err := parseRate(j.Rate)
+	if err != nil {
+		return errInvalid
+	}
+	headers := parseHeaderBlock(j.Headers)
+	if headers == nil {
+		return errInvalid
+	}
+	forms := strings.TrimSpace(string(j.Forms))
+	if !containsString([]string{"none", "get", "all"}, forms) {
+		return errInvalid
+	}
+
+	j.concurrency = concurrency
+	j.started = time.Now()
+	j.finished = time.Time{}
+	j.seen = make(map[string]bool)
+	j.visited = nil
+	j.skipped, j.errors = 0, 0
+	j.stop = make(chan struct{})
+	c := &crawler{
+		Proxy:    p,
+		Job:      j,
+		MaxDepth: depth,
+		Rate:     rate,
+		Headers:  headers,
+		Forms:    forms,
+	}
+	go c.run(crawlTarget{Method: "GET", URL: seed}, j.stop)
+	return nil
+}
+
+// Stop stops the job if it's running. Requests already in flight complete.
+func (j *crawlJob) Stop() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.stop != nil && j.finished.IsZero() {
+		close(j.stop)
+		j.finished = time.Now()
+	}
+}
+
+// claim marks the target as seen, returning false if it already was or the
+// page limit has been reached.
+func (j *crawlJob) claim(t crawlTarget) bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.seen[t.key()] || len(j.seen) >= maxCrawlPages {
+		return false
+	}
+	j.seen[t.key()] = true
+	return true
+}
+
+func (j *crawlJob) record(line string, skipped, failed bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if line != "" {
+		j.visited = append(j.visited, line)
+	}
+	if skipped {
+		j.skipped++
+	}
+	if failed {
+		j.errors++
+	}
+}
+
+// Visited returns the index of the requests made, one per line as a tab
+// separated depth, history ID, status, method and URL.
+func (j *crawlJob) Visited() []byte {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+	return []byte(strings.Join(j.visited, ""))
+}
+
+// Report returns a summary of the job's progress.
+func (j *crawlJob) Report() []byte {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+	if j.stop == nil {
+		return nil
+	}
+
+	buf := new(bytes.Buffer)
+	state := "finished"
+	elapsed := j.finished.Sub(j.started)
+	if j.finished.IsZero() {
+		state = "running"
+		elapsed = time.Since(j.started)
+	}
+	fmt.Fprintf(buf, "state: %s\n", state)
+	fmt.Fprintf(buf, "visited: %d\n", len(j.visited))
+	fmt.Fprintf(buf, "out of scope: %d\n", j.skipped)
+	fmt.Fprintf(buf, "errors: %d\n", j.errors)
+	fmt.Fprintf(buf, "concurrency: %d\n", j.concurrency)
+	fmt.Fprintf(buf, "elapsed: %v\n", elapsed)
+	return buf.Bytes()
+}
+
+// crawler holds the settings of a single run of a crawl job.
+type crawler struct {
+	Proxy    *Proxy
+	Job      *crawlJob
+	MaxDepth int
+	Rate     int
+	Headers  http.Header
+	Forms    string
+}
+
+// run crawls breadth first from the seed, a level of depth at a time.
+func (c *crawler) run(seed crawlTarget, stop chan struct{}) {
+	var tick <-chan time.Time
+	if c.Rate > 0 {
+		t := time.NewTicker(time.Second / time.Duration(c.Rate))
+		defer t.Stop()
+		tick = t.C
+	}
+
+	level := []crawlTarget{seed}
+	c.Job.claim(seed)
+	for len(level) > 0 {
+		mu := &sync.Mutex{}
+		next := make([]crawlTarget, 0)
+		jobs := make(chan crawlTarget)
+		wg := &sync.WaitGroup{}
+		for i := 0; i < c.Job.concurrency; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for t := range jobs {
+					found := c.visit(t)
+					mu.Lock()
+					next = append(next, found...)
+					mu.Unlock()
+				}
+			}()
+		}
+
+		stopped := false
+	loop:
+		for _, t := range level {
+			if tick != nil {
+				select {
+				case <-tick:
+				case <-stop:
+					stopped = true
+					break loop
+				}
+			}
+			select {
+			case jobs <- t:
+			case <-stop:
+				stopped = true
+				break loop
+			}
+		}
+		close(jobs)
+		wg.Wait()
+		if stopped {
+			break
+		}
+		level = next
+	}
+
+	c.Job.mu.Lock()
+	if c.Job.finished.IsZero() {
+		c.Job.finished = time.Now()
+	}
+	c.Job.mu.Unlock()
+}
+
+// visit makes the request for the target, recording it in the history, and
+// returns the new targets linked to from the response.
+func (c *crawler) visit(t crawlTarget) []crawlTarget {
+	req, err := http.NewRequest(t.Method, t.URL.String(), strings.NewReader(t.Body))
+	if err != nil {
+		c.Job.record("", false, true)
+		return nil
+	}
+	for k, v := range c.Headers {
+		req.Header[k] = v
+	}
+	if t.Method == "POST" {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+
+	e := c.Proxy.recordRequest(req, newClientInfo("crawl"))
+	resp, err := c.Proxy.send(prepareResend(e.Req))
+	if err != nil {
+		c.Job.record("", false, true)
+		return nil
+	}
+	c.Proxy.recordResponse(e, resp, time.Since(e.Time), "crawl")
+	resp.Body.Close()
+	c.Job.record(fmt.Sprintf("%d\t%d\t%d\t%s\t%s\n", t.Depth, e.ID, resp.StatusCode, t.Method, t.URL), false, false)
+
+	if t.Depth >= c.MaxDepth {
+		return nil
+	}
+	recorded := e.Response()
+	found := make([]crawlTarget, 0)
+	if loc, err := recorded.Location(); err == nil {
+		found = append(found, crawlTarget{Method: "GET", URL: loc, Depth: t.Depth + 1})
+	}
+	if strings.Contains(recorded.Header.Get("Content-Type"), "html") {
+		found = append(found, c.extract(t.URL, string(peekBody(&recorded.Body)), t.Depth+1)...)
+	}
+
+	ret := make([]crawlTarget, 0)
+	for _, n := range found {
+		if !c.Proxy.inScope(n.URL) {
+			c.Job.record("", true, false)
+			continue
+		}
+		if c.Job.claim(n) {
+			ret = append(ret, n)
+		}
+	}
+	return ret
+}
+
+// extract returns the links and forms in the given HTML page.
+func (c *crawler) extract(base *url.URL, page string, depth int) []crawlTarget {
+	ret := make([]crawlTarget, 0)
+	for _, m := range crawlLinkRe.FindAllStringSubmatch(page, -1) {
+		if u := resolveLink(base, m[1]+m[2]+m[3]); u != nil {
+			ret = append(ret, crawlTarget{Method: "GET", URL: u, Depth: depth})
+		}
+	}
+
+	if c.Forms == "none" {
+		return ret
+	}
+	for _, m := range crawlFormRe.FindAllStringSubmatch(page, -1) {
+		attrs := htmlAttrs(m[1])
+		method := strings.ToUpper(attrs["method"])
+		if method == "" {
+			method = "GET"
+		}
+		if (method != "GET" && method != "POST") || (method == "POST" && c.Forms != "all") {
+			continue
+		}
+		u := resolveLink(base, attrs["action"])
+		if u == nil {
+			continue
+		}
+
+		// Submit the form with its default values
+		values := url.Values{}
+		for _, input := range crawlInputRe.FindAllString(m[2], -1) {
+			a := htmlAttrs(input)
+			if a["name"] != "" {
+				values.Add(a["name"], a["value"])
+			}
+		}
+		t := crawlTarget{Method: method, URL: u, Depth: depth}
+		if method == "GET" {
+			u.RawQuery = values.Encode()
+		} else {
+			t.Body = values.Encode()
+		}
+		ret = append(ret, t)
+	}
+	return ret
+}
+
+// resolveLink resolves an HTML link against the page's URL, returning nil for
+// links that can't be followed.
+func resolveLink(base *url.URL, link string) *url.URL {
+	link = strings.TrimSpace(html.UnescapeString(link))
+	ref, err := url.Parse(link)
+	if err != nil {
+		return nil
+	}
+	u := base.ResolveReference(ref)
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil
+	}
+	u.Fragment = ""
+	return u
+}
+
+// htmlAttrs returns the attributes in the given HTML tag, with lower case
+// names.
+func htmlAttrs(tag string) map[string]string {
+	ret := make(map[string]string)
+	for _, m := range crawlAttrRe.FindAllStringSubmatch(tag, -1) {
+		ret[strings.ToLower(m[1])] = html.UnescapeString(m[2] + m[3] + m[4])
+	}
+	return ret
+}
+
+// newCrawlJobDir returns the Dir exposing a single crawl job.
+func newCrawlJobDir(p *Proxy, j *crawlJob) *fusebox.Dir {
+	ret, d := newNodeDir()
+	ret.Mode = os.ModeDir | 0755
+	d.add("url", newValueFile(&jobFile{&j.mu, &j.URL, func(data []byte) bool {
+		u, err := url.Parse(strings.TrimSpace(string(data)))
+		return err == nil && u.IsAbs()
+	}}))
+	d.add("depth", newValueFile(&jobFile{&j.mu, &j.Depth, func(data []byte) bool {
+		n, err := strconv.Atoi(strings.TrimSpace(string(data)))
+		return err == nil && n >= 0
+	}}))
+	d.add("rate", newValueFile(&jobFile{&j.mu, &j.Rate, func(data []byte) bool {
+		_, err := parseRate(data)
+		return err == nil
+	}}))
+	d.add("headers", newHandleFile(&jobFile{&j.mu, &j.Headers, func(data []byte) bool {
+		return parseHeaderBlock(data) != nil
+	}}))
+	d.add("forms", newValueFile(&jobFile{&j.mu, &j.Forms, func(data []byte) bool {
+		return containsString([]string{"none", "get", "all"}, strings.TrimSpace(string(data)))
+	}}))
+	d.add("run", newJobRunFile(p, j))
+	d.add("visited", newReadOnlyFile(j.Visited))
+	return ret
+}
@@ -0,0 +1,314 @@
+package proxyfs
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/pem"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+
+	"github.com/danielthatcher/fusebox"
+	"github.com/elazarl/goproxy"
+	flag "github.com/spf13/pflag"
+	"rsc.io/qr"
+)
+
+// setupHost is the host name that the device setup page can be reached at
+// through the proxy, once a device is using it.
+const setupHost = "proxyfs"
+
+// caCertPEM returns the PEM encoded certificate of the given CA.
+func caCertPEM(ca tls.Certificate) []byte {
+	if len(ca.Certificate) == 0 {
+		return nil
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Certificate[0]})
+}
+
+// lanIP returns the address of the interface used to reach other machines,
+// which is the address devices on the same network can reach the proxy at.
+// Nothing is sent to find it.
+func lanIP() string {
+	conn, err := net.Dial("udp", "192.0.2.1:9")
+	if err != nil {
+		return "127.0.0.1"
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP.String()
+}
+
+// deviceSetup describes how devices are set up to use the proxy.
+type deviceSetup struct {
+	// The address devices set as their proxy
+	Proxy string
+
+	// The URL of the setup page
+	Page string
+
+	// The CA that signs the certificates for intercepted HTTPS
+	CA tls.Certificate
+}
+
+// reachableAddr returns the address that other machines reach a listener on
+// the given address at. A listener on all interfaces is reached at the
+// machine's LAN address.
+func reachableAddr(listen string) string {
+	host, port, err := net.SplitHostPort(listen)
+	if err != nil {
+		return listen
+	}
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host = lanIP()
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// Instructions returns the steps to set up Android and iOS devices.
+func (s *deviceSetup) Instructions() []byte {
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, "Proxy: %s\n", s.Proxy)
+	fmt.Fprintf(buf, "CA certificate: %s/ca.crt\n\n", s.Page)
+	buf.WriteString(`Android
+1. Settings > Network & internet > Wi-Fi, edit the network, and set
+   Proxy to Manual with the host and port above.
+2. Download the CA certificate in the browser.
+3. Settings > Security > Encryption & credentials > Install a
+   certificate > CA certificate, and choose the downloaded file.
+   Apps targeting Android 7 or later only trust user CAs if their
+   network security config allows it.
+
+iOS
+1. Settings > Wi-Fi, tap the network, then Configure Proxy > Manual,
+   and enter the host and port above.
+2. Download the CA certificate in Safari and allow the profile to be
+   downloaded.
+3. Settings > General > VPN & Device Management, and install the
+   downloaded profile.
+4. Settings > General > About > Certificate Trust Settings, and turn
+   on full trust for the proxyfs CA.
+`)
+	return buf.Bytes()
+}
+
+// QR returns a QR code of the setup page's URL drawn with text, two rows of
+// the code to a line, for showing in a terminal.
+func (s *deviceSetup) QR() []byte {
+	code, err := qr.Encode(s.Page, qr.M)
+	if err != nil {
+		return nil
+	}
+
+	// The code is drawn dark on light, with a quiet zone around it
+	buf := new(bytes.Buffer)
+	for y := -2; y < code.Size+2; y += 2 {
+		for x := -2; x < code.Size+2; x++ {
+			top, bottom := code.Black(x, y), code.Black(x, y+1)
+			switch {
+			case top && bottom:
+				buf.WriteString(" ")
+			case top:
+				buf.WriteString("▄")
+			case bottom:
+				buf.WriteString("▀")
+			default:
+				buf.WriteString("█")
+			}
+		}
+		buf.WriteString("\n")
+	}
+	return buf.Bytes()
+}
+
+var setupPageTemplate = template.Must(template.New("setup").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>proxyfs device setup</title>
+</head>
+<body>
+<h1>proxyfs device setup</h1>
+<p>Set this device's proxy to <b>{{.Proxy}}</b>, then install the CA certificate.</p>
+<p><a href="/ca.crt">Download the CA certificate</a></p>
+<pre>{{.Instructions}}</pre>
+<p><img src="/qr.png" alt="QR code of this page"></p>
+</body>
+</html>
+`))
+
+// ServeHTTP serves the setup page, the CA certificate and a QR code of the
+// page's URL.
+func (s *deviceSetup) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/", "/index.html":
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		setupPageTemplate.Execute(w, struct {
+			Proxy        string
+			Instructions string
+		}{s.Proxy, string(s.Instructions())})
+	case "/ca.crt", "/ca.pem":
+		w.Header().Set("Content-Type", "application/x-x509-ca-cert")
+		w.Header().Set("Content-Disposition", `attachment; filename="proxyfs-ca.crt"`)
+		w.Write(caCertPEM(s.CA))
+	case "/qr.png":
+		code, err := qr.Encode(s.Page, qr.M)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(code.PNG())
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// deviceSetup returns the setup for devices using the proxy, whose setup page
+// is served to requests made directly to the proxy, and to those proxied to
+// http://proxyfs/.
+func (p *Proxy) deviceSetup() *deviceSetup {
+	addr := reachableAddr(p.listenAddr)
+	return &deviceSetup{Proxy: addr, Page: "http://" + addr, CA: p.CA()}
+}
+
+// serveSetup answers proxied requests to the setup page's host.
+func (p *Proxy) serveSetup(r *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	w := newResponseRecorder()
+	p.deviceSetup().ServeHTTP(w, r)
+	return r, w.Response(r)
+}
+
+// responseRecorder is a http.ResponseWriter that keeps what's written to it,
+// so that a handler's response can be returned through the proxy.
+type responseRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func newResponseRecorder() *responseRecorder {
+	return &responseRecorder{header: make(http.Header), status: http.StatusOK}
+}
+
+func (w *responseRecorder) Header() http.Header {
+	return w.header
+}
+
+func (w *responseRecorder) Write(data []byte) (int, error) {
+	return w.body.Write(data)
+}
+
+func (w *responseRecorder) WriteHeader(status int) {
+	w.status = status
+}
+
+// Response returns the response that was written, to the given request.
+func (w *responseRecorder) Response(r *http.Request) *http.Response {
+	return &http.Response{
+		Status:        strconv.Itoa(w.status) + " " + http.StatusText(w.status),
+		StatusCode:    w.status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        w.header,
+		Body:          ioutil.NopCloser(bytes.NewReader(w.body.Bytes())),
+		ContentLength: int64(w.body.Len()),
+		Request:       r,
+	}
+}
+
+// newCADir returns a Dir with the CA certificate, and how to set devices up
+// to use the proxy.
+func newCADir(p *Proxy) *fusebox.Dir {
+	ret, d := newNodeDir()
+	d.add("cert.pem", newReadOnlyFile(func() []byte {
+		return caCertPEM(p.CA())
+	}))
+	d.add("proxy", newReadOnlyFile(func() []byte {
+		return []byte(p.deviceSetup().Proxy + "\n")
+	}))
+	d.add("instructions", newReadOnlyFile(func() []byte {
+		return p.deviceSetup().Instructions()
+	}))
+	d.add("qr", newReadOnlyFile(func() []byte {
+		return p.deviceSetup().QR()
+	}))
+	return ret
+}
+
+// RunSetupDeviceCommand runs the setup-device subcommand, which serves the
+// setup page for devices on the local network until it's interrupted.
+func RunSetupDeviceCommand(args []string) error {
+	fs := flag.NewFlagSet("setup-device", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage of %s setup-device:\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "%s setup-device [OPTIONS]...\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	host := fs.String("host", "", "The address devices reach the proxy at. Defaults to this machine's LAN address.")
+	port := fs.IntP("port", "p", 8080, "The port the proxy listens on.")
+	serve := fs.StringP("listen", "l", ":8088", "The address to serve the setup page on.")
+	projectName := fs.String("project", "", "Serve the CA of the named project.")
+	caCert := fs.String("ca-cert", "", "Serve the CA whose certificate is in the given file, as given to the proxy's --ca-cert.")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	// Proxies given neither generate a new CA each time they start, whose
+	// setup page is served by the proxy itself
+	var ca tls.Certificate
+	switch {
+	case *projectName != "" && *caCert != "":
+		return fmt.Errorf("only one of --project and --ca-cert can be given")
+	case *projectName != "":
+		pr, err := openProject(*projectName)
+		if err != nil {
+			return err
+		}
+		if ca, err = pr.CA(); err != nil {
+			return fmt.Errorf("loading CA: %v", err)
+		}
+	case *caCert != "":
+		var err error
+		if ca, err = readCACert(*caCert); err != nil {
+			return fmt.Errorf("loading CA: %v", err)
+		}
+	default:
+		return fmt.Errorf("--project or --ca-cert must be given, to choose the CA to serve")
+	}
+
+	if *host == "" {
+		*host = lanIP()
+	}
+	l, err := listen(*serve)
+	if err != nil {
+		return err
+	}
+	setup := &deviceSetup{
+		Proxy: net.JoinHostPort(*host, strconv.Itoa(*port)),
+		Page:  "http://" + reachableAddr(l.Addr().String()),
+		CA:    ca,
+	}
+
+	fmt.Printf("Open %s on the device, or scan:\n\n", setup.Page)
+	os.Stdout.Write(setup.QR())
+	fmt.Println()
+	os.Stdout.Write(setup.Instructions())
+
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt)
+	go func() {
+		<-c
+		l.Close()
+	}()
+	if err := http.Serve(l, setup); err != nil {
+		log.Println("Stopped serving the setup page")
+	}
+	return nil
+}
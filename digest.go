@@ -0,0 +1,185 @@
+package proxyfs
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+
+	"bazil.org/fuse"
+)
+
+// digestRule recomputes a checksum header over the body of messages to hosts
+// matching a pattern.
+type digestRule struct {
+	Host     *regexp.Regexp
+	Header   string
+	Alg      string
+	Encoding string
+}
+
+// digestAlgs are the supported checksum algorithms, along with the names used
+// for them in Digest (RFC 3230) and Content-Digest (RFC 9530) headers.
+var digestAlgs = map[string]struct {
+	New        func() hash.Hash
+	DigestName string
+	SFName     string
+}{
+	"md5":    {md5.New, "MD5", "md5"},
+	"sha1":   {sha1.New, "SHA", "sha"},
+	"sha256": {sha256.New, "SHA-256", "sha-256"},
+	"sha512": {sha512.New, "SHA-512", "sha-512"},
+	"crc32":  {func() hash.Hash { return crc32.NewIEEE() }, "CRC32", "crc32"},
+}
+
+// digestRules is the list of digest rules, exposed as a file. Each line is a
+// rule made up of a host regex, a header name, an algorithm (md5, sha1,
+// sha256, sha512 or crc32) and an optional encoding, e.g.
+//
+//	example\.com$ Content-MD5 md5
+//	api\.example\.com$ X-Body-Checksum sha256 hex
+//
+// The encoding can be base64, hex, digest (the "SHA-256=..." format of the
+// Digest header) or sf (the "sha-256=:...:" format of Content-Digest). It
+// defaults to digest for the Digest header, sf for the Content-Digest and
+// Repr-Digest headers, and base64 otherwise.
+type digestRules struct {
+	mu    sync.RWMutex
+	src   []byte
+	rules []digestRule
+}
+
+// parseDigestRules parses rules in the format described for digestRules.
+func parseDigestRules(src string) ([]digestRule, error) {
+	ret := make([]digestRule, 0)
+	for _, line := range strings.Split(src, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) < 3 || len(fields) > 4 {
+			return nil, fmt.Errorf("invalid digest rule %q", line)
+		}
+
+		re, err := regexp.Compile(fields[0])
+		if err != nil {
+			return nil, err
+		}
+		rule := digestRule{Host: re, Header: http.CanonicalHeaderKey(fields[1]), Alg: strings.ToLower(fields[2])}
+		if _, ok := digestAlgs[rule.Alg]; !ok {
+			return nil, fmt.Errorf("unknown digest algorithm %q", fields[2])
+		}
+
+		switch {
+		case len(fields) == 4:
+			rule.Encoding = fields[3]
+		case rule.Header == "Digest":
+			rule.Encoding = "digest"
+		case rule.Header == "Content-Digest" || rule.Header == "Repr-Digest":
+			rule.Encoding = "sf"
+		default:
+			rule.Encoding = "base64"
+		}
+		switch rule.Encoding {
+		case "base64", "hex", "digest", "sf":
+		default:
+			return nil, fmt.Errorf("unknown digest encoding %q", rule.Encoding)
+		}
+
+		ret = append(ret, rule)
+	}
+
+	return ret, nil
+}
+
+// Value returns the header value for the given body.
+func (r *digestRule) Value(body []byte) string {
+	alg := digestAlgs[r.Alg]
+	h := alg.New()
+	h.Write(body)
+	sum := h.Sum(nil)
+
+	switch r.Encoding {
+	case "hex":
+		if r.Alg == "crc32" {
+			return fmt.Sprintf("%08x", binary.BigEndian.Uint32(sum))
+		}
+		return hex.EncodeToString(sum)
+	case "digest":
+		return alg.DigestName + "=" + base64.StdEncoding.EncodeToString(sum)
+	case "sf":
+		return alg.SFName + "=:" + base64.StdEncoding.EncodeToString(sum) + ":"
+	}
+	return base64.StdEncoding.EncodeToString(sum)
+}
+
+// ApplyRequest sets the headers of all rules matching the request's host.
+func (d *digestRules) ApplyRequest(req *http.Request) {
+	d.apply(req.URL.Host, req.Header, &req.Body)
+}
+
+// ApplyResponse sets the headers of all rules matching the host the response
+// came from.
+func (d *digestRules) ApplyResponse(resp *http.Response) {
+	if resp.Request == nil {
+		return
+	}
+	d.apply(resp.Request.URL.Host, resp.Header, &resp.Body)
+}
+
+// apply sets the headers of all rules matching the host. The body is only read
+// if a rule matches, so that bodies without checksums can be streamed.
+func (d *digestRules) apply(host string, h http.Header, body *io.ReadCloser) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	var data []byte
+	read := false
+	for _, r := range d.rules {
+		if r.Host.MatchString(host) {
+			if !read {
+				data, read = peekBody(body), true
+			}
+			h.Set(r.Header, r.Value(data))
+		}
+	}
+}
+
+func (d *digestRules) ValRead(ctx context.Context) ([]byte, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.src, nil
+}
+
+func (d *digestRules) ValWrite(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+	rules, err := parseDigestRules(string(req.Data))
+	if err != nil {
+		return errInvalid
+	}
+
+	d.mu.Lock()
+	d.src = append([]byte(nil), req.Data...)
+	d.rules = rules
+	d.mu.Unlock()
+
+	resp.Size = len(req.Data)
+	return nil
+}
+
+func (d *digestRules) Size(ctx context.Context) (uint64, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return uint64(len(d.src)), nil
+}
@@ -0,0 +1,320 @@
+package proxyfs
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"bazil.org/fuse"
+	"github.com/satori/go.uuid"
+)
+
+// dirNamePlaceholderRegexp matches the placeholders in a directory name
+// template.
+var dirNamePlaceholderRegexp = regexp.MustCompile(`<([a-z]+)>`)
+
+// dirNameMax is the longest name a directory can have, NAME_MAX on Linux.
+const dirNameMax = 255
+
+// dirNameIDMax is the longest an ID put in a directory name can be, that of a
+// UUID.
+const dirNameIDMax = 36
+
+// defaultDirNames is the template directories are named by until another is
+// written. It only has values that don't change while the entry exists.
+const defaultDirNames = "<seq>-<method>-<host>\n"
+
+// dirNames is the template used to name the directories of history entries and
+// queued requests and responses, so that listings show what each one is, e.g.
+//
+//	<seq>-<method>-<host>
+//
+// The placeholders are <seq>, the entry's ID in the history or its number in
+// order of arrival in the queues, <id>, the entry's ID in the history or its
+// UUID in a queue, and <method>, <host>, <path> and <status>. The template
+// must include <seq> or <id>, so that names are unique, and any name holding
+// an entry's <seq> or <id> where the template puts it leads to the entry, even
+// if its other values have since changed. Names are cut short to fit in
+// dirNameMax bytes by shortening the other values. Whatever the template,
+// directories can still be reached by their IDs, and queued ones by their
+// UUIDs and positions. An empty template names directories by their IDs and
+// UUIDs alone.
+type dirNames struct {
+	mu   sync.RWMutex
+	src  []byte
+	tmpl string
+
+	// Matches the names made by the template, capturing the values of its
+	// <seq> and <id> placeholders, which are listed in keys
+	re   *regexp.Regexp
+	keys []string
+}
+
+func newDirNames() *dirNames {
+	ret := &dirNames{}
+	ret.ValWrite(context.Background(), &fuse.WriteRequest{Data: []byte(defaultDirNames)}, &fuse.WriteResponse{})
+	return ret
+}
+
+// dirNameValues are what a directory name template is filled in with.
+type dirNameValues struct {
+	Seq    string
+	ID     string
+	Req    *http.Request
+	Status string
+}
+
+// parseDirNameTemplate checks a directory name template, returning it without
+// surrounding whitespace, along with a regexp matching the names it makes and
+// the placeholders the regexp captures.
+func parseDirNameTemplate(src string) (string, *regexp.Regexp, []string, error) {
+	tmpl := strings.TrimSpace(src)
+	if tmpl == "" {
+		return "", nil, nil, nil
+	}
+	if strings.ContainsAny(tmpl, "/\x00\n") {
+		return "", nil, nil, fmt.Errorf("template %q contains characters not allowed in names", tmpl)
+	}
+
+	pattern := new(strings.Builder)
+	pattern.WriteString("^")
+	keys := make([]string, 0)
+	fixed, last := 0, 0
+	for _, m := range dirNamePlaceholderRegexp.FindAllStringSubmatchIndex(tmpl, -1) {
+		pattern.WriteString(regexp.QuoteMeta(tmpl[last:m[0]]))
+		fixed += m[0] - last
+		last = m[1]
+
+		switch name := tmpl[m[2]:m[3]]; name {
+		case "seq":
+			pattern.WriteString(`([0-9]+)`)
+			keys = append(keys, name)
+			fixed += dirNameIDMax
+		case "id":
+			pattern.WriteString(`([0-9]+|[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12})`)
+			keys = append(keys, name)
+			fixed += dirNameIDMax
+		case "method", "host", "path", "status":
+			pattern.WriteString(`.*?`)
+		default:
+			return "", nil, nil, fmt.Errorf("unknown placeholder <%s>", name)
+		}
+	}
+	pattern.WriteString(regexp.QuoteMeta(tmpl[last:]))
+	pattern.WriteString("$")
+	fixed += len(tmpl) - last
+
+	if len(keys) == 0 {
+		return "", nil, nil, fmt.Errorf("template %q has neither <seq> nor <id>", tmpl)
+	}
+	if fixed > dirNameMax {
+		return "", nil, nil, fmt.Errorf("template %q makes names longer than %d bytes", tmpl, dirNameMax)
+	}
+	return tmpl, regexp.MustCompile(pattern.String()), keys, nil
+}
+
+// sanitiseDirName replaces the characters of a value that can't appear in a
+// directory name.
+func sanitiseDirName(v string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '/' || r < 0x20 || r == 0x7f {
+			return '_'
+		}
+		return r
+	}, v)
+}
+
+// truncateDirName cuts a value down to at most n bytes, without splitting a
+// character.
+func truncateDirName(v string, n int) string {
+	if len(v) <= n {
+		return v
+	}
+	if n < 0 {
+		n = 0
+	}
+	for n > 0 && !utf8.RuneStart(v[n]) {
+		n--
+	}
+	return v[:n]
+}
+
+// Name returns the name of the directory of an entry with the given values.
+func (n *dirNames) Name(v dirNameValues) string {
+	n.mu.RLock()
+	tmpl := n.tmpl
+	n.mu.RUnlock()
+	if tmpl == "" {
+		return v.ID
+	}
+
+	value := func(p string) string {
+		switch p {
+		case "<seq>":
+			return v.Seq
+		case "<id>":
+			return v.ID
+		case "<status>":
+			return sanitiseDirName(v.Status)
+		}
+		if v.Req == nil || v.Req.URL == nil {
+			return ""
+		}
+		switch p {
+		case "<method>":
+			return sanitiseDirName(v.Req.Method)
+		case "<host>":
+			return sanitiseDirName(strings.ToLower(v.Req.URL.Host))
+		}
+		return sanitiseDirName(strings.TrimPrefix(v.Req.URL.EscapedPath(), "/"))
+	}
+
+	ret := dirNamePlaceholderRegexp.ReplaceAllStringFunc(tmpl, value)
+	if len(ret) <= dirNameMax {
+		return ret
+	}
+
+	// Share what's left after the fixed parts of the name between the other
+	// values
+	placeholders := dirNamePlaceholderRegexp.FindAllString(tmpl, -1)
+	room, shared := dirNameMax-len(tmpl), 0
+	for _, p := range placeholders {
+		room += len(p)
+		if p == "<seq>" || p == "<id>" {
+			room -= len(value(p))
+		} else {
+			shared++
+		}
+	}
+	return dirNamePlaceholderRegexp.ReplaceAllStringFunc(tmpl, func(p string) string {
+		if p == "<seq>" || p == "<id>" {
+			return value(p)
+		}
+		return truncateDirName(value(p), room/shared)
+	})
+}
+
+// Keys returns the values of the <seq> and <id> placeholders in a name made by
+// the template, by placeholder, or nil if the template didn't make it.
+func (n *dirNames) Keys(name string) map[string]string {
+	n.mu.RLock()
+	re, keys := n.re, n.keys
+	n.mu.RUnlock()
+	if re == nil {
+		return nil
+	}
+
+	m := re.FindStringSubmatch(name)
+	if m == nil {
+		return nil
+	}
+	ret := make(map[string]string)
+	for i, k := range keys {
+		ret[k] = m[i+1]
+	}
+	return ret
+}
+
+func (n *dirNames) ValRead(ctx context.Context) ([]byte, error) {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	return n.src, nil
+}
+
+func (n *dirNames) ValWrite(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+	tmpl, re, keys, err := parseDirNameTemplate(string(req.Data))
+	if err != nil {
+		return errInvalid
+	}
+
+	n.mu.Lock()
+	n.src = append([]byte(nil), req.Data...)
+	n.tmpl, n.re, n.keys = tmpl, re, keys
+	n.mu.Unlock()
+
+	resp.Size = len(req.Data)
+	return nil
+}
+
+func (n *dirNames) Size(ctx context.Context) (uint64, error) {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	return uint64(len(n.src)), nil
+}
+
+// Templated returns whether directories are named by a template, rather than
+// by their IDs alone.
+func (n *dirNames) Templated() bool {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	return n.tmpl != ""
+}
+
+// historyDirName returns the name of a history entry's directory.
+func (p *Proxy) historyDirName(e *historyEntry) string {
+	status := "-"
+	if resp := e.Response(); resp != nil {
+		status = strconv.Itoa(resp.StatusCode)
+	} else if e.Aborted() {
+		status = "aborted"
+	}
+	id := strconv.Itoa(e.ID)
+	return p.DirNames.Name(dirNameValues{Seq: id, ID: id, Req: e.Req, Status: status})
+}
+
+// historyEntryByName returns the history entry with a directory of the given
+// name, or the given ID, or nil if there isn't one. A name made by the
+// template leads to the entry whose ID it holds, even if the entry's other
+// values have changed since it was listed.
+func (p *Proxy) historyEntryByName(name string) *historyEntry {
+	if id, err := strconv.Atoi(name); err == nil {
+		return p.History.Get(id)
+	}
+
+	for _, v := range p.DirNames.Keys(name) {
+		if id, err := strconv.Atoi(v); err == nil {
+			return p.History.Get(id)
+		}
+	}
+	return nil
+}
+
+// queuedReqName returns the name of the directory of a queued request.
+func (p *Proxy) queuedReqName(pr proxyReq) string {
+	ret := pr.ID.String()
+	pr.Lock.read(func() error {
+		ret = p.DirNames.Name(dirNameValues{Seq: strconv.FormatInt(pr.Seq, 10), ID: ret, Req: pr.Req, Status: "-"})
+		return nil
+	})
+	return ret
+}
+
+// queuedRespName returns the name of the directory of a queued response.
+func (p *Proxy) queuedRespName(pr proxyResp) string {
+	ret := pr.ID.String()
+	pr.Lock.read(func() error {
+		status := strconv.Itoa(pr.Resp.StatusCode)
+		ret = p.DirNames.Name(dirNameValues{Seq: strconv.FormatInt(pr.Seq, 10), ID: ret, Req: pr.Resp.Request, Status: status})
+		return nil
+	})
+	return ret
+}
+
+// namedPosition returns the position of the one of n queued entries, with the
+// given sequence numbers and UUIDs, that a name made by the template holds the
+// <seq> or <id> of, or -1 if there's none.
+func (p *Proxy) namedPosition(n int, seq func(int) int64, id func(int) uuid.UUID, name string) int {
+	for k, v := range p.DirNames.Keys(name) {
+		for i := 0; i < n; i++ {
+			if (k == "seq" && strconv.FormatInt(seq(i), 10) == v) || (k == "id" && id(i).String() == v) {
+				return i
+			}
+		}
+	}
+	return -1
+}
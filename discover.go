@@ -0,0 +1,279 @@
+package proxyfs
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+	"github.com/danielthatcher/fusebox"
+)
+
+// discoverResult is a resource found by a content discovery job.
+type discoverResult struct {
+	URL    string
+	Status int
+	Length int64
+}
+
+// discoverJob requests each word of a wordlist as a path under a base URL,
+// recording the resources that exist in the sitemap.
+type discoverJob struct {
+	mu       sync.RWMutex
+	URL      []byte
+	Wordlist []byte
+	Headers  []byte
+	Rate     []byte
+
+	concurrency int
+	started     time.Time
+	finished    time.Time
+	total       int
+	completed   int
+	skipped     int
+	errors      int
+	found       []discoverResult
+	stop        chan struct{}
+}
+
+// newDiscoverJobs returns the set of content discovery jobs.
+func newDiscoverJobs(p *Proxy) *jobSet {
+	create := func() job { return &discoverJob{} }
+	dir := func(j job) fusebox.VarNode { return newDiscoverJobDir(p, j.(*discoverJob)) }
+	return newJobSet(p, create, dir)
+}
+
+// Start generates the job's words and starts requesting them in the
+// background, with up to concurrency requests in flight.
+func (j *discoverJob) Start(p *Proxy, concurrency int) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.stop != nil && j.finished.IsZero() {
+		return fuse.Errno(syscall.EBUSY)
+	}
+
+	base, err := url.Parse(strings.TrimSpace(string(j.URL)))
+	if err != nil || !base.IsAbs() {
+		return errInvalid
+	}
+	if !strings.HasSuffix(base.Path, "/") {
+		base.Path += "/"
+	}
+	words, err := generatePayloads(j.Wordlist)
+	if err != nil || len(words) == 0 {
+		return errInvalid
+	}
+	headers := parseHeaderBlock(j.Headers)
+	if headers == nil {
+		return errInvalid
+	}
+	rate, err := parseRate(j.Rate)
+	if err != nil {
+		return errInvalid
+	}
+
+	j.concurrency = concurrency
+	j.started = time.Now()
+	j.finished = time.Time{}
+	j.total = len(words)
+	j.completed, j.skipped, j.errors = 0, 0, 0
+	j.found = nil
+	j.stop = make(chan struct{})
+	go j.run(p, base, words, headers, rate, j.stop)
+	return nil
+}
+
+// parseRate parses a limit on the number of requests a second, where empty
+// or 0 means no limit.
+func parseRate(data []byte) (int, error) {
+	s := strings.TrimSpace(string(data))
+	if s == "" {
+		return 0, nil
+	}
+	rate, err := strconv.Atoi(s)
+	if err != nil || rate < 0 {
+		return 0, fmt.Errorf("invalid rate %q", s)
+	}
+	return rate, nil
+}
+
+// Stop stops the job if it's running. Requests already in flight complete.
+func (j *discoverJob) Stop() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.stop != nil && j.finished.IsZero() {
+		close(j.stop)
+		j.finished = time.Now()
+	}
+}
+
+func (j *discoverJob) run(p *Proxy, base *url.URL, words []string, headers http.Header, rate int, stop chan struct{}) {
+	var tick <-chan time.Time
+	if rate > 0 {
+		t := time.NewTicker(time.Second / time.Duration(rate))
+		defer t.Stop()
+		tick = t.C
+	}
+
+	jobs := make(chan string)
+	wg := &sync.WaitGroup{}
+	for i := 0; i < j.concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for w := range jobs {
+				j.request(p, base, w, headers)
+			}
+		}()
+	}
+
+loop:
+	for _, w := range words {
+		if tick != nil {
+			select {
+			case <-tick:
+			case <-stop:
+				break loop
+			}
+		}
+		select {
+		case jobs <- w:
+		case <-stop:
+			break loop
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	j.mu.Lock()
+	if j.finished.IsZero() {
+		j.finished = time.Now()
+	}
+	j.mu.Unlock()
+}
+
+// request requests the given word under the base URL, if it's in scope, and
+// records the resource if it exists.
+func (j *discoverJob) request(p *Proxy, base *url.URL, word string, headers http.Header) {
+	ref, err := url.Parse(strings.TrimLeft(word, "/"))
+	if err != nil {
+		j.record(nil, false, true)
+		return
+	}
+	u := base.ResolveReference(ref)
+	if !p.inScope(u) {
+		j.record(nil, true, false)
+		return
+	}
+
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		j.record(nil, false, true)
+		return
+	}
+	for k, v := range headers {
+		req.Header[k] = v
+	}
+
+	resp, err := p.send(req)
+	if err != nil {
+		j.record(nil, false, true)
+		return
+	}
+	length, _ := io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		j.record(nil, false, false)
+		return
+	}
+	p.Sitemap.Add(u, resp.StatusCode, "discover")
+	j.record(&discoverResult{URL: u.String(), Status: resp.StatusCode, Length: length}, false, false)
+}
+
+func (j *discoverJob) record(found *discoverResult, skipped, failed bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.completed++
+	if found != nil {
+		j.found = append(j.found, *found)
+	}
+	if skipped {
+		j.skipped++
+	}
+	if failed {
+		j.errors++
+	}
+}
+
+// Found returns the index of the resources found, one per line as a tab
+// separated URL, status and body length.
+func (j *discoverJob) Found() []byte {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+	buf := new(bytes.Buffer)
+	for _, r := range j.found {
+		fmt.Fprintf(buf, "%s\t%d\t%d\n", r.URL, r.Status, r.Length)
+	}
+	return buf.Bytes()
+}
+
+// Report returns a summary of the job's progress.
+func (j *discoverJob) Report() []byte {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+	if j.stop == nil {
+		return nil
+	}
+
+	buf := new(bytes.Buffer)
+	state := "finished"
+	elapsed := j.finished.Sub(j.started)
+	if j.finished.IsZero() {
+		state = "running"
+		elapsed = time.Since(j.started)
+	} else if j.completed < j.total {
+		state = "stopped"
+	}
+	fmt.Fprintf(buf, "state: %s\n", state)
+	fmt.Fprintf(buf, "completed: %d/%d\n", j.completed, j.total)
+	fmt.Fprintf(buf, "found: %d\n", len(j.found))
+	fmt.Fprintf(buf, "out of scope: %d\n", j.skipped)
+	fmt.Fprintf(buf, "errors: %d\n", j.errors)
+	fmt.Fprintf(buf, "concurrency: %d\n", j.concurrency)
+	fmt.Fprintf(buf, "elapsed: %v\n", elapsed)
+	return buf.Bytes()
+}
+
+// newDiscoverJobDir returns the Dir exposing a single content discovery job.
+func newDiscoverJobDir(p *Proxy, j *discoverJob) *fusebox.Dir {
+	ret, d := newNodeDir()
+	ret.Mode = os.ModeDir | 0755
+	d.add("url", newValueFile(&jobFile{&j.mu, &j.URL, func(data []byte) bool {
+		u, err := url.Parse(strings.TrimSpace(string(data)))
+		return err == nil && u.IsAbs()
+	}}))
+	d.add("wordlist", newHandleFile(&jobFile{&j.mu, &j.Wordlist, func(data []byte) bool {
+		_, err := generatePayloads(data)
+		return err == nil
+	}}))
+	d.add("headers", newHandleFile(&jobFile{&j.mu, &j.Headers, func(data []byte) bool {
+		return parseHeaderBlock(data) != nil
+	}}))
+	d.add("rate", newValueFile(&jobFile{&j.mu, &j.Rate, func(data []byte) bool {
+		_, err := parseRate(data)
+		return err == nil
+	}}))
+	d.add("run", newJobRunFile(p, j))
+	d.add("found", newReadOnlyFile(j.Found))
+	return ret
+}
@@ -0,0 +1,404 @@
+package proxyfs
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"bazil.org/fuse"
+	"github.com/danielthatcher/fusebox"
+	"github.com/elazarl/goproxy"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// maxDNSLog is the number of DNS-over-HTTPS exchanges kept in the log.
+const maxDNSLog = 1000
+
+// dnsOverrideTTL is the TTL given to answers rewritten from the override
+// table, kept short so clients don't hold on to them after testing.
+const dnsOverrideTTL = 60
+
+// dnsOverride maps host names to an address.
+type dnsOverride struct {
+	IP    net.IP
+	Hosts []string
+}
+
+// dnsOverrides is a table of addresses to use for host names, in the format of
+// a hosts file: an address followed by the names that resolve to it, one
+// entry per line. A name starting with "*." also matches every subdomain. It's
+// a FileElement, so can be exposed and edited directly.
+type dnsOverrides struct {
+	mu      sync.RWMutex
+	src     []byte
+	entries []dnsOverride
+}
+
+// parseDNSOverrides parses a hosts file, ignoring blank lines and comments
+// starting with '#'.
+func parseDNSOverrides(data []byte) ([]dnsOverride, error) {
+	ret := make([]dnsOverride, 0)
+	s := bufio.NewScanner(bytes.NewReader(data))
+	for s.Scan() {
+		line := s.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("no host names for %s", fields[0])
+		}
+
+		ip := net.ParseIP(fields[0])
+		if ip == nil {
+			return nil, fmt.Errorf("invalid address %q", fields[0])
+		}
+		hosts := make([]string, 0, len(fields)-1)
+		for _, h := range fields[1:] {
+			hosts = append(hosts, strings.ToLower(strings.TrimSuffix(h, ".")))
+		}
+		ret = append(ret, dnsOverride{IP: ip, Hosts: hosts})
+	}
+	return ret, s.Err()
+}
+
+// Lookup returns the addresses the given host name is overridden to, if any.
+func (o *dnsOverrides) Lookup(host string) []net.IP {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+
+	ret := make([]net.IP, 0)
+	for _, e := range o.entries {
+		for _, h := range e.Hosts {
+			if h == host || (strings.HasPrefix(h, "*.") && strings.HasSuffix(host, h[1:])) {
+				ret = append(ret, e.IP)
+				break
+			}
+		}
+	}
+	return ret
+}
+
+func (o *dnsOverrides) ValRead(ctx context.Context) ([]byte, error) {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	return o.src, nil
+}
+
+func (o *dnsOverrides) ValWrite(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+	entries, err := parseDNSOverrides(req.Data)
+	if err != nil {
+		return errInvalid
+	}
+
+	o.mu.Lock()
+	o.src = append([]byte(nil), req.Data...)
+	o.entries = entries
+	o.mu.Unlock()
+
+	resp.Size = len(req.Data)
+	return nil
+}
+
+func (o *dnsOverrides) Size(ctx context.Context) (uint64, error) {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	return uint64(len(o.src)), nil
+}
+
+// dialContext dials the given address, using the override table for its
+// host if it has an entry, from the local address set for it. Hosts that
+// stand for unix sockets are dialled at the socket. It's used for all of the
+// proxy's upstream connections.
+func (p *Proxy) dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	d := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return d.DialContext(ctx, network, addr)
+	}
+	if t := p.Transport.LookupHost(host, port); t != nil && t.Unix != "" {
+		return d.DialContext(ctx, "unix", t.Unix)
+	}
+	if ip := p.bindOut(host, port); ip != nil {
+		d.LocalAddr = &net.TCPAddr{IP: ip}
+	}
+	ips := p.DNS.Overrides.Lookup(host)
+	if len(ips) == 0 {
+		return d.DialContext(ctx, network, addr)
+	}
+
+	for _, ip := range ips {
+		var conn net.Conn
+		if conn, err = d.DialContext(ctx, network, net.JoinHostPort(ip.String(), port)); err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+// dnsExchange is a DNS-over-HTTPS exchange seen through the proxy.
+type dnsExchange struct {
+	Time       time.Time
+	URL        string
+	Answer     *dnsmessage.Message
+	Overridden bool
+}
+
+// Summary returns a single, tab separated line summarising the exchange: its
+// time, the server's URL, each question, each answer, and whether the answer
+// was rewritten.
+func (x *dnsExchange) Summary() string {
+	questions := make([]string, 0, len(x.Answer.Questions))
+	for _, q := range x.Answer.Questions {
+		questions = append(questions, q.Name.String()+" "+dnsTypeName(q.Type))
+	}
+	answers := make([]string, 0, len(x.Answer.Answers))
+	for _, a := range x.Answer.Answers {
+		answers = append(answers, dnsTypeName(a.Header.Type)+" "+dnsResourceData(a.Body))
+	}
+	overridden := "-"
+	if x.Overridden {
+		overridden = "overridden"
+	}
+
+	return fmt.Sprintf("%s\t%s\t%s\t%s\t%s\n", x.Time.Format(time.RFC3339), x.URL,
+		strings.Join(questions, ","), strings.Join(answers, ","), overridden)
+}
+
+// dnsState holds the override table, and the DNS-over-HTTPS exchanges seen.
+type dnsState struct {
+	Overrides *dnsOverrides
+
+	// Whether answers in DNS-over-HTTPS responses are rewritten using the
+	// override table
+	RewriteDoH bool
+
+	mu  sync.RWMutex
+	log []*dnsExchange
+}
+
+func newDNSState() *dnsState {
+	return &dnsState{Overrides: &dnsOverrides{}}
+}
+
+// Log returns the logged exchanges.
+func (s *dnsState) Log() []*dnsExchange {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append([]*dnsExchange(nil), s.log...)
+}
+
+func (s *dnsState) add(x *dnsExchange) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.log = append(s.log, x)
+	if len(s.log) > maxDNSLog {
+		s.log = s.log[len(s.log)-maxDNSLog:]
+	}
+}
+
+// isDoHResponse returns whether the response is a DNS-over-HTTPS answer in
+// the DNS wire format.
+func isDoHResponse(resp *http.Response) bool {
+	return resp != nil && strings.HasPrefix(resp.Header.Get("Content-Type"), "application/dns-message")
+}
+
+// dohQuery returns the DNS query in a DNS-over-HTTPS request, which is either
+// the base64url encoded dns parameter of a GET, or the body of a POST.
+func dohQuery(req *http.Request) (*dnsmessage.Message, bool) {
+	var data []byte
+	if req.Method == "GET" {
+		q := req.URL.Query().Get("dns")
+		if q == "" {
+			return nil, false
+		}
+		var err error
+		if data, err = base64.RawURLEncoding.DecodeString(strings.TrimRight(q, "=")); err != nil {
+			return nil, false
+		}
+	} else if strings.HasPrefix(req.Header.Get("Content-Type"), "application/dns-message") {
+		data = peekBody(&req.Body)
+	} else {
+		return nil, false
+	}
+
+	var m dnsmessage.Message
+	if err := m.Unpack(data); err != nil {
+		return nil, false
+	}
+	return &m, true
+}
+
+// handleDoH decodes DNS-over-HTTPS answers passing through the proxy, logging
+// them, and rewrites them using the override table if enabled.
+func (p *Proxy) handleDoH(r *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+	if !isDoHResponse(r) {
+		return r
+	}
+
+	var m dnsmessage.Message
+	if err := m.Unpack(peekBody(&r.Body)); err != nil {
+		return r
+	}
+	x := &dnsExchange{Time: time.Now(), URL: r.Request.URL.String(), Answer: &m}
+	if p.DNS.RewriteDoH && p.overrideAnswers(&m) {
+		if data, err := m.Pack(); err == nil {
+			r.Body = ioutil.NopCloser(bytes.NewReader(data))
+			r.ContentLength = int64(len(data))
+			r.Header.Set("Content-Length", strconv.Itoa(len(data)))
+			x.Overridden = true
+		}
+	}
+	p.DNS.add(x)
+	return r
+}
+
+// overrideAnswers replaces the answers to A and AAAA questions for overridden
+// names with the addresses in the override table, returning whether any were
+// replaced.
+func (p *Proxy) overrideAnswers(m *dnsmessage.Message) bool {
+	changed := false
+	for _, q := range m.Questions {
+		if q.Type != dnsmessage.TypeA && q.Type != dnsmessage.TypeAAAA {
+			continue
+		}
+		ips := p.DNS.Overrides.Lookup(q.Name.String())
+		if len(ips) == 0 {
+			continue
+		}
+
+		// Drop the existing answers for the name, including any CNAMEs
+		answers := make([]dnsmessage.Resource, 0, len(m.Answers))
+		for _, a := range m.Answers {
+			if !strings.EqualFold(a.Header.Name.String(), q.Name.String()) {
+				answers = append(answers, a)
+			}
+		}
+		for _, ip := range ips {
+			h := dnsmessage.ResourceHeader{Name: q.Name, Class: q.Class, TTL: dnsOverrideTTL}
+			if ip4 := ip.To4(); ip4 != nil && q.Type == dnsmessage.TypeA {
+				var a [4]byte
+				copy(a[:], ip4)
+				answers = append(answers, dnsmessage.Resource{Header: h, Body: &dnsmessage.AResource{A: a}})
+			} else if ip4 == nil && q.Type == dnsmessage.TypeAAAA {
+				var a [16]byte
+				copy(a[:], ip.To16())
+				answers = append(answers, dnsmessage.Resource{Header: h, Body: &dnsmessage.AAAAResource{AAAA: a}})
+			}
+		}
+		m.Answers = answers
+		m.RCode = dnsmessage.RCodeSuccess
+		changed = true
+	}
+	return changed
+}
+
+// dnsTypeName returns the name of a record type, e.g. "AAAA".
+func dnsTypeName(t dnsmessage.Type) string {
+	return strings.TrimPrefix(t.String(), "Type")
+}
+
+// dnsResourceData returns the data of a record in a readable form.
+func dnsResourceData(body dnsmessage.ResourceBody) string {
+	switch b := body.(type) {
+	case *dnsmessage.AResource:
+		return net.IP(b.A[:]).String()
+	case *dnsmessage.AAAAResource:
+		return net.IP(b.AAAA[:]).String()
+	case *dnsmessage.CNAMEResource:
+		return b.CNAME.String()
+	case *dnsmessage.NSResource:
+		return b.NS.String()
+	case *dnsmessage.PTRResource:
+		return b.PTR.String()
+	case *dnsmessage.MXResource:
+		return fmt.Sprintf("%d %s", b.Pref, b.MX)
+	case *dnsmessage.TXTResource:
+		return strconv.Quote(strings.Join(b.TXT, ""))
+	case *dnsmessage.SRVResource:
+		return fmt.Sprintf("%d %d %d %s", b.Priority, b.Weight, b.Port, b.Target)
+	case *dnsmessage.SOAResource:
+		return fmt.Sprintf("%s %s %d", b.NS, b.MBox, b.Serial)
+	}
+	return "?"
+}
+
+// formatDNSMessage returns a DNS message in a readable form, similar to dig's
+// output.
+func formatDNSMessage(m *dnsmessage.Message) []byte {
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, ";; id %d, %s\n", m.ID, strings.TrimPrefix(m.RCode.String(), "RCode"))
+
+	buf.WriteString(";; question\n")
+	for _, q := range m.Questions {
+		fmt.Fprintf(buf, "%s\t%s\n", q.Name, dnsTypeName(q.Type))
+	}
+
+	sections := []struct {
+		name      string
+		resources []dnsmessage.Resource
+	}{{"answer", m.Answers}, {"authority", m.Authorities}, {"additional", m.Additionals}}
+	for _, s := range sections {
+		if len(s.resources) == 0 {
+			continue
+		}
+		fmt.Fprintf(buf, ";; %s\n", s.name)
+		for _, r := range s.resources {
+			fmt.Fprintf(buf, "%s\t%d\t%s\t%s\n", r.Header.Name, r.Header.TTL, dnsTypeName(r.Header.Type), dnsResourceData(r.Body))
+		}
+	}
+	return buf.Bytes()
+}
+
+// newDoHDir returns a Dir with the decoded query and answer of a
+// DNS-over-HTTPS exchange in the history.
+func newDoHDir(e *historyEntry) *fusebox.Dir {
+	ret, d := newNodeDir()
+	d.add("query", newReadOnlyFile(func() []byte {
+		if m, ok := dohQuery(e.Req); ok {
+			return formatDNSMessage(m)
+		}
+		return nil
+	}))
+	d.add("answer", newReadOnlyFile(func() []byte {
+		resp := e.Response()
+		if !isDoHResponse(resp) {
+			return nil
+		}
+		var m dnsmessage.Message
+		if err := m.Unpack(peekBody(&resp.Body)); err != nil {
+			return nil
+		}
+		return formatDNSMessage(&m)
+	}))
+	return ret
+}
+
+// newDNSDir returns the Dir exposing the override table, and the log of
+// DNS-over-HTTPS exchanges.
+func newDNSDir(s *dnsState) *fusebox.Dir {
+	ret, d := newNodeDir()
+	d.add("overrides", newHandleFile(s.Overrides))
+	d.add("rewrite-doh", newBoolFile(&s.RewriteDoH))
+	d.add("doh", newReadOnlyFile(func() []byte {
+		buf := new(bytes.Buffer)
+		for _, x := range s.Log() {
+			buf.WriteString(x.Summary())
+		}
+		return buf.Bytes()
+	}))
+	return ret
+}
@@ -0,0 +1,128 @@
+package proxyfs
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"bazil.org/fuse"
+)
+
+// decodeBody removes the given content encoding from data. Unsupported
+// encodings result in an error.
+func decodeBody(data []byte, encoding string) ([]byte, error) {
+	var r io.Reader
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "", "identity":
+		return data, nil
+	case "gzip", "x-gzip":
+		gr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		r = gr
+	case "deflate":
+		// Servers disagree on whether deflate means zlib or raw DEFLATE
+		zr, err := zlib.NewReader(bytes.NewReader(data))
+		if err != nil {
+			r = flate.NewReader(bytes.NewReader(data))
+		} else {
+			r = zr
+		}
+	default:
+		return nil, fuse.ENOTSUP
+	}
+
+	return ioutil.ReadAll(r)
+}
+
+// gzipBody compresses data with gzip.
+func gzipBody(data []byte) []byte {
+	buf := new(bytes.Buffer)
+	w := gzip.NewWriter(buf)
+	w.Write(data)
+	w.Close()
+	return buf.Bytes()
+}
+
+// acceptsGzip returns whether the request advertises support for gzip.
+func acceptsGzip(req *http.Request) bool {
+	if req == nil {
+		return false
+	}
+
+	for _, v := range strings.Split(req.Header.Get("Accept-Encoding"), ",") {
+		parts := strings.Split(v, ";")
+		enc := strings.ToLower(strings.TrimSpace(parts[0]))
+		if enc != "gzip" && enc != "x-gzip" && enc != "*" {
+			continue
+		}
+		if len(parts) > 1 && strings.Replace(strings.TrimSpace(parts[1]), " ", "", -1) == "q=0" {
+			continue
+		}
+		return true
+	}
+
+	return false
+}
+
+// decodedBodyFile exposes a response's body with its Content-Encoding removed.
+// Written bodies are re-compressed with gzip if the recompress setting is on
+// and the client accepts gzip, and are otherwise sent without an encoding,
+// with the headers updated to match in both cases.
+type decodedBodyFile struct {
+	Resp     *http.Response
+	Settings *settings
+}
+
+// Returns a new File exposing the decoded body of the response.
+func newDecodedBodyFile(resp *http.Response, settings *settings) *handleFile {
+	ret := newHandleFile(&decodedBodyFile{resp, settings})
+	ret.OpenFlags = fuse.OpenDirectIO
+	return ret
+}
+
+func (f *decodedBodyFile) ValRead(ctx context.Context) ([]byte, error) {
+	data, err := decodeBody(peekBody(&f.Resp.Body), f.Resp.Header.Get("Content-Encoding"))
+	if err != nil {
+		return nil, fuse.EIO
+	}
+
+	return data, nil
+}
+
+func (f *decodedBodyFile) ValWrite(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+	data := req.Data
+	if bodyTooBig(len(data), f.Settings) {
+		return errTooBig
+	}
+	if f.Settings.Get().Recompress && acceptsGzip(f.Resp.Request) {
+		data = gzipBody(data)
+		f.Resp.Header.Set("Content-Encoding", "gzip")
+	} else {
+		f.Resp.Header.Del("Content-Encoding")
+	}
+
+	f.Resp.Body = ioutil.NopCloser(bytes.NewReader(data))
+	f.Resp.ContentLength = int64(len(data))
+	f.Resp.Header.Set("Content-Length", strconv.Itoa(len(data)))
+	f.Resp.Uncompressed = false
+
+	resp.Size = len(req.Data)
+	return nil
+}
+
+func (f *decodedBodyFile) Size(ctx context.Context) (uint64, error) {
+	data, err := f.ValRead(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return uint64(len(data)), nil
+}
@@ -0,0 +1,32 @@
+package proxyfs
+
+import (
+	"syscall"
+
+	"bazil.org/fuse"
+)
+
+// Errors returned by nodes when writes are rejected, chosen so that scripts can
+// distinguish the cause of a failure.
+var (
+	// errInvalid is returned when a written value can't be parsed.
+	errInvalid = fuse.Errno(syscall.EINVAL)
+
+	// errTooBig is returned when a written body is larger than allowed.
+	errTooBig = fuse.Errno(syscall.EFBIG)
+
+	// errReadOnly is returned when writing to something that can't be changed.
+	errReadOnly = fuse.Errno(syscall.EACCES)
+
+	// errGone is returned by the files of a queued request or response once
+	// it has left the queue.
+	errGone = fuse.Errno(syscall.ESTALE)
+
+	// errUnsafe is returned when asked to send a request again that isn't
+	// safe to, without overriding the resend safety rules.
+	errUnsafe = fuse.Errno(syscall.EPERM)
+
+	// errInternal is returned when an operation fails because of a bug in
+	// the proxy, which also marks it as degraded.
+	errInternal = fuse.Errno(syscall.EIO)
+)
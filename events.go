@@ -0,0 +1,81 @@
+package proxyfs
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// emitEvent logs a notable event, and sends it to the events feed. If nothing
+// is reading the feed and its buffer is full, the event is only logged.
+func (p *Proxy) emitEvent(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	log.Println(msg)
+
+	line := fmt.Sprintf("%s %s\n", time.Now().Format(time.RFC3339), msg)
+	select {
+	case p.Events <- []byte(line):
+	default:
+	}
+}
+
+// checkQueueDepth raises an alarm when the number of intercepted items waiting
+// in the queues goes above the configured threshold, and optionally stops
+// intercepting so that they are all forwarded. The alarm is raised once each
+// time the threshold is crossed.
+func (p *Proxy) checkQueueDepth() {
+	limit := p.Settings.Get().AlarmQueueDepth
+	if limit <= 0 {
+		return
+	}
+
+	depth := 0
+	p.reqMu.RLock()
+	if p.IntReq.Get() {
+		depth += len(p.Requests)
+	}
+	p.reqMu.RUnlock()
+	p.respMu.RLock()
+	if p.IntResp.Get() {
+		depth += len(p.Responses)
+	}
+	p.respMu.RUnlock()
+
+	p.alarmMu.Lock()
+	defer p.alarmMu.Unlock()
+	if depth <= limit {
+		p.alarmed = false
+		return
+	}
+	if p.alarmed {
+		return
+	}
+	p.alarmed = true
+
+	p.emitEvent("alarm: %d intercepted items are queued, above the limit of %d", depth, limit)
+	if p.Settings.Get().AlarmAutoForward {
+		p.emitEvent("alarm: intercepting stopped, forwarding all queued items")
+		go p.stopIntercepting()
+	}
+}
+
+// stopIntercepting turns off request and response interception, and forwards
+// everything waiting in the queues.
+func (p *Proxy) stopIntercepting() {
+	p.IntReq.Set(false)
+	p.IntResp.Set(false)
+
+	p.reqMu.RLock()
+	reqs := append([]proxyReq(nil), p.Requests...)
+	p.reqMu.RUnlock()
+	for _, r := range reqs {
+		release(r.Forward)
+	}
+
+	p.respMu.RLock()
+	resps := append([]proxyResp(nil), p.Responses...)
+	p.respMu.RUnlock()
+	for _, r := range resps {
+		release(r.Forward)
+	}
+}
@@ -0,0 +1,120 @@
+package proxyfs
+
+import (
+	"bytes"
+	"encoding/csv"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/danielthatcher/fusebox"
+)
+
+// exportColumns are the columns that can be included in the CSV export of the
+// history, and how to get their values from an entry.
+var exportColumns = map[string]func(e *historyEntry) string{
+	"id":        func(e *historyEntry) string { return strconv.Itoa(e.ID) },
+	"timestamp": func(e *historyEntry) string { return e.Time.Format(time.RFC3339) },
+	"method":    func(e *historyEntry) string { return e.Req.Method },
+	"scheme":    func(e *historyEntry) string { return e.Req.URL.Scheme },
+	"host":      func(e *historyEntry) string { return e.Req.URL.Host },
+	"path":      func(e *historyEntry) string { return e.Req.URL.Path },
+	"query":     func(e *historyEntry) string { return e.Req.URL.RawQuery },
+	"url":       func(e *historyEntry) string { return e.Req.URL.String() },
+	"status": func(e *historyEntry) string {
+		if resp := e.Response(); resp != nil {
+			return strconv.Itoa(resp.StatusCode)
+		}
+		if e.Aborted() {
+			return "aborted"
+		}
+		return ""
+	},
+	"size": func(e *historyEntry) string {
+		if resp := e.Response(); resp != nil {
+			return strconv.Itoa(bodyLen(&resp.Body))
+		}
+		return ""
+	},
+	"mime": func(e *historyEntry) string {
+		if resp := e.Response(); resp != nil {
+			return resp.Header.Get("Content-Type")
+		}
+		return ""
+	},
+	"duration": func(e *historyEntry) string {
+		if e.Response() == nil {
+			return ""
+		}
+		return strconv.FormatInt(e.Latency().Nanoseconds()/int64(time.Millisecond), 10)
+	},
+	"tags":    func(e *historyEntry) string { return strings.Join(e.Labels(), ",") },
+	"notes":   func(e *historyEntry) string { return string(e.Notes()) },
+	"client":  func(e *historyEntry) string { return e.Client.Addr },
+	"route":   func(e *historyEntry) string { return e.Route() },
+	"session": func(e *historyEntry) string { return e.Session() },
+}
+
+// defaultExportColumns are the columns exported unless configured otherwise.
+const defaultExportColumns = "timestamp,method,host,path,status,size,duration,tags,notes"
+
+// parseExportColumns parses a comma or whitespace separated list of columns,
+// returning nil if any are unknown.
+func parseExportColumns(s string) []string {
+	cols := strings.FieldsFunc(s, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t' || r == '\n'
+	})
+	if len(cols) == 0 {
+		return nil
+	}
+	for _, c := range cols {
+		if _, ok := exportColumns[c]; !ok {
+			return nil
+		}
+	}
+	return cols
+}
+
+// exportCSV returns the given history entries as CSV, with a header row
+// followed by a row per entry, with the given redaction rules applied.
+// Durations are in milliseconds.
+func exportCSV(entries []*historyEntry, cols []string, redact *redactionRules) []byte {
+	buf := new(bytes.Buffer)
+	w := csv.NewWriter(buf)
+	w.Write(cols)
+	for _, e := range entries {
+		if !redact.Empty() {
+			req := *e.Req
+			req.URL = redact.URL(e.Req.URL)
+			e = &historyEntry{ID: e.ID, Time: e.Time, Req: &req, Resp: e.Response(), Client: e.Client,
+				labels: e.Labels(), notes: e.Notes(), latency: e.Latency(), aborted: e.Aborted()}
+		}
+		row := make([]string, len(cols))
+		for i, c := range cols {
+			row[i] = exportColumns[c](e)
+		}
+		w.Write(row)
+	}
+	w.Flush()
+	return buf.Bytes()
+}
+
+// newExportDir returns the Dir holding exports of the history, along with
+// their settings.
+func newExportDir(p *Proxy) *fusebox.Dir {
+	mu := &sync.RWMutex{}
+	columns := []byte(defaultExportColumns)
+
+	ret, d := newNodeDir()
+	d.add("csv", newReadOnlyFile(func() []byte {
+		mu.RLock()
+		cols := parseExportColumns(string(columns))
+		mu.RUnlock()
+		return exportCSV(p.History.Entries(), cols, p.Redaction)
+	}))
+	d.add("columns", newValueFile(&jobFile{mu, &columns, func(data []byte) bool {
+		return parseExportColumns(string(data)) != nil
+	}}))
+	return ret
+}
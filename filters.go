@@ -0,0 +1,190 @@
+package proxyfs
+
+import (
+	"context"
+	"mime"
+	"net/http"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"bazil.org/fuse"
+	"github.com/danielthatcher/fusebox"
+)
+
+// interceptFilter narrows which in scope messages are held for interception
+// by one of their properties. The file holds values separated by newlines,
+// commas or spaces, and a value prefixed with '!' excludes what it matches,
+// e.g.
+//
+//	!png, !css, !js
+//
+// A message passes if it matches none of the excluded values and, if there
+// are any others, one of them. An empty filter passes everything.
+type interceptFilter struct {
+	mu      sync.RWMutex
+	src     []byte
+	include []string
+	exclude []string
+
+	// Whether a value can be given, and whether a message's property
+	// matches it
+	valid func(v string) bool
+	match func(prop, v string) bool
+}
+
+// Allows returns whether a message with the given property passes the filter.
+func (f *interceptFilter) Allows(prop string) bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	for _, v := range f.exclude {
+		if f.match(prop, v) {
+			return false
+		}
+	}
+	if len(f.include) == 0 {
+		return true
+	}
+	for _, v := range f.include {
+		if f.match(prop, v) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *interceptFilter) ValRead(ctx context.Context) ([]byte, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.src, nil
+}
+
+func (f *interceptFilter) ValWrite(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+	include, exclude := make([]string, 0), make([]string, 0)
+	for _, v := range strings.FieldsFunc(string(req.Data), func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t' || r == '\n' || r == '\r'
+	}) {
+		list := &include
+		if strings.HasPrefix(v, "!") {
+			v, list = v[1:], &exclude
+		}
+		if v == "" || !f.valid(v) {
+			return errInvalid
+		}
+		*list = append(*list, v)
+	}
+
+	f.mu.Lock()
+	f.src = append([]byte(nil), req.Data...)
+	f.include, f.exclude = include, exclude
+	f.mu.Unlock()
+
+	resp.Size = len(req.Data)
+	return nil
+}
+
+func (f *interceptFilter) Size(ctx context.Context) (uint64, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return uint64(len(f.src)), nil
+}
+
+// statusPatternRegexp matches status codes and classes such as 4xx.
+var statusPatternRegexp = regexp.MustCompile(`^[1-5][0-9xX]{2}$`)
+
+// interceptFilters are the filters deciding which in scope messages are held
+// for interception. Requests are filtered by their method and the extension
+// of their path, and responses by their status, content type and the
+// extension of their request's path. Messages that are filtered out pass
+// through the queue without stopping, as they do when intercepting is off.
+type interceptFilters struct {
+	Method      *interceptFilter
+	ContentType *interceptFilter
+	Status      *interceptFilter
+	Extension   *interceptFilter
+}
+
+func newInterceptFilters() *interceptFilters {
+	anyValue := func(v string) bool { return true }
+	return &interceptFilters{
+		// Methods are matched exactly
+		Method: &interceptFilter{
+			valid: func(v string) bool { return !strings.ContainsAny(v, "/:") },
+			match: strings.EqualFold,
+		},
+
+		// Content types are matched without their parameters, e.g. charset.
+		// A type such as image/* matches its every subtype, and a value
+		// without a slash matches subtypes such as json and the suffixes of
+		// structured types such as application/vnd.api+json.
+		ContentType: &interceptFilter{
+			valid: anyValue,
+			match: func(prop, v string) bool {
+				ct, _, _ := mime.ParseMediaType(prop)
+				ct, v = strings.ToLower(ct), strings.ToLower(v)
+				if strings.HasSuffix(v, "/*") {
+					return strings.HasPrefix(ct, strings.TrimSuffix(v, "*"))
+				}
+				if !strings.Contains(v, "/") {
+					i := strings.Index(ct, "/")
+					return i >= 0 && (ct[i+1:] == v || strings.HasSuffix(ct, "+"+v))
+				}
+				return ct == v
+			},
+		},
+
+		// Statuses are codes, or classes such as 4xx
+		Status: &interceptFilter{
+			valid: statusPatternRegexp.MatchString,
+			match: func(prop, v string) bool {
+				if len(prop) != len(v) {
+					return false
+				}
+				for i := range v {
+					if v[i] != 'x' && v[i] != 'X' && v[i] != prop[i] {
+						return false
+					}
+				}
+				return true
+			},
+		},
+
+		// Extensions are given with or without their leading dot
+		Extension: &interceptFilter{
+			valid: func(v string) bool { return !strings.Contains(v, "/") },
+			match: func(prop, v string) bool {
+				return strings.EqualFold(prop, strings.TrimPrefix(v, "."))
+			},
+		},
+	}
+}
+
+// pathExt returns the extension of a URL's path, without its dot.
+func pathExt(req *http.Request) string {
+	return strings.TrimPrefix(path.Ext(req.URL.Path), ".")
+}
+
+// Request returns whether an in scope request is held for interception.
+func (f *interceptFilters) Request(req *http.Request) bool {
+	return f.Method.Allows(req.Method) && f.Extension.Allows(pathExt(req))
+}
+
+// Response returns whether an in scope response is held for interception.
+func (f *interceptFilters) Response(resp *http.Response) bool {
+	if !f.Status.Allows(strconv.Itoa(resp.StatusCode)) || !f.ContentType.Allows(resp.Header.Get("Content-Type")) {
+		return false
+	}
+	return resp.Request == nil || f.Extension.Allows(pathExt(resp.Request))
+}
+
+// newFiltersDir returns the Dir holding the intercept filters.
+func newFiltersDir(f *interceptFilters) *fusebox.Dir {
+	ret, d := newNodeDir()
+	d.add("method", newHandleFile(f.Method))
+	d.add("content-type", newHandleFile(f.ContentType))
+	d.add("status", newHandleFile(f.Status))
+	d.add("extension", newHandleFile(f.Extension))
+	return ret
+}
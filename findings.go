@@ -0,0 +1,248 @@
+package proxyfs
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/danielthatcher/fusebox"
+)
+
+// finding is something of interest noticed in the traffic, such as a leaked
+// secret. Findings with the same key are merged, with the sources they were
+// found in being accumulated.
+type finding struct {
+	ID      int
+	Kind    string
+	Key     string
+	Detail  string
+	Sources []string
+}
+
+// findingList is a category of findings, exposed as a directory under
+// /findings. If Sensitive is set, the details of findings are masked unless
+// Reveal is set.
+type findingList struct {
+	mu        sync.RWMutex
+	items     []*finding
+	byKey     map[string]*finding
+	Sensitive bool
+	Reveal    bool
+
+	// The store findings are saved to, if any, and the list's category in it
+	store    historyStore
+	category string
+}
+
+func newFindingList() *findingList {
+	return &findingList{
+		items: make([]*finding, 0),
+		byKey: make(map[string]*finding),
+	}
+}
+
+// Add records a finding of the given kind, identified by key, that was found
+// in source. If a finding with the same key already exists, the source is
+// added to it instead.
+func (l *findingList) Add(kind, key, detail, source string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if f, ok := l.byKey[key]; ok {
+		if !containsString(f.Sources, source) {
+			f.Sources = append(f.Sources, source)
+			l.save(f)
+		}
+		return
+	}
+
+	f := &finding{
+		ID:      len(l.items),
+		Kind:    kind,
+		Key:     key,
+		Detail:  detail,
+		Sources: []string{source},
+	}
+	l.items = append(l.items, f)
+	l.byKey[key] = f
+	l.save(f)
+}
+
+// restore adds a finding loaded from a store to the end of the list.
+func (l *findingList) restore(f *finding) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	f.ID = len(l.items)
+	l.items = append(l.items, f)
+	l.byKey[f.Key] = f
+}
+
+// save saves the given finding to the store, if there is one. The list must
+// be locked.
+func (l *findingList) save(f *finding) {
+	if l.store == nil {
+		return
+	}
+	if err := l.store.SaveFinding(l.category, f); err != nil {
+		log.Printf("Failed to save finding: %v\n", err)
+	}
+}
+
+// Items returns a copy of the findings in the list.
+func (l *findingList) Items() []finding {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	ret := make([]finding, len(l.items))
+	for i, f := range l.items {
+		ret[i] = *f
+		ret[i].Sources = append([]string(nil), f.Sources...)
+	}
+	return ret
+}
+
+// detail returns the detail of the finding as it should be displayed, masking
+// it if required.
+func (l *findingList) detail(f finding) string {
+	if l.Sensitive && !l.Reveal {
+		return maskSecret(f.Detail)
+	}
+	return f.Detail
+}
+
+// maskSecret hides all but the start and end of the given string.
+func maskSecret(s string) string {
+	if len(s) <= 12 {
+		return strings.Repeat("*", len(s))
+	}
+	return s[:4] + strings.Repeat("*", len(s)-8) + s[len(s)-4:]
+}
+
+// findings holds the categories of findings that are exposed under /findings.
+type findings struct {
+	mu    sync.RWMutex
+	names []string
+	lists map[string]*findingList
+	store historyStore
+}
+
+func newFindings() *findings {
+	return &findings{lists: make(map[string]*findingList)}
+}
+
+// Category returns the list of findings with the given name, creating it if
+// it doesn't already exist.
+func (fs *findings) Category(name string) *findingList {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	l, ok := fs.lists[name]
+	if !ok {
+		l = newFindingList()
+		l.store, l.category = fs.store, name
+		fs.lists[name] = l
+		fs.names = append(fs.names, name)
+	}
+	return l
+}
+
+// SetStore makes the findings be saved to the given store, taking up the
+// findings already saved in it. It must be called before anything is found.
+func (fs *findings) SetStore(s historyStore) error {
+	fs.mu.Lock()
+	fs.store = s
+	for name, l := range fs.lists {
+		l.mu.Lock()
+		l.store, l.category = s, name
+		l.mu.Unlock()
+	}
+	fs.mu.Unlock()
+
+	return s.LoadFindings(func(category string, f *finding) {
+		fs.Category(category).restore(f)
+	})
+}
+
+// newFindingsDir returns a Dir with a directory for each category of findings.
+func newFindingsDir(fs *findings) *fusebox.Dir {
+	keys := func() []string {
+		fs.mu.RLock()
+		defer fs.mu.RUnlock()
+		return append([]string(nil), fs.names...)
+	}
+
+	node := func(k string) fusebox.VarNode {
+		fs.mu.RLock()
+		l, ok := fs.lists[k]
+		fs.mu.RUnlock()
+		if !ok {
+			return nil
+		}
+		return newFindingListDir(l)
+	}
+
+	return newFuncDir(keys, node)
+}
+
+// newFindingListDir returns a Dir exposing the findings in a list, with an
+// index summarising them, and a numbered directory for each. Sensitive lists
+// also have a reveal file controlling whether details are masked.
+func newFindingListDir(l *findingList) *fusebox.Dir {
+	keys := func() []string {
+		items := l.Items()
+		ret := make([]string, 0, len(items)+2)
+		ret = append(ret, "index")
+		if l.Sensitive {
+			ret = append(ret, "reveal")
+		}
+		for _, f := range items {
+			ret = append(ret, strconv.Itoa(f.ID))
+		}
+		return ret
+	}
+
+	node := func(k string) fusebox.VarNode {
+		switch k {
+		case "index":
+			return newReadOnlyFile(func() []byte {
+				buf := new(bytes.Buffer)
+				for _, f := range l.Items() {
+					fmt.Fprintf(buf, "%d\t%s\t%s\t%s\n", f.ID, f.Kind, l.detail(f), strings.Join(f.Sources, ","))
+				}
+				return buf.Bytes()
+			})
+		case "reveal":
+			if l.Sensitive {
+				return newBoolFile(&l.Reveal)
+			}
+			return nil
+		}
+
+		id, err := strconv.Atoi(k)
+		if err != nil {
+			return nil
+		}
+		items := l.Items()
+		if id < 0 || id >= len(items) {
+			return nil
+		}
+		f := items[id]
+
+		ret, d := newNodeDir()
+		d.add("kind", newReadOnlyFile(func() []byte {
+			return []byte(f.Kind)
+		}))
+		d.add("detail", newReadOnlyFile(func() []byte {
+			return []byte(l.detail(f))
+		}))
+		d.add("sources", newReadOnlyFile(func() []byte {
+			return []byte(strings.Join(f.Sources, "\n") + "\n")
+		}))
+		return ret
+	}
+
+	return newFuncDir(keys, node)
+}
@@ -0,0 +1,311 @@
+package proxyfs
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httputil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"bazil.org/fuse"
+	"github.com/danielthatcher/fusebox"
+)
+
+// frozenRetryAfter is how long, in seconds, the clients of frozen requests are
+// told to wait before trying again.
+const frozenRetryAfter = 120
+
+// frozenExt is the extension of the files frozen requests are saved in.
+const frozenExt = ".http"
+
+// freezerDir returns the directory frozen requests are saved in, which is in
+// the project's directory, or a temporary one without a project, creating it
+// if it doesn't exist.
+func (p *Proxy) freezerDir() (string, error) {
+	dir := filepath.Join(os.TempDir(), "proxyfs-frozen")
+	if p.Project != nil {
+		dir = p.Project.path(projectFrozenDir)
+	}
+	return dir, os.MkdirAll(dir, 0700)
+}
+
+// frozenPath returns the path of the file a frozen request is saved in, given
+// its name, which is the ID it had in the queue.
+func (p *Proxy) frozenPath(name string) (string, error) {
+	if name == "" || strings.ContainsAny(name, `/\`) || strings.HasPrefix(name, ".") {
+		return "", fuse.ENOENT
+	}
+	dir, err := p.freezerDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, name+frozenExt), nil
+}
+
+// frozenNames returns the names of the frozen requests, oldest first.
+func (p *Proxy) frozenNames() []string {
+	dir, err := p.freezerDir()
+	if err != nil {
+		return nil
+	}
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].ModTime().Before(infos[j].ModTime())
+	})
+
+	ret := make([]string, 0, len(infos))
+	for _, info := range infos {
+		if !info.IsDir() && strings.HasSuffix(info.Name(), frozenExt) {
+			ret = append(ret, strings.TrimSuffix(info.Name(), frozenExt))
+		}
+	}
+	return ret
+}
+
+// freezeRequest saves a queued request to a file of its own in its raw form,
+// with the absolute URL in the request line so that it keeps its scheme and
+// host. The request must be held by its lock.
+func (p *Proxy) freezeRequest(pr proxyReq) error {
+	path, err := p.frozenPath(pr.ID.String())
+	if err != nil {
+		return err
+	}
+
+	r := prepareResend(pr.Req)
+	r.TransferEncoding = nil
+	r.Header.Del("Transfer-Encoding")
+	r.RequestURI = r.URL.String()
+	raw, err := httputil.DumpRequest(r, true)
+	if err != nil {
+		return fuse.EIO
+	}
+	if err := ioutil.WriteFile(path, raw, 0600); err != nil {
+		return err
+	}
+
+	p.emitEvent("frozen: saved the request to %s as %s", r.URL, path)
+	return nil
+}
+
+// thawRequest sends a frozen request upstream as it is in its file, recording
+// it in the history. The file is removed once the request has been sent, and
+// kept if sending fails, so that it can be thawed again.
+func (p *Proxy) thawRequest(name string) error {
+	path, err := p.frozenPath(name)
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return errGone
+	} else if err != nil {
+		return err
+	}
+	req, err := parseRawRequest(data, nil)
+	if err != nil {
+		return errInvalid
+	}
+
+	p.Digests.ApplyRequest(req)
+	if err := p.Signing.Sign(req, p.Vars); err != nil {
+		p.emitEvent("frozen: failed to sign %s: %v", name, err)
+	}
+	e := p.recordRequest(req, newClientInfo("thaw"))
+	resp, err := p.send(prepareResend(e.Req))
+	if err != nil {
+		p.emitEvent("frozen: failed to send %s: %v", name, err)
+		return fuse.EIO
+	}
+	p.recordResponse(e, resp, time.Since(e.Time), "thaw")
+	resp.Body.Close()
+
+	os.Remove(path)
+	p.emitEvent("frozen: thawed %s as history/%d, which got %d", name, e.ID, resp.StatusCode)
+	return nil
+}
+
+// frozenResponse is the response given to the client of a frozen request,
+// asking it to try again later.
+func frozenResponse(req *http.Request) *http.Response {
+	resp := droppedResponse(req)
+	msg := "Frozen by proxyfs"
+	resp.Status = "503 Service Unavailable"
+	resp.StatusCode = http.StatusServiceUnavailable
+	resp.Body = ioutil.NopCloser(strings.NewReader(msg))
+	resp.ContentLength = int64(len(msg))
+	resp.Header.Set("Retry-After", strconv.Itoa(frozenRetryAfter))
+	return resp
+}
+
+// freezeFile freezes a queued request when 1 is written to it, answering its
+// client with a 503 response.
+type freezeFile struct {
+	Proxy *Proxy
+	Req   proxyReq
+}
+
+func (f *freezeFile) ValRead(ctx context.Context) ([]byte, error) {
+	return nil, nil
+}
+
+func (f *freezeFile) ValWrite(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+	if strings.TrimSpace(string(req.Data)) != "1" {
+		return errInvalid
+	}
+	if err := f.Proxy.freezeRequest(f.Req); err != nil {
+		return err
+	}
+	release(f.Req.Freeze)
+	resp.Size = len(req.Data)
+	return nil
+}
+
+func (f *freezeFile) Size(ctx context.Context) (uint64, error) {
+	return 0, nil
+}
+
+// thawFile sends a frozen request when 1 is written to it, returning once the
+// response has arrived.
+type thawFile struct {
+	Proxy *Proxy
+	Name  string
+}
+
+func (f *thawFile) ValRead(ctx context.Context) ([]byte, error) {
+	return nil, nil
+}
+
+func (f *thawFile) ValWrite(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+	if strings.TrimSpace(string(req.Data)) != "1" {
+		return errInvalid
+	}
+	if err := f.Proxy.thawRequest(f.Name); err != nil {
+		return err
+	}
+	resp.Size = len(req.Data)
+	return nil
+}
+
+func (f *thawFile) Size(ctx context.Context) (uint64, error) {
+	return 0, nil
+}
+
+// frozenRequestFile exposes the file a frozen request is saved in, so that it
+// can be edited through the filesystem as well as directly.
+type frozenRequestFile struct {
+	Proxy *Proxy
+	Name  string
+}
+
+func (f *frozenRequestFile) ValRead(ctx context.Context) ([]byte, error) {
+	path, err := f.Proxy.frozenPath(f.Name)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, errGone
+	}
+	return data, err
+}
+
+func (f *frozenRequestFile) ValWrite(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+	path, err := f.Proxy.frozenPath(f.Name)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return errGone
+	}
+	if err := ioutil.WriteFile(path, req.Data, 0600); err != nil {
+		return err
+	}
+	resp.Size = len(req.Data)
+	return nil
+}
+
+func (f *frozenRequestFile) Size(ctx context.Context) (uint64, error) {
+	data, _ := f.ValRead(ctx)
+	return uint64(len(data)), nil
+}
+
+// freezerElement lists the frozen requests, by the IDs they had in the queue.
+// Removing one deletes its file without sending it.
+type freezerElement struct {
+	Proxy *Proxy
+}
+
+func (e *freezerElement) exists(name string) bool {
+	for _, n := range e.Proxy.frozenNames() {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *freezerElement) GetNode(ctx context.Context, k string) (fusebox.VarNode, error) {
+	if !e.exists(k) {
+		return nil, fuse.ENOENT
+	}
+	return e.Proxy.frozenRequestDir(k), nil
+}
+
+func (e *freezerElement) GetDirentType(ctx context.Context, k string) (fuse.DirentType, error) {
+	if !e.exists(k) {
+		return fuse.DT_Unknown, fuse.ENOENT
+	}
+	return fuse.DT_Dir, nil
+}
+
+func (e *freezerElement) GetKeys(ctx context.Context) []string {
+	return e.Proxy.frozenNames()
+}
+
+func (e *freezerElement) AddNode(name string, node interface{}) error {
+	return fuse.EPERM
+}
+
+func (e *freezerElement) RemoveNode(name string) error {
+	path, err := e.Proxy.frozenPath(name)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); os.IsNotExist(err) {
+		return fuse.ENOENT
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
+
+// newFreezerDir returns the Dir listing the frozen requests.
+func newFreezerDir(p *Proxy) *fusebox.Dir {
+	ret := fusebox.NewDir(&freezerElement{p})
+	ret.Mode = os.ModeDir | 0755
+	ret.OpenFlags = fuse.OpenDirectIO
+	return ret
+}
+
+// frozenRequestDir returns the Dir exposing a single frozen request.
+func (p *Proxy) frozenRequestDir(name string) *fusebox.Dir {
+	ret, d := newNodeDir()
+	d.add("path", newReadOnlyFile(func() []byte {
+		path, _ := p.frozenPath(name)
+		return []byte(path + "\n")
+	}))
+	d.add("request", newHandleFile(&frozenRequestFile{p, name}))
+
+	thaw := newHandleFile(&thawFile{p, name})
+	thaw.OpenFlags = fuse.OpenDirectIO
+	d.add("thaw", thaw)
+	return ret
+}
@@ -0,0 +1,12 @@
+package proxyfs
+
+import (
+	"github.com/danielthatcher/fusebox"
+)
+
+// freezeDir makes a directory, and everything below it, read-only, for
+// exposing what was recorded without letting it be changed. Writes fail with
+// errReadOnly. It's guarded by a read-only msgLock of its own.
+func freezeDir(d *fusebox.Dir) *fusebox.Dir {
+	return (&msgLock{readOnly: true}).guardDir(d)
+}
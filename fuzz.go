@@ -0,0 +1,449 @@
+package proxyfs
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+	"github.com/danielthatcher/fusebox"
+)
+
+// fuzzMarker marks where payloads are inserted into a fuzz job's request.
+const fuzzMarker = "FUZZ"
+
+// fuzzResult is the outcome of sending a fuzz job's request with one payload.
+type fuzzResult struct {
+	Payload  string
+	Req      *http.Request
+	Resp     *http.Response
+	Err      error
+	Duration time.Duration
+
+	// The similarity hash of the response body
+	Hash uint64
+}
+
+// Summary returns a single, tab separated line summarising the result.
+func (r *fuzzResult) Summary(n int) string {
+	status, length := "error", "-"
+	if r.Resp != nil {
+		status = strconv.Itoa(r.Resp.StatusCode)
+		length = strconv.Itoa(bodyLen(&r.Resp.Body))
+	}
+
+	return fmt.Sprintf("%d\t%s\t%s\t%s\t%v\n", n, r.Payload, status, length, r.Duration)
+}
+
+// fuzzJob sends a request template once for each of a set of payloads, with
+// every occurrence of fuzzMarker replaced by the payload.
+type fuzzJob struct {
+	mu       sync.RWMutex
+	Target   []byte
+	Request  []byte
+	Payloads []byte
+	Encoders []byte
+	Unsafe   []byte
+
+	concurrency int
+	started     time.Time
+	finished    time.Time
+	results     []*fuzzResult
+	completed   int
+	stop        chan struct{}
+}
+
+// Running returns whether the job is in progress.
+func (j *fuzzJob) Running() bool {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+	return j.stop != nil && j.finished.IsZero()
+}
+
+// Start generates the job's payloads and starts sending them in the
+// background, with up to concurrency requests in flight.
+func (j *fuzzJob) Start(p *Proxy, concurrency int) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.stop != nil && j.finished.IsZero() {
+		return fuse.Errno(syscall.EBUSY)
+	}
+
+	payloads, err := generatePayloads(j.Payloads)
+	if err != nil || len(payloads) == 0 {
+		return errInvalid
+	}
+	if !bytes.Contains(j.Request, []byte(fuzzMarker)) {
+		return errInvalid
+	}
+	encoders, err := parseFuzzEncoders(j.Encoders)
+	if err != nil {
+		return errInvalid
+	}
+	override, err := parseOverride(j.Unsafe)
+	if err != nil {
+		return errInvalid
+	}
+	t := &fuzzTemplate{
+		Request:  p.Vars.Expand(j.Request),
+		Target:   p.Vars.Expand(j.Target),
+		Encoders: encoders,
+		Override: override,
+	}
+	req, err := t.Build(payloads[0])
+	if err != nil {
+		return errInvalid
+	}
+	if !p.mayResend(req, override) {
+		return errUnsafe
+	}
+
+	j.concurrency = concurrency
+	j.started = time.Now()
+	j.finished = time.Time{}
+	j.results = make([]*fuzzResult, len(payloads))
+	j.completed = 0
+	j.stop = make(chan struct{})
+	go j.run(p, t, payloads, j.stop)
+	return nil
+}
+
+// Stop stops the job if it's running. Requests already in flight complete.
+func (j *fuzzJob) Stop() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.stop != nil && j.finished.IsZero() {
+		close(j.stop)
+		j.finished = time.Now()
+	}
+}
+
+func (j *fuzzJob) run(p *Proxy, t *fuzzTemplate, payloads []string, stop chan struct{}) {
+	jobs := make(chan int)
+	wg := &sync.WaitGroup{}
+	for i := 0; i < j.concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := range jobs {
+				j.record(n, sendFuzzRequest(p, t, payloads[n]))
+			}
+		}()
+	}
+
+loop:
+	for n := range payloads {
+		select {
+		case jobs <- n:
+		case <-stop:
+			break loop
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	j.mu.Lock()
+	if j.finished.IsZero() {
+		j.finished = time.Now()
+	}
+	j.mu.Unlock()
+}
+
+func (j *fuzzJob) record(n int, r *fuzzResult) {
+	j.mu.Lock()
+	j.results[n] = r
+	j.completed++
+	j.mu.Unlock()
+}
+
+// Result returns the result for the nth payload, or nil if it hasn't been sent.
+func (j *fuzzJob) Result(n int) *fuzzResult {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+	if n < 0 || n >= len(j.results) {
+		return nil
+	}
+	return j.results[n]
+}
+
+// Results returns the numbers of the payloads that have been sent.
+func (j *fuzzJob) Results() []int {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+	ret := make([]int, 0, j.completed)
+	for n, r := range j.results {
+		if r != nil {
+			ret = append(ret, n)
+		}
+	}
+	return ret
+}
+
+// Report returns a summary of the job's progress.
+func (j *fuzzJob) Report() []byte {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+	if j.stop == nil {
+		return nil
+	}
+
+	buf := new(bytes.Buffer)
+	state := "finished"
+	elapsed := j.finished.Sub(j.started)
+	if j.finished.IsZero() {
+		state = "running"
+		elapsed = time.Since(j.started)
+	} else if j.completed < len(j.results) {
+		state = "stopped"
+	}
+	errors := 0
+	for _, r := range j.results {
+		if r != nil && r.Err != nil {
+			errors++
+		}
+	}
+	fmt.Fprintf(buf, "state: %s\n", state)
+	fmt.Fprintf(buf, "completed: %d/%d\n", j.completed, len(j.results))
+	fmt.Fprintf(buf, "errors: %d\n", errors)
+	fmt.Fprintf(buf, "concurrency: %d\n", j.concurrency)
+	fmt.Fprintf(buf, "elapsed: %v\n", elapsed)
+	return buf.Bytes()
+}
+
+// sendFuzzRequest sends the request template with the given payload inserted.
+func sendFuzzRequest(p *Proxy, t *fuzzTemplate, payload string) *fuzzResult {
+	ret := &fuzzResult{Payload: payload}
+	req, err := t.Build(payload)
+	if err != nil {
+		ret.Err = err
+		return ret
+	}
+	ret.Req = snapshotRequest(req)
+	if !p.mayResend(req, t.Override) {
+		ret.Err = errUnsafeResend
+		return ret
+	}
+
+	start := time.Now()
+	resp, err := p.send(req)
+	ret.Duration = time.Since(start)
+	if err != nil {
+		ret.Err = err
+		return ret
+	}
+	ret.Resp = snapshotResponse(resp, ret.Req)
+	ret.Hash = simhash(peekBody(&ret.Resp.Body))
+	resp.Body.Close()
+	return ret
+}
+
+// fuzzTemplate is a fuzz job's request, as captured when the job started.
+type fuzzTemplate struct {
+	Request  []byte
+	Target   []byte
+	Encoders *fuzzEncoders
+
+	// Whether requests the resend safety rules don't allow are sent anyway
+	Override bool
+}
+
+// Build parses the raw request template with every occurrence of fuzzMarker
+// replaced by the payload, encoded for that insertion point, as for
+// parseRawRequest.
+func (t *fuzzTemplate) Build(payload string) (*http.Request, error) {
+	return parseRawRequest(t.insert(payload), t.Target)
+}
+
+// parseRawRequest parses a raw request to be sent upstream. The request is
+// sent to the scheme and host of the target URL, or of the URL in its request
+// line if that's absolute, or else over HTTP to its Host header. The body's length is updated to match what
+// follows the headers.
+func parseRawRequest(data, target []byte) (*http.Request, error) {
+	head, body := data, []byte(nil)
+	if i := bytes.Index(data, []byte("\r\n\r\n")); i >= 0 {
+		head, body = data[:i], data[i+4:]
+	} else if i := bytes.Index(data, []byte("\n\n")); i >= 0 {
+		head, body = data[:i], data[i+2:]
+	}
+
+	// The head is copied, so that terminating it doesn't overwrite the body
+	head = append(append([]byte(nil), bytes.TrimRight(head, "\r\n")...), "\r\n\r\n"...)
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(head)))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Del("Content-Length")
+	req.Header.Del("Transfer-Encoding")
+	req.TransferEncoding = nil
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	req.ContentLength = int64(len(body))
+
+	if req.URL.Host == "" {
+		req.URL.Scheme, req.URL.Host = "http", req.Host
+	}
+	if target := strings.TrimSpace(string(target)); target != "" {
+		u, err := url.Parse(target)
+		if err != nil || u.Host == "" {
+			return nil, fmt.Errorf("invalid target %q", target)
+		}
+		req.URL.Scheme, req.URL.Host = u.Scheme, u.Host
+	}
+	req.RequestURI = ""
+	return req, nil
+}
+
+// insert returns the request template with the payload inserted at each
+// insertion point.
+func (t *fuzzTemplate) insert(payload string) []byte {
+	parts := bytes.Split(t.Request, []byte(fuzzMarker))
+	buf := new(bytes.Buffer)
+	for i, part := range parts {
+		if i > 0 {
+			buf.WriteString(t.Encoders.Encode(i, payload))
+		}
+		buf.Write(part)
+	}
+	return buf.Bytes()
+}
+
+// newFuzzJobs returns the set of fuzz jobs.
+func newFuzzJobs(p *Proxy) *jobSet {
+	create := func() job { return &fuzzJob{Unsafe: []byte("0")} }
+	dir := func(j job) fusebox.VarNode { return p.fuzzJobDir(j.(*fuzzJob)) }
+	return newJobSet(p, create, dir)
+}
+
+// fuzzJobDir returns the Dir exposing a single fuzz job.
+func (p *Proxy) fuzzJobDir(j *fuzzJob) *fusebox.Dir {
+	ret, d := newNodeDir()
+	ret.Mode = os.ModeDir | 0755
+	d.add("target", newValueFile(&jobFile{&j.mu, &j.Target, nil}))
+	d.add("request", newHandleFile(&jobFile{&j.mu, &j.Request, nil}))
+	d.add("payloads", newHandleFile(&jobFile{&j.mu, &j.Payloads, func(data []byte) bool {
+		_, err := generatePayloads(data)
+		return err == nil
+	}}))
+	d.add("encoders", newHandleFile(&jobFile{&j.mu, &j.Encoders, func(data []byte) bool {
+		_, err := parseFuzzEncoders(data)
+		return err == nil
+	}}))
+	d.add("from", newHandleFile(&fromHistoryFile{p, &j.mu, &j.Request, &j.Target}))
+	d.add("unsafe", newValueFile(&jobFile{&j.mu, &j.Unsafe, func(data []byte) bool {
+		_, err := parseOverride(data)
+		return err == nil
+	}}))
+
+	d.add("run", newJobRunFile(p, j))
+	d.add("results", newFuzzResultsDir(j, j.Results))
+	d.add("clusters", newFuzzClustersDir(j))
+	return ret
+}
+
+// newFuzzResultsDir returns a Dir with a directory for each of the selected
+// results, named by the payload's position in the payload list, and an index
+// summarising them.
+func newFuzzResultsDir(j *fuzzJob, selected func() []int) *fusebox.Dir {
+	keys := func() []string {
+		results := selected()
+		ret := make([]string, 0, len(results)+1)
+		ret = append(ret, "index")
+		for _, n := range results {
+			ret = append(ret, strconv.Itoa(n))
+		}
+		return ret
+	}
+
+	node := func(k string) fusebox.VarNode {
+		if k == "index" {
+			return newReadOnlyFile(func() []byte {
+				buf := new(bytes.Buffer)
+				for _, n := range selected() {
+					buf.WriteString(j.Result(n).Summary(n))
+				}
+				return buf.Bytes()
+			})
+		}
+
+		n, err := strconv.Atoi(k)
+		if err != nil {
+			return nil
+		}
+		r := j.Result(n)
+		if r == nil || !containsInt(selected(), n) {
+			return nil
+		}
+
+		ret, d := newNodeDir()
+		d.add("payload", newReadOnlyFile(func() []byte {
+			return []byte(r.Payload)
+		}))
+		if r.Req != nil {
+			d.add("req", newReqDir(newReqDirElement(r.Req, nil)))
+		}
+		if r.Resp != nil {
+			d.add("resp", newRespDir(newRespDirElement(r.Resp, nil)))
+		}
+		if r.Err != nil {
+			d.add("error", newReadOnlyFile(func() []byte {
+				return []byte(r.Err.Error())
+			}))
+		}
+		return ret
+	}
+
+	return newFuncDir(keys, node)
+}
+
+// fromHistoryFile copies the request of the history entry whose ID is written
+// to it into a job or repeater tab, setting its target to the request's
+// scheme and host.
+type fromHistoryFile struct {
+	Proxy   *Proxy
+	mu      *sync.RWMutex
+	Request *[]byte
+	Target  *[]byte
+}
+
+func (f *fromHistoryFile) ValRead(ctx context.Context) ([]byte, error) {
+	return nil, nil
+}
+
+func (f *fromHistoryFile) ValWrite(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+	id, err := strconv.Atoi(strings.TrimSpace(string(req.Data)))
+	if err != nil {
+		return errInvalid
+	}
+	e := f.Proxy.History.Get(id)
+	if e == nil {
+		return fuse.ENOENT
+	}
+
+	r := prepareResend(e.Req)
+	raw, err := httputil.DumpRequest(r, true)
+	if err != nil {
+		return fuse.EIO
+	}
+
+	f.mu.Lock()
+	*f.Request = raw
+	*f.Target = []byte(r.URL.Scheme + "://" + r.URL.Host)
+	f.mu.Unlock()
+
+	resp.Size = len(req.Data)
+	return nil
+}
+
+func (f *fromHistoryFile) Size(ctx context.Context) (uint64, error) {
+	return 0, nil
+}
@@ -0,0 +1,108 @@
+package proxyfs
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// payloadEncoder transforms a payload before it's inserted into a request.
+type payloadEncoder func(string) string
+
+// payloadEncoders are the encoders that can be used in a fuzz job's encoders
+// file.
+var payloadEncoders = map[string]payloadEncoder{
+	"url":         urlEncode,
+	"double-url":  func(s string) string { return urlEncode(urlEncode(s)) },
+	"base64":      func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) },
+	"html-entity": htmlEntityEncode,
+}
+
+// urlEncode percent encodes everything but unreserved characters, including
+// spaces.
+func urlEncode(s string) string {
+	return strings.Replace(url.QueryEscape(s), "+", "%20", -1)
+}
+
+// htmlEntityEncode replaces every character other than letters and digits
+// with a numeric HTML entity.
+func htmlEntityEncode(s string) string {
+	buf := new(strings.Builder)
+	for _, r := range s {
+		if r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r)) {
+			buf.WriteRune(r)
+		} else {
+			fmt.Fprintf(buf, "&#%d;", r)
+		}
+	}
+	return buf.String()
+}
+
+// fuzzEncoders are the chains of encoders applied to payloads at each
+// insertion point of a fuzz job's request.
+type fuzzEncoders struct {
+	// The chains for specific insertion points, numbered from 1 in the order
+	// they appear in the request
+	points map[int][]payloadEncoder
+
+	// The chain for all other insertion points
+	all []payloadEncoder
+}
+
+// parseFuzzEncoders parses an encoders file, which has an insertion point
+// number (or '*' for every other point) followed by the encoders to apply in
+// order on each line, e.g. "2 base64 url". Blank lines and lines starting with
+// '#' are ignored.
+func parseFuzzEncoders(data []byte) (*fuzzEncoders, error) {
+	ret := &fuzzEncoders{points: make(map[int][]payloadEncoder)}
+	s := bufio.NewScanner(bytes.NewReader(data))
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		chain := make([]payloadEncoder, 0, len(fields)-1)
+		for _, name := range fields[1:] {
+			enc, ok := payloadEncoders[name]
+			if !ok {
+				return nil, fmt.Errorf("unknown encoder %q", name)
+			}
+			chain = append(chain, enc)
+		}
+
+		if fields[0] == "*" {
+			ret.all = chain
+			continue
+		}
+		point, err := strconv.Atoi(fields[0])
+		if err != nil || point <= 0 {
+			return nil, fmt.Errorf("invalid insertion point %q", fields[0])
+		}
+		ret.points[point] = chain
+	}
+
+	return ret, s.Err()
+}
+
+// Encode returns the payload encoded for the given insertion point.
+func (e *fuzzEncoders) Encode(point int, payload string) string {
+	if e == nil {
+		return payload
+	}
+
+	chain, ok := e.points[point]
+	if !ok {
+		chain = e.all
+	}
+	for _, enc := range chain {
+		payload = enc(payload)
+	}
+	return payload
+}
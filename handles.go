@@ -0,0 +1,281 @@
+package proxyfs
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"sync/atomic"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"github.com/danielthatcher/fusebox"
+)
+
+// handleFile is a File which gives each open of the file its own handle. Data
+// written through a handle is accumulated, and only committed to the file's
+// element when the handle is flushed (i.e. closed). This means values written
+// in several chunks, as many editors do, are only parsed once complete, and
+// any error from the element's validation is returned by close.
+type handleFile struct {
+	*fusebox.File
+	element fusebox.FileElement
+
+	// Whether reads of non-empty values that don't end in a newline have one
+	// added, for the benefit of line oriented tools.
+	NewlineOnRead bool
+
+	// Whether surrounding whitespace is removed from values before they are
+	// committed. Otherwise, values are committed exactly as written.
+	TrimWrites bool
+
+	// Whether the values read from the element are never changed in place,
+	// so that handles can read them without taking a copy.
+	SharedReads bool
+
+	mu      sync.Mutex
+	handles map[*fileHandle]struct{}
+
+	// The length of the value when it was last read, used to size the
+	// buffers it's read into
+	sizeHint int64
+}
+
+// Returns a new handleFile backed by the given element.
+func newHandleFile(e fusebox.FileElement) *handleFile {
+	return &handleFile{
+		File:    fusebox.NewFile(e),
+		element: e,
+		handles: make(map[*fileHandle]struct{}),
+	}
+}
+
+func (f *handleFile) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (fs.Handle, error) {
+	h := &fileHandle{file: f}
+
+	// Writes that don't truncate the file modify its existing value
+	if !req.Flags.IsReadOnly() && req.Flags&fuse.OpenTruncate == 0 {
+		data, err := f.element.ValRead(ctx)
+		if err != nil {
+			return nil, err
+		}
+		h.buf = append([]byte(nil), data...)
+	}
+
+	f.mu.Lock()
+	f.handles[h] = struct{}{}
+	f.mu.Unlock()
+
+	resp.Flags |= f.OpenFlags
+	return h, nil
+}
+
+// read returns the file's value as it should be read.
+func (f *handleFile) read(ctx context.Context) ([]byte, error) {
+	data, err := f.element.ValRead(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if f.NewlineOnRead && len(data) > 0 && data[len(data)-1] != '\n' {
+		data = append(data[:len(data):len(data)], '\n')
+	}
+	return data, nil
+}
+
+// readInto writes the file's value as it should be read into buf, which is
+// empty.
+func (f *handleFile) readInto(ctx context.Context, buf *bytes.Buffer) error {
+	if err := appendValue(ctx, f.element, buf); err != nil {
+		return err
+	}
+
+	if f.NewlineOnRead && buf.Len() > 0 && buf.Bytes()[buf.Len()-1] != '\n' {
+		buf.WriteByte('\n')
+	}
+	atomic.StoreInt64(&f.sizeHint, int64(buf.Len()))
+	return nil
+}
+
+func (f *handleFile) Attr(ctx context.Context, a *fuse.Attr) error {
+	if err := f.File.Attr(ctx, a); err != nil {
+		return err
+	}
+
+	// The size reported by the element doesn't include any added newline
+	if f.NewlineOnRead {
+		buf := getBuffer(int(atomic.LoadInt64(&f.sizeHint)))
+		defer putBuffer(buf)
+		if err := f.readInto(ctx, buf); err != nil {
+			return err
+		}
+		a.Size = uint64(buf.Len())
+	}
+	return nil
+}
+
+// Setattr handles truncation of the file by truncating the buffers of its open
+// handles, as truncation is usually sent separately from the writes that
+// follow it.
+func (f *handleFile) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse.SetattrResponse) error {
+	if req.Valid.Size() {
+		f.mu.Lock()
+		for h := range f.handles {
+			h.truncate(int(req.Size))
+		}
+		f.mu.Unlock()
+	}
+
+	if s, ok := interface{}(f.File).(fs.NodeSetattrer); ok {
+		return s.Setattr(ctx, req, resp)
+	}
+	return f.Attr(ctx, &resp.Attr)
+}
+
+func (f *handleFile) Fsync(ctx context.Context, req *fuse.FsyncRequest) error {
+	return nil
+}
+
+// fileHandle is an open handle to a handleFile.
+type fileHandle struct {
+	file *handleFile
+
+	mu    sync.Mutex
+	read  []byte
+	buf   []byte
+	dirty bool
+
+	// The pooled buffer holding read, if it's in one
+	readBuf *bytes.Buffer
+
+	// For files whose element is a handleQuery, the answer to what's been
+	// written through the handle, how much of it has been read, and any
+	// error answering it
+	answer    []byte
+	answerPos int
+	answerErr error
+}
+
+// handleQuery is a file element that answers what's written to it, such as a
+// request for a calculation. The answer is only read back through the handle
+// it was written through, so that scripts using the file at once don't see
+// each other's answers. It's worked out as soon as the data is written, and
+// read back from the start whatever the handle's offset, so that a script
+// can write and then read without closing the file. Any error answering is
+// returned when the handle is closed.
+type handleQuery interface {
+	Query(ctx context.Context, data []byte) ([]byte, error)
+}
+
+func (h *fileHandle) truncate(size int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if size < len(h.buf) {
+		h.buf = h.buf[:size]
+	}
+	h.dirty = true
+}
+
+// Read serves reads from a copy of the file's value taken on the first read,
+// so that reads in several chunks see a consistent value. The copy is made in
+// a pooled buffer, which is returned to the pool when the handle is released,
+// so that files read over and over don't allocate for each read.
+func (h *fileHandle) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if _, ok := h.file.element.(handleQuery); ok {
+		n := len(h.answer) - h.answerPos
+		if n > req.Size {
+			n = req.Size
+		}
+		resp.Data = h.answer[h.answerPos : h.answerPos+n]
+		h.answerPos += n
+		return nil
+	}
+
+	if h.read == nil || req.Offset == 0 {
+		if h.file.SharedReads {
+			data, err := h.file.read(ctx)
+			if err != nil {
+				return err
+			}
+			h.read = data
+		} else {
+			// A buffer being replaced may still be in use by a read
+			// being answered, so it's left to be collected rather than
+			// being returned to the pool
+			buf := getBuffer(int(atomic.LoadInt64(&h.file.sizeHint)))
+			if err := h.file.readInto(ctx, buf); err != nil {
+				putBuffer(buf)
+				return err
+			}
+			h.read, h.readBuf = buf.Bytes(), buf
+		}
+	}
+
+	if req.Offset >= int64(len(h.read)) {
+		return nil
+	}
+	end := req.Offset + int64(req.Size)
+	if end > int64(len(h.read)) {
+		end = int64(len(h.read))
+	}
+	resp.Data = h.read[req.Offset:end]
+	return nil
+}
+
+// Write adds the data to the handle's buffer at the given offset.
+func (h *fileHandle) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	end := int(req.Offset) + len(req.Data)
+	if end > len(h.buf) {
+		h.buf = append(h.buf, make([]byte, end-len(h.buf))...)
+	}
+	copy(h.buf[req.Offset:], req.Data)
+	h.dirty = true
+
+	if q, ok := h.file.element.(handleQuery); ok {
+		h.answer, h.answerErr = q.Query(ctx, h.buf)
+		h.answerPos = 0
+	}
+
+	resp.Size = len(req.Data)
+	return nil
+}
+
+// Flush commits any data written through the handle to the file's element,
+// returning any error from it.
+func (h *fileHandle) Flush(ctx context.Context, req *fuse.FlushRequest) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.dirty {
+		return nil
+	}
+	h.dirty = false
+
+	if _, ok := h.file.element.(handleQuery); ok {
+		return h.answerErr
+	}
+
+	data := h.buf
+	if h.file.TrimWrites {
+		data = bytes.TrimSpace(data)
+	}
+
+	wreq := &fuse.WriteRequest{Data: data}
+	return h.file.element.ValWrite(ctx, wreq, &fuse.WriteResponse{})
+}
+
+func (h *fileHandle) Release(ctx context.Context, req *fuse.ReleaseRequest) error {
+	h.file.mu.Lock()
+	delete(h.file.handles, h)
+	h.file.mu.Unlock()
+
+	h.mu.Lock()
+	putBuffer(h.readBuf)
+	h.read, h.readBuf = nil, nil
+	h.mu.Unlock()
+	return nil
+}
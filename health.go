@@ -0,0 +1,174 @@
+package proxyfs
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+
+	"bazil.org/fuse"
+	"github.com/danielthatcher/fusebox"
+)
+
+// health records whether the proxy has hit an internal error that could
+// leave traffic stuck, such as a panic in the goroutine that releases queued
+// items, and why.
+type health struct {
+	mu       sync.Mutex
+	degraded bool
+	reason   string
+	since    time.Time
+}
+
+// Fail marks the proxy as degraded for the given reason, returning whether
+// it was healthy until now. Only the first reason is kept until the state is
+// cleared.
+func (h *health) Fail(reason string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.degraded {
+		return false
+	}
+	h.degraded = true
+	h.reason = reason
+	h.since = time.Now()
+	return true
+}
+
+// Clear marks the proxy as healthy again.
+func (h *health) Clear() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.degraded = false
+	h.reason = ""
+	h.since = time.Time{}
+}
+
+// Degraded returns whether the proxy is degraded.
+func (h *health) Degraded() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.degraded
+}
+
+// Reason returns when and why the proxy became degraded, or nothing if it's
+// healthy.
+func (h *health) Reason() string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.degraded {
+		return ""
+	}
+	return fmt.Sprintf("%s %s\n", h.since.Format(time.RFC3339), h.reason)
+}
+
+// degrade marks the proxy as degraded, and applies the failure policy: failing
+// open stops intercepting and forwards everything queued, while failing
+// closed drops everything queued, and refuses in scope requests until the
+// state is cleared.
+func (p *Proxy) degrade(format string, args ...interface{}) {
+	reason := fmt.Sprintf(format, args...)
+	if !p.Health.Fail(reason) {
+		log.Printf("Internal error while degraded: %s\n", reason)
+		return
+	}
+
+	p.emitEvent("degraded: %s", reason)
+	if p.Settings.Get().FailPolicy == "closed" {
+		p.emitEvent("degraded: failing closed, dropping all queued items")
+		p.dropQueued()
+		return
+	}
+	p.emitEvent("degraded: failing open, forwarding all queued items")
+	p.stopIntercepting()
+}
+
+// recoverPanic recovers from a panic in the goroutine it's deferred in, and
+// marks the proxy as degraded. If restart is given, it's called afterwards so
+// that a long running goroutine can be started again.
+func (p *Proxy) recoverPanic(what string, restart func()) {
+	v := recover()
+	if v == nil {
+		return
+	}
+	log.Printf("Panic while %s: %v\n%s", what, v, debug.Stack())
+	p.degrade("panic while %s: %v", what, v)
+	if restart != nil {
+		restart()
+	}
+}
+
+// dropQueued drops everything waiting in the queues.
+func (p *Proxy) dropQueued() {
+	p.reqMu.RLock()
+	reqs := append([]proxyReq(nil), p.Requests...)
+	p.reqMu.RUnlock()
+	for _, r := range reqs {
+		release(r.Drop)
+	}
+
+	p.respMu.RLock()
+	resps := append([]proxyResp(nil), p.Responses...)
+	p.respMu.RUnlock()
+	for _, r := range resps {
+		release(r.Drop)
+	}
+}
+
+// refusing returns whether in scope traffic is being refused because the
+// proxy is degraded and fails closed.
+func (p *Proxy) refusing() bool {
+	return p.Settings.Get().FailPolicy == "closed" && p.Health.Degraded()
+}
+
+// degradedResponse returns the response sent in place of forwarding a request
+// while the proxy fails closed.
+func degradedResponse(req *http.Request) *http.Response {
+	msg := "proxyfs is degraded"
+	return &http.Response{
+		Status:        "503 Service Unavailable",
+		StatusCode:    http.StatusServiceUnavailable,
+		Body:          ioutil.NopCloser(strings.NewReader(msg)),
+		Header:        make(http.Header),
+		ContentLength: int64(len(msg)),
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Close:         true,
+		Request:       req,
+	}
+}
+
+// newStatusDir returns the Dir exposing the proxy's health.
+func newStatusDir(p *Proxy) *fusebox.Dir {
+	ret, d := newNodeDir()
+	d.add("degraded", newValueFile(&degradedFile{p.Health}))
+	d.add("reason", newReadOnlyFile(func() []byte { return []byte(p.Health.Reason()) }))
+	return ret
+}
+
+// degradedFile reads 1 while the proxy is degraded, and writing 0 to it clears
+// the state once the cause has been dealt with.
+type degradedFile struct {
+	Health *health
+}
+
+func (f *degradedFile) ValRead(ctx context.Context) ([]byte, error) {
+	if f.Health.Degraded() {
+		return []byte("1"), nil
+	}
+	return []byte("0"), nil
+}
+
+func (f *degradedFile) ValWrite(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+	if string(req.Data) != "0" {
+		return errInvalid
+	}
+	f.Health.Clear()
+	return nil
+}
@@ -0,0 +1,97 @@
+package proxyfs
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+
+	"bazil.org/fuse"
+)
+
+// highlightRule attaches a label, such as a colour, to exchanges that match
+// its expression.
+type highlightRule struct {
+	Label string
+	Expr  *matchExpr
+}
+
+// highlightRules is a list of highlight rules that can be read and replaced
+// as a file. Each line of the file is a rule, made up of a label followed by
+// a match expression, e.g.
+//
+//	red method=POST path~^/admin
+//
+// Blank lines and lines starting with '#' are ignored.
+type highlightRules struct {
+	mu    sync.RWMutex
+	src   []byte
+	rules []highlightRule
+}
+
+// Labels returns the labels of all rules that match the given exchange.
+func (h *highlightRules) Labels(req *http.Request, resp *http.Response) []string {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	ret := make([]string, 0)
+	for _, r := range h.rules {
+		if !containsString(ret, r.Label) && r.Expr.Match(req, resp) {
+			ret = append(ret, r.Label)
+		}
+	}
+
+	return ret
+}
+
+// parseHighlightRules parses rules in the format described for highlightRules.
+func parseHighlightRules(src string) ([]highlightRule, error) {
+	ret := make([]highlightRule, 0)
+	for _, line := range strings.Split(src, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		parts := strings.SplitN(line, " ", 2)
+		expr := ""
+		if len(parts) == 2 {
+			expr = parts[1]
+		}
+
+		m, err := parseMatchExpr(expr)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, highlightRule{Label: parts[0], Expr: m})
+	}
+
+	return ret, nil
+}
+
+func (h *highlightRules) ValRead(ctx context.Context) ([]byte, error) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.src, nil
+}
+
+func (h *highlightRules) ValWrite(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+	rules, err := parseHighlightRules(string(req.Data))
+	if err != nil {
+		return errInvalid
+	}
+
+	h.mu.Lock()
+	h.src = append([]byte(nil), req.Data...)
+	h.rules = rules
+	h.mu.Unlock()
+
+	resp.Size = len(req.Data)
+	return nil
+}
+
+func (h *highlightRules) Size(ctx context.Context) (uint64, error) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return uint64(len(h.src)), nil
+}
@@ -0,0 +1,862 @@
+package proxyfs
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"bazil.org/fuse"
+	"github.com/danielthatcher/fusebox"
+)
+
+// historyEntry is a record of a request, and its response once received, that
+// passed through the proxy. The request and response are snapshots of what was
+// sent, and are not affected by later changes to the originals.
+type historyEntry struct {
+	ID          int
+	Time        time.Time
+	Req         *http.Request
+	Resp        *http.Response
+	Client      *clientInfo
+	fingerprint string
+
+	mu      sync.RWMutex
+	labels  []string
+	notes   []byte
+	latency time.Duration
+	bench   *benchmark
+	cors    *corsCheck
+	authz   *authzCheck
+	aborted bool
+
+	// The upstream the request was routed to, or empty if it was sent to
+	// its own
+	route string
+
+	// The session the request was sent as, if any
+	session string
+
+	// The history the entry belongs to, which saves it when it changes
+	history *history
+
+	// The hashes of the entry's bodies in the body pool
+	pooled [][sha256.Size]byte
+}
+
+// intern pools the given body of the entry. The entry must be locked.
+func (e *historyEntry) intern(body *io.ReadCloser) {
+	if sum, ok := bodies.Intern(body); ok {
+		e.pooled = append(e.pooled, sum)
+	}
+}
+
+// release gives up the entry's pooled bodies, once it's no longer kept in
+// memory.
+func (e *historyEntry) release() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, sum := range e.pooled {
+		bodies.Release(sum)
+	}
+	e.pooled = nil
+}
+
+// save saves the entry to the history's store, if it has one. It's called
+// whenever the entry changes, without the entry's lock held.
+func (e *historyEntry) save() {
+	if e.history != nil {
+		e.history.save(e)
+	}
+}
+
+// Labels returns the labels attached to the entry.
+func (e *historyEntry) Labels() []string {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return append([]string(nil), e.labels...)
+}
+
+// AddLabels attaches the given labels to the entry, ignoring any it already has.
+func (e *historyEntry) AddLabels(labels ...string) {
+	if len(labels) == 0 {
+		return
+	}
+
+	e.mu.Lock()
+	for _, l := range labels {
+		if !containsString(e.labels, l) {
+			e.labels = append(e.labels, l)
+		}
+	}
+	e.mu.Unlock()
+	e.save()
+}
+
+// SetLabels replaces the labels attached to the entry.
+func (e *historyEntry) SetLabels(labels []string) {
+	e.mu.Lock()
+	e.labels = labels
+	e.mu.Unlock()
+	e.save()
+}
+
+// Response returns the recorded response, or nil if none has been received.
+func (e *historyEntry) Response() *http.Response {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.Resp
+}
+
+// SetResponse records a snapshot of the given response against the entry,
+// along with how long it took to arrive.
+func (e *historyEntry) SetResponse(resp *http.Response, latency time.Duration) {
+	snap := snapshotResponse(resp, e.Req)
+	e.mu.Lock()
+	e.intern(&snap.Body)
+	e.Resp = snap
+	e.latency = latency
+	e.mu.Unlock()
+	e.save()
+}
+
+// SetRequestBody sets the captured body of a request recorded with
+// RecordStreamed to what was captured of it as it was sent.
+func (e *historyEntry) SetRequestBody(body *capturedBody, s *bodySpool) {
+	var pooled io.ReadCloser = s.Reader()
+	e.mu.Lock()
+	e.intern(&pooled)
+	body.set(spoolBody(&pooled))
+	e.fingerprint = requestFingerprint(e.Req)
+	e.mu.Unlock()
+	e.save()
+}
+
+// Fingerprint returns the hash identifying the entry's request, as given by
+// requestFingerprint.
+func (e *historyEntry) Fingerprint() string {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.fingerprint
+}
+
+// Latency returns how long the response took to arrive, or 0 if there's no
+// response.
+func (e *historyEntry) Latency() time.Duration {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.latency
+}
+
+// Notes returns the free text notes attached to the entry.
+func (e *historyEntry) Notes() []byte {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.notes
+}
+
+// Aborted returns whether the client disconnected before the exchange finished.
+func (e *historyEntry) Aborted() bool {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.aborted
+}
+
+// SetAborted marks the exchange as abandoned by the client.
+func (e *historyEntry) SetAborted() {
+	e.mu.Lock()
+	e.aborted = true
+	e.mu.Unlock()
+	e.save()
+}
+
+// Route returns the upstream the request was routed to by a routing rule, or
+// nothing if it was sent to its own.
+func (e *historyEntry) Route() string {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.route
+}
+
+// SetRoute records the upstream the request was routed to.
+func (e *historyEntry) SetRoute(route string) {
+	e.mu.Lock()
+	e.route = route
+	e.mu.Unlock()
+	e.save()
+}
+
+// Session returns the session the request was sent as, or nothing if it was
+// sent as the client's.
+func (e *historyEntry) Session() string {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.session
+}
+
+// SetSession records the session the request was sent as.
+func (e *historyEntry) SetSession(session string) {
+	e.mu.Lock()
+	e.session = session
+	e.mu.Unlock()
+	e.save()
+}
+
+// Summary returns a single, tab separated line summarising the entry.
+func (e *historyEntry) Summary() string {
+	status, length := "-", "-"
+	if resp := e.Response(); resp != nil {
+		status = strconv.Itoa(resp.StatusCode)
+		length = strconv.Itoa(bodyLen(&resp.Body))
+	} else if e.Aborted() {
+		status = "aborted"
+	}
+
+	return fmt.Sprintf("%d\t%s\t%s\t%s\t%s\t%s\n", e.ID, e.Req.Method, e.Req.URL, status, length,
+		strings.Join(e.Labels(), ","))
+}
+
+// history is the record of all exchanges that have passed through the proxy.
+// If it has a store, entries are saved to it as they change, and all but the
+// most recent entries are kept only in the store, with a nil in their place,
+// being loaded from it when needed.
+type history struct {
+	mu       sync.RWMutex
+	entries  []*historyEntry
+	modified time.Time
+
+	store historyStore
+
+	// The rules applied to entries saved to the store
+	Redaction *redactionRules
+
+	// The number of entries kept in memory, and the first entry that
+	// hasn't been considered for eviction
+	resident  int
+	evictNext int
+
+	// The entries that have been deleted, which keep their IDs, and the
+	// time and host of the others, once known
+	deleted map[int]bool
+	meta    map[int]entryMeta
+}
+
+// entryMeta is what's needed to decide whether an entry is kept, without
+// loading it from the store.
+type entryMeta struct {
+	Time time.Time
+	Host string
+}
+
+// storeResidentEntries is the number of entries kept in memory when the
+// history has a store. Entries still waiting for a response are never
+// evicted.
+const storeResidentEntries = 1000
+
+func newHistory() *history {
+	return &history{
+		entries: make([]*historyEntry, 0),
+		deleted: make(map[int]bool),
+		meta:    make(map[int]entryMeta),
+	}
+}
+
+// Record adds a snapshot of the given request to the history, returning the
+// new entry so that the response can be recorded against it later.
+func (h *history) Record(req *http.Request, client *clientInfo) *historyEntry {
+	e := &historyEntry{
+		Time:   time.Now(),
+		Req:    snapshotRequest(req),
+		Client: client,
+	}
+	e.fingerprint = requestFingerprint(e.Req)
+	e.intern(&e.Req.Body)
+
+	h.add(e, e.Time)
+	return e
+}
+
+// RecordStreamed adds a request whose body is still being streamed upstream
+// to the end of the history, with the given captured body, which is set with
+// SetRequestBody once it's been sent.
+func (h *history) RecordStreamed(req *http.Request, body *capturedBody, client *clientInfo) *historyEntry {
+	snap := req.Clone(context.Background())
+	snap.Body = body
+	e := &historyEntry{
+		Time:   time.Now(),
+		Req:    snap,
+		Client: client,
+	}
+	e.fingerprint = requestFingerprint(e.Req)
+
+	h.add(e, e.Time)
+	return e
+}
+
+// Restore adds an entry loaded from a saved project to the end of the history,
+// giving it the next ID.
+func (h *history) Restore(e *historyEntry) {
+	e.intern(&e.Req.Body)
+	if e.Resp != nil {
+		e.intern(&e.Resp.Body)
+	}
+	h.add(e, time.Now())
+}
+
+// add adds an entry to the end of the history, saving it to the store if
+// there is one, and evicting older entries from memory if there are too many.
+func (h *history) add(e *historyEntry, modified time.Time) {
+	h.mu.Lock()
+	e.ID = len(h.entries)
+	e.history = h
+	h.entries = append(h.entries, e)
+	h.meta[e.ID] = entryMeta{e.Time, strings.ToLower(e.Req.URL.Hostname())}
+	h.modified = modified
+	h.resident++
+	if h.store != nil {
+		for ; h.resident > storeResidentEntries && h.evictNext < e.ID; h.evictNext++ {
+			old := h.entries[h.evictNext]
+			if old != nil && (old.Response() != nil || old.Aborted()) {
+				old.release()
+				h.entries[h.evictNext] = nil
+				h.resident--
+			}
+		}
+	}
+	h.mu.Unlock()
+
+	h.save(e)
+}
+
+// SetStore makes the history keep its entries in the given store, taking up
+// the entries already saved in it, which are loaded as they're needed. It
+// must be called before anything is recorded.
+func (h *history) SetStore(s historyStore) error {
+	ids, err := s.EntryIDs()
+	if err != nil {
+		return err
+	}
+	n := 0
+	if len(ids) > 0 {
+		n = ids[len(ids)-1] + 1
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.store = s
+	h.entries = make([]*historyEntry, n)
+	h.evictNext = n
+	h.modified = time.Now()
+
+	// Entries deleted from the store leave gaps in the IDs
+	for id, i := 0, 0; id < n; id++ {
+		if i < len(ids) && ids[i] == id {
+			i++
+		} else {
+			h.deleted[id] = true
+		}
+	}
+	return nil
+}
+
+// Delete removes the entry with the given ID from the history, returning
+// whether there was such an entry. The IDs of other entries are unchanged.
+func (h *history) Delete(id int) bool {
+	e := h.Get(id)
+	if e == nil {
+		return false
+	}
+
+	h.mu.Lock()
+	if h.deleted[id] {
+		h.mu.Unlock()
+		return false
+	}
+	h.deleted[id] = true
+	delete(h.meta, id)
+	if h.entries[id] != nil {
+		h.entries[id] = nil
+		h.resident--
+	}
+	h.modified = time.Now()
+	h.mu.Unlock()
+
+	e.release()
+	if h.store != nil {
+		if err := h.store.DeleteEntry(id, entryIndex(e)); err != nil {
+			log.Printf("Failed to delete history entry %d: %v\n", id, err)
+		}
+	}
+	return true
+}
+
+// Prune deletes the entries for which expired returns true, given their time
+// and host, returning the number deleted. Entries are only loaded from the
+// store the first time they're considered.
+func (h *history) Prune(expired func(t time.Time, host string) bool) int {
+	h.mu.RLock()
+	n := len(h.entries)
+	h.mu.RUnlock()
+
+	pruned := 0
+	for id := 0; id < n; id++ {
+		h.mu.RLock()
+		m, ok := h.meta[id]
+		deleted := h.deleted[id]
+		h.mu.RUnlock()
+		if deleted {
+			continue
+		}
+
+		if !ok {
+			e := h.Get(id)
+			if e == nil {
+				continue
+			}
+			m = entryMeta{e.Time, strings.ToLower(e.Req.URL.Hostname())}
+			h.mu.Lock()
+			h.meta[id] = m
+			h.mu.Unlock()
+		}
+		if expired(m.Time, m.Host) && h.Delete(id) {
+			pruned++
+		}
+	}
+	return pruned
+}
+
+// save saves the given entry to the store, if there is one.
+func (h *history) save(e *historyEntry) {
+	if h.store == nil {
+		return
+	}
+	h.mu.RLock()
+	deleted := h.deleted[e.ID]
+	h.mu.RUnlock()
+	if deleted {
+		return
+	}
+	if err := h.store.SaveEntry(e.ID, saveEntry(e, h.Redaction), entryIndex(e)); err != nil {
+		log.Printf("Failed to save history entry %d: %v\n", e.ID, err)
+	}
+}
+
+// load loads the entry with the given ID from the store.
+func (h *history) load(id int) *historyEntry {
+	saved, err := h.store.LoadEntry(id)
+	if err != nil {
+		log.Printf("Failed to load history entry %d: %v\n", id, err)
+		return nil
+	}
+	e, err := loadEntry(saved)
+	if err != nil {
+		log.Printf("Failed to load history entry %d: %v\n", id, err)
+		return nil
+	}
+	e.ID = id
+	e.history = h
+	return e
+}
+
+// entryIndex returns the values of the fields that an entry is indexed by in
+// a store.
+func entryIndex(e *historyEntry) map[string]string {
+	return map[string]string{
+		"fingerprint": e.Fingerprint(),
+		"method":      e.Req.Method,
+		"host":        strings.ToLower(e.Req.URL.Hostname()),
+	}
+}
+
+// Touch marks the history as having changed, e.g. when a response has been
+// recorded against an entry.
+func (h *history) Touch() {
+	h.mu.Lock()
+	h.modified = time.Now()
+	h.mu.Unlock()
+}
+
+// Stat returns the number of entries in the history, and when it last changed.
+func (h *history) Stat() (int, time.Time) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.entries) - len(h.deleted), h.modified
+}
+
+// Get returns the entry with the given ID, or nil if there is no such entry.
+func (h *history) Get(id int) *historyEntry {
+	h.mu.RLock()
+	if id < 0 || id >= len(h.entries) || h.deleted[id] {
+		h.mu.RUnlock()
+		return nil
+	}
+	e := h.entries[id]
+	h.mu.RUnlock()
+
+	if e == nil {
+		return h.load(id)
+	}
+	return e
+}
+
+// IDs returns the IDs of the entries in the history, without loading any from
+// the store.
+func (h *history) IDs() []int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	ret := make([]int, 0, len(h.entries)-len(h.deleted))
+	for id := range h.entries {
+		if !h.deleted[id] {
+			ret = append(ret, id)
+		}
+	}
+	return ret
+}
+
+// Entries returns a copy of the list of entries in the history, loading any
+// that are only in the store.
+func (h *history) Entries() []*historyEntry {
+	h.mu.RLock()
+	entries := append([]*historyEntry(nil), h.entries...)
+	deleted := make(map[int]bool, len(h.deleted))
+	for id := range h.deleted {
+		deleted[id] = true
+	}
+	h.mu.RUnlock()
+
+	ret := entries[:0]
+	for id, e := range entries {
+		if deleted[id] {
+			continue
+		}
+		if e == nil {
+			e = h.load(id)
+		}
+		if e != nil {
+			ret = append(ret, e)
+		}
+	}
+	return ret
+}
+
+// snapshotRequest returns a copy of the given request, whose body reads the
+// same spool as the original.
+func snapshotRequest(req *http.Request) *http.Request {
+	spool := spoolBody(&req.Body)
+	ret := req.Clone(context.Background())
+	ret.Body = spool.Reader()
+	return ret
+}
+
+// snapshotResponse returns a copy of the given response, whose body reads the
+// same spool as the original. The copy refers to the given request.
+func snapshotResponse(resp *http.Response, req *http.Request) *http.Response {
+	spool := spoolBody(&resp.Body)
+	ret := new(http.Response)
+	*ret = *resp
+	ret.Header = resp.Header.Clone()
+	ret.Trailer = resp.Trailer.Clone()
+	ret.Body = spool.Reader()
+	ret.Request = req
+	return ret
+}
+
+// newHistoryDir returns a Dir that exposes the history, with a directory per
+// entry named by its ID, an index summarising every entry, views of the
+// entries grouped by highlight label, method and path prefix, and a file to
+// purge entries with.
+func newHistoryDir(p *Proxy) *fusebox.Dir {
+	h := p.History
+	purge := newHandleFile(&purgeFile{Proxy: p})
+	purge.OpenFlags = fuse.OpenDirectIO
+	keys := func() []string {
+		ret := []string{"index", "highlighted", "by-method", "by-prefix", "purge"}
+		if p.DirNames.Templated() {
+			for _, e := range h.Entries() {
+				ret = append(ret, p.historyDirName(e))
+			}
+			return ret
+		}
+		for _, id := range h.IDs() {
+			ret = append(ret, strconv.Itoa(id))
+		}
+		return ret
+	}
+
+	node := func(k string) fusebox.VarNode {
+		switch k {
+		case "index":
+			return newReadOnlyFile(func() []byte {
+				return historyIndex(h.Entries())
+			})
+		case "highlighted":
+			return newHighlightedDir(p)
+		case "by-method":
+			return newByMethodDir(p)
+		case "by-prefix":
+			return newByPrefixDir(p)
+		case "purge":
+			return purge
+		}
+
+		if e := p.historyEntryByName(k); e != nil {
+			return p.historyEntryDir(e)
+		}
+		return nil
+	}
+
+	return newFuncDir(keys, node)
+}
+
+// historyIndex returns the summary lines of the given entries.
+func historyIndex(entries []*historyEntry) []byte {
+	buf := new(bytes.Buffer)
+	for _, e := range entries {
+		buf.WriteString(e.Summary())
+	}
+	return buf.Bytes()
+}
+
+// historyEntryDir returns a Dir exposing a single history entry.
+func (p *Proxy) historyEntryDir(e *historyEntry) *fusebox.Dir {
+	ret, d := newNodeDir()
+	re := newReqDirElement(e.Req, nil)
+	addReqFlowNodes(re)
+	d.add("req", freezeDir(newReqDir(re)))
+	if resp := e.Response(); resp != nil {
+		pe := newRespDirElement(resp, nil)
+		addRespFlowNodes(pe)
+		d.add("resp", freezeDir(newRespDir(pe)))
+		d.add("received", newReadOnlyFile(func() []byte {
+			return []byte(e.Time.Add(e.Latency()).Format(time.RFC3339Nano))
+		}))
+		d.add("duration", newReadOnlyFile(func() []byte {
+			return []byte(strconv.FormatInt(e.Latency().Nanoseconds()/int64(time.Millisecond), 10))
+		}))
+	}
+	d.add("client", newClientDir(e.Client))
+	d.add("time", newReadOnlyFile(func() []byte {
+		return []byte(e.Time.Format(time.RFC3339Nano))
+	}))
+	d.add("labels", newHandleFile(&labelsFile{e}))
+	d.add("notes", newHandleFile(&notesFile{e}))
+	d.add("aborted", newReadOnlyFile(func() []byte {
+		if e.Aborted() {
+			return []byte("1")
+		}
+		return []byte("0")
+	}))
+	d.add("route", newReadOnlyFile(func() []byte {
+		if route := e.Route(); route != "" {
+			return []byte(route)
+		}
+		return []byte("primary")
+	}))
+	d.add("session", newReadOnlyFile(func() []byte {
+		return []byte(e.Session())
+	}))
+	d.add("fingerprint", newReadOnlyFile(func() []byte {
+		return []byte(e.Fingerprint())
+	}))
+	if _, ok := dohQuery(e.Req); ok || isDoHResponse(e.Response()) {
+		d.add("dns", newDoHDir(e))
+	}
+	bench := newHandleFile(&benchmarkFile{p, e})
+	bench.OpenFlags = fuse.OpenDirectIO
+	d.add("benchmark", bench)
+	cors := newHandleFile(&corsFile{p, e})
+	cors.OpenFlags = fuse.OpenDirectIO
+	d.add("cors", cors)
+	authz := newHandleFile(&authzFile{p, e})
+	authz.OpenFlags = fuse.OpenDirectIO
+	d.add("authz", authz)
+	return ret
+}
+
+// newHighlightedDir returns a Dir with a directory for each label in use, which
+// in turn contains the entries with that label.
+func newHighlightedDir(p *Proxy) *fusebox.Dir {
+	h := p.History
+	byLabel := func() map[string][]*historyEntry {
+		ret := make(map[string][]*historyEntry)
+		for _, e := range h.Entries() {
+			for _, l := range e.Labels() {
+				ret[l] = append(ret[l], e)
+			}
+		}
+		return ret
+	}
+
+	keys := func() []string {
+		ret := make([]string, 0)
+		for l := range byLabel() {
+			ret = append(ret, l)
+		}
+		sort.Strings(ret)
+		return ret
+	}
+
+	node := func(label string) fusebox.VarNode {
+		if _, ok := byLabel()[label]; !ok {
+			return nil
+		}
+		return newHistoryViewDir(p, func(e *historyEntry) bool {
+			return containsString(e.Labels(), label)
+		})
+	}
+
+	return newFuncDir(keys, node)
+}
+
+// newHistoryViewDir returns a Dir containing the history entries selected by
+// the given function, named by their IDs, along with an index of them.
+func newHistoryViewDir(p *Proxy, include func(*historyEntry) bool) *fusebox.Dir {
+	h := p.History
+	selected := func() []*historyEntry {
+		ret := make([]*historyEntry, 0)
+		for _, e := range h.Entries() {
+			if include(e) {
+				ret = append(ret, e)
+			}
+		}
+		return ret
+	}
+
+	keys := func() []string {
+		entries := selected()
+		ret := make([]string, 0, len(entries)+1)
+		ret = append(ret, "index")
+		for _, e := range entries {
+			ret = append(ret, p.historyDirName(e))
+		}
+		return ret
+	}
+
+	node := func(k string) fusebox.VarNode {
+		if k == "index" {
+			return newReadOnlyFile(func() []byte {
+				return historyIndex(selected())
+			})
+		}
+
+		if e := p.historyEntryByName(k); e != nil && include(e) {
+			return p.historyEntryDir(e)
+		}
+		return nil
+	}
+
+	return newFuncDir(keys, node)
+}
+
+// notesFile exposes the free text notes attached to a history entry.
+type notesFile struct {
+	Entry *historyEntry
+}
+
+func (f *notesFile) ValRead(ctx context.Context) ([]byte, error) {
+	return f.Entry.Notes(), nil
+}
+
+func (f *notesFile) ValWrite(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+	f.Entry.mu.Lock()
+	f.Entry.notes = append([]byte(nil), req.Data...)
+	f.Entry.mu.Unlock()
+	f.Entry.save()
+
+	resp.Size = len(req.Data)
+	return nil
+}
+
+func (f *notesFile) Size(ctx context.Context) (uint64, error) {
+	return uint64(len(f.Entry.Notes())), nil
+}
+
+// labelsFile exposes the labels of a history entry, one per line, and allows
+// them to be replaced.
+type labelsFile struct {
+	Entry *historyEntry
+}
+
+func (f *labelsFile) ValRead(ctx context.Context) ([]byte, error) {
+	labels := f.Entry.Labels()
+	if len(labels) == 0 {
+		return nil, nil
+	}
+	return []byte(strings.Join(labels, "\n") + "\n"), nil
+}
+
+func (f *labelsFile) ValWrite(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+	f.Entry.SetLabels(strings.Fields(string(req.Data)))
+	resp.Size = len(req.Data)
+	return nil
+}
+
+func (f *labelsFile) Size(ctx context.Context) (uint64, error) {
+	b, _ := f.ValRead(ctx)
+	return uint64(len(b)), nil
+}
+
+// containsString returns whether the list contains the given string.
+func containsString(list []string, s string) bool {
+	for _, x := range list {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Find returns the entries whose requests have the given fingerprint.
+func (h *history) Find(fingerprint string) []*historyEntry {
+	ret := make([]*historyEntry, 0)
+	if h.store != nil {
+		ids, err := h.store.FindEntries("fingerprint", fingerprint)
+		if err != nil {
+			log.Printf("Failed to search the history: %v\n", err)
+		}
+		for _, id := range ids {
+			if e := h.Get(id); e != nil {
+				ret = append(ret, e)
+			}
+		}
+		return ret
+	}
+
+	for _, e := range h.Entries() {
+		if e.Fingerprint() == fingerprint {
+			ret = append(ret, e)
+		}
+	}
+
+	return ret
+}
+
+// requestFingerprint returns a hash identifying the given request, which is
+// the same for requests that differ only in ways that shouldn't affect the
+// server's response, such as the order of query parameters, the case of the
+// host, and headers.
+func requestFingerprint(req *http.Request) string {
+	u := *req.URL
+	u.Host = strings.ToLower(u.Host)
+	if (u.Scheme == "http" && u.Port() == "80") || (u.Scheme == "https" && u.Port() == "443") {
+		u.Host = u.Hostname()
+	}
+	u.RawQuery = u.Query().Encode()
+	u.Fragment = ""
+
+	h := sha256.New()
+	fmt.Fprintf(h, "%s %s\n", req.Method, u.String())
+	if req.Body != nil && req.Body != http.NoBody {
+		io.Copy(h, spoolBody(&req.Body).Reader())
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
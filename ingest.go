@@ -0,0 +1,206 @@
+package proxyfs
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"bazil.org/fuse"
+)
+
+// maxIngestSitemaps is the most sitemap files fetched by a single ingest,
+// including those listed in sitemap indexes.
+const maxIngestSitemaps = 20
+
+// sitemapXML is the subset of the sitemaps.org format needed to find URLs,
+// covering both URL sets and sitemap indexes.
+type sitemapXML struct {
+	URLs     []string `xml:"url>loc"`
+	Sitemaps []string `xml:"sitemap>loc"`
+}
+
+// ingestAdvertised fetches the robots.txt and sitemaps of the target at the
+// given URL, adding the resources they advertise to the sitemap without
+// requesting them. Only files and resources in scope are fetched and added, so
+// that a target can't have the proxy send requests to other hosts. It returns
+// a report of what was found.
+func (p *Proxy) ingestAdvertised(target *url.URL) []byte {
+	buf := new(bytes.Buffer)
+	root := &url.URL{Scheme: target.Scheme, Host: target.Host, Path: "/"}
+
+	// Paths mentioned in robots.txt, and the sitemaps it lists
+	sitemaps := []string{root.ResolveReference(&url.URL{Path: "/sitemap.xml"}).String()}
+	robots := root.ResolveReference(&url.URL{Path: "/robots.txt"})
+	if !p.inScope(robots) {
+		fmt.Fprintf(buf, "%s: out of scope\n", robots)
+	} else if data, err := p.fetchAdvertised(robots); err != nil {
+		fmt.Fprintf(buf, "%s: %v\n", robots, err)
+	} else {
+		paths, listed := parseRobots(data)
+		for _, path := range paths {
+			if ref, err := url.Parse(path); err == nil {
+				if u := root.ResolveReference(ref); p.inScope(u) {
+					p.Sitemap.Add(u, 0, "robots.txt")
+				}
+			}
+		}
+		for _, s := range listed {
+			if !containsString(sitemaps, s) {
+				sitemaps = append(sitemaps, s)
+			}
+		}
+		fmt.Fprintf(buf, "%s: %d paths, %d sitemaps\n", robots, len(paths), len(listed))
+	}
+
+	// Sitemaps, following sitemap indexes
+	for i := 0; i < len(sitemaps) && i < maxIngestSitemaps; i++ {
+		u, err := url.Parse(sitemaps[i])
+		if err != nil || !u.IsAbs() {
+			fmt.Fprintf(buf, "%s: invalid URL\n", sitemaps[i])
+			continue
+		}
+		if !p.inScope(u) {
+			fmt.Fprintf(buf, "%s: out of scope\n", u)
+			continue
+		}
+		data, err := p.fetchAdvertised(u)
+		if err != nil {
+			fmt.Fprintf(buf, "%s: %v\n", u, err)
+			continue
+		}
+
+		var s sitemapXML
+		if err := xml.Unmarshal(data, &s); err != nil {
+			fmt.Fprintf(buf, "%s: %v\n", u, err)
+			continue
+		}
+		for _, loc := range s.URLs {
+			if l, err := url.Parse(strings.TrimSpace(loc)); err == nil && l.IsAbs() && p.inScope(l) {
+				p.Sitemap.Add(l, 0, "sitemap.xml")
+			}
+		}
+		for _, loc := range s.Sitemaps {
+			if loc = strings.TrimSpace(loc); !containsString(sitemaps, loc) {
+				sitemaps = append(sitemaps, loc)
+			}
+		}
+		fmt.Fprintf(buf, "%s: %d urls, %d sitemaps\n", u, len(s.URLs), len(s.Sitemaps))
+	}
+	if len(sitemaps) > maxIngestSitemaps {
+		fmt.Fprintf(buf, "stopped after %d sitemaps\n", maxIngestSitemaps)
+	}
+
+	return buf.Bytes()
+}
+
+// fetchAdvertised fetches the body of a robots.txt or sitemap file, which is
+// decompressed if it's gzipped.
+func (p *Proxy) fetchAdvertised(u *url.URL) ([]byte, error) {
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := p.send(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %d", resp.StatusCode)
+	}
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.HasPrefix(data, []byte{0x1f, 0x8b}) {
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.ReadAll(r)
+	}
+	return data, nil
+}
+
+// parseRobots returns the paths in the Allow and Disallow rules of a
+// robots.txt file, cut off at any wildcard, and the sitemaps it lists.
+func parseRobots(data []byte) ([]string, []string) {
+	paths, sitemaps := make([]string, 0), make([]string, 0)
+	s := bufio.NewScanner(bytes.NewReader(data))
+	for s.Scan() {
+		line := s.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		value := strings.TrimSpace(parts[1])
+
+		switch strings.ToLower(strings.TrimSpace(parts[0])) {
+		case "allow", "disallow":
+			if i := strings.IndexAny(value, "*$"); i >= 0 {
+				value = value[:i]
+			}
+			if strings.HasPrefix(value, "/") && value != "/" && !containsString(paths, value) {
+				paths = append(paths, value)
+			}
+		case "sitemap":
+			if value != "" && !containsString(sitemaps, value) {
+				sitemaps = append(sitemaps, value)
+			}
+		}
+	}
+	return paths, sitemaps
+}
+
+// ingestFile starts fetching the robots.txt and sitemaps of the target whose
+// URL is written to it, in the background. Reading it gives the report of the
+// last ingest.
+type ingestFile struct {
+	Proxy *Proxy
+	mu    sync.Mutex
+	last  []byte
+}
+
+func (f *ingestFile) ValRead(ctx context.Context) ([]byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.last, nil
+}
+
+func (f *ingestFile) ValWrite(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+	u, err := url.Parse(strings.TrimSpace(string(req.Data)))
+	if err != nil || !u.IsAbs() {
+		return errInvalid
+	}
+
+	f.mu.Lock()
+	f.last = []byte(fmt.Sprintf("fetching from %s\n", u.Host))
+	f.mu.Unlock()
+	go func() {
+		report := f.Proxy.ingestAdvertised(u)
+		f.mu.Lock()
+		f.last = report
+		f.mu.Unlock()
+	}()
+
+	resp.Size = len(req.Data)
+	return nil
+}
+
+func (f *ingestFile) Size(ctx context.Context) (uint64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return uint64(len(f.last)), nil
+}
@@ -0,0 +1,192 @@
+package proxyfs
+
+import (
+	"context"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"bazil.org/fuse"
+	"github.com/danielthatcher/fusebox"
+)
+
+// job is a background task, such as a fuzz job, that runs until it's finished
+// or stopped.
+type job interface {
+	// Start starts the job, with up to concurrency requests in flight.
+	Start(p *Proxy, concurrency int) error
+
+	// Stop stops the job if it's running.
+	Stop()
+
+	// Report returns a summary of the job's progress.
+	Report() []byte
+}
+
+// jobSet holds a set of named jobs of the same kind, which are created with
+// mkdir and removed, stopping them, with rmdir.
+type jobSet struct {
+	Proxy *Proxy
+	mu    sync.RWMutex
+	jobs  map[string]job
+
+	// create returns a new, empty job, and dir returns the Dir exposing a job
+	create func() job
+	dir    func(job) fusebox.VarNode
+}
+
+func newJobSet(p *Proxy, create func() job, dir func(job) fusebox.VarNode) *jobSet {
+	return &jobSet{Proxy: p, jobs: make(map[string]job), create: create, dir: dir}
+}
+
+// Get returns the named job, or nil if there is no such job.
+func (s *jobSet) Get(name string) job {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.jobs[name]
+}
+
+func (s *jobSet) GetNode(ctx context.Context, k string) (fusebox.VarNode, error) {
+	j := s.Get(k)
+	if j == nil {
+		return nil, fuse.ENOENT
+	}
+
+	return s.dir(j), nil
+}
+
+func (s *jobSet) GetDirentType(ctx context.Context, k string) (fuse.DirentType, error) {
+	if s.Get(k) == nil {
+		return fuse.DT_Unknown, fuse.ENOENT
+	}
+	return fuse.DT_Dir, nil
+}
+
+func (s *jobSet) GetKeys(ctx context.Context) []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	ret := make([]string, 0, len(s.jobs))
+	for name := range s.jobs {
+		ret = append(ret, name)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// AddNode creates a new, empty job with the given name, e.g. through mkdir.
+func (s *jobSet) AddNode(name string, node interface{}) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.jobs[name]; !ok {
+		s.jobs[name] = s.create()
+	}
+	return nil
+}
+
+// RemoveNode stops and removes the named job.
+func (s *jobSet) RemoveNode(name string) error {
+	s.mu.Lock()
+	j, ok := s.jobs[name]
+	delete(s.jobs, name)
+	s.mu.Unlock()
+	if !ok {
+		return fuse.ENOENT
+	}
+
+	j.Stop()
+	return nil
+}
+
+// newJobsDir returns the Dir holding a set of jobs.
+func newJobsDir(s *jobSet) *fusebox.Dir {
+	ret := fusebox.NewDir(s)
+	ret.Mode = os.ModeDir | 0777
+	ret.OpenFlags = fuse.OpenDirectIO
+	return ret
+}
+
+// jobRunFile starts a job when written to, with an optional number of
+// requests to have in flight at once, and stops it when "stop" is written.
+// Reading it gives the job's progress.
+type jobRunFile struct {
+	Proxy *Proxy
+	Job   job
+}
+
+// Returns a new File controlling the given job.
+func newJobRunFile(p *Proxy, j job) *handleFile {
+	ret := newHandleFile(&jobRunFile{p, j})
+	ret.OpenFlags = fuse.OpenDirectIO
+	return ret
+}
+
+func (f *jobRunFile) ValRead(ctx context.Context) ([]byte, error) {
+	return f.Job.Report(), nil
+}
+
+func (f *jobRunFile) ValWrite(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+	fields := strings.Fields(string(req.Data))
+	if len(fields) > 1 {
+		return errInvalid
+	}
+
+	concurrency := 1
+	if len(fields) == 1 {
+		if fields[0] == "stop" {
+			f.Job.Stop()
+			resp.Size = len(req.Data)
+			return nil
+		}
+
+		var err error
+		concurrency, err = strconv.Atoi(fields[0])
+		if err != nil || concurrency <= 0 {
+			return errInvalid
+		}
+	}
+
+	if err := f.Job.Start(f.Proxy, concurrency); err != nil {
+		return err
+	}
+	resp.Size = len(req.Data)
+	return nil
+}
+
+func (f *jobRunFile) Size(ctx context.Context) (uint64, error) {
+	return uint64(len(f.Job.Report())), nil
+}
+
+// jobFile exposes one of a job's settings, guarded by the job's lock. If valid
+// is set, written values it rejects are invalid.
+type jobFile struct {
+	mu    *sync.RWMutex
+	Data  *[]byte
+	valid func([]byte) bool
+}
+
+func (f *jobFile) ValRead(ctx context.Context) ([]byte, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return *f.Data, nil
+}
+
+func (f *jobFile) ValWrite(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+	if f.valid != nil && !f.valid(req.Data) {
+		return errInvalid
+	}
+
+	f.mu.Lock()
+	*f.Data = append([]byte(nil), req.Data...)
+	f.mu.Unlock()
+
+	resp.Size = len(req.Data)
+	return nil
+}
+
+func (f *jobFile) Size(ctx context.Context) (uint64, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return uint64(len(*f.Data)), nil
+}
@@ -0,0 +1,256 @@
+package proxyfs
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+
+	"bazil.org/fuse"
+	"github.com/danielthatcher/fusebox"
+)
+
+// jwtRegexp matches a JWT in compact serialisation.
+var jwtRegexp = regexp.MustCompile(`eyJ[A-Za-z0-9_-]*\.[A-Za-z0-9_-]*\.[A-Za-z0-9_-]*`)
+
+// jwtHeaders are the request headers that are searched for a JWT, in order.
+var jwtHeaders = []string{"Authorization", "Cookie"}
+
+// findRequestJWT returns the first JWT found in the request's Authorization or
+// Cookie headers, or an empty string if there is none.
+func findRequestJWT(req *http.Request) string {
+	for _, h := range jwtHeaders {
+		for _, v := range req.Header[h] {
+			if t := jwtRegexp.FindString(v); t != "" {
+				return t
+			}
+		}
+	}
+
+	return ""
+}
+
+// replaceRequestJWT replaces the given JWT wherever it appears in the
+// request's Authorization or Cookie headers.
+func replaceRequestJWT(req *http.Request, old, new string) {
+	for _, h := range jwtHeaders {
+		for i, v := range req.Header[h] {
+			req.Header[h][i] = strings.Replace(v, old, new, -1)
+		}
+	}
+}
+
+// jwtParts holds the decoded parts of a JWT.
+type jwtParts struct {
+	Header    []byte
+	Claims    []byte
+	Signature []byte
+}
+
+// parseJWT decodes the parts of a JWT in compact serialisation.
+func parseJWT(token string) (*jwtParts, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed JWT")
+	}
+
+	ret := &jwtParts{}
+	var err error
+	if ret.Header, err = base64.RawURLEncoding.DecodeString(parts[0]); err != nil {
+		return nil, err
+	}
+	if ret.Claims, err = base64.RawURLEncoding.DecodeString(parts[1]); err != nil {
+		return nil, err
+	}
+	if ret.Signature, err = base64.RawURLEncoding.DecodeString(parts[2]); err != nil {
+		return nil, err
+	}
+
+	return ret, nil
+}
+
+// signingInput returns the header and claims encoded as they are signed.
+func (j *jwtParts) signingInput() string {
+	return base64.RawURLEncoding.EncodeToString(j.Header) + "." + base64.RawURLEncoding.EncodeToString(j.Claims)
+}
+
+// String returns the JWT in compact serialisation.
+func (j *jwtParts) String() string {
+	return j.signingInput() + "." + base64.RawURLEncoding.EncodeToString(j.Signature)
+}
+
+// Sign replaces the signature of the token using the algorithm in its header
+// and the given key. Tokens using "none" get an empty signature. If the
+// algorithm isn't supported, or no key is given, the signature is left as it
+// is, so that servers' handling of invalid signatures can still be tested.
+func (j *jwtParts) Sign(key string) error {
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := json.Unmarshal(j.Header, &header); err != nil {
+		return err
+	}
+
+	hashes := map[string]crypto.Hash{"256": crypto.SHA256, "384": crypto.SHA384, "512": crypto.SHA512}
+	alg := strings.ToUpper(header.Alg)
+	if alg == "NONE" {
+		j.Signature = nil
+		return nil
+	}
+	if key == "" || len(alg) != 5 {
+		return nil
+	}
+	hash, ok := hashes[alg[2:]]
+	if !ok {
+		return nil
+	}
+
+	input := []byte(j.signingInput())
+	switch alg[:2] {
+	case "HS":
+		mac := hmac.New(hash.New, []byte(key))
+		mac.Write(input)
+		j.Signature = mac.Sum(nil)
+	case "RS":
+		block, _ := pem.Decode([]byte(key))
+		if block == nil {
+			return errors.New("JWT key is not PEM encoded")
+		}
+		priv, err := parseRSAPrivateKey(block.Bytes)
+		if err != nil {
+			return err
+		}
+		h := hash.New()
+		h.Write(input)
+		sig, err := rsa.SignPKCS1v15(rand.Reader, priv, hash, h.Sum(nil))
+		if err != nil {
+			return err
+		}
+		j.Signature = sig
+	}
+
+	return nil
+}
+
+// parseRSAPrivateKey parses a PKCS1 or PKCS8 encoded RSA private key.
+func parseRSAPrivateKey(der []byte) (*rsa.PrivateKey, error) {
+	if k, err := x509.ParsePKCS1PrivateKey(der); err == nil {
+		return k, nil
+	}
+
+	k, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, err
+	}
+	rk, ok := k.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("JWT key is not an RSA key")
+	}
+	return rk, nil
+}
+
+// jwtFile exposes one part of the JWT in a request. The header and claims are
+// shown as indented JSON, and the signature base64url encoded. Writing to the
+// header or claims re-signs the token with the key in /settings/jwt-key, and
+// writing to the signature replaces it. In each case the new token replaces
+// the old one in the request, so that it is sent when the request is
+// forwarded.
+type jwtFile struct {
+	Req      *http.Request
+	Settings *settings
+	Part     string
+}
+
+func (f *jwtFile) ValRead(ctx context.Context) ([]byte, error) {
+	j, err := parseJWT(findRequestJWT(f.Req))
+	if err != nil {
+		return nil, fuse.EIO
+	}
+
+	var data []byte
+	switch f.Part {
+	case "header":
+		data = j.Header
+	case "claims":
+		data = j.Claims
+	case "signature":
+		return []byte(base64.RawURLEncoding.EncodeToString(j.Signature)), nil
+	}
+
+	buf := new(bytes.Buffer)
+	if err := json.Indent(buf, data, "", "  "); err != nil {
+		return data, nil
+	}
+	return buf.Bytes(), nil
+}
+
+func (f *jwtFile) ValWrite(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+	old := findRequestJWT(f.Req)
+	j, err := parseJWT(old)
+	if err != nil {
+		return fuse.EIO
+	}
+
+	data := bytes.TrimSpace(req.Data)
+	switch f.Part {
+	case "header", "claims":
+		buf := new(bytes.Buffer)
+		if err := json.Compact(buf, data); err != nil {
+			return errInvalid
+		}
+		if f.Part == "header" {
+			j.Header = buf.Bytes()
+		} else {
+			j.Claims = buf.Bytes()
+		}
+		if err := j.Sign(f.Settings.Get().JWTKey); err != nil {
+			return errInvalid
+		}
+	case "signature":
+		sig, err := base64.RawURLEncoding.DecodeString(string(data))
+		if err != nil {
+			return errInvalid
+		}
+		j.Signature = sig
+	}
+
+	replaceRequestJWT(f.Req, old, j.String())
+	resp.Size = len(req.Data)
+	return nil
+}
+
+func (f *jwtFile) Size(ctx context.Context) (uint64, error) {
+	data, err := f.ValRead(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return uint64(len(data)), nil
+}
+
+// newJWTDir returns a Dir exposing the decoded parts of the JWT in the given
+// request, signing edited tokens with the key in the settings.
+func newJWTDir(req *http.Request, settings *settings) *fusebox.Dir {
+	ret, d := newNodeDir()
+	ret.Mode = os.ModeDir | 0755
+	for _, part := range []string{"header", "claims", "signature"} {
+		f := newHandleFile(&jwtFile{Req: req, Settings: settings, Part: part})
+		f.OpenFlags = fuse.OpenDirectIO
+		d.add(part, f)
+	}
+	d.add("token", newReadOnlyFile(func() []byte {
+		return []byte(findRequestJWT(req))
+	}))
+
+	return ret
+}
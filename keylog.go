@@ -0,0 +1,137 @@
+package proxyfs
+
+import (
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+
+	"github.com/elazarl/goproxy"
+)
+
+// keyLog is a writer for TLS secrets in the NSS key log format, as used with
+// SSLKEYLOGFILE, which lets Wireshark decrypt captured traffic. Lines from
+// concurrent connections are written whole.
+type keyLog struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (k *keyLog) Write(p []byte) (int, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.w.Write(p)
+}
+
+// OpenKeyLog starts logging the secrets of both the TLS connections from
+// clients that are intercepted, and the connections made upstream, to the
+// given file. The file is appended to if it exists.
+func (p *Proxy) OpenKeyLog(path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	p.KeyLog = &keyLog{w: f}
+
+	// goproxy's default TLS config is shared, so it's copied
+	var cfg *tls.Config
+	if p.Server.Tr.TLSClientConfig != nil {
+		cfg = p.Server.Tr.TLSClientConfig.Clone()
+	} else {
+		cfg = &tls.Config{}
+	}
+	cfg.KeyLogWriter = p.KeyLog
+	p.Server.Tr.TLSClientConfig = cfg
+	return nil
+}
+
+// mitmConnect is the goproxy handler for CONNECTs to intercept, which
+// intercepts them with certificates signed by the proxy's CA. goproxy keeps
+// the intercepted connection to itself, passing WebSocket upgrades straight
+// through, so with settings/websocket-tls on the connection is served by
+// hijackConnect instead.
+func (p *Proxy) mitmConnect(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+	if p.Settings.Get().WebSocketTLS {
+		return &goproxy.ConnectAction{Action: goproxy.ConnectHijack, Hijack: p.hijackConnect}, host
+	}
+	return &goproxy.ConnectAction{Action: goproxy.ConnectMitm, TLSConfig: p.mitmTLSConfig}, host
+}
+
+// hijackConnect intercepts the TLS connection of a CONNECT, and serves the
+// requests sent over it with the proxy's own HTTP server, over HTTP/1.1 or
+// HTTP/2 as the client prefers. WebSocket upgrades are taken over by
+// serveWebSocket, and every other request is handed to goproxy.
+func (p *Proxy) hijackConnect(req *http.Request, client net.Conn, ctx *goproxy.ProxyCtx) {
+	host := req.URL.Host
+	cfg, err := p.mitmTLSConfig(host, ctx)
+	if err != nil {
+		client.Close()
+		return
+	}
+	cfg.NextProtos = []string{"h2", "http/1.1"}
+
+	srv := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !r.URL.IsAbs() {
+				r.URL.Scheme = "https"
+				r.URL.Host = host
+			}
+			if p.interceptsWebSocket(r) {
+				p.serveWebSocket(w, r)
+				return
+			}
+			p.Server.ServeHTTP(&flushingWriter{w}, r)
+		}),
+		ErrorLog: log.New(ioutil.Discard, "", 0),
+	}
+	go srv.Serve(&connListener{conn: tls.Server(client, cfg)})
+}
+
+// connListener is a listener that accepts a single connection it already
+// has, and then stops.
+type connListener struct {
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.conn == nil {
+		return nil, io.EOF
+	}
+	ret := l.conn
+	l.conn = nil
+	return ret, nil
+}
+
+func (l *connListener) Close() error {
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.conn == nil {
+		return &net.TCPAddr{}
+	}
+	return l.conn.LocalAddr()
+}
+
+// mitmTLSConfig returns the TLS config used to intercept a connection to the
+// given host, which logs its secrets if there's a key log.
+func (p *Proxy) mitmTLSConfig(host string, ctx *goproxy.ProxyCtx) (*tls.Config, error) {
+	ca := p.CA()
+	cfg, err := goproxy.TLSConfigFromCA(&ca)(host, ctx)
+	if err != nil {
+		return nil, err
+	}
+	if p.KeyLog != nil {
+		cfg.KeyLogWriter = p.KeyLog
+	}
+	return cfg, nil
+}
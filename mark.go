@@ -0,0 +1,40 @@
+package proxyfs
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/elazarl/goproxy"
+)
+
+// proxiedByHeader is set on responses stamped by the proxy.
+const proxiedByHeader = "X-Proxied-By"
+
+// markApplies returns whether a marking setting applies to a response, given
+// whether it's in scope.
+func markApplies(setting string, inScope bool) bool {
+	return setting == "all" || (setting == "scope" && inScope)
+}
+
+// markResponse strips the headers that mark traffic as proxied from the
+// response, and stamps it with the proxy's own, according to the settings.
+func (p *Proxy) markResponse(r *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+	if r == nil {
+		return r
+	}
+	inScope := ctx.Req != nil && p.inScope(ctx.Req.URL)
+
+	if markApplies(p.Settings.Get().StripMarkers, inScope) {
+		r.Header.Del("Via")
+		r.Header.Del(proxiedByHeader)
+	}
+	if markApplies(p.Settings.Get().Mark, inScope) {
+		major, minor := r.ProtoMajor, r.ProtoMinor
+		if major == 0 {
+			major, minor = 1, 1
+		}
+		r.Header.Add("Via", fmt.Sprintf("%d.%d proxyfs", major, minor))
+		r.Header.Set(proxiedByHeader, "proxyfs")
+	}
+	return r
+}
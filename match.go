@@ -0,0 +1,171 @@
+package proxyfs
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// matchExpr is a parsed match expression, used by rules that need to select
+// requests and responses. An expression is made up of whitespace separated
+// terms, all of which must match. Each term has the form <field><op><value>,
+// where op is '=' for an exact (case insensitive) match, or '~' for a regular
+// expression match. A term can be negated by prefixing it with '!'. The
+// following fields are supported:
+//
+//	url, host, path, ext, method, body           - taken from the request
+//	status, contenttype, respbody                - taken from the response
+//	header:<Name>, respheader:<Name>             - request and response headers
+//
+// Terms on response fields never match when there is no response.
+type matchExpr struct {
+	src   string
+	terms []matchTerm
+}
+
+type matchTerm struct {
+	field  string
+	header string
+	negate bool
+	value  string
+	re     *regexp.Regexp
+}
+
+// parseMatchExpr parses the given match expression. An empty expression
+// matches everything.
+func parseMatchExpr(s string) (*matchExpr, error) {
+	ret := &matchExpr{src: strings.TrimSpace(s)}
+	for _, t := range strings.Fields(s) {
+		term := matchTerm{}
+		if strings.HasPrefix(t, "!") {
+			term.negate = true
+			t = t[1:]
+		}
+
+		i := strings.IndexAny(t, "=~")
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid match term %q", t)
+		}
+		term.field = strings.ToLower(t[:i])
+		if j := strings.Index(term.field, ":"); j >= 0 {
+			term.header = http.CanonicalHeaderKey(t[j+1 : i])
+			term.field = term.field[:j]
+		}
+
+		switch term.field {
+		case "url", "host", "path", "ext", "method", "body", "status", "contenttype", "respbody":
+			if term.header != "" {
+				return nil, fmt.Errorf("field %q does not take a header name", term.field)
+			}
+		case "header", "respheader":
+			if term.header == "" {
+				return nil, fmt.Errorf("field %q requires a header name", term.field)
+			}
+		default:
+			return nil, fmt.Errorf("unknown match field %q", term.field)
+		}
+
+		if t[i] == '~' {
+			re, err := regexp.Compile(t[i+1:])
+			if err != nil {
+				return nil, err
+			}
+			term.re = re
+		} else {
+			term.value = t[i+1:]
+		}
+
+		ret.terms = append(ret.terms, term)
+	}
+
+	return ret, nil
+}
+
+// String returns the source of the expression.
+func (m *matchExpr) String() string {
+	return m.src
+}
+
+// Match returns whether the given request, and optionally response, match
+// the expression. Bodies are read into memory if required, and replaced so
+// that they can still be read afterwards.
+func (m *matchExpr) Match(req *http.Request, resp *http.Response) bool {
+	for _, t := range m.terms {
+		if t.match(req, resp) == t.negate {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (t *matchTerm) match(req *http.Request, resp *http.Response) bool {
+	var vals []string
+	switch t.field {
+	case "url":
+		vals = []string{req.URL.String()}
+	case "host":
+		vals = []string{req.URL.Hostname()}
+	case "path":
+		vals = []string{req.URL.Path}
+	case "ext":
+		vals = []string{strings.TrimPrefix(path.Ext(req.URL.Path), ".")}
+	case "method":
+		vals = []string{req.Method}
+	case "body":
+		vals = []string{string(peekBody(&req.Body))}
+	case "header":
+		vals = req.Header[t.header]
+	}
+
+	if resp != nil {
+		switch t.field {
+		case "status":
+			vals = []string{strconv.Itoa(resp.StatusCode)}
+		case "contenttype":
+			ct, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+			vals = []string{ct}
+		case "respbody":
+			vals = []string{string(peekBody(&resp.Body))}
+		case "respheader":
+			vals = resp.Header[t.header]
+		}
+	}
+
+	for _, v := range vals {
+		if t.re != nil && t.re.MatchString(v) {
+			return true
+		}
+		if t.re == nil && strings.EqualFold(t.value, v) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// peekBody reads the whole of the given body, replacing it with a fresh reader
+// so that it can be read again. A nil body is treated as empty.
+func peekBody(body *io.ReadCloser) []byte {
+	if *body == nil || *body == http.NoBody {
+		return nil
+	}
+	if cb, ok := (*body).(*chunkedBody); ok {
+		return cb.Bytes()
+	}
+	return spoolBody(body).Bytes()
+}
+
+// peekBodyHead returns up to the first n bytes of the given body, like
+// peekBody, without reading the rest of a large body into memory.
+func peekBodyHead(body *io.ReadCloser, n int64) []byte {
+	if *body == nil || *body == http.NoBody {
+		return nil
+	}
+	return spoolBody(body).Head(n)
+}
@@ -0,0 +1,122 @@
+package proxyfs
+
+import (
+	"fmt"
+	"log"
+	"sort"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+)
+
+// mountPolicy controls what can be done through a single mount of the
+// filesystem. Every mount serves the same tree, so changes made through one
+// are seen through all of them.
+type mountPolicy struct {
+	// Whether the mount rejects every write, so that it can only be used to
+	// watch the proxy, e.g. from a dashboard.
+	ReadOnly bool
+
+	// Whether users other than the one running the proxy can access the
+	// mount. This needs user_allow_other to be set in /etc/fuse.conf.
+	AllowOther bool
+
+	// What the mount's users are allowed to change. The user running the
+	// proxy can change anything the mount options allow.
+	Role role
+
+	// The roles of particular users, by UID, in place of Role.
+	Users map[uint32]role
+}
+
+// String returns the policy's mount options as they'd be given to mount,
+// followed by its roles.
+func (m mountPolicy) String() string {
+	ret := "rw"
+	if m.ReadOnly {
+		ret = "ro"
+	}
+	if m.AllowOther {
+		ret += ",allow_other"
+	}
+	ret += ",role=" + m.Role.String()
+	uids := make([]int, 0, len(m.Users))
+	for uid := range m.Users {
+		uids = append(uids, int(uid))
+	}
+	sort.Ints(uids)
+	for _, uid := range uids {
+		ret += fmt.Sprintf(",%d=%v", uid, m.Users[uint32(uid)])
+	}
+	return ret
+}
+
+// Mount mounts the filesystem at the given path, read-write for admins, and
+// serves it until it's unmounted.
+func (p *Proxy) Mount(path string) error {
+	return p.MountWith(path, mountPolicy{Role: roleAdmin})
+}
+
+// MountWith mounts the filesystem at the given path with the given policy,
+// and serves it until it's unmounted. It can be called for several
+// mountpoints at once.
+func (p *Proxy) MountWith(path string, policy mountPolicy) error {
+	opts := []fuse.MountOption{fuse.FSName("proxyfs"), fuse.Subtype("proxyfs")}
+	if policy.ReadOnly {
+		opts = append(opts, fuse.ReadOnly())
+	}
+	if policy.AllowOther {
+		opts = append(opts, fuse.AllowOther())
+	}
+
+	c, err := fuse.Mount(path, opts...)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	p.mountMu.Lock()
+	p.mounts = append(p.mounts, path)
+	p.mountMu.Unlock()
+	defer p.forgetMount(path)
+	p.Readiness.Done("filesystem")
+
+	config := &fs.Config{}
+	if p.FuseTrace != nil {
+		config.Debug = p.FuseTrace.Debugger(path)
+	}
+	if err := fs.New(c, config).Serve(newRoleFS(p, newAuditFS(p, path, true), policy.Role, policy.Users, true)); err != nil {
+		return err
+	}
+	<-c.Ready
+	return c.MountError
+}
+
+// forgetMount removes the given path from the list of mountpoints.
+func (p *Proxy) forgetMount(path string) {
+	p.mountMu.Lock()
+	defer p.mountMu.Unlock()
+	for i, m := range p.mounts {
+		if m == path {
+			p.mounts = append(p.mounts[:i], p.mounts[i+1:]...)
+			return
+		}
+	}
+}
+
+// Unmount unmounts every mountpoint the filesystem is mounted at, returning
+// the last error encountered.
+func (p *Proxy) Unmount() error {
+	p.mountMu.Lock()
+	mounts := append([]string(nil), p.mounts...)
+	p.mountMu.Unlock()
+
+	var ret error
+	for _, m := range mounts {
+		if err := fuse.Unmount(m); err != nil {
+			log.Printf("Failed to unmount %s: %v\n", m, err)
+			ret = fmt.Errorf("unmounting %s: %v", m, err)
+		}
+	}
+	return ret
+}
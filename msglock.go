@@ -0,0 +1,221 @@
+package proxyfs
+
+import (
+	"bytes"
+	"context"
+	"sync"
+
+	"bazil.org/fuse"
+	"github.com/danielthatcher/fusebox"
+)
+
+// msgLock guards a queued request or response, which is read and changed both
+// through the filesystem and by the handler waiting to send it. Files of the
+// message are read and written holding the lock exclusively, as reading a body
+// may replace it with a spool, while listings and lookups share it. Once the
+// handler has taken the message back with Release, its nodes fail with
+// errGone, so that the handler can go on changing it without locking.
+//
+// A nil msgLock guards nothing, for messages that aren't shared, such as those
+// in the history. A read-only msgLock guards what was recorded, failing writes
+// with errReadOnly, and is never released.
+type msgLock struct {
+	mu       sync.RWMutex
+	released bool
+	readOnly bool
+
+	// Bumped each time the message is changed through the filesystem, so
+	// that the raw dumps kept of it, by message, can be told apart from
+	// those of its current state
+	gen   uint64
+	dumps map[interface{}]*rawDump
+}
+
+// newMsgLock returns the lock for a newly queued message.
+func newMsgLock() *msgLock {
+	return &msgLock{}
+}
+
+// read calls fn holding the lock shared, unless the message has been released.
+func (l *msgLock) read(fn func() error) error {
+	if l == nil {
+		return fn()
+	}
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.released {
+		return errGone
+	}
+	return fn()
+}
+
+// write calls fn holding the lock exclusively, unless the message has been
+// released.
+func (l *msgLock) write(fn func() error) error {
+	if l == nil {
+		return fn()
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.released {
+		return errGone
+	}
+	return fn()
+}
+
+// change calls fn holding the lock exclusively, as write does, for a change to
+// the message.
+func (l *msgLock) change(fn func() error) error {
+	if l == nil {
+		return fn()
+	}
+	return l.write(func() error {
+		err := fn()
+		l.gen++
+		return err
+	})
+}
+
+// Release hands the message back to its handler, waiting for any reads or
+// writes through the filesystem to finish, and drops its raw dumps.
+func (l *msgLock) Release() {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	l.released = true
+	l.dumps = nil
+	l.mu.Unlock()
+}
+
+// guard has the given node, and any nodes looked up through it, access the
+// message holding the lock, and if the lock is read-only, makes them read-only.
+// Nodes other than files and directories, such as forward files, are returned
+// as they are.
+func (l *msgLock) guard(node fusebox.VarNode) fusebox.VarNode {
+	if l == nil {
+		return node
+	}
+	switch n := node.(type) {
+	case *handleFile:
+		n.element = &lockedFile{n.element, l}
+		n.File.Element = n.element
+		if l.readOnly {
+			n.File.Mode &^= 0222
+		}
+	case *fusebox.File:
+		n.Element = &lockedFile{n.Element, l}
+		if l.readOnly {
+			n.Mode &^= 0222
+		}
+	case *fusebox.Dir:
+		l.guardDir(n)
+	}
+	return node
+}
+
+// guardDir is guard for a directory.
+func (l *msgLock) guardDir(d *fusebox.Dir) *fusebox.Dir {
+	if l != nil {
+		d.Element = &lockedDir{d.Element, l}
+		if l.readOnly {
+			d.Mode &^= 0222
+		}
+	}
+	return d
+}
+
+// lockedFile is a file element that's read and written holding a msgLock.
+type lockedFile struct {
+	fusebox.FileElement
+	lock *msgLock
+}
+
+func (e *lockedFile) ValRead(ctx context.Context) ([]byte, error) {
+	var ret []byte
+	err := e.lock.write(func() (err error) {
+		ret, err = e.FileElement.ValRead(ctx)
+		return err
+	})
+	return ret, err
+}
+
+func (e *lockedFile) AppendVal(ctx context.Context, buf *bytes.Buffer) error {
+	return e.lock.write(func() error {
+		return appendValue(ctx, e.FileElement, buf)
+	})
+}
+
+func (e *lockedFile) ValWrite(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+	if e.lock.readOnly {
+		return errReadOnly
+	}
+	return e.lock.change(func() error {
+		return e.FileElement.ValWrite(ctx, req, resp)
+	})
+}
+
+func (e *lockedFile) Size(ctx context.Context) (uint64, error) {
+	var ret uint64
+	err := e.lock.write(func() (err error) {
+		ret, err = e.FileElement.Size(ctx)
+		return err
+	})
+	return ret, err
+}
+
+// lockedDir is a directory element whose entries are listed and looked up
+// holding a msgLock, and whose nodes are guarded by it in turn. Listings are
+// taken as a snapshot while holding the lock.
+type lockedDir struct {
+	fusebox.DirElement
+	lock *msgLock
+}
+
+func (e *lockedDir) GetNode(ctx context.Context, k string) (fusebox.VarNode, error) {
+	var ret fusebox.VarNode
+	err := e.lock.read(func() (err error) {
+		ret, err = e.DirElement.GetNode(ctx, k)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return e.lock.guard(ret), nil
+}
+
+func (e *lockedDir) GetDirentType(ctx context.Context, k string) (fuse.DirentType, error) {
+	ret := fuse.DT_Unknown
+	err := e.lock.read(func() (err error) {
+		ret, err = e.DirElement.GetDirentType(ctx, k)
+		return err
+	})
+	return ret, err
+}
+
+func (e *lockedDir) GetKeys(ctx context.Context) []string {
+	var ret []string
+	e.lock.read(func() error {
+		ret = append([]string(nil), e.DirElement.GetKeys(ctx)...)
+		return nil
+	})
+	return ret
+}
+
+func (e *lockedDir) AddNode(name string, node interface{}) error {
+	if e.lock.readOnly {
+		return errReadOnly
+	}
+	return e.lock.change(func() error {
+		return e.DirElement.AddNode(name, node)
+	})
+}
+
+func (e *lockedDir) RemoveNode(name string) error {
+	if e.lock.readOnly {
+		return errReadOnly
+	}
+	return e.lock.change(func() error {
+		return e.DirElement.RemoveNode(name)
+	})
+}
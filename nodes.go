@@ -1,18 +1,20 @@
-package main
+package proxyfs
 
 import (
 	"bufio"
 	"bytes"
 	"context"
 	"io"
-	"io/ioutil"
 	"net/http"
-	"net/http/httputil"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 
 	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
 	"github.com/danielthatcher/fusebox"
+	"github.com/satori/go.uuid"
 )
 
 type reqDirElement struct {
@@ -20,45 +22,78 @@ type reqDirElement struct {
 	files   []string
 	dirs    []string
 	forward chan int
+	extra   map[string]func() fusebox.VarNode
+
+	// The settings limiting the size of written bodies and whether
+	// whitespace is trimmed from them, or nil for no limit or trimming
+	settings *settings
+
+	// The snippets that can be inserted into written headers and bodies, or
+	// nil for none
+	snippets *snippetSet
+
+	// The lock guarding the message while it's queued, which keeps its raw
+	// dump, or nil
+	lock *msgLock
 }
 
 func newReqDirElement(req *http.Request, forward chan int) *reqDirElement {
 	return &reqDirElement{
 		Data:    req,
-		files:   []string{"method", "url", "proto", "close", "host", "raw", "contentlength", "body", "forward"},
-		dirs:    []string{"headers"},
+		files:   []string{"method", "url", "proto", "close", "host", "raw", "contentlength", "body", "body.sha256", "forward"},
+		dirs:    []string{"headers", "params"},
 		forward: forward,
+		extra:   make(map[string]func() fusebox.VarNode),
+	}
+}
+
+// addNode adds an extra node to the directory, which is created by calling fn
+// each time it is looked up.
+func (e *reqDirElement) addNode(name string, dir bool, fn func() fusebox.VarNode) {
+	if dir {
+		e.dirs = append(e.dirs, name)
+	} else {
+		e.files = append(e.files, name)
 	}
+	e.extra[name] = fn
 }
 
 func (e *reqDirElement) GetNode(ctx context.Context, k string) (fusebox.VarNode, error) {
 	switch k {
 	case "method":
-		return fusebox.NewStringFile(&e.Data.Method), nil
+		return newStringFile(&e.Data.Method), nil
 	case "url":
-		return fusebox.NewURLFile(e.Data.URL), nil
+		return newURLFile(e.Data.URL), nil
 	case "requrl":
-		return fusebox.NewStringFile(&e.Data.RequestURI), nil
+		return newStringFile(&e.Data.RequestURI), nil
 	case "proto":
-		return fusebox.NewStringFile(&e.Data.Proto), nil
+		return newStringFile(&e.Data.Proto), nil
 	case "close":
-		return fusebox.NewBoolFile(&e.Data.Close), nil
+		return newBoolFile(&e.Data.Close), nil
 	case "host":
-		return fusebox.NewStringFile(&e.Data.Host), nil
+		return newStringFile(&e.Data.Host), nil
 	case "headers":
-		d := newHTTPHeaderDir(&e.Data.Header)
+		d := newHTTPHeaderDir(&e.Data.Header, e.snippets)
 		d.OpenFlags = fuse.OpenDirectIO
 		return d, nil
+	case "params":
+		return newParamsDir(e.Data, e.snippets), nil
 	case "raw":
-		return newHTTPReqRawFile(e.Data), nil
+		return newHTTPReqRawFile(e.Data, e.settings, e.lock), nil
 	case "contentlength":
-		return fusebox.NewInt64File(&e.Data.ContentLength), nil
+		return newInt64File(&e.Data.ContentLength), nil
 	case "body":
-		return newHTTPBodyFile(&e.Data.Body), nil
+		return newHTTPBodyFile(e.Data.Header, &e.Data.Body, &e.Data.ContentLength, &e.Data.TransferEncoding, e.settings, e.snippets), nil
+	case "body.sha256":
+		return newBodyHashFile(&e.Data.Body), nil
 	case "forward":
 		return fusebox.NewChanFile(e.forward), nil
 	}
 
+	if fn, ok := e.extra[k]; ok {
+		return fn(), nil
+	}
+
 	return nil, fuse.ENOENT
 }
 
@@ -79,7 +114,7 @@ func (e *reqDirElement) GetDirentType(ctx context.Context, k string) (fuse.Diren
 }
 
 func (e *reqDirElement) GetKeys(ctx context.Context) []string {
-	return append(e.files, e.dirs...)
+	return append(e.files[:len(e.files):len(e.files)], e.dirs...)
 }
 
 func (*reqDirElement) AddNode(name string, node interface{}) error {
@@ -93,7 +128,13 @@ func (*reqDirElement) RemoveNode(name string) error {
 // newHTTPReqDir returns a Dir that represents the values of a http.Request
 // object. By default, these values are readable and writeable.
 func newHTTPReqDir(req *http.Request, forward chan int) *fusebox.Dir {
-	ret := fusebox.NewDir(newReqDirElement(req, forward))
+	return newReqDir(newReqDirElement(req, forward))
+}
+
+// newReqDir returns a Dir for the given request element, allowing extra nodes
+// to be added to the element first.
+func newReqDir(e *reqDirElement) *fusebox.Dir {
+	ret := fusebox.NewDir(e)
 	ret.Mode = os.ModeDir | 0666
 	return ret
 }
@@ -103,43 +144,76 @@ type respDirElement struct {
 	files   []string
 	dirs    []string
 	forward chan int
+	extra   map[string]func() fusebox.VarNode
+
+	// The settings limiting the size of written bodies and whether
+	// whitespace is trimmed from them, or nil for no limit or trimming
+	settings *settings
+
+	// The snippets that can be inserted into written headers and bodies, or
+	// nil for none
+	snippets *snippetSet
+
+	// The lock guarding the message while it's queued, which keeps its raw
+	// dump, or nil
+	lock *msgLock
 }
 
 func newRespDirElement(resp *http.Response, forward chan int) *respDirElement {
 	return &respDirElement{
 		Data:    resp,
-		files:   []string{"status", "statuscode", "proto", "close", "raw", "contentlength", "body", "forward"},
+		files:   []string{"status", "statuscode", "proto", "close", "raw", "contentlength", "body", "body.sha256", "forward"},
 		dirs:    []string{"headers", "req"},
 		forward: forward,
+		extra:   make(map[string]func() fusebox.VarNode),
+	}
+}
+
+// addNode adds an extra node to the directory, which is created by calling fn
+// each time it is looked up.
+func (e *respDirElement) addNode(name string, dir bool, fn func() fusebox.VarNode) {
+	if dir {
+		e.dirs = append(e.dirs, name)
+	} else {
+		e.files = append(e.files, name)
 	}
+	e.extra[name] = fn
 }
 
 func (e *respDirElement) GetNode(ctx context.Context, k string) (fusebox.VarNode, error) {
 	switch k {
 	case "status":
-		return fusebox.NewStringFile(&e.Data.Status), nil
+		return newStringFile(&e.Data.Status), nil
 	case "statuscode":
-		return fusebox.NewIntFile(&e.Data.StatusCode), nil
+		return newIntFile(&e.Data.StatusCode), nil
 	case "proto":
-		return fusebox.NewStringFile(&e.Data.Proto), nil
+		return newStringFile(&e.Data.Proto), nil
 	case "close":
-		return fusebox.NewBoolFile(&e.Data.Close), nil
+		return newBoolFile(&e.Data.Close), nil
 	case "headers":
-		ret := newHTTPHeaderDir(&e.Data.Header)
+		ret := newHTTPHeaderDir(&e.Data.Header, e.snippets)
 		ret.OpenFlags = fuse.OpenDirectIO
 		return ret, nil
 	case "req":
-		return newHTTPReqDir(e.Data.Request, nil), nil
+		re := newReqDirElement(e.Data.Request, nil)
+		re.lock = e.lock
+		return newReqDir(re), nil
 	case "raw":
-		return newHTTPRespRawFile(e.Data), nil
+		return newHTTPRespRawFile(e.Data, e.settings, e.lock), nil
 	case "contentlength":
-		return fusebox.NewInt64File(&e.Data.ContentLength), nil
+		return newInt64File(&e.Data.ContentLength), nil
 	case "body":
-		return newHTTPBodyFile(&e.Data.Body), nil
+		return newHTTPBodyFile(e.Data.Header, &e.Data.Body, &e.Data.ContentLength, &e.Data.TransferEncoding, e.settings, e.snippets), nil
+	case "body.sha256":
+		return newBodyHashFile(&e.Data.Body), nil
 	case "forward":
 		return fusebox.NewChanFile(e.forward), nil
 	}
 
+	if fn, ok := e.extra[k]; ok {
+		return fn(), nil
+	}
+
 	return nil, fuse.ENOENT
 }
 
@@ -160,7 +234,7 @@ func (e *respDirElement) GetDirentType(ctx context.Context, k string) (fuse.Dire
 }
 
 func (e *respDirElement) GetKeys(ctx context.Context) []string {
-	return append(e.files, e.dirs...)
+	return append(e.files[:len(e.files):len(e.files)], e.dirs...)
 }
 
 func (*respDirElement) AddNode(name string, node interface{}) error {
@@ -174,34 +248,94 @@ func (*respDirElement) RemoveNode(name string) error {
 // newHTTPRespDir returns a Dir that represents the values of a http.Response
 // object. By default, these values are readable and writeable.
 func newHTTPRespDir(resp *http.Response, forward chan int) *fusebox.Dir {
-	ret := fusebox.NewDir(newRespDirElement(resp, forward))
+	return newRespDir(newRespDirElement(resp, forward))
+}
+
+// newRespDir returns a Dir for the given response element, allowing extra nodes
+// to be added to the element first.
+func newRespDir(e *respDirElement) *fusebox.Dir {
+	ret := fusebox.NewDir(e)
 	ret.Mode = os.ModeDir | 0666
 	return ret
 }
 
 type reqListElement struct {
-	Data *[]proxyReq
+	Data  *[]proxyReq
+	Proxy *Proxy
+
+	// The named queue listed, or empty for the main queue
+	Queue string
+
+	// The host the queue is filtered to, or empty for the whole queue
+	Host string
+}
+
+// entries returns the queued requests that are listed, in the order they
+// were queued.
+func (e *reqListElement) entries() []proxyReq {
+	e.Proxy.reqMu.RLock()
+	defer e.Proxy.reqMu.RUnlock()
+	ret := make([]proxyReq, 0)
+	for _, pr := range *e.Data {
+		if pr.Queue == e.Queue && (e.Host == "" || pr.host() == e.Host) {
+			ret = append(ret, pr)
+		}
+	}
+	return ret
+}
+
+// position returns the position of the listed request with the given name, which
+// is its directory's name, its UUID or its position, or -1 if there's no such
+// request.
+func (e *reqListElement) position(entries []proxyReq, name string) int {
+	if i := queuePosition(len(entries), func(i int) uuid.UUID { return entries[i].ID }, name); i >= 0 {
+		return i
+	}
+	return e.Proxy.namedPosition(len(entries), func(i int) int64 { return entries[i].Seq },
+		func(i int) uuid.UUID { return entries[i].ID }, name)
 }
 
 func (e *reqListElement) GetNode(ctx context.Context, k string) (fusebox.VarNode, error) {
-	i, err := strconv.Atoi(k)
-	if err != nil || i >= len(*e.Data) {
-		return nil, fuse.EPERM
+	if k == "by-host" && e.Host == "" {
+		return newQueueHostsDir(e.Proxy, "req", e.Queue), nil
 	}
 
-	return newHTTPReqDir((*e.Data)[i].Req, (*e.Data)[i].Forward), nil
+	entries := e.entries()
+	if k == "index" {
+		return newReadOnlyFile(func() []byte {
+			buf := new(bytes.Buffer)
+			for _, pr := range e.entries() {
+				buf.WriteString(pr.indexLine())
+			}
+			return buf.Bytes()
+		}), nil
+	}
+
+	i := e.position(entries, k)
+	if i < 0 {
+		return nil, fuse.ENOENT
+	}
+
+	return e.Proxy.queuedReqDir(entries[i]), nil
 }
 
 func (*reqListElement) GetDirentType(ctx context.Context, k string) (fuse.DirentType, error) {
+	if k == "index" {
+		return fuse.DT_File, nil
+	}
 	return fuse.DT_Dir, nil
 }
 
 func (e *reqListElement) GetKeys(ctx context.Context) []string {
-	ret := make([]string, len(*e.Data))
-	for i := range ret {
-		ret[i] = strconv.Itoa(i)
+	entries := e.entries()
+	ret := make([]string, 0, len(entries)+2)
+	for _, pr := range entries {
+		ret = append(ret, e.Proxy.queuedReqName(pr))
+	}
+	ret = append(ret, "index")
+	if e.Host == "" {
+		ret = append(ret, "by-host")
 	}
-
 	return ret
 }
 
@@ -210,42 +344,100 @@ func (e *reqListElement) AddNode(name string, node interface{}) error {
 }
 
 func (e *reqListElement) RemoveNode(name string) error {
-	i, err := strconv.Atoi(name)
-	if err != nil || i >= len(*e.Data) {
+	entries := e.entries()
+	i := e.position(entries, name)
+	if i < 0 {
 		return fuse.ENOENT
 	}
 
-	(*e.Data)[i].Drop <- 1
+	release(entries[i].Drop)
 	return nil
 }
 
-func newReqListDir(l *[]proxyReq) *fusebox.Dir {
-	ret := fusebox.NewDir(&reqListElement{l})
+// newReqListDir returns the Dir listing the requests in the main queue, or in
+// the named queue given.
+func newReqListDir(p *Proxy, queue string) *fusebox.Dir {
+	ret := fusebox.NewDir(&reqListElement{Data: &p.Requests, Proxy: p, Queue: queue})
 	ret.Mode = os.ModeDir | 0666
 	return ret
 }
 
 type respListElement struct {
-	Data *[]proxyResp
+	Data  *[]proxyResp
+	Proxy *Proxy
+
+	// The named queue listed, or empty for the main queue
+	Queue string
+
+	// The host the queue is filtered to, or empty for the whole queue
+	Host string
+}
+
+// entries returns the queued responses that are listed, in the order they
+// were queued.
+func (e *respListElement) entries() []proxyResp {
+	e.Proxy.respMu.RLock()
+	defer e.Proxy.respMu.RUnlock()
+	ret := make([]proxyResp, 0)
+	for _, pr := range *e.Data {
+		if pr.Queue == e.Queue && (e.Host == "" || pr.host() == e.Host) {
+			ret = append(ret, pr)
+		}
+	}
+	return ret
+}
+
+// position returns the position of the listed response with the given name, which
+// is its directory's name, its UUID or its position, or -1 if there's no such
+// response.
+func (e *respListElement) position(entries []proxyResp, name string) int {
+	if i := queuePosition(len(entries), func(i int) uuid.UUID { return entries[i].ID }, name); i >= 0 {
+		return i
+	}
+	return e.Proxy.namedPosition(len(entries), func(i int) int64 { return entries[i].Seq },
+		func(i int) uuid.UUID { return entries[i].ID }, name)
 }
 
 func (e *respListElement) GetNode(ctx context.Context, k string) (fusebox.VarNode, error) {
-	i, err := strconv.Atoi(k)
-	if err != nil || i >= len(*e.Data) {
+	if k == "by-host" && e.Host == "" {
+		return newQueueHostsDir(e.Proxy, "resp", e.Queue), nil
+	}
+
+	entries := e.entries()
+	if k == "index" {
+		return newReadOnlyFile(func() []byte {
+			buf := new(bytes.Buffer)
+			for _, pr := range e.entries() {
+				buf.WriteString(pr.indexLine())
+			}
+			return buf.Bytes()
+		}), nil
+	}
+
+	i := e.position(entries, k)
+	if i < 0 {
 		return nil, fuse.ENOENT
 	}
 
-	return newHTTPRespDir((*e.Data)[i].Resp, (*e.Data)[i].Forward), nil
+	return e.Proxy.queuedRespDir(entries[i]), nil
 }
 
 func (*respListElement) GetDirentType(ctx context.Context, k string) (fuse.DirentType, error) {
+	if k == "index" {
+		return fuse.DT_File, nil
+	}
 	return fuse.DT_Dir, nil
 }
 
 func (e *respListElement) GetKeys(ctx context.Context) []string {
-	ret := make([]string, len(*e.Data))
-	for i := range ret {
-		ret[i] = strconv.Itoa(i)
+	entries := e.entries()
+	ret := make([]string, 0, len(entries)+2)
+	for _, pr := range entries {
+		ret = append(ret, e.Proxy.queuedRespName(pr))
+	}
+	ret = append(ret, "index")
+	if e.Host == "" {
+		ret = append(ret, "by-host")
 	}
 	return ret
 }
@@ -255,17 +447,20 @@ func (e *respListElement) AddNode(name string, node interface{}) error {
 }
 
 func (e *respListElement) RemoveNode(name string) error {
-	i, err := strconv.Atoi(name)
-	if err != nil || i >= len(*e.Data) {
+	entries := e.entries()
+	i := e.position(entries, name)
+	if i < 0 {
 		return fuse.ENOENT
 	}
 
-	(*e.Data)[i].Drop <- 1
+	release(entries[i].Drop)
 	return nil
 }
 
-func newRespListDir(l *[]proxyResp) *fusebox.Dir {
-	ret := fusebox.NewDir(&respListElement{l})
+// newRespListDir returns the Dir listing the responses in the main queue, or in
+// the named queue given.
+func newRespListDir(p *Proxy, queue string) *fusebox.Dir {
+	ret := fusebox.NewDir(&respListElement{Data: &p.Responses, Proxy: p, Queue: queue})
 	ret.Mode = os.ModeDir | 0666
 	return ret
 }
@@ -275,67 +470,114 @@ func newRespListDir(l *[]proxyResp) *fusebox.Dir {
 type httpBodyFile struct {
 	// A pointer to the actual Request or Response's body
 	Body *io.ReadCloser
+
+	// The message's headers and length fields, which are kept consistent
+	// with written bodies
+	Header           http.Header
+	ContentLength    *int64
+	TransferEncoding *[]string
+
+	// The settings giving the largest body that can be written, and whether
+	// surrounding whitespace is trimmed from written bodies. Bodies of any
+	// size are written byte for byte if this is nil.
+	Settings *settings
+
+	// The snippets that can be inserted into written bodies, or nil for none
+	Snippets *snippetSet
 }
 
 // Returns a new HTTPBodyFile that exposes and updates the given body, as well as
 // automatically updating the given content length.
-func newHTTPBodyFile(body *io.ReadCloser) *fusebox.File {
-	return fusebox.NewFile(&httpBodyFile{body})
-}
-
-// Read a copy of the body, and replace the original reader with a fresh one to allow
-// for future reading.
-func (bf *httpBodyFile) readCopy() ([]byte, error) {
-	buf := bytes.NewBuffer(make([]byte, 0))
-	tee := io.TeeReader(*bf.Body, buf)
-	data, err := ioutil.ReadAll(tee)
-	*bf.Body = ioutil.NopCloser(buf)
-
-	return data, err
+func newHTTPBodyFile(h http.Header, body *io.ReadCloser, contentLength *int64, transferEncoding *[]string, settings *settings, snippets *snippetSet) *handleFile {
+	ret := newHandleFile(&httpBodyFile{body, h, contentLength, transferEncoding, settings, snippets})
+	ret.SharedReads = true
+	return ret
 }
 
 func (bf *httpBodyFile) ValRead(ctx context.Context) ([]byte, error) {
-	data, err := bf.readCopy()
-	if err != nil {
-		return nil, fuse.EIO
+	if cb, ok := (*bf.Body).(*chunkedBody); ok {
+		return cb.Bytes(), nil
 	}
-
-	return data, nil
+	return spoolBody(bf.Body).Bytes(), nil
 }
 
 func (bf *httpBodyFile) ValWrite(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
 	// Update the data
-	b := bytes.TrimSpace(req.Data)
-	*bf.Body = ioutil.NopCloser(bytes.NewBuffer(b))
+	b := bf.Snippets.Expand(req.Data)
+	if bf.Settings != nil && bf.Settings.Get().TrimWrites {
+		b = bytes.TrimSpace(b)
+	}
+	if bodyTooBig(len(b), bf.Settings) {
+		return errTooBig
+	}
+	*bf.Body = newSpool(b).Reader()
+	bf.updateLength(len(b))
 
 	resp.Size = len(req.Data)
 	return nil
 }
 
 func (bf *httpBodyFile) Size(context.Context) (uint64, error) {
-	b, err := bf.readCopy()
-	if err != nil {
-		return 0, err
+	return uint64(bodyLen(bf.Body)), nil
+}
+
+// updateLength updates the message's length to match a written body of the
+// given size. Chunked messages stay chunked, and are chunked again as they're
+// sent, while others have their Content-Length set, so that the body isn't
+// cut short or waited on.
+func (bf *httpBodyFile) updateLength(size int) {
+	if bf.ContentLength == nil {
+		return
+	}
+	if bf.TransferEncoding != nil && containsString(*bf.TransferEncoding, "chunked") {
+		*bf.ContentLength = -1
+		bf.Header.Del("Content-Length")
+		return
+	}
+
+	*bf.ContentLength = int64(size)
+	if bf.Header != nil && (size > 0 || bf.Header.Get("Content-Length") != "") {
+		bf.Header.Set("Content-Length", strconv.Itoa(size))
+	}
+}
+
+// bodyTooBig returns whether a body of the given size is over the limit in
+// the settings. There's no limit if settings is nil.
+func bodyTooBig(size int, settings *settings) bool {
+	if settings == nil {
+		return false
 	}
-	return uint64(len(b)), nil
+	limit := settings.Get().MaxBody
+	return limit > 0 && int64(size) > limit
 }
 
 type headerElement struct {
-	Data *http.Header
+	Data     *http.Header
+	Snippets *snippetSet
+}
+
+// key returns the key a header is held under, which is the name given if the
+// header has it as is, and otherwise its canonical form, so that headers can
+// be created and looked up in any case.
+func (e *headerElement) key(name string) string {
+	if _, ok := (*e.Data)[name]; ok {
+		return name
+	}
+	return http.CanonicalHeaderKey(name)
 }
 
 func (e *headerElement) GetNode(ctx context.Context, k string) (fusebox.VarNode, error) {
-	h, ok := (*e.Data)[k]
-	if !ok {
+	k = e.key(k)
+	if _, ok := (*e.Data)[k]; !ok {
 		return nil, fuse.ENOENT
 	}
-	ret := fusebox.NewStringFile(&h[0])
+	ret := newValueFile(&snippetValue{&headerValues{e.Data, k}, e.Snippets})
 	ret.OpenFlags = fuse.OpenDirectIO
 	return ret, nil
 }
 
 func (e *headerElement) GetDirentType(ctx context.Context, k string) (fuse.DirentType, error) {
-	_, ok := (*e.Data)[k]
+	_, ok := (*e.Data)[e.key(k)]
 	if !ok {
 		return fuse.DT_Unknown, fuse.ENOENT
 	}
@@ -353,19 +595,72 @@ func (e *headerElement) GetKeys(ctx context.Context) []string {
 
 	return ret
 }
+
+// AddNode adds a header with an empty value, e.g. through touch, or when a
+// value is written to a new file.
 func (e *headerElement) AddNode(name string, node interface{}) error {
-	return fuse.EPERM
+	if name == "" || strings.ContainsAny(name, "/: \t\r\n") {
+		return fuse.EPERM
+	}
+	k := e.key(name)
+	if _, ok := (*e.Data)[k]; !ok {
+		if *e.Data == nil {
+			*e.Data = make(http.Header)
+		}
+		(*e.Data)[k] = []string{""}
+	}
+	return nil
 }
+
+// RemoveNode removes every value of a header, e.g. through rm.
 func (e *headerElement) RemoveNode(name string) error {
+	k := e.key(name)
+	if _, ok := (*e.Data)[k]; !ok {
+		return fuse.ENOENT
+	}
+	delete(*e.Data, k)
+	return nil
+}
+
+// headerValues exposes every value of a header, one per line, so that
+// repeated headers such as Set-Cookie can be read and edited as a whole.
+type headerValues struct {
+	Header *http.Header
+	Name   string
+}
+
+func (v *headerValues) ValRead(ctx context.Context) ([]byte, error) {
+	return []byte(strings.Join((*v.Header)[v.Name], "\n")), nil
+}
+
+func (v *headerValues) ValWrite(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+	if _, ok := (*v.Header)[v.Name]; !ok {
+		return errGone
+	}
+
+	vals := make([]string, 0)
+	for _, line := range strings.Split(string(req.Data), "\n") {
+		if line = strings.TrimRight(line, "\r"); line != "" {
+			vals = append(vals, line)
+		}
+	}
+	if len(vals) == 0 {
+		vals = append(vals, "")
+	}
+	(*v.Header)[v.Name] = vals
+
+	resp.Size = len(req.Data)
 	return nil
 }
 
 // Returns a new Dir that exposes the headers of a request or response, with
 // the name of the contained files being the header names, and their contents
-// being the header values. For now this is limited to just the first string
-// for a given key in http.Header
-func newHTTPHeaderDir(h *http.Header) *fusebox.Dir {
-	ret := fusebox.NewDir(&headerElement{h})
+// being the header values, one per line for headers given more than once.
+// Headers are added by creating files, and removed by removing them.
+// References to snippets in written values are expanded, if snippets isn't
+// nil.
+func newHTTPHeaderDir(h *http.Header, snippets *snippetSet) *fusebox.Dir {
+	ret := fusebox.NewDir(&headerElement{h, snippets})
 	ret.Mode = os.ModeDir | 0666
 	return ret
 }
@@ -374,18 +669,23 @@ func newHTTPHeaderDir(h *http.Header) *fusebox.Dir {
 // For limitations on reading, see
 // https://godoc.org/net/http/httputil#DumpRequest
 type httpReqRawFile struct {
-	Data *http.Request
+	Data     *http.Request
+	Settings *settings
+
+	// The lock guarding the request, which keeps its dump, or nil to dump
+	// it on each read
+	Lock *msgLock
 }
 
 // Return a HTTPReqRawFile for the given http.Request.
-func newHTTPReqRawFile(req *http.Request) *fusebox.File {
-	ret := fusebox.NewFile(&httpReqRawFile{Data: req})
+func newHTTPReqRawFile(req *http.Request, settings *settings, lock *msgLock) *handleFile {
+	ret := newHandleFile(&httpReqRawFile{Data: req, Settings: settings, Lock: lock})
 	ret.OpenFlags = fuse.OpenDirectIO
 	return ret
 }
 
 func (rf *httpReqRawFile) ValRead(ctx context.Context) ([]byte, error) {
-	data, err := httputil.DumpRequest(rf.Data, true)
+	data, err := rf.Lock.dumpRequest(rf.Data)
 	if err != nil {
 		return nil, fuse.EIO
 	}
@@ -397,7 +697,10 @@ func (rf *httpReqRawFile) ValWrite(ctx context.Context, req *fuse.WriteRequest,
 	buf := bufio.NewReader(bytes.NewReader(req.Data))
 	httpReq, err := http.ReadRequest(buf)
 	if err != nil {
-		return fuse.ERANGE
+		return errInvalid
+	}
+	if bodyTooBig(bodyLen(&httpReq.Body), rf.Settings) {
+		return errTooBig
 	}
 
 	*rf.Data = *httpReq
@@ -406,7 +709,7 @@ func (rf *httpReqRawFile) ValWrite(ctx context.Context, req *fuse.WriteRequest,
 }
 
 func (rf *httpReqRawFile) Size(context.Context) (uint64, error) {
-	data, err := httputil.DumpRequest(rf.Data, true)
+	data, err := rf.Lock.dumpRequest(rf.Data)
 	if err != nil {
 		return 0, fuse.EIO
 	}
@@ -418,18 +721,23 @@ func (rf *httpReqRawFile) Size(context.Context) (uint64, error) {
 // are the same as those for HTTPReqRawFile, which come from
 // https://godoc.org/net/http/httputil#DumpRequest
 type httpRespRawFile struct {
-	Data *http.Response
+	Data     *http.Response
+	Settings *settings
+
+	// The lock guarding the response, which keeps its dump, or nil to dump
+	// it on each read
+	Lock *msgLock
 }
 
 // Return a new HTTPRespRawFile for the given http.Response
-func newHTTPRespRawFile(resp *http.Response) *fusebox.File {
-	ret := fusebox.NewFile(&httpRespRawFile{Data: resp})
+func newHTTPRespRawFile(resp *http.Response, settings *settings, lock *msgLock) *handleFile {
+	ret := newHandleFile(&httpRespRawFile{Data: resp, Settings: settings, Lock: lock})
 	ret.OpenFlags = fuse.OpenDirectIO
 	return ret
 }
 
 func (rf *httpRespRawFile) ValRead(ctx context.Context) ([]byte, error) {
-	data, err := httputil.DumpResponse(rf.Data, true)
+	data, err := rf.Lock.dumpResponse(rf.Data)
 	if err != nil {
 		return nil, fuse.EIO
 	}
@@ -441,7 +749,10 @@ func (rf *httpRespRawFile) ValWrite(ctx context.Context, req *fuse.WriteRequest,
 	buf := bufio.NewReader(bytes.NewReader(req.Data))
 	httpResp, err := http.ReadResponse(buf, rf.Data.Request)
 	if err != nil {
-		return fuse.ERANGE
+		return errInvalid
+	}
+	if bodyTooBig(bodyLen(&httpResp.Body), rf.Settings) {
+		return errTooBig
 	}
 
 	*rf.Data = *httpResp
@@ -450,10 +761,173 @@ func (rf *httpRespRawFile) ValWrite(ctx context.Context, req *fuse.WriteRequest,
 }
 
 func (rf *httpRespRawFile) Size(context.Context) (uint64, error) {
-	data, err := httputil.DumpResponse(rf.Data, true)
+	data, err := rf.Lock.dumpResponse(rf.Data)
 	if err != nil {
 		return 0, fuse.EIO
 	}
 
 	return uint64(len(data)), nil
 }
+
+// A read-only file whose contents are generated by a function on each read.
+type readOnlyFile struct {
+	read func() []byte
+}
+
+// Returns a new read-only File whose contents are given by calling read.
+func newReadOnlyFile(read func() []byte) *fusebox.File {
+	ret := fusebox.NewFile(&readOnlyFile{read})
+	ret.Mode = 0444
+	ret.OpenFlags = fuse.OpenDirectIO
+	return ret
+}
+
+func (f *readOnlyFile) ValRead(ctx context.Context) ([]byte, error) {
+	return f.read(), nil
+}
+
+func (f *readOnlyFile) ValWrite(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+	return errReadOnly
+}
+
+func (f *readOnlyFile) Size(context.Context) (uint64, error) {
+	return uint64(len(f.read())), nil
+}
+
+// nodeDirElement is a DirElement holding a fixed set of nodes that are added by
+// the proxy itself. Nodes can't be added or removed through the filesystem.
+type nodeDirElement struct {
+	keys  []string
+	nodes map[string]fusebox.VarNode
+}
+
+// Returns a new Dir containing no nodes, along with its element which can be
+// used to add nodes.
+func newNodeDir() (*fusebox.Dir, *nodeDirElement) {
+	e := &nodeDirElement{nodes: make(map[string]fusebox.VarNode)}
+	ret := fusebox.NewDir(e)
+	ret.Mode = os.ModeDir | 0555
+	return ret, e
+}
+
+// add adds a node to the directory with the given name.
+func (e *nodeDirElement) add(name string, node fusebox.VarNode) {
+	if _, ok := e.nodes[name]; !ok {
+		e.keys = append(e.keys, name)
+	}
+	e.nodes[name] = node
+}
+
+func (e *nodeDirElement) GetNode(ctx context.Context, k string) (fusebox.VarNode, error) {
+	n, ok := e.nodes[k]
+	if !ok {
+		return nil, fuse.ENOENT
+	}
+
+	return n, nil
+}
+
+func (e *nodeDirElement) GetDirentType(ctx context.Context, k string) (fuse.DirentType, error) {
+	n, ok := e.nodes[k]
+	if !ok {
+		return fuse.DT_Unknown, fuse.ENOENT
+	}
+
+	return direntType(n), nil
+}
+
+func (e *nodeDirElement) GetKeys(ctx context.Context) []string {
+	return e.keys
+}
+
+func (*nodeDirElement) AddNode(name string, node interface{}) error {
+	return fuse.EPERM
+}
+
+func (*nodeDirElement) RemoveNode(name string) error {
+	return fuse.EPERM
+}
+
+// funcDirElement is a read-only DirElement whose contents are listed and created
+// by functions on demand, for directories that provide a view of other state.
+type funcDirElement struct {
+	keys func() []string
+	node func(k string) fusebox.VarNode
+}
+
+// Returns a new read-only Dir whose entries are listed by keys, and constructed
+// by node. node should return nil if there is no entry for the given key.
+func newFuncDir(keys func() []string, node func(k string) fusebox.VarNode) *fusebox.Dir {
+	ret := fusebox.NewDir(&funcDirElement{keys: keys, node: node})
+	ret.Mode = os.ModeDir | 0555
+	ret.OpenFlags = fuse.OpenDirectIO
+	return ret
+}
+
+func (e *funcDirElement) GetNode(ctx context.Context, k string) (fusebox.VarNode, error) {
+	if n := e.node(k); n != nil {
+		return n, nil
+	}
+
+	return nil, fuse.ENOENT
+}
+
+func (e *funcDirElement) GetDirentType(ctx context.Context, k string) (fuse.DirentType, error) {
+	n := e.node(k)
+	if n == nil {
+		return fuse.DT_Unknown, fuse.ENOENT
+	}
+
+	return direntType(n), nil
+}
+
+func (e *funcDirElement) GetKeys(ctx context.Context) []string {
+	return e.keys()
+}
+
+func (*funcDirElement) AddNode(name string, node interface{}) error {
+	return fuse.EPERM
+}
+
+func (*funcDirElement) RemoveNode(name string) error {
+	return fuse.EPERM
+}
+
+// direntType returns the directory entry type for the given node.
+func direntType(n fusebox.VarNode) fuse.DirentType {
+	switch n.(type) {
+	case fs.NodeStringLookuper, fs.NodeRequestLookuper:
+		return fuse.DT_Dir
+	}
+
+	return fuse.DT_File
+}
+
+// statDir wraps a Dir to report the number of entries it contains as its size
+// and link count, and the time it last changed as its modification time, so
+// that changes can be detected with a single stat rather than a listing.
+type statDir struct {
+	*fusebox.Dir
+	stat func() (int, time.Time)
+}
+
+// Returns a new statDir wrapping d, with its entry count and modification time
+// given by stat.
+func newStatDir(d *fusebox.Dir, stat func() (int, time.Time)) *statDir {
+	return &statDir{d, stat}
+}
+
+func (d *statDir) Attr(ctx context.Context, a *fuse.Attr) error {
+	if err := d.Dir.Attr(ctx, a); err != nil {
+		return err
+	}
+
+	n, mtime := d.stat()
+	a.Size = uint64(n)
+	a.Nlink = uint32(n + 2)
+	if !mtime.IsZero() {
+		a.Mtime = mtime
+		a.Ctime = mtime
+	}
+	return nil
+}
@@ -0,0 +1,40 @@
+package proxyfs
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/elazarl/goproxy"
+)
+
+// offlineHeader marks responses that were served from the history because
+// the target couldn't be reached, giving the entry they came from.
+const offlineHeader = "X-Proxyfs-Offline"
+
+// offlineRoundTrip sends a request upstream, answering it from the history
+// if the target can't be reached. The answer is the response of the most
+// recent entry with the same fingerprint, so that a demo can carry on while
+// the target, or the network, is down.
+func (p *Proxy) offlineRoundTrip(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Response, error) {
+	resp, err := p.roundTrip(req)
+	if err == nil || err == context.Canceled {
+		return resp, err
+	}
+
+	fingerprint := requestFingerprint(req)
+	entries := p.History.Entries()
+	for i := len(entries) - 1; i >= 0; i-- {
+		e := entries[i]
+		cached := e.Response()
+		if e.Fingerprint() != fingerprint || cached == nil || e == ctx.UserData {
+			continue
+		}
+
+		ret := snapshotResponse(cached, req)
+		ret.Header.Set(offlineHeader, fmt.Sprintf("history/%d", e.ID))
+		p.emitEvent("offline: answered %s %s from history/%d: %v", req.Method, req.URL, e.ID, err)
+		return ret, nil
+	}
+	return nil, err
+}
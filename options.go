@@ -0,0 +1,352 @@
+package proxyfs
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/danielthatcher/fusebox"
+)
+
+// Options configures a Proxy created with New. The zero value is a proxy on
+// 127.0.0.1:8080 intercepting everything, with its state kept in memory.
+type Options struct {
+	// The address to listen on, or unix:<path> for a unix socket, and the
+	// port to listen on for addresses. They default to 127.0.0.1 and 8080.
+	Listen string
+	Port   int
+
+	// A regex defining the scope of what to intercept. Defaults to the
+	// project's saved scope if there is one, else ".".
+	Scope string
+
+	// Host or URL patterns to include in and exclude from the scope, such as
+	// *.example.com, or regexes prefixed with '~', replacing the project's if
+	// given.
+	Include []string
+	Exclude []string
+
+	// The addresses of upstream proxies, failing over to the next when one
+	// is down.
+	Upstreams []string
+
+	// The URL, or unix:<path>, to act as a reverse proxy for, if any.
+	Reverse string
+
+	// The local address to make upstream connections from, if any.
+	BindOut net.IP
+
+	// The name of the project to keep the proxy's state in, if any.
+	Project string
+
+	// The files holding the certificate and key of the CA that signs
+	// intercepted HTTPS, generated if neither exists. Without them, the
+	// project's CA is used, or one generated for this run.
+	CACert string
+	CAKey  string
+
+	// The file to append the secrets of TLS connections to, if any.
+	KeyLog string
+
+	// Whether the queue responders are run. They run commands, and are
+	// saved with a project, so they're off unless asked for.
+	Responders bool
+
+	// Where to trace FUSE operations, if anywhere.
+	TraceFUSE io.Writer
+
+	// The store to keep the history and findings in, as bolt:<path> or
+	// sqlite:<path>, and the secret its key is derived from, if any.
+	Store       string
+	StoreSecret []byte
+
+	// Raw streams to forward, as listen=target. See ListenStreams.
+	Forwards []string
+
+	// The unix socket to serve the filesystem over SFTP on, if any, and the
+	// role of its clients. The role defaults to admin.
+	SFTP     string
+	SFTPRole string
+
+	// The address to serve liveness and readiness probes on, if any.
+	Probes string
+
+	// Paths to mount read-only copies of the filesystem at, and paths to
+	// mount it at for users with a role, given as path=role. UserRoles give
+	// users, as user=role, a role on shares in place of the share's.
+	Mirrors    []string
+	Shares     []string
+	UserRoles  []string
+	AllowOther bool
+}
+
+// serveConfig is what Serve runs, as parsed from the Options given to New.
+type serveConfig struct {
+	listen     string
+	upstreams  []*url.URL
+	forwards   []*streamForward
+	sftp       string
+	sftpRole   role
+	probes     string
+	mirrors    []string
+	shares     map[string]role
+	users      map[uint32]role
+	allowOther bool
+}
+
+// New returns a proxy configured by the given options, resuming its project
+// and loading its store if it has them. The proxy doesn't listen or mount the
+// filesystem until Serve and Mount are called.
+func New(opts Options) (*Proxy, error) {
+	cfg, err := parseOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+	if (opts.CACert == "") != (opts.CAKey == "") {
+		return nil, fmt.Errorf("the CA's certificate and key must be given together")
+	}
+
+	// A project's saved scope is used unless another is given
+	var proj *project
+	scope := opts.Scope
+	if opts.Project != "" {
+		if proj, err = openProject(opts.Project); err != nil {
+			return nil, err
+		}
+		if s, ok := proj.Scope(); ok && scope == "" {
+			scope = s
+		}
+	}
+	if scope == "" {
+		scope = "."
+	}
+
+	p, err := NewProxy(scope)
+	if err != nil {
+		return nil, err
+	}
+	p.serve = cfg
+	if strings.HasPrefix(opts.Reverse, unixPrefix) {
+		p.Reverse = p.unixTarget(strings.TrimPrefix(opts.Reverse, unixPrefix))
+	} else if opts.Reverse != "" {
+		if p.Reverse, err = url.Parse(opts.Reverse); err != nil {
+			return nil, err
+		}
+	}
+	p.Settings.Set(func(v *settingValues) {
+		v.BindOut = opts.BindOut
+	})
+	p.Responders.Enabled = opts.Responders
+
+	if opts.TraceFUSE != nil {
+		p.FuseTrace = newFuseTracer(opts.TraceFUSE)
+	}
+	if opts.KeyLog != "" {
+		if err := p.OpenKeyLog(opts.KeyLog); err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.Store != "" {
+		s, err := openStore(opts.Store, opts.StoreSecret)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open store: %v", err)
+		}
+		p.store = s
+		if err := p.SetStore(s); err != nil {
+			return nil, fmt.Errorf("failed to load store: %v", err)
+		}
+	}
+
+	if proj != nil {
+		if err := p.SetProject(proj); err != nil {
+			return nil, fmt.Errorf("failed to open project %s: %v", proj.Name, err)
+		}
+		go p.autosaveProject(time.Minute)
+	}
+
+	// Scope patterns given replace the project's include and exclude lists
+	if len(opts.Include) > 0 {
+		if err := p.ScopeInclude.Replace(scopePatternRules(opts.Include)); err != nil {
+			return nil, fmt.Errorf("invalid include pattern: %v", err)
+		}
+	}
+	if len(opts.Exclude) > 0 {
+		if err := p.ScopeExclude.Replace(scopePatternRules(opts.Exclude)); err != nil {
+			return nil, fmt.Errorf("invalid exclude pattern: %v", err)
+		}
+	}
+
+	// Intercepted HTTPS is signed by the given CA, else the project's, else
+	// one generated for this run
+	if opts.CACert != "" {
+		ca, err := loadCA(opts.CACert, opts.CAKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load CA: %v", err)
+		}
+		p.SetCA(ca)
+	} else if proj == nil {
+		ca, err := newInstanceCA()
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate CA: %v", err)
+		}
+		p.SetCA(ca)
+	}
+
+	// The parts that have to be up before the proxy is ready
+	p.Readiness.Expect("proxy")
+	if cfg.sftp != "" {
+		p.Readiness.Expect("sftp")
+	}
+	return p, nil
+}
+
+// parseOptions validates the options that configure what Serve runs.
+func parseOptions(opts Options) (serveConfig, error) {
+	cfg := serveConfig{
+		sftp:       opts.SFTP,
+		probes:     opts.Probes,
+		mirrors:    opts.Mirrors,
+		shares:     make(map[string]role),
+		users:      make(map[uint32]role),
+		allowOther: opts.AllowOther,
+	}
+
+	cfg.listen = opts.Listen
+	if cfg.listen == "" {
+		cfg.listen = "127.0.0.1"
+	}
+	if !strings.HasPrefix(cfg.listen, unixPrefix) {
+		if net.ParseIP(cfg.listen) == nil {
+			return cfg, fmt.Errorf("invalid listen address: %s", cfg.listen)
+		}
+		port := opts.Port
+		if port == 0 {
+			port = 8080
+		}
+		cfg.listen = net.JoinHostPort(cfg.listen, strconv.Itoa(port))
+	}
+
+	for _, up := range opts.Upstreams {
+		u, err := url.Parse(up)
+		if err != nil {
+			return cfg, err
+		}
+		cfg.upstreams = append(cfg.upstreams, u)
+	}
+	for _, f := range opts.Forwards {
+		sf, err := parseStreamForward(f)
+		if err != nil {
+			return cfg, err
+		}
+		cfg.forwards = append(cfg.forwards, sf)
+	}
+
+	for _, s := range opts.Shares {
+		path, r, err := parseShare(s)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid share: %v", err)
+		}
+		cfg.shares[path] = r
+	}
+	for _, s := range opts.UserRoles {
+		uid, r, err := parseUserRole(s)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid user role: %v", err)
+		}
+		cfg.users[uid] = r
+	}
+	cfg.sftpRole = roleAdmin
+	if opts.SFTPRole != "" {
+		r, err := parseRole(opts.SFTPRole)
+		if err != nil {
+			return cfg, err
+		}
+		cfg.sftpRole = r
+	}
+	return cfg, nil
+}
+
+// Serve runs the proxy, along with the probes, raw stream forwards, SFTP
+// server, mirrors and shares given in its options, until one of them fails.
+func (p *Proxy) Serve() error {
+	cfg := p.serve
+	errs := make(chan error, 1)
+	run := func(what string, fn func() error) {
+		go func() {
+			if err := fn(); err != nil {
+				select {
+				case errs <- fmt.Errorf("%s: %v", what, err):
+				default:
+				}
+			}
+		}()
+	}
+
+	if cfg.probes != "" {
+		run("failed to serve probes", func() error {
+			return p.ServeProbes(cfg.probes)
+		})
+	}
+	for _, m := range cfg.mirrors {
+		m := m
+		run("failed to mount mirror at "+m, func() error {
+			return p.MountWith(m, mountPolicy{ReadOnly: true, AllowOther: cfg.allowOther, Role: roleObserver})
+		})
+	}
+	for m, r := range cfg.shares {
+		// Shares are only mounted read-only if nobody can change anything
+		readOnly := r == roleObserver
+		for _, ur := range cfg.users {
+			readOnly = readOnly && ur == roleObserver
+		}
+		policy := mountPolicy{ReadOnly: readOnly, AllowOther: cfg.allowOther, Role: r, Users: cfg.users}
+		m := m
+		run("failed to mount share at "+m, func() error {
+			return p.MountWith(m, policy)
+		})
+	}
+	for _, f := range cfg.forwards {
+		f := f
+		run(fmt.Sprintf("failed to forward %s to %s", f.Listen, f.Target), func() error {
+			return p.ListenStreams(f)
+		})
+	}
+	if cfg.sftp != "" {
+		run("failed to serve SFTP", func() error {
+			return p.ListenSFTP(cfg.sftp, cfg.sftpRole)
+		})
+	}
+	run("failed to serve proxy", func() error {
+		return p.ListenAndServe(cfg.listen, cfg.upstreams)
+	})
+	return <-errs
+}
+
+// Close saves the project, closes the store and unmounts the filesystem,
+// logging anything that fails, before the program embedding the proxy exits.
+func (p *Proxy) Close() {
+	if err := p.SaveProject(); err != nil {
+		log.Printf("Failed to save project: %v\n", err)
+	}
+	if p.store != nil {
+		if err := p.store.Close(); err != nil {
+			log.Printf("Failed to close store: %v\n", err)
+		}
+	}
+	if err := p.Unmount(); err != nil {
+		log.Printf("Failed to properly unmount: %v\n", err)
+	}
+}
+
+// AddNode adds a node to the root of the filesystem, alongside the proxy's
+// own, so that programs embedding the proxy can expose their own files and
+// controls through it.
+func (p *Proxy) AddNode(name string, node fusebox.VarNode) error {
+	return p.root.AddNode(name, node)
+}
@@ -0,0 +1,193 @@
+package proxyfs
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/textproto"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+
+	"bazil.org/fuse"
+	"github.com/danielthatcher/fusebox"
+)
+
+// statusOverride is a replacement body and set of headers for responses with
+// a given status code.
+type statusOverride struct {
+	mu      sync.RWMutex
+	Body    []byte
+	Headers []byte
+}
+
+// Apply replaces the body of the response, and sets any configured headers,
+// expanding references to variables in both.
+func (o *statusOverride) Apply(r *http.Response, vars *varSet) {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+
+	r.Header.Del("Content-Encoding")
+	for k, v := range parseHeaderBlock(vars.Expand(o.Headers)) {
+		r.Header[k] = v
+	}
+
+	body := vars.Expand(o.Body)
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+	r.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	r.TransferEncoding = nil
+}
+
+// parseHeaderBlock parses headers in the format "Name: value", one per line.
+// It returns nil if they can't be parsed.
+func parseHeaderBlock(data []byte) http.Header {
+	data = bytes.TrimSpace(data)
+	if len(data) == 0 {
+		return http.Header{}
+	}
+
+	r := textproto.NewReader(bufio.NewReader(bytes.NewReader(append(data, "\r\n\r\n"...))))
+	h, err := r.ReadMIMEHeader()
+	if err != nil {
+		return nil
+	}
+	return http.Header(h)
+}
+
+// statusOverrides holds the response overrides configured for each status
+// code, which replace any in scope response with that status.
+type statusOverrides struct {
+	mu        sync.RWMutex
+	overrides map[int]*statusOverride
+}
+
+func newStatusOverrides() *statusOverrides {
+	return &statusOverrides{overrides: make(map[int]*statusOverride)}
+}
+
+// Get returns the override for the given status code, or nil if there is none.
+func (s *statusOverrides) Get(code int) *statusOverride {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.overrides[code]
+}
+
+func (s *statusOverrides) GetNode(ctx context.Context, k string) (fusebox.VarNode, error) {
+	code, err := strconv.Atoi(k)
+	if err != nil {
+		return nil, fuse.ENOENT
+	}
+	o := s.Get(code)
+	if o == nil {
+		return nil, fuse.ENOENT
+	}
+
+	ret, d := newNodeDir()
+	ret.Mode = os.ModeDir | 0755
+	d.add("body", newHandleFile(&overrideFile{o, &o.Body, false}))
+	d.add("headers", newHandleFile(&overrideFile{o, &o.Headers, true}))
+	return ret, nil
+}
+
+func (s *statusOverrides) GetDirentType(ctx context.Context, k string) (fuse.DirentType, error) {
+	code, err := strconv.Atoi(k)
+	if err != nil || s.Get(code) == nil {
+		return fuse.DT_Unknown, fuse.ENOENT
+	}
+	return fuse.DT_Dir, nil
+}
+
+func (s *statusOverrides) GetKeys(ctx context.Context) []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	codes := make([]int, 0, len(s.overrides))
+	for c := range s.overrides {
+		codes = append(codes, c)
+	}
+	sort.Ints(codes)
+
+	ret := make([]string, len(codes))
+	for i, c := range codes {
+		ret[i] = strconv.Itoa(c)
+	}
+	return ret
+}
+
+// AddNode creates a new, empty override for the status code given by name,
+// e.g. through mkdir.
+func (s *statusOverrides) AddNode(name string, node interface{}) error {
+	code, err := strconv.Atoi(name)
+	if err != nil || code < 100 || code > 999 {
+		return fuse.EPERM
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.overrides[code]; !ok {
+		s.overrides[code] = &statusOverride{}
+	}
+	return nil
+}
+
+func (s *statusOverrides) RemoveNode(name string) error {
+	code, err := strconv.Atoi(name)
+	if err != nil {
+		return fuse.ENOENT
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.overrides[code]; !ok {
+		return fuse.ENOENT
+	}
+	delete(s.overrides, code)
+	return nil
+}
+
+// newOverridesDir returns the Dir holding the response overrides.
+func newOverridesDir(s *statusOverrides) *fusebox.Dir {
+	status := fusebox.NewDir(s)
+	status.Mode = os.ModeDir | 0777
+	status.OpenFlags = fuse.OpenDirectIO
+
+	ret, d := newNodeDir()
+	d.add("status", status)
+	return ret
+}
+
+// overrideFile exposes either the body or the headers of an override.
+type overrideFile struct {
+	Override *statusOverride
+	Data     *[]byte
+	Headers  bool
+}
+
+func (f *overrideFile) ValRead(ctx context.Context) ([]byte, error) {
+	f.Override.mu.RLock()
+	defer f.Override.mu.RUnlock()
+	return *f.Data, nil
+}
+
+func (f *overrideFile) ValWrite(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+	if f.Headers && parseHeaderBlock(req.Data) == nil {
+		return errInvalid
+	}
+
+	f.Override.mu.Lock()
+	*f.Data = append([]byte(nil), req.Data...)
+	f.Override.mu.Unlock()
+
+	resp.Size = len(req.Data)
+	return nil
+}
+
+func (f *overrideFile) Size(ctx context.Context) (uint64, error) {
+	f.Override.mu.RLock()
+	defer f.Override.mu.RUnlock()
+	return uint64(len(*f.Data)), nil
+}
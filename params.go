@@ -0,0 +1,190 @@
+package proxyfs
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"bazil.org/fuse"
+	"github.com/danielthatcher/fusebox"
+)
+
+// queryParam is a parameter in a URL's query. Raw is how it appears in the
+// query, so that parameters that aren't changed keep their encoding.
+type queryParam struct {
+	Name  string
+	Value string
+	Raw   string
+}
+
+// newQueryParam returns a parameter with the given name and value, encoded
+// for a query.
+func newQueryParam(name, value string) queryParam {
+	return queryParam{name, value, url.QueryEscape(name) + "=" + url.QueryEscape(value)}
+}
+
+// parseQueryParams splits a raw query into its parameters, in order, with
+// their names and values decoded. Those that can't be decoded are kept as they
+// are.
+func parseQueryParams(raw string) []queryParam {
+	ret := make([]queryParam, 0)
+	for _, part := range strings.Split(raw, "&") {
+		if part == "" {
+			continue
+		}
+		p := queryParam{Raw: part}
+		p.Name, p.Value = part, ""
+		if i := strings.Index(part, "="); i >= 0 {
+			p.Name, p.Value = part[:i], part[i+1:]
+		}
+		if n, err := url.QueryUnescape(p.Name); err == nil {
+			p.Name = n
+		}
+		if v, err := url.QueryUnescape(p.Value); err == nil {
+			p.Value = v
+		}
+		ret = append(ret, p)
+	}
+	return ret
+}
+
+// encodeQueryParams joins parameters into a raw query.
+func encodeQueryParams(params []queryParam) string {
+	raw := make([]string, len(params))
+	for i, p := range params {
+		raw[i] = p.Raw
+	}
+	return strings.Join(raw, "&")
+}
+
+// validParamName returns whether a parameter can be exposed as a file named
+// after it.
+func validParamName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.Contains(name, "/")
+}
+
+// queryParamsElement exposes the parameters in a request's query, a file each
+// named by the parameter's decoded name and holding its decoded value. Where a
+// parameter is given more than once, the file holds the first. Creating a file
+// adds a parameter to the end of the query, and removing one removes every
+// parameter with its name.
+type queryParamsElement struct {
+	Data     *http.Request
+	Snippets *snippetSet
+}
+
+// params returns the parameters in the request's query.
+func (e *queryParamsElement) params() []queryParam {
+	return parseQueryParams(e.Data.URL.RawQuery)
+}
+
+// setParams replaces the parameters in the request's query.
+func (e *queryParamsElement) setParams(params []queryParam) {
+	e.Data.URL.RawQuery = encodeQueryParams(params)
+	e.Data.URL.ForceQuery = false
+}
+
+// findQueryParam returns the position of the first parameter with the given
+// name, or -1 if there is none.
+func findQueryParam(params []queryParam, name string) int {
+	for i, p := range params {
+		if p.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+func (e *queryParamsElement) GetNode(ctx context.Context, k string) (fusebox.VarNode, error) {
+	if findQueryParam(e.params(), k) < 0 {
+		return nil, fuse.ENOENT
+	}
+	return newValueFile(&snippetValue{&queryParamValue{e, k}, e.Snippets}), nil
+}
+
+func (e *queryParamsElement) GetDirentType(ctx context.Context, k string) (fuse.DirentType, error) {
+	if findQueryParam(e.params(), k) < 0 {
+		return fuse.DT_Unknown, fuse.ENOENT
+	}
+	return fuse.DT_File, nil
+}
+
+func (e *queryParamsElement) GetKeys(ctx context.Context) []string {
+	seen := make(map[string]bool)
+	ret := make([]string, 0)
+	for _, p := range e.params() {
+		if validParamName(p.Name) && !seen[p.Name] {
+			seen[p.Name] = true
+			ret = append(ret, p.Name)
+		}
+	}
+	return ret
+}
+
+// AddNode adds an empty parameter with the given name, e.g. through touch.
+func (e *queryParamsElement) AddNode(name string, node interface{}) error {
+	if !validParamName(name) {
+		return fuse.EPERM
+	}
+	params := e.params()
+	if findQueryParam(params, name) < 0 {
+		e.setParams(append(params, newQueryParam(name, "")))
+	}
+	return nil
+}
+
+func (e *queryParamsElement) RemoveNode(name string) error {
+	params := e.params()
+	if findQueryParam(params, name) < 0 {
+		return fuse.ENOENT
+	}
+	kept := params[:0]
+	for _, p := range params {
+		if p.Name != name {
+			kept = append(kept, p)
+		}
+	}
+	e.setParams(kept)
+	return nil
+}
+
+// queryParamValue is the value of the first parameter in a query with a given
+// name.
+type queryParamValue struct {
+	Params *queryParamsElement
+	Name   string
+}
+
+func (v *queryParamValue) ValRead(ctx context.Context) ([]byte, error) {
+	params := v.Params.params()
+	i := findQueryParam(params, v.Name)
+	if i < 0 {
+		return nil, errGone
+	}
+	return []byte(params[i].Value), nil
+}
+
+func (v *queryParamValue) ValWrite(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+	params := v.Params.params()
+	i := findQueryParam(params, v.Name)
+	if i < 0 {
+		return errGone
+	}
+	params[i] = newQueryParam(v.Name, string(req.Data))
+	v.Params.setParams(params)
+	resp.Size = len(req.Data)
+	return nil
+}
+
+// newParamsDir returns the Dir exposing the parameters of a request.
+func newParamsDir(req *http.Request, snippets *snippetSet) *fusebox.Dir {
+	query := fusebox.NewDir(&queryParamsElement{req, snippets})
+	query.Mode = os.ModeDir | 0666
+	query.OpenFlags = fuse.OpenDirectIO
+
+	ret, d := newNodeDir()
+	d.add("query", query)
+	return ret
+}
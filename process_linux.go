@@ -0,0 +1,112 @@
+//go:build linux
+// +build linux
+
+package proxyfs
+
+import (
+	"bufio"
+	"encoding/hex"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// lookupProcess finds the process owning the local TCP socket bound to addr by
+// finding the socket's inode in /proc/net/tcp{,6}, and then searching the file
+// descriptors of running processes for that inode.
+func lookupProcess(addr string) (int, string) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return 0, ""
+	}
+	ip := net.ParseIP(host)
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if ip == nil || err != nil {
+		return 0, ""
+	}
+
+	inode := ""
+	for _, f := range []string{"/proc/net/tcp", "/proc/net/tcp6"} {
+		if inode = findSocketInode(f, ip, uint16(port)); inode != "" {
+			break
+		}
+	}
+	if inode == "" {
+		return 0, ""
+	}
+
+	target := "socket:[" + inode + "]"
+	fds, _ := filepath.Glob("/proc/[0-9]*/fd/*")
+	for _, fd := range fds {
+		link, err := os.Readlink(fd)
+		if err != nil || link != target {
+			continue
+		}
+
+		pidDir := filepath.Dir(filepath.Dir(fd))
+		pid, err := strconv.Atoi(filepath.Base(pidDir))
+		if err != nil {
+			continue
+		}
+
+		comm, _ := ioutil.ReadFile(filepath.Join(pidDir, "comm"))
+		return pid, strings.TrimSpace(string(comm))
+	}
+
+	return 0, ""
+}
+
+// findSocketInode returns the inode of the socket in the given /proc/net table
+// with a local address of ip:port, or an empty string if there is none.
+func findSocketInode(table string, ip net.IP, port uint16) string {
+	f, err := os.Open(table)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	s.Scan() // Skip the header
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) < 10 {
+			continue
+		}
+
+		lip, lport, ok := parseProcNetAddr(fields[1])
+		if !ok || lport != port || !lip.Equal(ip) {
+			continue
+		}
+
+		return fields[9]
+	}
+
+	return ""
+}
+
+// parseProcNetAddr parses an address in the format used by /proc/net/tcp,
+// i.e. a hex IP, stored as host byte order 32 bit words, and a hex port.
+func parseProcNetAddr(s string) (net.IP, uint16, bool) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 2 {
+		return nil, 0, false
+	}
+
+	raw, err := hex.DecodeString(parts[0])
+	if err != nil || (len(raw) != net.IPv4len && len(raw) != net.IPv6len) {
+		return nil, 0, false
+	}
+	for i := 0; i < len(raw); i += 4 {
+		raw[i], raw[i+1], raw[i+2], raw[i+3] = raw[i+3], raw[i+2], raw[i+1], raw[i]
+	}
+
+	port, err := strconv.ParseUint(parts[1], 16, 16)
+	if err != nil {
+		return nil, 0, false
+	}
+
+	return net.IP(raw), uint16(port), true
+}
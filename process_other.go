@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package proxyfs
+
+// lookupProcess is only supported on Linux, where /proc/net can be used to map
+// sockets to processes.
+func lookupProcess(addr string) (int, string) {
+	return 0, ""
+}
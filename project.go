@@ -0,0 +1,433 @@
+package proxyfs
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"bazil.org/fuse"
+	"github.com/danielthatcher/fusebox"
+)
+
+// project is a named engagement whose state is kept in its own directory, so
+// that engagements on the same machine don't share history, certificates or
+// settings, and can each be resumed later.
+type project struct {
+	Name string
+	Dir  string
+}
+
+// The files in a project's directory
+const (
+	projectCAFile       = "ca.pem"
+	projectScopeFile    = "scope"
+	projectSettingsFile = "settings.json"
+	projectHistoryFile  = "history.jsonl"
+	projectAuditFile    = "audit.jsonl"
+	projectFrozenDir    = "frozen"
+)
+
+// projectsRoot returns the directory holding every project, which is under
+// $XDG_DATA_HOME, or ~/.local/share if it isn't set.
+func projectsRoot() (string, error) {
+	data := os.Getenv("XDG_DATA_HOME")
+	if data == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		data = filepath.Join(home, ".local", "share")
+	}
+	return filepath.Join(data, "proxyfs", "projects"), nil
+}
+
+// openProject returns the project with the given name, creating its directory
+// if it doesn't exist.
+func openProject(name string) (*project, error) {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return nil, fmt.Errorf("invalid project name %q", name)
+	}
+	root, err := projectsRoot()
+	if err != nil {
+		return nil, err
+	}
+
+	dir := filepath.Join(root, name)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &project{Name: name, Dir: dir}, nil
+}
+
+func (pr *project) path(file string) string {
+	return filepath.Join(pr.Dir, file)
+}
+
+// Scope returns the scope regex patterns saved in the project, one per line,
+// if there are any.
+func (pr *project) Scope() (string, bool) {
+	data, err := ioutil.ReadFile(pr.path(projectScopeFile))
+	if err != nil {
+		return "", false
+	}
+	return strings.TrimSpace(string(data)), true
+}
+
+// CA returns the project's CA certificate and key, generating them the first
+// time. Each project has its own CA, so trusting one project's certificate
+// doesn't trust any other's.
+func (pr *project) CA() (tls.Certificate, error) {
+	data, err := ioutil.ReadFile(pr.path(projectCAFile))
+	if os.IsNotExist(err) {
+		data, err = generateCA("proxyfs " + pr.Name)
+		if err == nil {
+			err = ioutil.WriteFile(pr.path(projectCAFile), data, 0600)
+		}
+	}
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	return parseCA(data, data)
+}
+
+// CACert returns the PEM encoded certificate of the project's CA, without
+// its key, for installing in clients.
+func (pr *project) CACert() []byte {
+	data, err := ioutil.ReadFile(pr.path(projectCAFile))
+	if err != nil {
+		return nil
+	}
+
+	cert, _ := splitPEM(data)
+	return cert
+}
+
+// generateCA returns a new self signed CA certificate and its private key,
+// PEM encoded in a single file.
+func generateCA(name string) ([]byte, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: name, Organization: []string{"proxyfs"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := new(bytes.Buffer)
+	pem.Encode(buf, &pem.Block{Type: "CERTIFICATE", Bytes: der})
+	pem.Encode(buf, &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	return buf.Bytes(), nil
+}
+
+// projectRules are the rule lists saved with a project, by file name.
+func (p *Proxy) projectRules() map[string]fusebox.FileElement {
+	return map[string]fusebox.FileElement{
+		"highlight":     p.Highlight,
+		"prefixes":      p.Prefixes,
+		"retention":     p.Retention,
+		"redact":        p.Redaction,
+		"signing":       p.Signing,
+		"digests":       p.Digests,
+		"include":       p.ScopeInclude,
+		"exclude":       p.ScopeExclude,
+		"hosts":         p.DNS.Overrides,
+		"baseline":      p.Baseline,
+		"offline":       p.Offline,
+		"mirror":        p.Mirror.Rules,
+		"routes":        p.Routes,
+		"resend":        p.ResendSafe,
+		"queues":        p.Queues,
+		"filter-method": p.Filters.Method,
+		"filter-type":   p.Filters.ContentType,
+		"filter-status": p.Filters.Status,
+		"filter-ext":    p.Filters.Extension,
+		"responders":    p.Responders,
+		"sessions":      p.Sessions.Rules,
+		"dir-names":     p.DirNames,
+	}
+}
+
+// savedEntry is a history entry as saved in a project. The request and
+// response are saved as they were sent over the wire.
+type savedEntry struct {
+	Time     time.Time     `json:"time"`
+	URL      string        `json:"url"`
+	Client   string        `json:"client"`
+	Labels   []string      `json:"labels,omitempty"`
+	Notes    string        `json:"notes,omitempty"`
+	Latency  time.Duration `json:"latency,omitempty"`
+	Aborted  bool          `json:"aborted,omitempty"`
+	Route    string        `json:"route,omitempty"`
+	Session  string        `json:"session,omitempty"`
+	Request  []byte        `json:"request"`
+	Response []byte        `json:"response,omitempty"`
+}
+
+// SetProject switches the proxy to the given project, using its CA for
+// intercepted HTTPS and loading any state it has saved.
+func (p *Proxy) SetProject(pr *project) error {
+	ca, err := pr.CA()
+	if err != nil {
+		return fmt.Errorf("loading CA: %v", err)
+	}
+	p.SetCA(ca)
+	p.Project = pr
+
+	// Settings and rules
+	if data, err := ioutil.ReadFile(pr.path(projectSettingsFile)); err == nil {
+		if err := json.Unmarshal(data, p.Settings); err != nil {
+			return fmt.Errorf("loading settings: %v", err)
+		}
+	}
+	for name, rules := range p.projectRules() {
+		data, err := ioutil.ReadFile(pr.path(name))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		req := &fuse.WriteRequest{Data: data}
+		if err := rules.ValWrite(context.Background(), req, &fuse.WriteResponse{}); err != nil {
+			return fmt.Errorf("loading %s: %v", name, err)
+		}
+	}
+
+	// History and the audit log, unless they're kept in a store
+	if p.History.store != nil {
+		return nil
+	}
+	if err := p.Audit.SetFile(pr.path(projectAuditFile)); err != nil {
+		return err
+	}
+	f, err := os.Open(pr.path(projectHistoryFile))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	s.Buffer(nil, 1<<30)
+	for s.Scan() {
+		var saved savedEntry
+		if err := json.Unmarshal(s.Bytes(), &saved); err != nil {
+			return fmt.Errorf("loading history: %v", err)
+		}
+		if err := p.restoreEntry(&saved); err != nil {
+			return fmt.Errorf("loading history: %v", err)
+		}
+	}
+	return s.Err()
+}
+
+// restoreEntry adds a saved entry to the end of the history, and its
+// resource to the sitemap.
+func (p *Proxy) restoreEntry(saved *savedEntry) error {
+	e, err := loadEntry(saved)
+	if err != nil {
+		return err
+	}
+	if resp := e.Response(); resp != nil {
+		p.Sitemap.Add(e.Req.URL, resp.StatusCode, "history")
+	}
+	p.History.Restore(e)
+	return nil
+}
+
+// loadEntry returns the history entry that was saved as the given entry.
+func loadEntry(saved *savedEntry) (*historyEntry, error) {
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(saved.Request)))
+	if err != nil {
+		return nil, err
+	}
+	if req.URL, err = url.Parse(saved.URL); err != nil {
+		return nil, err
+	}
+	req.RequestURI = ""
+
+	e := &historyEntry{
+		Time:    saved.Time,
+		Req:     snapshotRequest(req),
+		Client:  newClientInfo(saved.Client),
+		labels:  saved.Labels,
+		notes:   []byte(saved.Notes),
+		latency: saved.Latency,
+		aborted: saved.Aborted,
+		route:   saved.Route,
+		session: saved.Session,
+	}
+	e.fingerprint = requestFingerprint(e.Req)
+	if len(saved.Response) > 0 {
+		resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(saved.Response)), e.Req)
+		if err != nil {
+			return nil, err
+		}
+		e.Resp = snapshotResponse(resp, e.Req)
+	}
+	return e, nil
+}
+
+// SaveProject writes the proxy's settings, rules and history to its project,
+// if it has one.
+func (p *Proxy) SaveProject() error {
+	pr := p.Project
+	if pr == nil {
+		return nil
+	}
+
+	scope, _ := p.ScopeRegex.ValRead(context.Background())
+	if err := writeFileAtomic(pr.path(projectScopeFile), scope); err != nil {
+		return err
+	}
+	settings, err := json.MarshalIndent(p.Settings, "", "\t")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(pr.path(projectSettingsFile), settings); err != nil {
+		return err
+	}
+	for name, rules := range p.projectRules() {
+		data, err := rules.ValRead(context.Background())
+		if err != nil {
+			return err
+		}
+		if err := writeFileAtomic(pr.path(name), data); err != nil {
+			return err
+		}
+	}
+
+	// A store saves the history as it changes
+	if p.History.store != nil {
+		return nil
+	}
+	buf := new(bytes.Buffer)
+	enc := json.NewEncoder(buf)
+	for _, e := range p.History.Entries() {
+		if err := enc.Encode(saveEntry(e, p.Redaction)); err != nil {
+			return err
+		}
+	}
+	return writeFileAtomic(pr.path(projectHistoryFile), buf.Bytes())
+}
+
+// saveEntry returns the given history entry in the form it's saved in, with
+// the given redaction rules applied.
+func saveEntry(e *historyEntry, redact *redactionRules) *savedEntry {
+	u := redact.URL(e.Req.URL)
+	ret := &savedEntry{
+		Time:    e.Time,
+		URL:     u.String(),
+		Client:  e.Client.Addr,
+		Labels:  e.Labels(),
+		Notes:   string(e.Notes()),
+		Latency: e.Latency(),
+		Aborted: e.Aborted(),
+		Route:   e.Route(),
+		Session: e.Session(),
+	}
+
+	// The snapshots are shared, so are dumped from copies with their own body.
+	// Client requests don't necessarily have a Content-Length header, which is
+	// needed to read the body back, and redaction can change its length.
+	req := *e.Req
+	req.URL = u
+	req.Header = redact.Header(req.Header)
+	orig := peekBody(&e.Req.Body)
+	body := redact.Body(orig)
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	if len(req.TransferEncoding) == 0 && len(body) > 0 && (req.Header.Get("Content-Length") == "" || len(body) != len(orig)) {
+		req.Header = req.Header.Clone()
+		req.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	}
+	ret.Request, _ = httputil.DumpRequest(&req, true)
+	if r := e.Response(); r != nil {
+		resp := *r
+		resp.Header = redact.Header(r.Header)
+		body := redact.Body(peekBody(&r.Body))
+		resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+		if resp.ContentLength >= 0 {
+			resp.ContentLength = int64(len(body))
+		}
+		ret.Response, _ = httputil.DumpResponse(&resp, true)
+	}
+	return ret
+}
+
+// writeFileAtomic writes a file by renaming a temporary file over it, so that
+// the previous version survives if the write is interrupted.
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// autosaveProject saves the project at the given interval until the proxy
+// exits.
+func (p *Proxy) autosaveProject(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := p.SaveProject(); err != nil {
+			p.emitEvent("saving project: %v", err)
+		}
+	}
+}
+
+// newProjectDir returns the Dir describing the current project, which is
+// empty if there is none.
+func newProjectDir(p *Proxy) *fusebox.Dir {
+	ret, d := newNodeDir()
+	d.add("name", newReadOnlyFile(func() []byte {
+		if p.Project == nil {
+			return nil
+		}
+		return []byte(p.Project.Name + "\n")
+	}))
+	d.add("dir", newReadOnlyFile(func() []byte {
+		if p.Project == nil {
+			return nil
+		}
+		return []byte(p.Project.Dir + "\n")
+	}))
+	d.add("ca.pem", newReadOnlyFile(func() []byte {
+		if p.Project == nil {
+			return nil
+		}
+		return p.Project.CACert()
+	}))
+	return ret
+}
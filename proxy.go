@@ -1,12 +1,18 @@
-package main
+package proxyfs
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
 	"io/ioutil"
+	"log"
+	"net"
 	"net/http"
 	"net/url"
-	"regexp"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/danielthatcher/fusebox"
 	"github.com/elazarl/goproxy"
@@ -15,17 +21,97 @@ import (
 
 // Proxy can be used to setup a proxy server and a filesystem which can be used to control it
 type Proxy struct {
-	Server    *goproxy.ProxyHttpServer
-	Scope     *regexp.Regexp
-	FS        *fusebox.FS
-	IntReq    bool
-	IntResp   bool
-	reqMu     *sync.RWMutex
-	respMu    *sync.RWMutex
-	Requests  []proxyReq
-	Responses []proxyResp
-	ReqChan   chan []byte
-	RespChan  chan []byte
+	Server *goproxy.ProxyHttpServer
+
+	// The scope regex, and the patterns it's composed of
+	ScopeRegex *scopeRegex
+
+	// Rules narrowing the scope to, and excluding, particular URLs
+	ScopeInclude *scopeRules
+	ScopeExclude *scopeRules
+
+	FS         *fusebox.FS
+	IntReq     atomicFlag
+	IntResp    atomicFlag
+	reqMu      *sync.RWMutex
+	respMu     *sync.RWMutex
+	Requests   []proxyReq
+	Responses  []proxyResp
+	ReqChan    chan []byte
+	RespChan   chan []byte
+	History    *history
+	Highlight  *highlightRules
+	Prefixes   *prefixViews
+	Retention  *retentionRules
+	Redaction  *redactionRules
+	Findings   *findings
+	Audit      *auditLog
+	Secrets    *findingList
+	Caching    *cacheChecker
+	Baseline   *headerBaseline
+	Offline    *scopeList
+	Snippets   *snippetSet
+	Vars       *varSet
+	All        *observedTraffic
+	Transport  *transportHosts
+	Readiness  *readiness
+	Health     *health
+	Mirror     *shadowSet
+	Routes     *routeRules
+	Coalescer  *coalescer
+	Upstreams  *upstreamSet
+	ResendSafe *resendRules
+	Queues     *queueRules
+	Filters    *interceptFilters
+	Responders *queueResponders
+	Sessions   *sessionSet
+	DirNames   *dirNames
+	Settings   *settings
+	Reverse    *url.URL
+	Project    *project
+	KeyLog     *keyLog
+	Overrides  *statusOverrides
+	Signing    *signingRules
+	Digests    *digestRules
+	Stats      *sessionStats
+	Fuzz       *jobSet
+	Discover   *jobSet
+	Crawl      *jobSet
+	Replay     *jobSet
+	Repeat     *jobSet
+	Sitemap    *sitemap
+	Streams    *streamSet
+	WebSockets *wsSet
+	DNS        *dnsState
+	Events     chan []byte
+	FuseTrace  *fuseTracer
+	alarmMu    *sync.Mutex
+	alarmed    bool
+
+	// The address the proxy listens on
+	listenAddr string
+
+	// The CA that signs the certificates for intercepted HTTPS
+	caMu sync.RWMutex
+	ca   tls.Certificate
+
+	// What Serve runs, and the store the history is kept in, if any
+	serve serveConfig
+	store historyStore
+
+	// The root of the filesystem
+	root *fusebox.Dir
+
+	// The paths the filesystem is mounted at
+	mountMu *sync.Mutex
+	mounts  []string
+
+	// The times the queues were last changed
+	reqModified  time.Time
+	respModified time.Time
+
+	// The sequence number of the last item queued
+	queueSeq int64
 }
 
 // proxyReq is a wrapper for a http.Request, and a channel used to control intercepting
@@ -33,7 +119,25 @@ type proxyReq struct {
 	Req     *http.Request
 	Forward chan int
 	Drop    chan int
+	Freeze  chan int
 	ID      uuid.UUID
+	Client  *clientInfo
+
+	// The number of the request in order of arrival in the queues, which
+	// doesn't change while it's queued
+	Seq int64
+
+	// The named queue the request was routed to, or empty for the main queue
+	Queue string
+
+	// Guards the request while it's queued
+	Lock *msgLock
+
+	// When the request is scheduled to be forwarded, if ever
+	Schedule *forwardSchedule
+
+	// The session the request is sent as, if any
+	Session *sessionChoice
 }
 
 // proxyResp is a wrapper for a http.Response, and a channel used to control intercepting
@@ -42,11 +146,22 @@ type proxyResp struct {
 	Forward chan int
 	Drop    chan int
 	ID      uuid.UUID
+
+	// The number of the response in order of arrival in the queues
+	Seq int64
+
+	// The named queue the response was routed to, or empty for the main
+	// queue
+	Queue string
+
+	// Guards the response while it's queued
+	Lock *msgLock
 }
 
-// NewProxy returns a new proxy, compiling the given scope to a regexp
+// NewProxy returns a new proxy, compiling the given scope to a regexp. The
+// scope may be several patterns, one per line, as saved in a project.
 func NewProxy(scope string) (*Proxy, error) {
-	r, err := regexp.Compile(scope)
+	sr, err := newScopeRegex(scope)
 	if err != nil {
 		return nil, err
 	}
@@ -54,29 +169,85 @@ func NewProxy(scope string) (*Proxy, error) {
 	server := goproxy.NewProxyHttpServer()
 
 	ret := &Proxy{
-		Server:    server,
-		Scope:     r,
-		Requests:  make([]proxyReq, 0),
-		Responses: make([]proxyResp, 0),
-		reqMu:     &sync.RWMutex{},
-		respMu:    &sync.RWMutex{},
-		ReqChan:   make(chan []byte, 10),
-		RespChan:  make(chan []byte, 10),
+		Server:       server,
+		ScopeRegex:   sr,
+		ca:           goproxy.GoproxyCa,
+		ScopeInclude: newScopeRules(),
+		ScopeExclude: newScopeRules(),
+		Offline:      &scopeList{},
+		Snippets:     newSnippetSet(),
+		Vars:         newVarSet(),
+		All:          newObservedTraffic(),
+		Transport:    newTransportHosts(),
+		Readiness:    newReadiness(),
+		Health:       &health{},
+		Mirror:       newShadowSet(),
+		Routes:       &routeRules{},
+		Coalescer:    newCoalescer(),
+		Upstreams:    &upstreamSet{},
+		ResendSafe:   newResendRules(),
+		Queues:       &queueRules{},
+		Filters:      newInterceptFilters(),
+		Responders:   &queueResponders{},
+		Sessions:     newSessionSet(),
+		DirNames:     newDirNames(),
+		Requests:     make([]proxyReq, 0),
+		Responses:    make([]proxyResp, 0),
+		reqMu:        &sync.RWMutex{},
+		respMu:       &sync.RWMutex{},
+		ReqChan:      make(chan []byte, 10),
+		RespChan:     make(chan []byte, 10),
+		History:      newHistory(),
+		Highlight:    &highlightRules{},
+		Prefixes:     &prefixViews{},
+		Retention:    &retentionRules{},
+		Redaction:    &redactionRules{},
+		Findings:     newFindings(),
+		Audit:        newAuditLog(),
+		Baseline:     newHeaderBaseline(),
+		Settings:     defaultSettings(),
+		Overrides:    newStatusOverrides(),
+		Signing:      &signingRules{},
+		Digests:      &digestRules{},
+		Stats:        &sessionStats{},
+		Sitemap:      newSitemap(),
+		Streams:      &streamSet{},
+		WebSockets:   &wsSet{},
+		DNS:          newDNSState(),
+		Events:       make(chan []byte, 100),
+		alarmMu:      &sync.Mutex{},
+		mountMu:      &sync.Mutex{},
+	}
+	server.Tr.DialContext = ret.dialContext
+	server.Tr.Dial = func(network, addr string) (net.Conn, error) {
+		return ret.dialContext(context.Background(), network, addr)
 	}
+	ret.History.Redaction = ret.Redaction
+	ret.Fuzz = newFuzzJobs(ret)
+	ret.Discover = newDiscoverJobs(ret)
+	ret.Crawl = newCrawlJobs(ret)
+	ret.Replay = newReplayJobs(ret)
+	ret.Repeat = newRepeatTabs(ret)
+	ret.Secrets = ret.Findings.Category("secrets")
+	ret.Secrets.Sensitive = true
+	ret.Caching = newCacheChecker(ret.Findings.Category("caching"))
 
 	fs, d := fusebox.NewEmptyFS()
 	ret.FS = fs
-	d.AddNode("scope", fusebox.NewRegexpFile(ret.Scope))
+	ret.root = d
+	d.AddNode("scope", newScopeDir(ret))
 
 	// Intercept controls
-	reqNode := fusebox.NewBoolFile(&ret.IntReq)
-	respNode := fusebox.NewBoolFile(&ret.IntResp)
-	d.AddNode("intreq", reqNode)
-	d.AddNode("intresp", respNode)
+	reqChange, respChange := make(chan int, 1), make(chan int, 1)
+	d.AddNode("intreq", newFlagFile(&ret.IntReq, reqChange))
+	d.AddNode("intresp", newFlagFile(&ret.IntResp, respChange))
 
 	// Responses and requests
-	d.AddNode("req", newReqListDir(&ret.Requests))
-	d.AddNode("resp", newRespListDir(&ret.Responses))
+	d.AddNode("req", newStatDir(newReqListDir(ret, ""), ret.reqStat))
+	d.AddNode("resp", newStatDir(newRespListDir(ret, ""), ret.respStat))
+	d.AddNode("queues", newQueuesDir(ret))
+	d.AddNode("filters", newFiltersDir(ret.Filters))
+	d.AddNode("sessions", newSessionsDir(ret.Sessions))
 
 	reqChanNode := fusebox.NewBytePipeFile(ret.ReqChan)
 	respChanNode := fusebox.NewBytePipeFile(ret.RespChan)
@@ -85,160 +256,521 @@ func NewProxy(scope string) (*Proxy, error) {
 	d.AddNode("urlreq", reqChanNode)
 	d.AddNode("urlresp", respChanNode)
 
-	go ret.dispatchIntercepts(reqNode.Change, respNode.Change)
+	eventsNode := fusebox.NewBytePipeFile(ret.Events)
+	eventsNode.Mode = 0444
+	d.AddNode("events", eventsNode)
+
+	// History and settings
+	d.AddNode("history", newStatDir(newHistoryDir(ret), ret.History.Stat))
+	d.AddNode("all", newStatDir(newAllDir(ret.All), ret.All.Stat))
+	d.AddNode("findings", newFindingsDir(ret.Findings))
+	d.AddNode("similarity", newSimilarityFile(ret))
+	d.AddNode("audit", newAuditDir(ret))
+	d.AddNode("export", newExportDir(ret))
+	d.AddNode("overrides", newOverridesDir(ret.Overrides))
+	d.AddNode("stats", newStatsDir(ret.Stats))
+	d.AddNode("fuzz", newJobsDir(ret.Fuzz))
+	d.AddNode("discover", newJobsDir(ret.Discover))
+	d.AddNode("crawl", newJobsDir(ret.Crawl))
+	d.AddNode("replay", newJobsDir(ret.Replay))
+	d.AddNode("repeat", newJobsDir(ret.Repeat))
+	d.AddNode("frozen", newFreezerDir(ret))
+	d.AddNode("sitemap", newStatDir(newSitemapDir(ret), ret.Sitemap.Stat))
+	d.AddNode("dns", newDNSDir(ret.DNS))
+	d.AddNode("streams", newStatDir(newStreamsDir(ret.Streams), ret.Streams.Stat))
+	d.AddNode("ws", newStatDir(newWebSocketsDir(ret.WebSockets), ret.WebSockets.Stat))
+	d.AddNode("mirror", newStatDir(newMirrorDir(ret.Mirror), ret.Mirror.Stat))
+	d.AddNode("upstreams", newUpstreamsDir(ret.Upstreams))
+	d.AddNode("snippets", newValueSetDir(ret.Snippets.valueSet))
+	d.AddNode("vars", newValueSetDir(ret.Vars.valueSet))
+	d.AddNode("settings", newSettingsDir(ret))
+	d.AddNode("project", newProjectDir(ret))
+	d.AddNode("ca", newCADir(ret))
+	d.AddNode("ca.pem", newReadOnlyFile(func() []byte {
+		return caCertPEM(ret.CA())
+	}))
+	d.AddNode("debug", newDebugDir(ret))
+	d.AddNode("status", newStatusDir(ret))
+
+	go ret.dispatchIntercepts(reqChange, respChange)
+	go ret.enforceRetention(time.Minute)
 
 	return ret, nil
 }
 
-// ListenAndServe sets up the proxy on the given host string (e.g. "127.0.0.1:8080" or ":8080") and
-// sets up intercepting functions for in scope items
-func (p *Proxy) ListenAndServe(host string, upstream *url.URL) error {
-	p.Server.OnRequest(goproxy.UrlMatches(p.Scope)).HandleConnect(goproxy.AlwaysMitm)
-	p.Server.OnRequest(goproxy.UrlMatches(p.Scope)).DoFunc(p.HandleRequest)
-	p.Server.OnResponse(goproxy.UrlMatches(p.Scope)).DoFunc(p.HandleResponse)
+// ListenAndServe sets up the proxy on the given host string (e.g. "127.0.0.1:8080", ":8080" or
+// "unix:/tmp/proxyfs.sock") and sets up intercepting functions for in scope items. Requests
+// are sent through the first of the given upstream proxies that's up, if any.
+func (p *Proxy) ListenAndServe(host string, upstreams []*url.URL) error {
+	// The include and exclude regexes apply to individual requests, so
+	// CONNECTs only need to match the scope regex and patterns
+	p.Server.OnRequest(goproxy.DstHostIs(setupHost)).DoFunc(p.serveSetup)
+	p.Server.OnRequest(p.connectCondition()).HandleConnect(goproxy.FuncHttpsHandler(p.mitmConnect))
+	p.Server.OnRequest(goproxy.Not(p.connectCondition())).HandleConnect(goproxy.FuncHttpsHandler(p.observeConnect))
+	p.Server.OnRequest(p.scopeCondition()).DoFunc(p.HandleRequest)
+	p.Server.OnRequest(goproxy.Not(p.scopeCondition())).DoFunc(p.observeRequest)
+	p.Server.OnResponse().DoFunc(p.rewriteLinks)
+	p.Server.OnResponse().DoFunc(p.handleDoH)
+	p.Server.OnResponse().DoFunc(p.markResponse)
+	p.Server.OnResponse(p.scopeCondition()).DoFunc(p.HandleResponse)
+	p.Server.OnResponse(goproxy.Not(p.scopeCondition())).DoFunc(p.observeResponse)
+
+	if p.Reverse != nil {
+		p.Server.NonproxyHandler = p.reverseHandler(p.Reverse)
+	} else {
+		p.Server.NonproxyHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			p.deviceSetup().ServeHTTP(w, r)
+		})
+	}
+
+	if len(upstreams) > 0 {
+		for _, u := range upstreams {
+			p.Upstreams.Add(u)
+		}
+		p.Server.Tr.Proxy = p.Upstreams.Proxy
+		go p.checkUpstreams(upstreamCheckInterval)
+	}
 
-	if upstream != nil {
-		u := http.ProxyURL(upstream)
-		p.Server.Tr.Proxy = u
+	l, err := listen(host)
+	if err != nil {
+		return err
 	}
+	p.listenAddr = l.Addr().String()
+	p.Readiness.Done("proxy")
+	return http.Serve(l, http.HandlerFunc(p.serveProxy))
+}
 
-	return http.ListenAndServe(host, p.Server)
+// serveProxy serves a request sent to the proxy, taking over WebSocket
+// upgrades in scope, and handing everything else to goproxy. Responses are
+// flushed to the client as they're written, so that streamed bodies aren't
+// held up.
+func (p *Proxy) serveProxy(w http.ResponseWriter, r *http.Request) {
+	if p.interceptsWebSocket(r) {
+		p.serveWebSocket(w, r)
+		return
+	}
+	if r.Method != http.MethodConnect {
+		w = &flushingWriter{w}
+	}
+	p.Server.ServeHTTP(w, r)
 }
 
 // HandleResponse handles a response through the proxy server
 func (p *Proxy) HandleResponse(r *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
-	// Add to the queue
+	// Failed round trips have no response to handle
+	if r == nil {
+		return r
+	}
+	if p.refusing() {
+		return degradedResponse(r.Request)
+	}
+	received := time.Now()
+
+	p.normaliseResponse(r)
+
+	// The cookies set for a session go to its jar, rather than the client
+	var sess *session
+	if e, ok := ctx.UserData.(*historyEntry); ok {
+		if sess = p.Sessions.Get(e.Session()); sess != nil {
+			sess.Jar.Update(r)
+		}
+	}
+
+	// Hold the response in the queue until it's forwarded, or until the
+	// client goes away, unless it's filtered out. Responses that aren't held
+	// are never queued, so that their bodies can be streamed.
+	held := p.IntResp.Get() && p.Filters.Response(r)
+	if held {
+		r = p.holdResponse(r)
+	}
+	aborted := clientGone(r.Request)
+
+	// Update checksums in case the response was edited, and record the
+	// response against the request's history entry. The bodies of responses
+	// that weren't held are streamed to the client, and recorded once
+	// they've finished.
+	if aborted {
+		if e, ok := ctx.UserData.(*historyEntry); ok {
+			e.SetAborted()
+			p.History.Touch()
+		}
+		return droppedResponse(r.Request)
+	}
+	p.Digests.ApplyResponse(r)
+	if e, ok := ctx.UserData.(*historyEntry); ok {
+		if !held && streams(r.Body) {
+			p.streamResponse(e, r, received.Sub(e.Time))
+		} else {
+			p.recordResponse(e, r, received.Sub(e.Time), "proxy")
+		}
+	}
+	if sess != nil {
+		r.Header.Del("Set-Cookie")
+	}
+
+	return r
+}
+
+// HandleRequest handles a request through the proxy server
+func (p *Proxy) HandleRequest(r *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	if p.refusing() {
+		return r, degradedResponse(r)
+	}
+	p.normaliseRequest(r)
+
+	// Hold the request in the queue until it's forwarded, or until the
+	// client goes away, unless it's filtered out. Requests that aren't held
+	// are never queued, so that their bodies can be streamed.
+	client := lookupClient(r.RemoteAddr)
+	session := &sessionChoice{name: p.Sessions.Rules.Session(r)}
+	held := p.IntReq.Get() && p.Filters.Request(r)
+	var resp *http.Response
+	if held {
+		resp = p.holdRequest(r, client, session)
+	}
+
+	// Requests whose clients have gone aren't sent, even if they were
+	// forwarded, since nobody is waiting for the response
+	aborted := clientGone(r)
+	if aborted {
+		resp = droppedResponse(r)
+	}
+
+	// Abandoned requests are recorded as such, and not sent
+	if aborted {
+		e := p.History.Record(r, client)
+		e.SetAborted()
+		p.History.Touch()
+		return r, resp
+	}
+
+	// Record the request in the history if it's being sent, as its session
+	// if it has one, after updating its checksums and re-signing it in case
+	// it was edited
+	if resp == nil {
+		sessionName := session.Name()
+		if s := p.Sessions.Get(sessionName); s != nil {
+			s.Apply(r, p.Vars)
+		}
+		p.Digests.ApplyRequest(r)
+		if err := p.Signing.Sign(r, p.Vars); err != nil {
+			log.Printf("Failed to sign request to %v: %v\n", r.URL, err)
+		}
+
+		// The bodies of requests that weren't held are streamed upstream,
+		// and recorded once they've been sent
+		offline := p.Offline.Match(r.URL.String())
+		var e *historyEntry
+		if !held && !offline && streams(r.Body) {
+			e = p.streamRequest(r, client)
+		} else {
+			e = p.recordRequest(r, client)
+			p.mirrorRequest(e)
+		}
+		if sessionName != "" {
+			e.SetSession(sessionName)
+		}
+		ctx.UserData = e
+		if offline {
+			ctx.RoundTripper = goproxy.RoundTripperFunc(p.offlineRoundTrip)
+		} else {
+			target := p.Routes.Choose(r)
+			if target != nil {
+				e.SetRoute(target.String())
+			}
+			ctx.RoundTripper = goproxy.RoundTripperFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Response, error) {
+				if target != nil {
+					retarget(req, target)
+				}
+				if p.Settings.Get().Coalesce && canCoalesce(req) {
+					resp, shared, err := p.Coalescer.Do(req, p.roundTrip)
+					if shared {
+						e.AddLabels("coalesced")
+					}
+					return resp, err
+				}
+				return p.roundTrip(req)
+			})
+		}
+	}
+
+	return r, resp
+}
+
+// recordRequest records a request being sent upstream in the history, and
+// runs the passive checks over it.
+func (p *Proxy) recordRequest(r *http.Request, client *clientInfo) *historyEntry {
+	e := p.History.Record(r, client)
+	p.checkRequest(e)
+	return e
+}
+
+// checkRequest runs the passive checks over a recorded request.
+func (p *Proxy) checkRequest(e *historyEntry) {
+	e.AddLabels(p.Highlight.Labels(e.Req, nil)...)
+	scanSecrets(p.Secrets, e.Req.Header, peekBodyHead(&e.Req.Body, maxSecretScan), fmt.Sprintf("history/%d req", e.ID))
+	p.Stats.RecordRequest(bodyLen(&e.Req.Body))
+}
+
+// holdResponse adds a response to the queue and waits until it's forwarded or
+// dropped, or the client goes away, before removing it, returning the
+// response to send. Responses in named queues may be handled by their queue's
+// responder.
+func (p *Proxy) holdResponse(r *http.Response) *http.Response {
 	id, err := uuid.NewV1()
 	if err != nil {
 		panic("Couldn't create UUID!")
 	}
 
 	pr := proxyResp{Resp: r,
-		Forward: make(chan int),
-		Drop:    make(chan int),
+		Forward: make(chan int, 1),
+		Drop:    make(chan int, 1),
 		ID:      id,
+		Seq:     atomic.AddInt64(&p.queueSeq, 1),
+		Queue:   p.Queues.Queue(r.Request, r),
+		Lock:    newMsgLock(),
 	}
 
 	p.respMu.Lock()
 	p.Responses = append(p.Responses, pr)
-	if len(p.Responses) == 1 {
+	p.respModified = time.Now()
+	if respQueueHead(p.Responses, "") == len(p.Responses)-1 {
 		go p.broadcastResponse()
 	}
 	p.respMu.Unlock()
+	p.checkQueueDepth()
 
-	// Wait until forwarded
-	if p.IntResp {
-		select {
-		case <-pr.Forward:
-		case <-pr.Drop:
-			r = droppedResponse(r.Request)
-		}
+	if pr.Queue != "" {
+		go p.respondResponse(pr)
+	}
+	select {
+	case <-pr.Forward:
+	case <-pr.Drop:
+		r = droppedResponse(r.Request)
+	case <-requestDone(r.Request):
 	}
+	pr.Lock.Release()
 
-	// Remove the response from the queue before returning
 	p.respMu.Lock()
 	for i, x := range p.Responses {
 		if x.ID == pr.ID {
+			head := respQueueHead(p.Responses, "")
 			p.Responses = append(p.Responses[:i], p.Responses[i+1:]...)
-			if i == 0 {
+			p.respModified = time.Now()
+			if i == head {
 				go p.broadcastResponse()
 			}
 			break
 		}
 	}
 	p.respMu.Unlock()
-
 	return r
 }
 
-// HandleRequest handles a request through the proxy server
-func (p *Proxy) HandleRequest(r *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
-	// Add to the queue
+// holdRequest adds a request to the queue and waits until it's forwarded,
+// dropped or frozen, or the client goes away, before removing it, returning
+// the response to send instead of the request, if any. Requests in named
+// queues may be handled by their queue's responder.
+func (p *Proxy) holdRequest(r *http.Request, client *clientInfo, session *sessionChoice) *http.Response {
 	id, err := uuid.NewV1()
 	if err != nil {
 		panic("Couldn't create UUID!")
 	}
 	pr := proxyReq{
 		Req:     r,
-		Forward: make(chan int),
-		Drop:    make(chan int),
+		Forward: make(chan int, 1),
+		Drop:    make(chan int, 1),
+		Freeze:  make(chan int, 1),
 		ID:      id,
+		Seq:     atomic.AddInt64(&p.queueSeq, 1),
+		Client:  client,
+		Queue:   p.Queues.Queue(r, nil),
+		Lock:    newMsgLock(),
+		Session: session,
 	}
+	pr.Schedule = newForwardSchedule(pr.Forward)
 
 	p.reqMu.Lock()
 	p.Requests = append(p.Requests, pr)
-	if len(p.Requests) == 1 {
+	p.reqModified = time.Now()
+	if reqQueueHead(p.Requests, "") == len(p.Requests)-1 {
 		go p.broadcastRequest()
 	}
 	p.reqMu.Unlock()
+	p.checkQueueDepth()
 
-	// Wait until forwarded
 	var resp *http.Response
-	if p.IntReq {
-		select {
-		case <-pr.Forward:
-		case <-pr.Drop:
-			resp = droppedResponse(r)
-		}
+	if pr.Queue != "" {
+		go p.respondRequest(pr)
+	}
+	select {
+	case <-pr.Forward:
+	case <-pr.Drop:
+		resp = droppedResponse(r)
+	case <-pr.Freeze:
+		resp = frozenResponse(r)
+	case <-r.Context().Done():
 	}
+	pr.Lock.Release()
 
-	// Remove the request from the queue before returning
 	p.reqMu.Lock()
 	for i, x := range p.Requests {
 		if x.ID == pr.ID {
+			head := reqQueueHead(p.Requests, "")
 			p.Requests = append(p.Requests[:i], p.Requests[i+1:]...)
-			if i == 0 {
+			p.reqModified = time.Now()
+			if i == head {
 				go p.broadcastRequest()
 			}
 		}
 	}
 	p.reqMu.Unlock()
+	pr.Schedule.Set(time.Time{})
+	return resp
+}
 
-	return r, resp
+// recordResponse records the response to a request in its history entry and
+// the sitemap, noting where the exchange came from, and runs the passive
+// checks over it.
+func (p *Proxy) recordResponse(e *historyEntry, r *http.Response, latency time.Duration, source string) {
+	e.SetResponse(r, latency)
+	p.History.Touch()
+	p.Sitemap.Add(e.Req.URL, r.StatusCode, source)
+	resp := e.Response()
+	p.Stats.RecordResponse(bodyLen(&resp.Body), latency)
+	e.AddLabels(p.Highlight.Labels(e.Req, resp)...)
+	scanSecrets(p.Secrets, resp.Header, peekBodyHead(&resp.Body, maxSecretScan), fmt.Sprintf("history/%d resp", e.ID))
+	p.Caching.Check(e.Req, resp, spoolBody(&resp.Body).Sum(), fmt.Sprintf("history/%d resp", e.ID))
+}
+
+// reqStat returns the number of requests in the main queue, and when it last
+// changed.
+func (p *Proxy) reqStat() (int, time.Time) {
+	return p.queueStat("req", "", "")
+}
+
+// respStat returns the number of responses in the main queue, and when it
+// last changed.
+func (p *Proxy) respStat() (int, time.Time) {
+	return p.queueStat("resp", "", "")
+}
+
+// normaliseRequest applies the settings that rewrite in scope requests before
+// they are queued.
+func (p *Proxy) normaliseRequest(r *http.Request) {
+	settings := p.Settings.Get()
+	switch settings.AcceptEncoding {
+	case "strip":
+		r.Header.Del("Accept-Encoding")
+	case "identity":
+		r.Header.Set("Accept-Encoding", "identity")
+	}
+
+	if settings.Range == "collapse" {
+		r.Header.Del("Range")
+		r.Header.Del("If-Range")
+	}
+
+	if settings.StripCache {
+		r.Header.Del("If-None-Match")
+		r.Header.Del("If-Modified-Since")
+	}
 }
 
-// Mount monuts the proxy's pseudo filesystem at the given path, returning any error encountered.
-func (p *Proxy) Mount(path string) error {
-	return p.FS.Mount(path)
+// normaliseResponse applies the settings that rewrite in scope responses
+// before they are queued.
+func (p *Proxy) normaliseResponse(r *http.Response) {
+	if o := p.Overrides.Get(r.StatusCode); o != nil {
+		o.Apply(r, p.Vars)
+	}
+
+	if p.Settings.Get().StripCache {
+		r.Header.Set("Cache-Control", "no-store")
+		r.Header.Del("Expires")
+		r.Header.Del("ETag")
+		r.Header.Del("Last-Modified")
+	}
 }
 
 // Listend for changes to p.InterceptRequests and p.InterceptResponses, and start/stop
 // intercepting appropriately
 func (p *Proxy) dispatchIntercepts(req <-chan int, resp <-chan int) {
+	defer p.recoverPanic("dispatching intercepts", func() {
+		go p.dispatchIntercepts(req, resp)
+	})
 	for {
 		select {
 		case <-req:
-			if !p.IntReq {
+			if !p.IntReq.Get() {
+				p.reqMu.RLock()
 				for _, r := range p.Requests {
-					r.Forward <- 1
+					release(r.Forward)
 				}
+				p.reqMu.RUnlock()
 			}
 		case <-resp:
-			if !p.IntResp {
+			if !p.IntResp.Get() {
+				p.respMu.RLock()
 				for _, r := range p.Responses {
-					r.Forward <- 1
+					release(r.Forward)
 				}
+				p.respMu.RUnlock()
 			}
 		}
 	}
 }
 
 func (p *Proxy) broadcastRequest() {
-	if len(p.Requests) == 0 {
+	defer p.recoverPanic("broadcasting the queued request", nil)
+	p.reqMu.RLock()
+	i := reqQueueHead(p.Requests, "")
+	if i < 0 {
+		p.reqMu.RUnlock()
 		return
 	}
-	u := p.Requests[0].Req.URL.String()
+	u := p.Requests[i].Req.URL.String()
+	p.reqMu.RUnlock()
 	p.ReqChan <- append([]byte(u), '\n')
 }
 
 func (p *Proxy) broadcastResponse() {
-	if len(p.Responses) == 0 {
+	defer p.recoverPanic("broadcasting the queued response", nil)
+	p.respMu.RLock()
+	i := respQueueHead(p.Responses, "")
+	if i < 0 {
+		p.respMu.RUnlock()
 		return
 	}
-	u := p.Responses[0].Resp.Request.URL.String()
+	u := p.Responses[i].Resp.Request.URL.String()
+	p.respMu.RUnlock()
 	p.RespChan <- append([]byte(u), '\n')
 }
 
+// release signals a waiting request or response on the given channel. The
+// channels are buffered so that signalling never blocks, even if the handler
+// has already stopped waiting, and extra signals are discarded.
+func release(c chan int) {
+	select {
+	case c <- 1:
+	default:
+	}
+}
+
+// requestDone returns a channel that's closed when the client that sent the
+// given request disconnects, or nil if this can't be known.
+func requestDone(req *http.Request) <-chan struct{} {
+	if req == nil {
+		return nil
+	}
+	return req.Context().Done()
+}
+
+// clientGone returns whether the client that sent the given request has
+// disconnected.
+func clientGone(req *http.Request) bool {
+	return req != nil && req.Context().Err() != nil
+}
+
 // Create the response returned when a request or response is dropped.
 func droppedResponse(req *http.Request) *http.Response {
 	msg := "Dropped by proxyfs"
@@ -0,0 +1,280 @@
+package proxyfs
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"bazil.org/fuse"
+	"github.com/danielthatcher/fusebox"
+	"github.com/satori/go.uuid"
+)
+
+// queuedReqDir returns the Dir for a request waiting in the intercept queue,
+// which extends the plain request directory with extra information.
+func (p *Proxy) queuedReqDir(pr proxyReq) *fusebox.Dir {
+	e := newReqDirElement(pr.Req, pr.Forward)
+	e.settings = p.Settings
+	e.lock = pr.Lock
+	e.snippets = p.Snippets
+	e.addNode("client", true, func() fusebox.VarNode {
+		return newClientDir(pr.Client)
+	})
+	e.addNode("seen-before", false, func() fusebox.VarNode {
+		return newReadOnlyFile(func() []byte {
+			return historyIndex(p.History.Find(requestFingerprint(pr.Req)))
+		})
+	})
+	e.addNode("client-gone", false, func() fusebox.VarNode {
+		return newClientGoneFile(pr.Req)
+	})
+	e.addNode("forward-after", false, func() fusebox.VarNode {
+		return newValueFile(&forwardAfterFile{pr.Schedule})
+	})
+	e.addNode("session", false, func() fusebox.VarNode {
+		ret := newHandleFile(pr.Session)
+		ret.NewlineOnRead = true
+		return ret
+	})
+	e.addNode("freeze", false, func() fusebox.VarNode {
+		ret := newHandleFile(&freezeFile{p, pr})
+		ret.OpenFlags = fuse.OpenDirectIO
+		return ret
+	})
+	e.addNode("chunks", false, func() fusebox.VarNode {
+		return newChunksFile(pr.Req.Header, &pr.Req.Body, &pr.Req.ContentLength, &pr.Req.TransferEncoding, false)
+	})
+	addReqFlowNodes(e)
+	pr.Lock.read(func() error {
+		if findRequestJWT(pr.Req) != "" {
+			e.addNode("jwt", true, func() fusebox.VarNode {
+				return newJWTDir(pr.Req, p.Settings)
+			})
+		}
+		return nil
+	})
+
+	return pr.Lock.guardDir(newReqDir(e))
+}
+
+// queuedRespDir returns the Dir for a response waiting in the intercept queue.
+func (p *Proxy) queuedRespDir(pr proxyResp) *fusebox.Dir {
+	e := newRespDirElement(pr.Resp, pr.Forward)
+	e.settings = p.Settings
+	e.lock = pr.Lock
+	e.snippets = p.Snippets
+	e.addNode("decodedbody", false, func() fusebox.VarNode {
+		return newDecodedBodyFile(pr.Resp, p.Settings)
+	})
+	e.addNode("client-gone", false, func() fusebox.VarNode {
+		return newClientGoneFile(pr.Resp.Request)
+	})
+	e.addNode("chunks", false, func() fusebox.VarNode {
+		return newChunksFile(pr.Resp.Header, &pr.Resp.Body, &pr.Resp.ContentLength, &pr.Resp.TransferEncoding, true)
+	})
+	addRespFlowNodes(e)
+
+	return pr.Lock.guardDir(newRespDir(e))
+}
+
+// newClientGoneFile returns a file reading 1 if the client that sent the given
+// request has disconnected, in which case it won't be sent even if forwarded.
+func newClientGoneFile(req *http.Request) *fusebox.File {
+	return newReadOnlyFile(func() []byte {
+		if clientGone(req) {
+			return []byte("1")
+		}
+		return []byte("0")
+	})
+}
+
+// queuedHost returns the host that a queued request, or the request of a
+// queued response, is for, which names its directory under by-host.
+func queuedHost(req *http.Request) string {
+	if req == nil || req.URL == nil {
+		return ""
+	}
+	return strings.ToLower(req.URL.Hostname())
+}
+
+// host returns the queued host of the request, which is empty once it has
+// left the queue.
+func (pr proxyReq) host() string {
+	var ret string
+	pr.Lock.read(func() error {
+		ret = queuedHost(pr.Req)
+		return nil
+	})
+	return ret
+}
+
+// host returns the queued host of the response, which is empty once it has
+// left the queue.
+func (pr proxyResp) host() string {
+	var ret string
+	pr.Lock.read(func() error {
+		ret = queuedHost(pr.Resp.Request)
+		return nil
+	})
+	return ret
+}
+
+// indexLine returns the request's line in the index of its queue: its UUID,
+// method and URL, tab separated.
+func (pr proxyReq) indexLine() string {
+	var ret string
+	pr.Lock.read(func() error {
+		ret = fmt.Sprintf("%s\t%s\t%s\n", pr.ID, pr.Req.Method, pr.Req.URL)
+		return nil
+	})
+	return ret
+}
+
+// indexLine returns the response's line in the index of its queue: its UUID,
+// status and the URL of its request, tab separated.
+func (pr proxyResp) indexLine() string {
+	var ret string
+	pr.Lock.read(func() error {
+		ret = fmt.Sprintf("%s\t%d\t%s\n", pr.ID, pr.Resp.StatusCode, pr.Resp.Request.URL)
+		return nil
+	})
+	return ret
+}
+
+// queuePosition returns the position in a queue of n entries of the one with
+// the given name, or -1 if there's no such entry. Entries are named by their
+// UUIDs, which don't change while they're queued, but can also be named by
+// their current position, for quick use from a shell.
+func queuePosition(n int, id func(int) uuid.UUID, name string) int {
+	if u, err := uuid.FromString(name); err == nil {
+		for i := 0; i < n; i++ {
+			if uuid.Equal(id(i), u) {
+				return i
+			}
+		}
+		return -1
+	}
+
+	i, err := strconv.Atoi(name)
+	if err != nil || i < 0 || i >= n {
+		return -1
+	}
+	return i
+}
+
+// queueHostsElement lists the hosts that have requests or responses in a
+// queue, each as a view of the queue filtered to that host. Any host can be
+// looked up, so that a host's view can be waited on before anything is queued
+// for it.
+type queueHostsElement struct {
+	Proxy *Proxy
+
+	// Either "req" or "resp"
+	Kind string
+
+	// The named queue, or empty for the main queue
+	Queue string
+}
+
+// newQueueHostsDir returns the by-host Dir of a request or response queue.
+func newQueueHostsDir(p *Proxy, kind string, queue string) *fusebox.Dir {
+	ret := fusebox.NewDir(&queueHostsElement{p, kind, queue})
+	ret.Mode = os.ModeDir | 0666
+	return ret
+}
+
+// hosts returns the hosts with entries in the queue.
+func (e *queueHostsElement) hosts() []string {
+	seen := make(map[string]bool)
+	if e.Kind == "req" {
+		e.Proxy.reqMu.RLock()
+		for _, pr := range e.Proxy.Requests {
+			if pr.Queue == e.Queue {
+				seen[pr.host()] = true
+			}
+		}
+		e.Proxy.reqMu.RUnlock()
+	} else {
+		e.Proxy.respMu.RLock()
+		for _, pr := range e.Proxy.Responses {
+			if pr.Queue == e.Queue {
+				seen[pr.host()] = true
+			}
+		}
+		e.Proxy.respMu.RUnlock()
+	}
+
+	ret := make([]string, 0, len(seen))
+	for host := range seen {
+		if host != "" {
+			ret = append(ret, host)
+		}
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+func (e *queueHostsElement) GetNode(ctx context.Context, k string) (fusebox.VarNode, error) {
+	host := strings.ToLower(k)
+	if host == "" || strings.ContainsAny(host, "/ ") {
+		return nil, fuse.ENOENT
+	}
+
+	var d *fusebox.Dir
+	if e.Kind == "req" {
+		d = fusebox.NewDir(&reqListElement{Data: &e.Proxy.Requests, Proxy: e.Proxy, Queue: e.Queue, Host: host})
+	} else {
+		d = fusebox.NewDir(&respListElement{Data: &e.Proxy.Responses, Proxy: e.Proxy, Queue: e.Queue, Host: host})
+	}
+	d.Mode = os.ModeDir | 0666
+	return newStatDir(d, func() (int, time.Time) {
+		return e.Proxy.queueStat(e.Kind, e.Queue, host)
+	}), nil
+}
+
+func (*queueHostsElement) GetDirentType(ctx context.Context, k string) (fuse.DirentType, error) {
+	return fuse.DT_Dir, nil
+}
+
+func (e *queueHostsElement) GetKeys(ctx context.Context) []string {
+	return e.hosts()
+}
+
+func (*queueHostsElement) AddNode(name string, node interface{}) error {
+	return fuse.EPERM
+}
+
+func (*queueHostsElement) RemoveNode(name string) error {
+	return fuse.EPERM
+}
+
+// queueStat returns the number of requests or responses in a queue, for the
+// given host or for every host if it's empty, and when the queues last
+// changed.
+func (p *Proxy) queueStat(kind string, queue string, host string) (int, time.Time) {
+	n := 0
+	if kind == "req" {
+		p.reqMu.RLock()
+		defer p.reqMu.RUnlock()
+		for _, pr := range p.Requests {
+			if pr.Queue == queue && (host == "" || pr.host() == host) {
+				n++
+			}
+		}
+		return n, p.reqModified
+	}
+
+	p.respMu.RLock()
+	defer p.respMu.RUnlock()
+	for _, pr := range p.Responses {
+		if pr.Queue == queue && (host == "" || pr.host() == host) {
+			n++
+		}
+	}
+	return n, p.respModified
+}
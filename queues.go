@@ -0,0 +1,232 @@
+package proxyfs
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"bazil.org/fuse"
+	"github.com/danielthatcher/fusebox"
+)
+
+// queueNameRegexp matches the names that can be given to queues.
+var queueNameRegexp = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// queueRule routes the intercepted items matching its expression to a named
+// queue.
+type queueRule struct {
+	Name string
+	Expr *matchExpr
+}
+
+// queueRules routes intercepted requests and responses into named queues, so
+// that different people or tools can each work through their own. Each line
+// of the file is a rule, made up of the queue's name and a match expression,
+// e.g.
+//
+//	api host=api.example.com
+//	auth path~^/(login|oauth)/
+//
+// Items go to the queue of the first rule they match, and to the main queue
+// if they match none. Blank lines and lines starting with '#' are ignored.
+type queueRules struct {
+	mu    sync.RWMutex
+	src   []byte
+	rules []queueRule
+}
+
+// Queue returns the name of the queue the given request, or response to it,
+// is routed to, or an empty string for the main queue.
+func (r *queueRules) Queue(req *http.Request, resp *http.Response) string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, rule := range r.rules {
+		if rule.Expr.Match(req, resp) {
+			return rule.Name
+		}
+	}
+	return ""
+}
+
+// Names returns the names of the queues, in the order of their first rules.
+func (r *queueRules) Names() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	seen := make(map[string]bool)
+	ret := make([]string, 0)
+	for _, rule := range r.rules {
+		if !seen[rule.Name] {
+			seen[rule.Name] = true
+			ret = append(ret, rule.Name)
+		}
+	}
+	return ret
+}
+
+// parseQueueRules parses rules in the format described for queueRules.
+func parseQueueRules(src string) ([]queueRule, error) {
+	ret := make([]queueRule, 0)
+	for _, line := range strings.Split(src, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		parts := strings.SplitN(line, " ", 2)
+		if !queueNameRegexp.MatchString(parts[0]) || parts[0] == "rules" || parts[0] == "responders" {
+			return nil, fmt.Errorf("invalid queue name %q", parts[0])
+		}
+		expr := ""
+		if len(parts) == 2 {
+			expr = parts[1]
+		}
+		m, err := parseMatchExpr(expr)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, queueRule{Name: parts[0], Expr: m})
+	}
+	return ret, nil
+}
+
+func (r *queueRules) ValRead(ctx context.Context) ([]byte, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.src, nil
+}
+
+func (r *queueRules) ValWrite(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+	rules, err := parseQueueRules(string(req.Data))
+	if err != nil {
+		return errInvalid
+	}
+
+	r.mu.Lock()
+	r.src = append([]byte(nil), req.Data...)
+	r.rules = rules
+	r.mu.Unlock()
+
+	resp.Size = len(req.Data)
+	return nil
+}
+
+func (r *queueRules) Size(ctx context.Context) (uint64, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return uint64(len(r.src)), nil
+}
+
+// reqQueueHead returns the position of the first of the given requests that's
+// in the given queue, or -1 if there are none.
+func reqQueueHead(reqs []proxyReq, queue string) int {
+	for i, pr := range reqs {
+		if pr.Queue == queue {
+			return i
+		}
+	}
+	return -1
+}
+
+// respQueueHead is reqQueueHead for responses.
+func respQueueHead(resps []proxyResp, queue string) int {
+	for i, pr := range resps {
+		if pr.Queue == queue {
+			return i
+		}
+	}
+	return -1
+}
+
+// queuesElement lists the named queues: those with rules, and any that still
+// hold items after their rules were removed. It also holds the rules and the
+// queues' responders.
+type queuesElement struct {
+	Proxy *Proxy
+}
+
+// names returns the names of the queues.
+func (e *queuesElement) names() []string {
+	ret := e.Proxy.Queues.Names()
+	seen := make(map[string]bool)
+	for _, name := range ret {
+		seen[name] = true
+	}
+
+	e.Proxy.reqMu.RLock()
+	for _, pr := range e.Proxy.Requests {
+		if pr.Queue != "" && !seen[pr.Queue] {
+			seen[pr.Queue] = true
+			ret = append(ret, pr.Queue)
+		}
+	}
+	e.Proxy.reqMu.RUnlock()
+	e.Proxy.respMu.RLock()
+	for _, pr := range e.Proxy.Responses {
+		if pr.Queue != "" && !seen[pr.Queue] {
+			seen[pr.Queue] = true
+			ret = append(ret, pr.Queue)
+		}
+	}
+	e.Proxy.respMu.RUnlock()
+	return ret
+}
+
+func (e *queuesElement) GetNode(ctx context.Context, k string) (fusebox.VarNode, error) {
+	if k == "rules" {
+		return newHandleFile(e.Proxy.Queues), nil
+	}
+	if k == "responders" {
+		return newHandleFile(e.Proxy.Responders), nil
+	}
+	for _, name := range e.names() {
+		if name == k {
+			return e.Proxy.namedQueueDir(name), nil
+		}
+	}
+	return nil, fuse.ENOENT
+}
+
+func (e *queuesElement) GetDirentType(ctx context.Context, k string) (fuse.DirentType, error) {
+	if k == "rules" || k == "responders" {
+		return fuse.DT_File, nil
+	}
+	return fuse.DT_Dir, nil
+}
+
+func (e *queuesElement) GetKeys(ctx context.Context) []string {
+	return append([]string{"rules", "responders"}, e.names()...)
+}
+
+func (e *queuesElement) AddNode(name string, node interface{}) error {
+	return fuse.EPERM
+}
+
+func (e *queuesElement) RemoveNode(name string) error {
+	return fuse.EPERM
+}
+
+// newQueuesDir returns the Dir holding the named queues and their rules.
+func newQueuesDir(p *Proxy) *fusebox.Dir {
+	ret := fusebox.NewDir(&queuesElement{p})
+	ret.Mode = os.ModeDir | 0755
+	ret.OpenFlags = fuse.OpenDirectIO
+	return ret
+}
+
+// namedQueueDir returns the Dir of a named queue, whose req and resp list its
+// requests and responses as the main queue's do.
+func (p *Proxy) namedQueueDir(name string) *fusebox.Dir {
+	ret, d := newNodeDir()
+	d.add("req", newStatDir(newReqListDir(p, name), func() (int, time.Time) {
+		return p.queueStat("req", name, "")
+	}))
+	d.add("resp", newStatDir(newRespListDir(p, name), func() (int, time.Time) {
+		return p.queueStat("resp", name, "")
+	}))
+	return ret
+}
@@ -0,0 +1,78 @@
+package proxyfs
+
+import (
+	"io"
+	"net/http"
+	"net/http/httputil"
+)
+
+// rawDumpMax is the largest raw dump kept. Larger dumps are made again on each
+// read, rather than doubling the memory held by the message.
+const rawDumpMax = 64 << 20
+
+// rawDump is the kept dump of a request or response, along with the generation
+// of the lock guarding it and the body it was made from.
+type rawDump struct {
+	gen  uint64
+	body interface{}
+	data []byte
+}
+
+// bodyIdentity returns what identifies a body that can't change without being
+// replaced, or false if the body isn't one of those.
+func bodyIdentity(body io.ReadCloser) (interface{}, bool) {
+	switch b := body.(type) {
+	case nil:
+		return nil, true
+	case spooled:
+		return b.Spool(), true
+	case *chunkedBody:
+		return b, true
+	}
+	return body, body == http.NoBody
+}
+
+// dump returns the dump of the given message with the given body, made with fn
+// unless one was kept at the lock's current generation, so that stating and
+// reading raw files doesn't dump the message again each time, which takes time
+// in proportion to its body. It must be called holding the lock exclusively.
+// Messages without a lock are dumped each time.
+func (l *msgLock) dump(msg interface{}, body *io.ReadCloser, fn func() ([]byte, error)) ([]byte, error) {
+	if _, ok := (*body).(*chunkedBody); !ok {
+		spoolBody(body)
+	}
+	id, keep := bodyIdentity(*body)
+	keep = keep && l != nil
+	if keep {
+		if d, ok := l.dumps[msg]; ok && d.gen == l.gen && d.body == id {
+			return d.data, nil
+		}
+	}
+
+	orig := *body
+	data, err := fn()
+	restoreBody(body, orig)
+	if err != nil || !keep || len(data) > rawDumpMax {
+		return data, err
+	}
+
+	if l.dumps == nil {
+		l.dumps = make(map[interface{}]*rawDump)
+	}
+	l.dumps[msg] = &rawDump{gen: l.gen, body: id, data: data}
+	return data, nil
+}
+
+// dumpRequest returns the raw dump of a request, including its body.
+func (l *msgLock) dumpRequest(req *http.Request) ([]byte, error) {
+	return l.dump(req, &req.Body, func() ([]byte, error) {
+		return httputil.DumpRequest(req, true)
+	})
+}
+
+// dumpResponse returns the raw dump of a response, including its body.
+func (l *msgLock) dumpResponse(resp *http.Response) ([]byte, error) {
+	return l.dump(resp, &resp.Body, func() ([]byte, error) {
+		return httputil.DumpResponse(resp, true)
+	})
+}
@@ -0,0 +1,215 @@
+package proxyfs
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+
+	"bazil.org/fuse"
+)
+
+// redacted replaces the values removed by redaction rules.
+const redacted = "REDACTED"
+
+// redactionRule removes a secret from what's saved or exported: the value of
+// a header, the value of a query parameter, or the matches of a regexp in
+// bodies.
+type redactionRule struct {
+	Kind string
+	Name string
+	Re   *regexp.Regexp
+}
+
+// redactionRules is a list of redaction rules that can be read and replaced
+// as a file. Each line of the file is a rule, made up of its kind followed by
+// a header name, query parameter name or regexp, e.g.
+//
+//	header Authorization
+//	param access_token
+//	body "password":"([^"]*)"
+//
+// Body regexps replace their whole match, or just their groups if they have
+// any. Blank lines and lines starting with '#' are ignored. The rules are
+// applied to the history as it's saved to a store or project and to exports,
+// but never to traffic being forwarded.
+type redactionRules struct {
+	mu    sync.RWMutex
+	src   []byte
+	rules []redactionRule
+}
+
+// parseRedactionRules parses rules in the format described for
+// redactionRules.
+func parseRedactionRules(src string) ([]redactionRule, error) {
+	ret := make([]redactionRule, 0)
+	for n, line := range strings.Split(src, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		parts := strings.SplitN(line, " ", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[1]) == "" {
+			return nil, fmt.Errorf("line %d: expected a kind and a name or regexp", n+1)
+		}
+		rule := redactionRule{Kind: parts[0], Name: strings.TrimSpace(parts[1])}
+		switch rule.Kind {
+		case "header":
+			rule.Name = http.CanonicalHeaderKey(rule.Name)
+		case "param":
+		case "body":
+			re, err := regexp.Compile(rule.Name)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", n+1, err)
+			}
+			rule.Re = re
+		default:
+			return nil, fmt.Errorf("line %d: unknown kind %q", n+1, rule.Kind)
+		}
+		ret = append(ret, rule)
+	}
+
+	return ret, nil
+}
+
+// Empty returns whether there are no rules, in which case nothing needs to be
+// redacted.
+func (r *redactionRules) Empty() bool {
+	if r == nil {
+		return true
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.rules) == 0
+}
+
+// Header returns a copy of the given headers with the values of redacted
+// headers replaced, or the headers themselves if none are redacted.
+func (r *redactionRules) Header(h http.Header) http.Header {
+	if r.Empty() {
+		return h
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	ret, cloned := h, false
+	for _, rule := range r.rules {
+		if rule.Kind != "header" || len(h[rule.Name]) == 0 {
+			continue
+		}
+		if !cloned {
+			ret, cloned = h.Clone(), true
+		}
+		vals := make([]string, len(h[rule.Name]))
+		for i := range vals {
+			vals[i] = redacted
+		}
+		ret[rule.Name] = vals
+	}
+	return ret
+}
+
+// URL returns a copy of the given URL with the values of redacted query
+// parameters replaced.
+func (r *redactionRules) URL(u *url.URL) *url.URL {
+	ret := *u
+	if r.Empty() || u.RawQuery == "" {
+		return &ret
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	q := u.Query()
+	changed := false
+	for _, rule := range r.rules {
+		if vals, ok := q[rule.Name]; ok && rule.Kind == "param" {
+			for i := range vals {
+				vals[i] = redacted
+			}
+			changed = true
+		}
+	}
+	if changed {
+		ret.RawQuery = q.Encode()
+	}
+	return &ret
+}
+
+// Body returns the given body with the matches of the body rules replaced.
+func (r *redactionRules) Body(body []byte) []byte {
+	if r.Empty() || len(body) == 0 {
+		return body
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, rule := range r.rules {
+		if rule.Kind == "body" {
+			body = redactMatches(rule.Re, body)
+		}
+	}
+	return body
+}
+
+// redactMatches replaces the matches of re in data, or just the parts of
+// them matched by its groups if it has any.
+func redactMatches(re *regexp.Regexp, data []byte) []byte {
+	matches := re.FindAllSubmatchIndex(data, -1)
+	if len(matches) == 0 {
+		return data
+	}
+
+	ret := make([]byte, 0, len(data))
+	last := 0
+	for _, m := range matches {
+		spans := [][]int{{m[0], m[1]}}
+		if len(m) > 2 {
+			spans = spans[:0]
+			for i := 2; i < len(m); i += 2 {
+				if m[i] >= last && m[i] >= 0 {
+					spans = append(spans, []int{m[i], m[i+1]})
+				}
+			}
+		}
+		for _, s := range spans {
+			if s[0] < last {
+				continue
+			}
+			ret = append(ret, data[last:s[0]]...)
+			ret = append(ret, redacted...)
+			last = s[1]
+		}
+	}
+	return append(ret, data[last:]...)
+}
+
+func (r *redactionRules) ValRead(ctx context.Context) ([]byte, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.src, nil
+}
+
+func (r *redactionRules) ValWrite(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+	rules, err := parseRedactionRules(string(req.Data))
+	if err != nil {
+		return errInvalid
+	}
+
+	r.mu.Lock()
+	r.src = append([]byte(nil), req.Data...)
+	r.rules = rules
+	r.mu.Unlock()
+
+	resp.Size = len(req.Data)
+	return nil
+}
+
+func (r *redactionRules) Size(ctx context.Context) (uint64, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return uint64(len(r.src)), nil
+}
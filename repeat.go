@@ -0,0 +1,189 @@
+package proxyfs
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+	"github.com/danielthatcher/fusebox"
+)
+
+// repeatTab holds a raw request that's sent upstream by hand, as many times
+// as wanted, keeping the response to the last send so that a request can be
+// edited and re-sent while watching how the response changes.
+type repeatTab struct {
+	mu      sync.RWMutex
+	Request []byte
+	Target  []byte
+
+	cancel   context.CancelFunc
+	sent     int
+	time     time.Time
+	req      *http.Request
+	resp     *http.Response
+	err      error
+	duration time.Duration
+}
+
+// newRepeatTabs returns the set of repeater tabs.
+func newRepeatTabs(p *Proxy) *jobSet {
+	create := func() job { return &repeatTab{} }
+	dir := func(j job) fusebox.VarNode { return p.repeatTabDir(j.(*repeatTab)) }
+	return newJobSet(p, create, dir)
+}
+
+// Start sends the tab's request, waiting for the response. The concurrency
+// is ignored, as a tab only sends one request at a time.
+func (t *repeatTab) Start(p *Proxy, concurrency int) error {
+	t.mu.Lock()
+	if t.cancel != nil {
+		t.mu.Unlock()
+		return fuse.Errno(syscall.EBUSY)
+	}
+	req, err := parseRawRequest(p.Vars.Expand(t.Request), p.Vars.Expand(t.Target))
+	if err != nil {
+		t.mu.Unlock()
+		return errInvalid
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.cancel = cancel
+	t.mu.Unlock()
+	defer cancel()
+
+	sent := snapshotRequest(req)
+	start := time.Now()
+	resp, err := p.send(req.WithContext(ctx))
+	duration := time.Since(start)
+	var snap *http.Response
+	if err == nil {
+		snap = snapshotResponse(resp, sent)
+		resp.Body.Close()
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.cancel = nil
+	t.sent++
+	t.time = start
+	t.req, t.resp, t.err = sent, snap, err
+	t.duration = duration
+	return nil
+}
+
+// Stop cancels the request being sent, if any.
+func (t *repeatTab) Stop() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.cancel != nil {
+		t.cancel()
+	}
+}
+
+// Report returns a summary of the last send.
+func (t *repeatTab) Report() []byte {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	buf := new(bytes.Buffer)
+	state := "idle"
+	if t.cancel != nil {
+		state = "sending"
+	}
+	fmt.Fprintf(buf, "state: %s\n", state)
+	fmt.Fprintf(buf, "sent: %d\n", t.sent)
+	if t.sent == 0 {
+		return buf.Bytes()
+	}
+	status := "error"
+	if t.resp != nil {
+		status = strconv.Itoa(t.resp.StatusCode)
+	}
+	fmt.Fprintf(buf, "last: %s\n", t.time.Format(time.RFC3339))
+	fmt.Fprintf(buf, "status: %s\n", status)
+	fmt.Fprintf(buf, "duration: %v\n", t.duration)
+	return buf.Bytes()
+}
+
+// Last returns the request and response of the last send, and the error it
+// failed with, if any.
+func (t *repeatTab) Last() (*http.Request, *http.Response, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.req, t.resp, t.err
+}
+
+// RawResponse returns the response to the last send in its raw form.
+func (t *repeatTab) RawResponse() []byte {
+	_, resp, _ := t.Last()
+	if resp == nil {
+		return nil
+	}
+	ret, err := httputil.DumpResponse(snapshotResponse(resp, resp.Request), true)
+	if err != nil {
+		return nil
+	}
+	return ret
+}
+
+// repeatSendFile sends a repeater tab's request when 1 is written to it,
+// returning once the response has arrived. Reading it gives a summary of the
+// last send.
+type repeatSendFile struct {
+	Proxy *Proxy
+	Tab   *repeatTab
+}
+
+func (f *repeatSendFile) ValRead(ctx context.Context) ([]byte, error) {
+	return f.Tab.Report(), nil
+}
+
+func (f *repeatSendFile) ValWrite(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+	if strings.TrimSpace(string(req.Data)) != "1" {
+		return errInvalid
+	}
+	if err := f.Tab.Start(f.Proxy, 1); err != nil {
+		return err
+	}
+	resp.Size = len(req.Data)
+	return nil
+}
+
+func (f *repeatSendFile) Size(ctx context.Context) (uint64, error) {
+	return uint64(len(f.Tab.Report())), nil
+}
+
+// repeatTabDir returns the Dir exposing a single repeater tab.
+func (p *Proxy) repeatTabDir(t *repeatTab) *fusebox.Dir {
+	ret, d := newNodeDir()
+	ret.Mode = os.ModeDir | 0755
+	d.add("target", newValueFile(&jobFile{&t.mu, &t.Target, nil}))
+	d.add("request", newHandleFile(&jobFile{&t.mu, &t.Request, nil}))
+	d.add("from", newHandleFile(&fromHistoryFile{p, &t.mu, &t.Request, &t.Target}))
+
+	send := newHandleFile(&repeatSendFile{p, t})
+	send.OpenFlags = fuse.OpenDirectIO
+	d.add("send", send)
+
+	d.add("response", newReadOnlyFile(t.RawResponse))
+	d.add("error", newReadOnlyFile(func() []byte {
+		if _, _, err := t.Last(); err != nil {
+			return []byte(err.Error())
+		}
+		return nil
+	}))
+	if req, resp, _ := t.Last(); req != nil {
+		d.add("req", freezeDir(newReqDir(newReqDirElement(req, nil))))
+		if resp != nil {
+			d.add("resp", freezeDir(newRespDir(newRespDirElement(resp, nil))))
+		}
+	}
+	return ret
+}
@@ -0,0 +1,274 @@
+package proxyfs
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+	"github.com/danielthatcher/fusebox"
+)
+
+// replayJob re-sends requests from the history, keeping the gaps between
+// them that there were when they were first sent, optionally sped up or
+// slowed down, so that load patterns and time dependent behaviour can be
+// reproduced.
+type replayJob struct {
+	mu      sync.RWMutex
+	Entries []byte
+	Speed   []byte
+	Unsafe  []byte
+
+	concurrency int
+	started     time.Time
+	finished    time.Time
+	total       int
+	completed   int
+	errors      int
+	sent        []string
+	stop        chan struct{}
+}
+
+// newReplayJobs returns the set of replay jobs.
+func newReplayJobs(p *Proxy) *jobSet {
+	create := func() job { return &replayJob{Speed: []byte("1"), Unsafe: []byte("0")} }
+	dir := func(j job) fusebox.VarNode { return newReplayJobDir(p, j.(*replayJob)) }
+	return newJobSet(p, create, dir)
+}
+
+// parseIDRanges parses a list of history IDs and inclusive ranges of them,
+// separated by commas or whitespace, e.g. "3-10,14". It returns nil for an
+// empty list.
+func parseIDRanges(data []byte) ([][2]int, error) {
+	fields := strings.FieldsFunc(string(data), func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t' || r == '\n'
+	})
+	if len(fields) == 0 {
+		return nil, nil
+	}
+
+	ret := make([][2]int, 0, len(fields))
+	for _, f := range fields {
+		parts := strings.SplitN(f, "-", 2)
+		from, err := strconv.Atoi(parts[0])
+		if err != nil || from < 0 {
+			return nil, fmt.Errorf("invalid ID %q", f)
+		}
+		to := from
+		if len(parts) == 2 {
+			if to, err = strconv.Atoi(parts[1]); err != nil || to < from {
+				return nil, fmt.Errorf("invalid range %q", f)
+			}
+		}
+		ret = append(ret, [2]int{from, to})
+	}
+	return ret, nil
+}
+
+// parseSpeed parses a speed multiplier, where 0 means requests are sent as
+// quickly as possible, ignoring their original timing.
+func parseSpeed(data []byte) (float64, error) {
+	speed, err := strconv.ParseFloat(strings.TrimSpace(string(data)), 64)
+	if err != nil || speed < 0 {
+		return 0, fmt.Errorf("invalid speed %q", data)
+	}
+	return speed, nil
+}
+
+// selectEntries returns the history entries with IDs in the given ranges, or
+// every entry if there are none, in the order they were sent.
+func selectEntries(h *history, ranges [][2]int) []*historyEntry {
+	ret := make([]*historyEntry, 0)
+	for _, e := range h.Entries() {
+		if ranges == nil {
+			ret = append(ret, e)
+			continue
+		}
+		for _, r := range ranges {
+			if e.ID >= r[0] && e.ID <= r[1] {
+				ret = append(ret, e)
+				break
+			}
+		}
+	}
+	sort.SliceStable(ret, func(i, j int) bool { return ret[i].Time.Before(ret[j].Time) })
+	return ret
+}
+
+// Start starts replaying the selected entries in the background, with up to
+// concurrency requests in flight.
+func (j *replayJob) Start(p *Proxy, concurrency int) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.stop != nil && j.finished.IsZero() {
+		return fuse.Errno(syscall.EBUSY)
+	}
+
+	ranges, err := parseIDRanges(j.Entries)
+	if err != nil {
+		return errInvalid
+	}
+	speed, err := parseSpeed(j.Speed)
+	if err != nil {
+		return errInvalid
+	}
+	override, err := parseOverride(j.Unsafe)
+	if err != nil {
+		return errInvalid
+	}
+	entries := selectEntries(p.History, ranges)
+	if len(entries) == 0 {
+		return errInvalid
+	}
+	for _, e := range entries {
+		if !p.mayResend(e.Req, override) {
+			return errUnsafe
+		}
+	}
+
+	j.concurrency = concurrency
+	j.started = time.Now()
+	j.finished = time.Time{}
+	j.total = len(entries)
+	j.completed, j.errors = 0, 0
+	j.sent = nil
+	j.stop = make(chan struct{})
+	go j.run(p, entries, speed, j.stop)
+	return nil
+}
+
+// Stop stops the job if it's running. Requests already in flight complete.
+func (j *replayJob) Stop() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.stop != nil && j.finished.IsZero() {
+		close(j.stop)
+		j.finished = time.Now()
+	}
+}
+
+// run sends each entry's request at its original offset from the first,
+// divided by the speed. Requests that are due while concurrency requests are
+// already in flight wait for one to finish, so the concurrency should be
+// high enough for the traffic being replayed.
+func (j *replayJob) run(p *Proxy, entries []*historyEntry, speed float64, stop chan struct{}) {
+	slots := make(chan struct{}, j.concurrency)
+	wg := &sync.WaitGroup{}
+	first := entries[0].Time
+	start := time.Now()
+
+loop:
+	for _, e := range entries {
+		if speed > 0 {
+			due := start.Add(time.Duration(float64(e.Time.Sub(first)) / speed))
+			select {
+			case <-time.After(time.Until(due)):
+			case <-stop:
+				break loop
+			}
+		}
+		select {
+		case slots <- struct{}{}:
+		case <-stop:
+			break loop
+		}
+
+		wg.Add(1)
+		go func(e *historyEntry, offset time.Duration) {
+			defer wg.Done()
+			j.replay(p, e, offset)
+			<-slots
+		}(e, time.Since(start))
+	}
+	wg.Wait()
+
+	j.mu.Lock()
+	if j.finished.IsZero() {
+		j.finished = time.Now()
+	}
+	j.mu.Unlock()
+}
+
+// replay sends the entry's request again, recording it in the history.
+func (j *replayJob) replay(p *Proxy, e *historyEntry, offset time.Duration) {
+	r := p.recordRequest(prepareResend(e.Req), newClientInfo("replay"))
+	resp, err := p.send(prepareResend(r.Req))
+	if err != nil {
+		j.record(fmt.Sprintf("%v\t%d\t%d\terror\n", offset, e.ID, r.ID), true)
+		return
+	}
+	p.recordResponse(r, resp, time.Since(r.Time), "replay")
+	resp.Body.Close()
+	j.record(fmt.Sprintf("%v\t%d\t%d\t%d\n", offset, e.ID, r.ID, resp.StatusCode), false)
+}
+
+func (j *replayJob) record(line string, failed bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.completed++
+	j.sent = append(j.sent, line)
+	if failed {
+		j.errors++
+	}
+}
+
+// Sent returns a line for each request sent, giving the offset it was sent
+// at from the start of the replay, the ID of the entry replayed, the ID of
+// the new entry, and the status of the response.
+func (j *replayJob) Sent() []byte {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+	return []byte(strings.Join(j.sent, ""))
+}
+
+// Report returns a summary of the job's progress.
+func (j *replayJob) Report() []byte {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+	if j.stop == nil {
+		return nil
+	}
+
+	buf := new(bytes.Buffer)
+	state := "finished"
+	elapsed := j.finished.Sub(j.started)
+	if j.finished.IsZero() {
+		state = "running"
+		elapsed = time.Since(j.started)
+	} else if j.completed < j.total {
+		state = "stopped"
+	}
+	fmt.Fprintf(buf, "state: %s\n", state)
+	fmt.Fprintf(buf, "completed: %d/%d\n", j.completed, j.total)
+	fmt.Fprintf(buf, "errors: %d\n", j.errors)
+	fmt.Fprintf(buf, "concurrency: %d\n", j.concurrency)
+	fmt.Fprintf(buf, "elapsed: %v\n", elapsed)
+	return buf.Bytes()
+}
+
+// newReplayJobDir returns the Dir exposing a single replay job.
+func newReplayJobDir(p *Proxy, j *replayJob) *fusebox.Dir {
+	ret, d := newNodeDir()
+	ret.Mode = os.ModeDir | 0755
+	d.add("entries", newValueFile(&jobFile{&j.mu, &j.Entries, func(data []byte) bool {
+		_, err := parseIDRanges(data)
+		return err == nil
+	}}))
+	d.add("speed", newValueFile(&jobFile{&j.mu, &j.Speed, func(data []byte) bool {
+		_, err := parseSpeed(data)
+		return err == nil
+	}}))
+	d.add("unsafe", newValueFile(&jobFile{&j.mu, &j.Unsafe, func(data []byte) bool {
+		_, err := parseOverride(data)
+		return err == nil
+	}}))
+	d.add("run", newJobRunFile(p, j))
+	d.add("sent", newReadOnlyFile(j.Sent))
+	return ret
+}
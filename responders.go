@@ -0,0 +1,250 @@
+package proxyfs
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"bazil.org/fuse"
+)
+
+// responderTimeout is how long a responder has to decide what to do with an
+// item before it's left in the queue.
+const responderTimeout = 10 * time.Second
+
+// queueResponders are the programs deciding what happens to the items routed
+// to named queues, so that a queue can be handled automatically. Each line of
+// the file is a queue's name followed by a command, which is run with sh, e.g.
+//
+//	api /usr/local/bin/strip-tracking
+//	auth lua ~/responders/auth.lua
+//
+// Blank lines and lines starting with '#' are ignored. Queues without a
+// responder, including the main queue, are left to be handled by hand.
+type queueResponders struct {
+	// Whether responders are run. They're saved with a project, so they're
+	// only run if asked for, so that opening a project can't run commands.
+	// Set before the proxy is started.
+	Enabled bool
+
+	mu   sync.RWMutex
+	src  []byte
+	cmds map[string]string
+}
+
+// Command returns the responder command of the given queue, if it has one and
+// responders are enabled.
+func (r *queueResponders) Command(queue string) string {
+	if !r.Enabled {
+		return ""
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cmds[queue]
+}
+
+// parseQueueResponders parses responders in the format described for
+// queueResponders.
+func parseQueueResponders(src string) (map[string]string, error) {
+	ret := make(map[string]string)
+	for _, line := range strings.Split(src, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		parts := strings.SplitN(line, " ", 2)
+		if len(parts) < 2 || strings.TrimSpace(parts[1]) == "" {
+			return nil, fmt.Errorf("responder %q isn't a queue followed by a command", line)
+		}
+		if !queueNameRegexp.MatchString(parts[0]) {
+			return nil, fmt.Errorf("invalid queue name %q", parts[0])
+		}
+		if _, ok := ret[parts[0]]; ok {
+			return nil, fmt.Errorf("queue %q has more than one responder", parts[0])
+		}
+		ret[parts[0]] = strings.TrimSpace(parts[1])
+	}
+	return ret, nil
+}
+
+func (r *queueResponders) ValRead(ctx context.Context) ([]byte, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.src, nil
+}
+
+func (r *queueResponders) ValWrite(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+	cmds, err := parseQueueResponders(string(req.Data))
+	if err != nil {
+		return errInvalid
+	}
+
+	r.mu.Lock()
+	r.src = append([]byte(nil), req.Data...)
+	r.cmds = cmds
+	r.mu.Unlock()
+
+	resp.Size = len(req.Data)
+	return nil
+}
+
+func (r *queueResponders) Size(ctx context.Context) (uint64, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return uint64(len(r.src)), nil
+}
+
+// runResponder runs a responder command with the raw item on its stdin and
+// the given variables in its environment. The first line of its output is
+// its decision, forward, drop, modify or hold, and for modify the rest is the
+// raw item to forward in place of the original. Empty output means hold.
+func runResponder(command string, env []string, raw []byte) (string, []byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), responderTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "sh", "-c", command)
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Stdin = bytes.NewReader(raw)
+	stderr := new(bytes.Buffer)
+	cmd.Stderr = stderr
+	out, err := cmd.Output()
+	if ctx.Err() != nil {
+		return "", nil, fmt.Errorf("timed out after %v", responderTimeout)
+	}
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", nil, fmt.Errorf("%v: %s", err, msg)
+		}
+		return "", nil, err
+	}
+
+	decision, rest := out, []byte(nil)
+	if i := bytes.IndexByte(out, '\n'); i >= 0 {
+		decision, rest = out[:i], out[i+1:]
+	}
+	switch d := strings.ToLower(strings.TrimSpace(string(decision))); d {
+	case "", "hold", "forward", "drop":
+		return d, nil, nil
+	case "modify":
+		return d, rest, nil
+	default:
+		return "", nil, fmt.Errorf("unknown decision %q", d)
+	}
+}
+
+// runQueueResponder runs the responder command of a queued item and applies
+// its decision. The responder is given a snapshot of the item, its environment
+// and raw dump, taken by calling snapshot holding the item's lock. The lock
+// isn't held while the responder runs, so that the item can be read and edited
+// meanwhile, and the decision is only applied if the item hasn't changed
+// since, calling modify holding the lock for modify.
+func runQueueResponder(lock *msgLock, command string, snapshot func() ([]string, []byte, error), modify func([]byte) error, forward, drop chan int) error {
+	var env []string
+	var raw []byte
+	var gen uint64
+	err := lock.write(func() (err error) {
+		env, raw, err = snapshot()
+		gen = lock.gen
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	decision, modified, err := runResponder(command, env, raw)
+	if err != nil {
+		return err
+	}
+	return lock.write(func() error {
+		if lock.gen != gen {
+			return fmt.Errorf("it was changed while the responder ran")
+		}
+		if decision == "modify" {
+			if err := modify(modified); err != nil {
+				return err
+			}
+			lock.gen++
+		}
+		applyDecision(decision, forward, drop)
+		return nil
+	})
+}
+
+// respondRequest has the responder of a request's queue, if any, decide what
+// happens to the request.
+func (p *Proxy) respondRequest(pr proxyReq) {
+	defer p.recoverPanic("running a queue responder", nil)
+	command := p.Responders.Command(pr.Queue)
+	if command == "" {
+		return
+	}
+
+	snapshot := func() ([]string, []byte, error) {
+		raw, err := pr.Lock.dumpRequest(pr.Req)
+		return responderEnv(pr.Queue, "req", pr.ID.String(), pr.Req.URL.String()), raw, err
+	}
+	modify := func(modified []byte) error {
+		raw := &httpReqRawFile{Data: pr.Req, Settings: p.Settings}
+		if err := raw.ValWrite(context.Background(), &fuse.WriteRequest{Data: modified}, &fuse.WriteResponse{}); err != nil {
+			return fmt.Errorf("invalid modified request: %v", err)
+		}
+		return nil
+	}
+	err := runQueueResponder(pr.Lock, command, snapshot, modify, pr.Forward, pr.Drop)
+	if err != nil && err != errGone {
+		p.emitEvent("responder: queue %s failed on request %s, leaving it queued: %v", pr.Queue, pr.ID, err)
+	}
+}
+
+// respondResponse is respondRequest for responses.
+func (p *Proxy) respondResponse(pr proxyResp) {
+	defer p.recoverPanic("running a queue responder", nil)
+	command := p.Responders.Command(pr.Queue)
+	if command == "" {
+		return
+	}
+
+	snapshot := func() ([]string, []byte, error) {
+		raw, err := pr.Lock.dumpResponse(pr.Resp)
+		return responderEnv(pr.Queue, "resp", pr.ID.String(), pr.Resp.Request.URL.String()), raw, err
+	}
+	modify := func(modified []byte) error {
+		raw := &httpRespRawFile{Data: pr.Resp, Settings: p.Settings}
+		if err := raw.ValWrite(context.Background(), &fuse.WriteRequest{Data: modified}, &fuse.WriteResponse{}); err != nil {
+			return fmt.Errorf("invalid modified response: %v", err)
+		}
+		return nil
+	}
+	err := runQueueResponder(pr.Lock, command, snapshot, modify, pr.Forward, pr.Drop)
+	if err != nil && err != errGone {
+		p.emitEvent("responder: queue %s failed on response %s, leaving it queued: %v", pr.Queue, pr.ID, err)
+	}
+}
+
+// applyDecision forwards or drops a queued item as a responder decided.
+// Items held by the responder are left in the queue.
+func applyDecision(decision string, forward, drop chan int) {
+	switch decision {
+	case "forward", "modify":
+		release(forward)
+	case "drop":
+		release(drop)
+	}
+}
+
+// responderEnv returns the environment variables describing a queued item to
+// its responder.
+func responderEnv(queue, kind, id, url string) []string {
+	return []string{
+		"PROXYFS_QUEUE=" + queue,
+		"PROXYFS_KIND=" + kind,
+		"PROXYFS_ID=" + id,
+		"PROXYFS_URL=" + url,
+	}
+}
@@ -0,0 +1,173 @@
+package proxyfs
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"bazil.org/fuse"
+	"github.com/danielthatcher/fusebox"
+)
+
+// retentionRule is how long the history entries for a host, and its
+// subdomains, are kept.
+type retentionRule struct {
+	Host string
+	Age  time.Duration
+}
+
+// retentionRules is a list of per-host overrides of how long history entries
+// are kept, which can be read and replaced as a file. Each line of the file
+// is a rule, made up of a host followed by an age, such as 7d or 12h, or 0 to
+// keep the host's entries forever, e.g.
+//
+//	api.example.com 2h
+//
+// Blank lines and lines starting with '#' are ignored.
+type retentionRules struct {
+	mu    sync.RWMutex
+	src   []byte
+	rules []retentionRule
+}
+
+// Age returns how long the entries for the given host are kept, which is
+// given by the rule for the most specific matching host, or def if no rule
+// matches.
+func (r *retentionRules) Age(host string, def time.Duration) time.Duration {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	ret, best := def, -1
+	for _, rule := range r.rules {
+		if (host == rule.Host || strings.HasSuffix(host, "."+rule.Host)) && len(rule.Host) > best {
+			ret, best = rule.Age, len(rule.Host)
+		}
+	}
+	return ret
+}
+
+// parseRetentionRules parses rules in the format described for
+// retentionRules.
+func parseRetentionRules(src string) ([]retentionRule, error) {
+	ret := make([]retentionRule, 0)
+	for n, line := range strings.Split(src, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("line %d: expected a host and an age", n+1)
+		}
+		age, err := parseDuration(fields[1])
+		if err != nil || age < 0 {
+			return nil, fmt.Errorf("line %d: invalid age %q", n+1, fields[1])
+		}
+		ret = append(ret, retentionRule{Host: strings.ToLower(fields[0]), Age: age})
+	}
+
+	return ret, nil
+}
+
+func (r *retentionRules) ValRead(ctx context.Context) ([]byte, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.src, nil
+}
+
+func (r *retentionRules) ValWrite(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+	rules, err := parseRetentionRules(string(req.Data))
+	if err != nil {
+		return errInvalid
+	}
+
+	r.mu.Lock()
+	r.src = append([]byte(nil), req.Data...)
+	r.rules = rules
+	r.mu.Unlock()
+
+	resp.Size = len(req.Data)
+	return nil
+}
+
+func (r *retentionRules) Size(ctx context.Context) (uint64, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return uint64(len(r.src)), nil
+}
+
+// pruneHistory deletes the history entries that are older than their host's
+// retention age, returning the number deleted.
+func (p *Proxy) pruneHistory(now time.Time) int {
+	return p.History.Prune(func(t time.Time, host string) bool {
+		age := p.Retention.Age(host, p.Settings.Get().RetentionAge)
+		return age > 0 && now.Sub(t) > age
+	})
+}
+
+// enforceRetention prunes the history at the given interval until the proxy
+// exits.
+func (p *Proxy) enforceRetention(interval time.Duration) {
+	defer p.recoverPanic("enforcing retention", func() {
+		go p.enforceRetention(interval)
+	})
+	for now := range time.Tick(interval) {
+		if n := p.pruneHistory(now); n > 0 {
+			p.emitEvent("retention: pruned %d history entries", n)
+		}
+	}
+}
+
+// purgeFile deletes the history entries matching the match expression
+// written to it. Reading it gives the number of entries deleted by the last
+// purge.
+type purgeFile struct {
+	Proxy *Proxy
+
+	mu     sync.Mutex
+	purged int
+}
+
+func (f *purgeFile) ValRead(ctx context.Context) ([]byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return []byte(fmt.Sprintf("%d\n", f.purged)), nil
+}
+
+func (f *purgeFile) ValWrite(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+	src := strings.TrimSpace(string(req.Data))
+	m, err := parseMatchExpr(src)
+	if err != nil || src == "" {
+		return errInvalid
+	}
+
+	n := 0
+	for _, e := range f.Proxy.History.Entries() {
+		if m.Match(e.Req, e.Response()) && f.Proxy.History.Delete(e.ID) {
+			n++
+		}
+	}
+	f.mu.Lock()
+	f.purged = n
+	f.mu.Unlock()
+
+	resp.Size = len(req.Data)
+	return nil
+}
+
+func (f *purgeFile) Size(ctx context.Context) (uint64, error) {
+	data, _ := f.ValRead(ctx)
+	return uint64(len(data)), nil
+}
+
+// newRetentionDir returns the Dir with the settings that control how long
+// history entries are kept.
+func newRetentionDir(p *Proxy) *fusebox.Dir {
+	ret, d := newNodeDir()
+	d.add("age", p.Settings.file(&durationValue{&p.Settings.values.RetentionAge}))
+	d.add("hosts", newHandleFile(p.Retention))
+	return ret
+}
@@ -0,0 +1,81 @@
+package proxyfs
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/elazarl/goproxy"
+)
+
+// reverseHostKey is the context key used to store the host that a client used
+// to reach the proxy in reverse proxy mode.
+type reverseHostKey struct{}
+
+// reverseHandler returns a handler for requests made directly to the proxy,
+// rather than through it, which sends them to the target through the normal
+// proxy pipeline, so that the proxy acts as a reverse proxy for the target.
+func (p *Proxy) reverseHandler(target *url.URL) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), reverseHostKey{}, r.Host)
+		r = r.WithContext(ctx)
+		r.URL.Scheme = target.Scheme
+		r.URL.Host = target.Host
+		r.Host = target.Host
+		p.Server.ServeHTTP(w, r)
+	})
+}
+
+// rewriteLinks replaces absolute links to the reverse proxy's target in HTML,
+// CSS and JavaScript responses, and redirects, with links to the proxy, so
+// that browsing stays within the proxied session.
+func (p *Proxy) rewriteLinks(r *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+	if r == nil || p.Reverse == nil || !p.Settings.Get().RewriteLinks {
+		return r
+	}
+
+	proxyHost, ok := ctx.Req.Context().Value(reverseHostKey{}).(string)
+	if !ok {
+		return r
+	}
+
+	// Links to the target may be absolute, protocol relative, or have
+	// escaped slashes inside of JavaScript strings
+	replacements := make([]string, 0)
+	for _, scheme := range []string{"https:", "http:", ""} {
+		from := scheme + "//" + p.Reverse.Host
+		to := "//" + proxyHost
+		if scheme != "" {
+			to = "http:" + to
+		}
+		replacements = append(replacements, from, to)
+		replacements = append(replacements, strings.Replace(from, "/", `\/`, -1), strings.Replace(to, "/", `\/`, -1))
+	}
+	replacer := strings.NewReplacer(replacements...)
+
+	if loc := r.Header.Get("Location"); loc != "" {
+		r.Header.Set("Location", replacer.Replace(loc))
+	}
+
+	ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if ct != "text/html" && ct != "text/css" && !strings.Contains(ct, "javascript") {
+		return r
+	}
+
+	body, err := decodeBody(peekBody(&r.Body), r.Header.Get("Content-Encoding"))
+	if err != nil {
+		return r
+	}
+	body = []byte(replacer.Replace(string(body)))
+
+	r.Header.Del("Content-Encoding")
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+	r.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	return r
+}
@@ -0,0 +1,339 @@
+package proxyfs
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/user"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+)
+
+// role is what the users of a mount or SFTP socket are allowed to change, so
+// that a shared proxy can be exposed to a team without everyone being able to
+// reconfigure it.
+type role int
+
+const (
+	// Observers can read everything, but change nothing.
+	roleObserver role = iota
+
+	// Operators can also forward, drop and edit intercepted items, label
+	// and annotate history, and run jobs.
+	roleOperator
+
+	// Admins can also change the proxy's settings.
+	roleAdmin
+)
+
+// adminPaths are the parts of the filesystem that configure the proxy, which
+// only admins can change. A path covers everything below it.
+var adminPaths = []string{
+	"scope",
+	"settings",
+	"project",
+	"overrides",
+	"dns",
+	"history/purge",
+	"mirror/rules",
+	"queues/responders",
+}
+
+// parseRole parses the name of a role.
+func parseRole(s string) (role, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "observer":
+		return roleObserver, nil
+	case "operator":
+		return roleOperator, nil
+	case "admin":
+		return roleAdmin, nil
+	}
+	return roleObserver, fmt.Errorf("unknown role %q, expected observer, operator or admin", s)
+}
+
+func (r role) String() string {
+	switch r {
+	case roleOperator:
+		return "operator"
+	case roleAdmin:
+		return "admin"
+	}
+	return "observer"
+}
+
+// CanWrite returns whether the role can change the node at the given path,
+// given as its names from the root.
+func (r role) CanWrite(path []string) bool {
+	switch r {
+	case roleAdmin:
+		return true
+	case roleOperator:
+		p := strings.Join(path, "/")
+		for _, a := range adminPaths {
+			if p == a || strings.HasPrefix(p, a+"/") {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// roleFS serves a filesystem to users with the given role, rejecting
+// changes the role isn't allowed to make with EACCES.
+//
+// Through a mount, each request is checked against the role of the user making
+// it: the user running the proxy is an admin, users given their own role have
+// that role, and other users have the mount's role. The permissions shown by
+// stat are those of the mount's role, as the kernel shares them between users.
+type roleFS struct {
+	fs   fs.FS
+	role role
+
+	// The roles of particular users, by UID
+	users map[uint32]role
+
+	// The UID of the user running the proxy
+	owner uint32
+
+	// Whether requests carry the user making them, which they don't over SFTP
+	uids bool
+
+	// Marks the proxy as degraded when an operation panics
+	degrade func(format string, args ...interface{})
+}
+
+// newRoleFS returns the given filesystem as it's served to users of the
+// proxy with the given role, or the given users with their own roles.
+func newRoleFS(p *Proxy, f fs.FS, r role, users map[uint32]role, uids bool) *roleFS {
+	return &roleFS{
+		fs:      f,
+		role:    r,
+		users:   users,
+		owner:   uint32(os.Getuid()),
+		uids:    uids,
+		degrade: p.degrade,
+	}
+}
+
+// roleOf returns the role of the user making the request with the given
+// header.
+func (f *roleFS) roleOf(h fuse.Header) role {
+	if !f.uids {
+		return f.role
+	}
+	if r, ok := f.users[h.Uid]; ok {
+		return r
+	}
+	if h.Uid == f.owner {
+		return roleAdmin
+	}
+	return f.role
+}
+
+func (f *roleFS) Root() (fs.Node, error) {
+	root, err := f.fs.Root()
+	if err != nil {
+		return nil, err
+	}
+	return &roleNode{Node: root, fs: f}, nil
+}
+
+// roleNode wraps a node, checking writes to it and changes to its children
+// against a role. Nodes looked up through it are wrapped in turn, and opening
+// it returns the wrapped node's own handle, so reads and writes through an
+// open handle behave exactly as they would without the wrapper.
+type roleNode struct {
+	fs.Node
+	fs   *roleFS
+	path []string
+}
+
+// catchPanic recovers from a panic in the filesystem operation it's deferred
+// in, on the node at the given path, marking the proxy as degraded with the
+// given function and failing the operation with EIO.
+func catchPanic(degrade func(format string, args ...interface{}), op string, path []string, err *error) {
+	v := recover()
+	if v == nil {
+		return
+	}
+	log.Printf("Panic in %s of %s: %v\n%s", op, strings.Join(path, "/"), v, debug.Stack())
+	degrade("panic in %s of %s: %v", op, strings.Join(path, "/"), v)
+	*err = errInternal
+}
+
+// child returns the path of the child with the given name.
+func (n *roleNode) child(name string) []string {
+	return append(append([]string(nil), n.path...), name)
+}
+
+// wrap returns the given child node wrapped.
+func (n *roleNode) wrap(node fs.Node, name string) *roleNode {
+	return &roleNode{Node: node, fs: n.fs, path: n.child(name)}
+}
+
+func (n *roleNode) Attr(ctx context.Context, a *fuse.Attr) error {
+	if err := n.Node.Attr(ctx, a); err != nil {
+		return err
+	}
+	if !n.fs.role.CanWrite(n.path) {
+		a.Mode &^= 0222
+	}
+	return nil
+}
+
+func (n *roleNode) Lookup(ctx context.Context, name string) (_ fs.Node, err error) {
+	defer catchPanic(n.fs.degrade, "lookup", n.path, &err)
+	dir, ok := n.Node.(fs.NodeStringLookuper)
+	if !ok {
+		return nil, fuse.Errno(syscall.ENOTDIR)
+	}
+	node, err := dir.Lookup(ctx, name)
+	if err != nil || node == nil {
+		return node, err
+	}
+	return n.wrap(node, name), nil
+}
+
+func (n *roleNode) ReadDirAll(ctx context.Context) (_ []fuse.Dirent, err error) {
+	defer catchPanic(n.fs.degrade, "readdir", n.path, &err)
+	dir, ok := n.Node.(fs.HandleReadDirAller)
+	if !ok {
+		return nil, fuse.Errno(syscall.ENOTDIR)
+	}
+	return dir.ReadDirAll(ctx)
+}
+
+func (n *roleNode) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (_ fs.Handle, err error) {
+	defer catchPanic(n.fs.degrade, "open", n.path, &err)
+	if (!req.Flags.IsReadOnly() || req.Flags&fuse.OpenTruncate != 0) && !n.fs.roleOf(req.Header).CanWrite(n.path) {
+		return nil, errReadOnly
+	}
+	if o, ok := n.Node.(fs.NodeOpener); ok {
+		return o.Open(ctx, req, resp)
+	}
+	return n.Node, nil
+}
+
+func (n *roleNode) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse.SetattrResponse) (err error) {
+	defer catchPanic(n.fs.degrade, "setattr", n.path, &err)
+	if !n.fs.roleOf(req.Header).CanWrite(n.path) {
+		return errReadOnly
+	}
+	if s, ok := n.Node.(fs.NodeSetattrer); ok {
+		return s.Setattr(ctx, req, resp)
+	}
+	return nil
+}
+
+func (n *roleNode) Fsync(ctx context.Context, req *fuse.FsyncRequest) error {
+	if s, ok := n.Node.(fs.NodeFsyncer); ok {
+		return s.Fsync(ctx, req)
+	}
+	return nil
+}
+
+func (n *roleNode) Mkdir(ctx context.Context, req *fuse.MkdirRequest) (_ fs.Node, err error) {
+	defer catchPanic(n.fs.degrade, "mkdir", n.path, &err)
+	if !n.fs.roleOf(req.Header).CanWrite(n.child(req.Name)) {
+		return nil, errReadOnly
+	}
+	m, ok := n.Node.(fs.NodeMkdirer)
+	if !ok {
+		return nil, fuse.EPERM
+	}
+	node, err := m.Mkdir(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	return n.wrap(node, req.Name), nil
+}
+
+func (n *roleNode) Create(ctx context.Context, req *fuse.CreateRequest, resp *fuse.CreateResponse) (_ fs.Node, _ fs.Handle, err error) {
+	defer catchPanic(n.fs.degrade, "create", n.path, &err)
+	if !n.fs.roleOf(req.Header).CanWrite(n.child(req.Name)) {
+		return nil, nil, errReadOnly
+	}
+	c, ok := n.Node.(fs.NodeCreater)
+	if !ok {
+		return nil, nil, fuse.EPERM
+	}
+	node, h, err := c.Create(ctx, req, resp)
+	if err != nil {
+		return nil, nil, err
+	}
+	return n.wrap(node, req.Name), h, nil
+}
+
+func (n *roleNode) Remove(ctx context.Context, req *fuse.RemoveRequest) (err error) {
+	defer catchPanic(n.fs.degrade, "remove", n.path, &err)
+	if !n.fs.roleOf(req.Header).CanWrite(n.child(req.Name)) {
+		return errReadOnly
+	}
+	r, ok := n.Node.(fs.NodeRemover)
+	if !ok {
+		return fuse.EPERM
+	}
+	return r.Remove(ctx, req)
+}
+
+func (n *roleNode) Rename(ctx context.Context, req *fuse.RenameRequest, newDir fs.Node) (err error) {
+	defer catchPanic(n.fs.degrade, "rename", n.path, &err)
+	to, ok := newDir.(*roleNode)
+	r := n.fs.roleOf(req.Header)
+	if !ok || !r.CanWrite(n.child(req.OldName)) || !r.CanWrite(to.child(req.NewName)) {
+		return errReadOnly
+	}
+	rn, ok := n.Node.(fs.NodeRenamer)
+	if !ok {
+		return fuse.EPERM
+	}
+	return rn.Rename(ctx, req, to.Node)
+}
+
+// parseShare parses a mount given as path=role.
+func parseShare(s string) (string, role, error) {
+	i := strings.LastIndex(s, "=")
+	if i < 0 {
+		return "", roleObserver, fmt.Errorf("expected path=role, got %q", s)
+	}
+	r, err := parseRole(s[i+1:])
+	if err != nil {
+		return "", roleObserver, err
+	}
+	return s[:i], r, nil
+}
+
+// parseUserRole parses a user's role given as user=role, where the user is a
+// name or a UID.
+func parseUserRole(s string) (uint32, role, error) {
+	i := strings.LastIndex(s, "=")
+	if i < 0 {
+		return 0, roleObserver, fmt.Errorf("expected user=role, got %q", s)
+	}
+	r, err := parseRole(s[i+1:])
+	if err != nil {
+		return 0, roleObserver, err
+	}
+
+	name := s[:i]
+	if _, err := strconv.ParseUint(name, 10, 32); err != nil {
+		u, err := user.Lookup(name)
+		if err != nil {
+			return 0, roleObserver, err
+		}
+		name = u.Uid
+	}
+	uid, err := strconv.ParseUint(name, 10, 32)
+	if err != nil {
+		return 0, roleObserver, fmt.Errorf("user %s has no numeric UID", s[:i])
+	}
+	return uint32(uid), r, nil
+}
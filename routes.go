@@ -0,0 +1,148 @@
+package proxyfs
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"bazil.org/fuse"
+)
+
+// routeRule sends a share of the requests matching its expression to another
+// upstream.
+type routeRule struct {
+	// The percentage of matching requests routed to Target
+	Weight float64
+	Target *url.URL
+	Expr   *matchExpr
+}
+
+// routeRules is a list of weighted routing rules that can be read and
+// replaced as a file. Each line of the file is a rule, made up of a
+// percentage, the base URL of the upstream to route to, and a match
+// expression, e.g.
+//
+//	10% https://canary.example.com path~^/api/
+//
+// A request matching several rules is routed by one of them, with each taking
+// its share of the requests in turn, and any that are left going to their
+// own upstream. Blank lines and lines starting with '#' are ignored.
+type routeRules struct {
+	mu    sync.RWMutex
+	src   []byte
+	rules []routeRule
+}
+
+// Choose picks where the given request is sent, returning the upstream it's
+// routed to, or nil if it goes to its own.
+func (r *routeRules) Choose(req *http.Request) *url.URL {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	roll := rand.Float64() * 100
+	total := 0.0
+	for _, rule := range r.rules {
+		if !rule.Expr.Match(req, nil) {
+			continue
+		}
+		total += rule.Weight
+		if roll < total {
+			return rule.Target
+		}
+	}
+	return nil
+}
+
+// parseRouteRules parses rules in the format described for routeRules.
+func parseRouteRules(src string) ([]routeRule, error) {
+	ret := make([]routeRule, 0)
+	for _, line := range strings.Split(src, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		parts := strings.SplitN(line, " ", 3)
+		if len(parts) < 2 || !strings.HasSuffix(parts[0], "%") {
+			return nil, fmt.Errorf("route %q isn't a percentage followed by a URL", line)
+		}
+		weight, err := strconv.ParseFloat(strings.TrimSuffix(parts[0], "%"), 64)
+		if err != nil || weight < 0 || weight > 100 {
+			return nil, fmt.Errorf("invalid percentage %q", parts[0])
+		}
+		target, err := parseUpstreamBase(parts[1])
+		if err != nil {
+			return nil, err
+		}
+
+		expr := ""
+		if len(parts) == 3 {
+			expr = parts[2]
+		}
+		m, err := parseMatchExpr(expr)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, routeRule{Weight: weight, Target: target, Expr: m})
+	}
+
+	return ret, nil
+}
+
+func (r *routeRules) ValRead(ctx context.Context) ([]byte, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.src, nil
+}
+
+func (r *routeRules) ValWrite(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+	rules, err := parseRouteRules(string(req.Data))
+	if err != nil {
+		return errInvalid
+	}
+
+	r.mu.Lock()
+	r.src = append([]byte(nil), req.Data...)
+	r.rules = rules
+	r.mu.Unlock()
+
+	resp.Size = len(req.Data)
+	return nil
+}
+
+func (r *routeRules) Size(ctx context.Context) (uint64, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return uint64(len(r.src)), nil
+}
+
+// parseUpstreamBase parses the base URL of an alternate upstream, such as a
+// shadow or canary, which must be an absolute http or https URL.
+func parseUpstreamBase(s string) (*url.URL, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return nil, fmt.Errorf("upstream %q isn't an http or https URL", s)
+	}
+	return u, nil
+}
+
+// retarget points a request at an alternate upstream, replacing its scheme
+// and host with the upstream's, and prepending the upstream's path, if any,
+// to its own.
+func retarget(req *http.Request, target *url.URL) {
+	req.URL.Scheme = target.Scheme
+	req.URL.Host = target.Host
+	if target.Path != "" && target.Path != "/" {
+		req.URL.Path = strings.TrimSuffix(target.Path, "/") + req.URL.Path
+		req.URL.RawPath = ""
+	}
+	req.Host = target.Host
+}
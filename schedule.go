@@ -0,0 +1,111 @@
+package proxyfs
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"bazil.org/fuse"
+)
+
+// forwardSchedule forwards a queued request at a set time, so that requests
+// can be lined up to be sent together, or at a particular moment, without the
+// operator being present.
+type forwardSchedule struct {
+	mu      sync.Mutex
+	forward chan int
+	at      time.Time
+	timer   *time.Timer
+}
+
+func newForwardSchedule(forward chan int) *forwardSchedule {
+	return &forwardSchedule{forward: forward}
+}
+
+// Set schedules the request to be forwarded at the given time, replacing any
+// earlier schedule. A zero time cancels the schedule.
+func (s *forwardSchedule) Set(at time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+	s.at = at
+	if at.IsZero() {
+		return
+	}
+	s.timer = time.AfterFunc(time.Until(at), func() {
+		release(s.forward)
+	})
+}
+
+// At returns the time the request is scheduled to be forwarded, or the zero
+// time if it isn't.
+func (s *forwardSchedule) At() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.at
+}
+
+// parseForwardTime parses a duration from now, such as "1m30s", or an
+// absolute time. Absolute times are either RFC 3339 timestamps, or a time of
+// day such as "15:00" or "15:00:00.5", which is the next time that time of
+// day comes around.
+func parseForwardTime(s string, now time.Time) (time.Time, bool) {
+	if d, err := time.ParseDuration(s); err == nil {
+		return now.Add(d), true
+	}
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t, true
+	}
+
+	for _, layout := range []string{"15:04", "15:04:05.999999999"} {
+		t, err := time.ParseInLocation(layout, s, now.Location())
+		if err != nil {
+			continue
+		}
+		y, m, d := now.Date()
+		t = time.Date(y, m, d, t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), now.Location())
+		if t.Before(now) {
+			t = t.AddDate(0, 0, 1)
+		}
+		return t, true
+	}
+	return time.Time{}, false
+}
+
+// forwardAfterFile schedules a queued request to be forwarded when written
+// to with a duration or time, in the formats accepted by parseForwardTime.
+// Writing an empty value cancels the schedule. Reading it gives the time the
+// request is scheduled for, if any.
+type forwardAfterFile struct {
+	s *forwardSchedule
+}
+
+func (f *forwardAfterFile) ValRead(ctx context.Context) ([]byte, error) {
+	at := f.s.At()
+	if at.IsZero() {
+		return nil, nil
+	}
+	return []byte(at.Format(time.RFC3339Nano)), nil
+}
+
+func (f *forwardAfterFile) ValWrite(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+	s := string(req.Data)
+	if s == "" {
+		f.s.Set(time.Time{})
+		resp.Size = len(req.Data)
+		return nil
+	}
+
+	at, ok := parseForwardTime(s, time.Now())
+	if !ok {
+		return errInvalid
+	}
+	f.s.Set(at)
+
+	resp.Size = len(req.Data)
+	return nil
+}
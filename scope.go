@@ -0,0 +1,511 @@
+package proxyfs
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+
+	"bazil.org/fuse"
+	"github.com/elazarl/goproxy"
+)
+
+// scopeList is a list of regexes matched against full URLs, one per line.
+// It's a FileElement, so can be exposed and edited directly.
+type scopeList struct {
+	mu    sync.RWMutex
+	src   []byte
+	rules []*regexp.Regexp
+}
+
+// parseScopeList compiles the regexes on each line of the given data,
+// ignoring blank lines and lines starting with '#'.
+func parseScopeList(data []byte) ([]*regexp.Regexp, error) {
+	ret := make([]*regexp.Regexp, 0)
+	s := bufio.NewScanner(bytes.NewReader(data))
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		re, err := regexp.Compile(line)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, re)
+	}
+	return ret, s.Err()
+}
+
+// Match returns whether any rule in the list matches the URL.
+func (l *scopeList) Match(u string) bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	for _, re := range l.rules {
+		if re.MatchString(u) {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *scopeList) ValRead(ctx context.Context) ([]byte, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.src, nil
+}
+
+func (l *scopeList) ValWrite(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+	rules, err := parseScopeList(req.Data)
+	if err != nil {
+		return errInvalid
+	}
+
+	l.mu.Lock()
+	l.src = append([]byte(nil), req.Data...)
+	l.rules = rules
+	l.mu.Unlock()
+
+	resp.Size = len(req.Data)
+	return nil
+}
+
+func (l *scopeList) Size(ctx context.Context) (uint64, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return uint64(len(l.src)), nil
+}
+
+// scopeRegex is the scope regex, composed of patterns that can be added and
+// removed one at a time. Each line of the file is a pattern, and the regex
+// matches whatever any of them matches. Lines written starting with '+' add a
+// pattern and lines starting with '-' remove one, so that
+//
+//	echo '+api\.example\.com' >> scope/regex
+//
+// widens the scope without rewriting it. A write made up only of such lines
+// changes the existing patterns, whether or not it's appended, while any other
+// write replaces them.
+type scopeRegex struct {
+	mu       sync.RWMutex
+	patterns []string
+
+	// The composed regex, which is replaced on each write, so it's only read
+	// through Regexp
+	re *regexp.Regexp
+}
+
+// scopeRegexPatterns returns the patterns on each line of the given data,
+// ignoring blank lines.
+func scopeRegexPatterns(data string) []string {
+	ret := make([]string, 0)
+	for _, line := range strings.Split(data, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			ret = append(ret, line)
+		}
+	}
+	return ret
+}
+
+// composeScopeRegex returns the regex matching anything one of the given
+// patterns matches. No patterns match everything.
+func composeScopeRegex(patterns []string) (*regexp.Regexp, error) {
+	for _, pat := range patterns {
+		if _, err := regexp.Compile(pat); err != nil {
+			return nil, err
+		}
+	}
+	if len(patterns) == 1 {
+		return regexp.Compile(patterns[0])
+	}
+	alts := make([]string, len(patterns))
+	for i, pat := range patterns {
+		alts[i] = "(?:" + pat + ")"
+	}
+	return regexp.Compile(strings.Join(alts, "|"))
+}
+
+// newScopeRegex returns the scope regex composed of the patterns on each line
+// of the given scope.
+func newScopeRegex(scope string) (*scopeRegex, error) {
+	patterns := scopeRegexPatterns(scope)
+	re, err := composeScopeRegex(patterns)
+	if err != nil {
+		return nil, err
+	}
+	return &scopeRegex{patterns: patterns, re: re}, nil
+}
+
+// Regexp returns the composed regex.
+func (s *scopeRegex) Regexp() *regexp.Regexp {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.re
+}
+
+// applyScopeRegexWrite returns the patterns after the given lines are written
+// to a file holding the given patterns, as described for scopeRegex.
+func applyScopeRegexWrite(patterns, lines []string) []string {
+	// Writes with any plain patterns replace the existing ones
+	ret := append([]string(nil), patterns...)
+	for _, line := range lines {
+		if line[0] != '+' && line[0] != '-' {
+			ret = ret[:0]
+			break
+		}
+	}
+
+	for _, line := range lines {
+		op, pat := byte('+'), line
+		if line[0] == '+' || line[0] == '-' {
+			op, pat = line[0], strings.TrimSpace(line[1:])
+		}
+		i := 0
+		for i < len(ret) && ret[i] != pat {
+			i++
+		}
+		switch {
+		case op == '+' && i == len(ret) && pat != "":
+			ret = append(ret, pat)
+		case op == '-' && i < len(ret):
+			ret = append(ret[:i], ret[i+1:]...)
+		}
+	}
+	return ret
+}
+
+func (s *scopeRegex) ValRead(ctx context.Context) ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if len(s.patterns) == 0 {
+		return nil, nil
+	}
+	return []byte(strings.Join(s.patterns, "\n") + "\n"), nil
+}
+
+func (s *scopeRegex) ValWrite(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	patterns := applyScopeRegexWrite(s.patterns, scopeRegexPatterns(string(req.Data)))
+	re, err := composeScopeRegex(patterns)
+	if err != nil {
+		return errInvalid
+	}
+	s.patterns = patterns
+	s.re = re
+
+	resp.Size = len(req.Data)
+	return nil
+}
+
+func (s *scopeRegex) Size(ctx context.Context) (uint64, error) {
+	data, _ := s.ValRead(ctx)
+	return uint64(len(data)), nil
+}
+
+// scopeURL returns the URL of a request as matched by the scope lists, e.g.
+// "https://example.com/path?query", without default ports. CONNECT requests
+// are treated as the root of an HTTPS site.
+func scopeURL(u *url.URL) string {
+	scheme, host, path := u.Scheme, u.Host, u.EscapedPath()
+	if scheme == "" {
+		scheme = "https"
+	}
+	if h, port, err := net.SplitHostPort(host); err == nil {
+		if (scheme == "https" && port == "443") || (scheme == "http" && port == "80") {
+			host = h
+		}
+	}
+	if path == "" {
+		path = "/"
+	}
+
+	ret := scheme + "://" + host + path
+	if u.RawQuery != "" {
+		ret += "?" + u.RawQuery
+	}
+	return ret
+}
+
+// inScope returns whether the given URL is in scope. It must match the scope
+// regex as the path, or host and path, and if there are any include rules it
+// must match one of them. URLs matching an exclude rule are never in scope.
+func (p *Proxy) inScope(u *url.URL) bool {
+	if !p.scopeRegexMatches(u) {
+		return false
+	}
+	if !p.ScopeInclude.Empty() && !p.ScopeInclude.Match(u) {
+		return false
+	}
+	return !p.ScopeExclude.Match(u)
+}
+
+// scopeRegexMatches returns whether the scope regex matches the URL's path,
+// host and path, or the whole URL.
+func (p *Proxy) scopeRegexMatches(u *url.URL) bool {
+	re := p.ScopeRegex.Regexp()
+	return re.MatchString(u.Path) || re.MatchString(u.Host+u.Path) || re.MatchString(u.String())
+}
+
+// connectCondition is the goproxy condition for CONNECT requests to hosts
+// whose HTTPS is intercepted: the host must match the scope regex, and an
+// include rule if there are any, and not be excluded as a whole by an exclude
+// pattern. Other connections are tunnelled.
+func (p *Proxy) connectCondition() goproxy.ReqConditionFunc {
+	return func(req *http.Request, ctx *goproxy.ProxyCtx) bool {
+		if re := p.ScopeRegex.Regexp(); !re.MatchString(req.URL.Path) && !re.MatchString(req.URL.Host+req.URL.Path) {
+			return false
+		}
+		if !p.ScopeInclude.Empty() && !p.ScopeInclude.MatchHost(req.URL, false) {
+			return false
+		}
+		return !p.ScopeExclude.MatchHost(req.URL, true)
+	}
+}
+
+// scopeCondition is the goproxy condition for requests and responses being
+// in scope.
+func (p *Proxy) scopeCondition() goproxy.ReqConditionFunc {
+	return func(req *http.Request, ctx *goproxy.ProxyCtx) bool {
+		return req != nil && p.inScope(req.URL)
+	}
+}
+
+// importScope reads a scope definition, or history, exported from another
+// tool. The supported formats are Burp's project options (JSON), ZAP's
+// contexts (XML) and Burp's saved items (XML). It returns a report of what was
+// imported.
+func (p *Proxy) importScope(data []byte) ([]byte, error) {
+	data = bytes.TrimSpace(data)
+	if bytes.HasPrefix(data, []byte("{")) {
+		include, exclude, err := parseBurpScope(data)
+		if err != nil {
+			return nil, err
+		}
+		p.ScopeInclude.Append(include)
+		p.ScopeExclude.Append(exclude)
+		return []byte(fmt.Sprintf("burp project options: %d include and %d exclude rules\n", len(include), len(exclude))), nil
+	}
+
+	var root struct {
+		XMLName xml.Name
+	}
+	if err := xml.Unmarshal(data, &root); err != nil {
+		return nil, err
+	}
+	switch root.XMLName.Local {
+	case "configuration":
+		include, exclude, err := parseZAPContext(data)
+		if err != nil {
+			return nil, err
+		}
+		p.ScopeInclude.Append(include)
+		p.ScopeExclude.Append(exclude)
+		return []byte(fmt.Sprintf("zap context: %d include and %d exclude rules\n", len(include), len(exclude))), nil
+	case "items":
+		n, skipped, err := p.importBurpItems(data)
+		if err != nil {
+			return nil, err
+		}
+		return []byte(fmt.Sprintf("burp items: %d imported into history, %d skipped\n", n, skipped)), nil
+	}
+	return nil, fmt.Errorf("unknown format %q", root.XMLName.Local)
+}
+
+// burpScopeRule is a rule in Burp's scope, in either its simple (prefix) or
+// advanced form.
+type burpScopeRule struct {
+	Enabled  bool   `json:"enabled"`
+	Prefix   string `json:"prefix"`
+	Protocol string `json:"protocol"`
+	Host     string `json:"host"`
+	Port     string `json:"port"`
+	File     string `json:"file"`
+}
+
+// Regexp returns the rule as a regex matching URLs.
+func (r burpScopeRule) Regexp() string {
+	if r.Prefix != "" {
+		return "^" + regexp.QuoteMeta(r.Prefix)
+	}
+
+	unanchor := func(s, def string) string {
+		s = strings.TrimSuffix(strings.TrimPrefix(s, "^"), "$")
+		if s == "" {
+			return def
+		}
+		return s
+	}
+	scheme := "https?"
+	if r.Protocol == "http" || r.Protocol == "https" {
+		scheme = r.Protocol
+	}
+	port := `(?::\d+)?`
+	if r.Port != "" {
+		port = "(?::(?:" + unanchor(r.Port, "") + "))?"
+	}
+	file := ""
+	if r.File != "" {
+		file = "(?:" + strings.TrimPrefix(unanchor(r.File, ""), "/") + ")"
+		if strings.HasSuffix(r.File, "$") {
+			file += `(?:\?.*)?$`
+		}
+	}
+	return "^" + scheme + "://(?:" + unanchor(r.Host, "[^/]*") + ")" + port + "(?:/|$)" + file
+}
+
+// parseBurpScope returns the enabled include and exclude rules in Burp's
+// project options, as regex rules.
+func parseBurpScope(data []byte) ([]string, []string, error) {
+	var opts struct {
+		Target struct {
+			Scope struct {
+				Include []burpScopeRule `json:"include"`
+				Exclude []burpScopeRule `json:"exclude"`
+			} `json:"scope"`
+		} `json:"target"`
+	}
+	if err := json.Unmarshal(data, &opts); err != nil {
+		return nil, nil, err
+	}
+
+	convert := func(rules []burpScopeRule) []string {
+		ret := make([]string, 0, len(rules))
+		for _, r := range rules {
+			if r.Enabled {
+				ret = append(ret, scopeRegexRule(r.Regexp()))
+			}
+		}
+		return ret
+	}
+	return convert(opts.Target.Scope.Include), convert(opts.Target.Scope.Exclude), nil
+}
+
+// parseZAPContext returns the include and exclude regexes of the contexts in
+// an exported ZAP context, as regex rules. ZAP's regexes must match the whole
+// URL, so they are anchored.
+func parseZAPContext(data []byte) ([]string, []string, error) {
+	var conf struct {
+		Contexts []struct {
+			Include []string `xml:"incregexes"`
+			Exclude []string `xml:"excregexes"`
+		} `xml:"context"`
+	}
+	if err := xml.Unmarshal(data, &conf); err != nil {
+		return nil, nil, err
+	}
+
+	include, exclude := make([]string, 0), make([]string, 0)
+	for _, c := range conf.Contexts {
+		for _, r := range c.Include {
+			include = append(include, scopeRegexRule("^(?:"+strings.TrimSpace(r)+")$"))
+		}
+		for _, r := range c.Exclude {
+			exclude = append(exclude, scopeRegexRule("^(?:"+strings.TrimSpace(r)+")$"))
+		}
+	}
+	return include, exclude, nil
+}
+
+// burpItem is a request and response saved from Burp.
+type burpItem struct {
+	URL      string    `xml:"url"`
+	Request  burpBlock `xml:"request"`
+	Response burpBlock `xml:"response"`
+}
+
+// burpBlock is a request or response in a saved item, which may be base64
+// encoded.
+type burpBlock struct {
+	Base64 bool   `xml:"base64,attr"`
+	Data   string `xml:",chardata"`
+}
+
+// Bytes returns the block's contents.
+func (b burpBlock) Bytes() ([]byte, error) {
+	if b.Base64 {
+		return base64.StdEncoding.DecodeString(strings.TrimSpace(b.Data))
+	}
+	return []byte(b.Data), nil
+}
+
+// importBurpItems adds the requests and responses in Burp's saved items to
+// the history, returning how many were imported and skipped.
+func (p *Proxy) importBurpItems(data []byte) (int, int, error) {
+	var items struct {
+		Items []burpItem `xml:"item"`
+	}
+	if err := xml.Unmarshal(data, &items); err != nil {
+		return 0, 0, err
+	}
+
+	imported, skipped := 0, 0
+	for _, item := range items.Items {
+		u, err := url.Parse(strings.TrimSpace(item.URL))
+		raw, rerr := item.Request.Bytes()
+		if err != nil || rerr != nil || !u.IsAbs() {
+			skipped++
+			continue
+		}
+		req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(raw)))
+		if err != nil {
+			skipped++
+			continue
+		}
+		req.URL.Scheme, req.URL.Host = u.Scheme, u.Host
+		req.RequestURI = ""
+
+		e := p.recordRequest(req, newClientInfo("import"))
+		imported++
+		if raw, err := item.Response.Bytes(); err == nil && len(raw) > 0 {
+			if resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(raw)), e.Req); err == nil {
+				p.recordResponse(e, resp, 0, "import")
+			}
+		}
+	}
+	return imported, skipped, nil
+}
+
+// scopeImportFile imports the exported configuration or history written to
+// it. Reading it gives the report of the last import.
+type scopeImportFile struct {
+	Proxy *Proxy
+	mu    sync.Mutex
+	last  []byte
+}
+
+func (f *scopeImportFile) ValRead(ctx context.Context) ([]byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.last, nil
+}
+
+func (f *scopeImportFile) ValWrite(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+	report, err := f.Proxy.importScope(req.Data)
+	if err != nil {
+		return errInvalid
+	}
+
+	f.mu.Lock()
+	f.last = report
+	f.mu.Unlock()
+
+	resp.Size = len(req.Data)
+	return nil
+}
+
+func (f *scopeImportFile) Size(ctx context.Context) (uint64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return uint64(len(f.last)), nil
+}
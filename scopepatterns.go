@@ -0,0 +1,484 @@
+package proxyfs
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"bazil.org/fuse"
+	"github.com/danielthatcher/fusebox"
+)
+
+// scopePattern is a host or URL pattern of the include or exclude list. A
+// pattern is a host, optionally with a scheme, port and path prefix, where
+// '*' matches any characters, e.g.
+//
+//	example.com
+//	*.example.com
+//	https://api.example.com:8443/v2/
+//
+// Patterns without a scheme, port or path match any.
+type scopePattern struct {
+	Src    string
+	Scheme string
+	Port   string
+	Host   *regexp.Regexp
+
+	// The path prefix, or nil to match any path
+	Path *regexp.Regexp
+}
+
+// globRegexp compiles a pattern where '*' matches any characters, anchored at
+// the start, and at the end if whole is set.
+func globRegexp(s string, whole bool) *regexp.Regexp {
+	expr := "^" + strings.Replace(regexp.QuoteMeta(s), `\*`, ".*", -1)
+	if whole {
+		expr += "$"
+	}
+	return regexp.MustCompile(expr)
+}
+
+// parseScopePattern parses a pattern in the format described for
+// scopePattern.
+func parseScopePattern(s string) (*scopePattern, error) {
+	ret := &scopePattern{Src: strings.TrimSpace(s)}
+	rest := ret.Src
+	if i := strings.Index(rest, "://"); i >= 0 {
+		ret.Scheme = strings.ToLower(rest[:i])
+		rest = rest[i+3:]
+		if ret.Scheme != "http" && ret.Scheme != "https" {
+			return nil, fmt.Errorf("pattern %q isn't for http or https", s)
+		}
+	}
+
+	host, path := rest, ""
+	if i := strings.Index(rest, "/"); i >= 0 {
+		host, path = rest[:i], rest[i:]
+	}
+	if i := strings.LastIndex(host, ":"); i >= 0 && !strings.HasSuffix(host, "]") {
+		host, ret.Port = host[:i], host[i+1:]
+		if _, err := strconv.Atoi(ret.Port); err != nil {
+			return nil, fmt.Errorf("invalid port in pattern %q", s)
+		}
+	}
+	host = strings.Trim(strings.ToLower(host), "[]")
+	if host == "" || strings.ContainsAny(host, " \t") {
+		return nil, fmt.Errorf("invalid host in pattern %q", s)
+	}
+
+	ret.Host = globRegexp(host, true)
+	if path != "" && path != "/" {
+		ret.Path = globRegexp(path, false)
+	}
+	return ret, nil
+}
+
+// matchHost returns whether the pattern matches the scheme, host and port of
+// the URL, which are https and its default port for CONNECT requests.
+func (p *scopePattern) matchHost(u *url.URL) bool {
+	scheme := u.Scheme
+	if scheme == "" {
+		scheme = "https"
+	}
+	if p.Scheme != "" && p.Scheme != scheme {
+		return false
+	}
+	if p.Port != "" {
+		port := u.Port()
+		if port == "" {
+			port = "80"
+			if scheme == "https" {
+				port = "443"
+			}
+		}
+		if p.Port != port {
+			return false
+		}
+	}
+	return p.Host.MatchString(strings.ToLower(u.Hostname()))
+}
+
+// Match returns whether the pattern matches the URL.
+func (p *scopePattern) Match(u *url.URL) bool {
+	if !p.matchHost(u) {
+		return false
+	}
+	if p.Path == nil {
+		return true
+	}
+	path := u.Path
+	if path == "" {
+		path = "/"
+	}
+	return p.Path.MatchString(path)
+}
+
+// scopeRule is a rule of the include or exclude list: a host or URL pattern,
+// e.g. "*.example.com", or a regex matched against full URLs, as given by
+// scopeURL, written with a leading '~', e.g. "~^https://example\.com/app/".
+type scopeRule struct {
+	Src     string
+	Regexp  *regexp.Regexp
+	Pattern *scopePattern
+}
+
+// parseScopeRule parses a rule in the format described for scopeRule.
+func parseScopeRule(s string) (*scopeRule, error) {
+	ret := &scopeRule{Src: strings.TrimSpace(s)}
+	if strings.HasPrefix(ret.Src, "~") {
+		re, err := regexp.Compile(ret.Src[1:])
+		if err != nil {
+			return nil, err
+		}
+		ret.Regexp = re
+		return ret, nil
+	}
+
+	p, err := parseScopePattern(ret.Src)
+	if err != nil {
+		return nil, err
+	}
+	ret.Pattern = p
+	return ret, nil
+}
+
+// scopeRegexRule returns the rule for the given regex.
+func scopeRegexRule(re string) string {
+	return "~" + re
+}
+
+// Match returns whether the rule matches the URL.
+func (r *scopeRule) Match(u *url.URL) bool {
+	if r.Pattern != nil {
+		return r.Pattern.Match(u)
+	}
+	return r.Regexp.MatchString(scopeURL(u))
+}
+
+// MatchHost returns whether the rule matches the URL's scheme, host and port,
+// whatever its path. If whole is set, only patterns for every path of a host
+// count. Regexes can't be matched against a host alone, so they count unless
+// whole is set.
+func (r *scopeRule) MatchHost(u *url.URL, whole bool) bool {
+	if r.Pattern == nil {
+		return !whole
+	}
+	return (!whole || r.Pattern.Path == nil) && r.Pattern.matchHost(u)
+}
+
+// scopeRules is the include or exclude list. Each rule is exposed as a file of
+// its own, named by a number that doesn't change while it's in the list, and
+// the list as a whole as a file with a rule per line.
+type scopeRules struct {
+	mu    sync.RWMutex
+	next  int
+	rules map[int]*scopeRule
+}
+
+func newScopeRules() *scopeRules {
+	return &scopeRules{rules: make(map[int]*scopeRule)}
+}
+
+// IDs returns the numbers of the rules, in the order they were added.
+func (l *scopeRules) IDs() []int {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	ret := make([]int, 0, len(l.rules))
+	for id := range l.rules {
+		ret = append(ret, id)
+	}
+	sort.Ints(ret)
+	return ret
+}
+
+// Get returns the rule with the given number, or nil if there isn't one.
+func (l *scopeRules) Get(id int) *scopeRule {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.rules[id]
+}
+
+// Empty returns whether the list has no rules.
+func (l *scopeRules) Empty() bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return len(l.rules) == 0
+}
+
+// Match returns whether any rule in the list matches the URL.
+func (l *scopeRules) Match(u *url.URL) bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	for _, r := range l.rules {
+		if r.Match(u) {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchHost returns whether any rule in the list matches the URL's scheme,
+// host and port, as for scopeRule.MatchHost.
+func (l *scopeRules) MatchHost(u *url.URL, whole bool) bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	for _, r := range l.rules {
+		if r.MatchHost(u, whole) {
+			return true
+		}
+	}
+	return false
+}
+
+// Add parses the rules on each line of data, ignoring blank lines and lines
+// starting with '#', and adds them to the list. Nothing is added if any of
+// them is invalid.
+func (l *scopeRules) Add(data []byte) error {
+	rules, err := parseScopeRules(data)
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, r := range rules {
+		l.rules[l.next] = r
+		l.next++
+	}
+	return nil
+}
+
+// Append adds the given rules to the list, skipping any that are invalid or
+// that it already has.
+func (l *scopeRules) Append(rules []string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, s := range rules {
+		r, err := parseScopeRule(s)
+		if err != nil || l.has(r.Src) {
+			continue
+		}
+		l.rules[l.next] = r
+		l.next++
+	}
+}
+
+// has returns whether the list has a rule written as src. l.mu must be held.
+func (l *scopeRules) has(src string) bool {
+	for _, r := range l.rules {
+		if r.Src == src {
+			return true
+		}
+	}
+	return false
+}
+
+// Set replaces the rule with the given number.
+func (l *scopeRules) Set(id int, r *scopeRule) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.rules[id]; !ok {
+		return errGone
+	}
+	l.rules[id] = r
+	return nil
+}
+
+// parseScopeRules parses a rule per line, ignoring blank lines and lines
+// starting with '#'.
+func parseScopeRules(data []byte) ([]*scopeRule, error) {
+	ret := make([]*scopeRule, 0)
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		r, err := parseScopeRule(line)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, r)
+	}
+	return ret, nil
+}
+
+// scopePatternRules returns the given rules, such as those given on the
+// command line, one per line.
+func scopePatternRules(patterns []string) []byte {
+	buf := new(bytes.Buffer)
+	for _, pat := range patterns {
+		buf.WriteString(strings.TrimSpace(pat) + "\n")
+	}
+	return buf.Bytes()
+}
+
+// ValRead returns every rule, one per line, so that the list can be edited as
+// a whole and saved with a project.
+func (l *scopeRules) ValRead(ctx context.Context) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	for _, id := range l.IDs() {
+		if r := l.Get(id); r != nil {
+			buf.WriteString(r.Src + "\n")
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// Replace replaces every rule in the list with those on each line of data, as
+// for Add.
+func (l *scopeRules) Replace(data []byte) error {
+	rules, err := parseScopeRules(data)
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rules = make(map[int]*scopeRule)
+	for _, r := range rules {
+		l.rules[l.next] = r
+		l.next++
+	}
+	return nil
+}
+
+// ValWrite replaces every rule with those written, one per line.
+func (l *scopeRules) ValWrite(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+	if err := l.Replace(req.Data); err != nil {
+		return errInvalid
+	}
+	resp.Size = len(req.Data)
+	return nil
+}
+
+func (l *scopeRules) Size(ctx context.Context) (uint64, error) {
+	data, _ := l.ValRead(ctx)
+	return uint64(len(data)), nil
+}
+
+func (l *scopeRules) GetNode(ctx context.Context, k string) (fusebox.VarNode, error) {
+	if k == "add" {
+		ret := newHandleFile(&scopeAddFile{l})
+		ret.OpenFlags = fuse.OpenDirectIO
+		return ret, nil
+	}
+
+	id, err := strconv.Atoi(k)
+	if err != nil || l.Get(id) == nil {
+		return nil, fuse.ENOENT
+	}
+	return newValueFile(&scopeRuleFile{l, id}), nil
+}
+
+func (l *scopeRules) GetDirentType(ctx context.Context, k string) (fuse.DirentType, error) {
+	if _, err := l.GetNode(ctx, k); err != nil {
+		return fuse.DT_Unknown, err
+	}
+	return fuse.DT_File, nil
+}
+
+func (l *scopeRules) GetKeys(ctx context.Context) []string {
+	ret := []string{"add"}
+	for _, id := range l.IDs() {
+		ret = append(ret, strconv.Itoa(id))
+	}
+	return ret
+}
+
+func (l *scopeRules) AddNode(name string, node interface{}) error {
+	return fuse.EPERM
+}
+
+// RemoveNode removes the rule with the given number, e.g. through rm.
+func (l *scopeRules) RemoveNode(name string) error {
+	id, err := strconv.Atoi(name)
+	if err != nil {
+		return fuse.EPERM
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.rules[id]; !ok {
+		return fuse.ENOENT
+	}
+	delete(l.rules, id)
+	return nil
+}
+
+// newScopeRulesDir returns the Dir exposing the rules of an include or exclude
+// list one at a time.
+func newScopeRulesDir(l *scopeRules) *fusebox.Dir {
+	ret := fusebox.NewDir(l)
+	ret.Mode = os.ModeDir | 0755
+	ret.OpenFlags = fuse.OpenDirectIO
+	return ret
+}
+
+// scopeRuleFile exposes a single rule of a list, which can be changed by
+// writing another.
+type scopeRuleFile struct {
+	List *scopeRules
+	ID   int
+}
+
+func (f *scopeRuleFile) ValRead(ctx context.Context) ([]byte, error) {
+	r := f.List.Get(f.ID)
+	if r == nil {
+		return nil, errGone
+	}
+	return []byte(r.Src), nil
+}
+
+func (f *scopeRuleFile) ValWrite(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+	r, err := parseScopeRule(string(req.Data))
+	if err != nil {
+		return errInvalid
+	}
+	if err := f.List.Set(f.ID, r); err != nil {
+		return err
+	}
+	resp.Size = len(req.Data)
+	return nil
+}
+
+// scopeAddFile adds the rules written to it, one per line, to a list.
+type scopeAddFile struct {
+	List *scopeRules
+}
+
+func (f *scopeAddFile) ValRead(ctx context.Context) ([]byte, error) {
+	return nil, nil
+}
+
+func (f *scopeAddFile) ValWrite(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+	if err := f.List.Add(req.Data); err != nil {
+		return errInvalid
+	}
+	resp.Size = len(req.Data)
+	return nil
+}
+
+func (f *scopeAddFile) Size(ctx context.Context) (uint64, error) {
+	return 0, nil
+}
+
+// newScopeDir returns the Dir exposing the scope: the rules of the include and
+// exclude lists, which are also exposed whole in settings/scope, and the scope
+// regex's patterns along with the regex composed of them.
+func newScopeDir(p *Proxy) *fusebox.Dir {
+	ret, d := newNodeDir()
+	d.add("include", newScopeRulesDir(p.ScopeInclude))
+	d.add("exclude", newScopeRulesDir(p.ScopeExclude))
+	d.add("regex", newHandleFile(p.ScopeRegex))
+	d.add("compiled", newReadOnlyFile(func() []byte {
+		return []byte(p.ScopeRegex.Regexp().String() + "\n")
+	}))
+	return ret
+}
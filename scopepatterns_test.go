@@ -0,0 +1,46 @@
+package proxyfs
+
+import (
+	"net/url"
+	"testing"
+)
+
+// TestScopeRules checks that rules are host or URL patterns unless they're
+// marked as regexes with '~'.
+func TestScopeRules(t *testing.T) {
+	tests := []struct {
+		rule  string
+		url   string
+		match bool
+	}{
+		{"*.example.com", "https://api.example.com/login", true},
+		{"*.example.com", "https://example.org/", false},
+		{"https://example.com/api/", "https://example.com/api/users", true},
+		{"https://example.com/api/", "http://example.com/api/users", false},
+		{"~^https://example\\.com/app/", "https://example.com/app/login", true},
+		{"~^https://example\\.com/app/", "https://example.com/", false},
+	}
+	for _, test := range tests {
+		r, err := parseScopeRule(test.rule)
+		if err != nil {
+			t.Errorf("%q: %v", test.rule, err)
+			continue
+		}
+		u, _ := url.Parse(test.url)
+		if got := r.Match(u); got != test.match {
+			t.Errorf("%q matching %s: got %v, expected %v", test.rule, test.url, got, test.match)
+		}
+	}
+
+	if _, err := parseScopeRule("~(unclosed"); err == nil {
+		t.Error("invalid regex rule was accepted")
+	}
+
+	l := newScopeRules()
+	if err := l.Add([]byte("*.example.com\n~^https://example\\.org/\n")); err != nil {
+		t.Fatal(err)
+	}
+	if ids := l.IDs(); len(ids) != 2 || l.Get(ids[0]).Pattern == nil || l.Get(ids[1]).Regexp == nil {
+		t.Errorf("add gave rules %v", ids)
+	}
+}
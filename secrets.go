@@ -0,0 +1,71 @@
+package proxyfs
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+)
+
+// secretPattern describes a type of credential that can be detected in traffic.
+// If the pattern has a submatch, the first submatch is taken to be the secret.
+type secretPattern struct {
+	Kind string
+	Re   *regexp.Regexp
+}
+
+// secretPatterns are the types of credential searched for in traffic.
+var secretPatterns = []secretPattern{
+	{"jwt", regexp.MustCompile(`eyJ[A-Za-z0-9_-]{4,}\.eyJ[A-Za-z0-9_-]{4,}\.[A-Za-z0-9_-]*`)},
+	{"aws-access-key", regexp.MustCompile(`\b(?:AKIA|ASIA)[0-9A-Z]{16}\b`)},
+	{"aws-secret-key", regexp.MustCompile(`(?i)aws.{0,20}?secret.{0,20}?['"=:\s]([A-Za-z0-9/+]{40})\b`)},
+	{"bearer", regexp.MustCompile(`(?i)\bbearer\s+([A-Za-z0-9\-._~+/]{8,}=*)`)},
+	{"basic-auth", regexp.MustCompile(`(?i)\bbasic\s+([A-Za-z0-9+/]{8,}=*)`)},
+	{"github-token", regexp.MustCompile(`\bgh[pousr]_[A-Za-z0-9]{36}\b`)},
+	{"slack-token", regexp.MustCompile(`\bxox[abprs]-[A-Za-z0-9-]{10,}`)},
+	{"private-key", regexp.MustCompile(`-----BEGIN [A-Z ]*PRIVATE KEY-----`)},
+	{"api-key", regexp.MustCompile(`(?i)["']?(?:api[_-]?key|secret|access[_-]?token)["']?\s*[:=]\s*["']?([A-Za-z0-9_\-]{16,})`)},
+}
+
+// maxSecretScan is how much of the start of a body is scanned for secrets.
+const maxSecretScan = 1 << 20
+
+// scanSecrets searches the given headers and body for credentials, adding
+// any found to the list. The source describes where they came from, e.g.
+// "history/3 req".
+func scanSecrets(l *findingList, h http.Header, body []byte, source string) {
+	for k, vals := range h {
+		for _, v := range vals {
+			for _, s := range findSecrets([]byte(v)) {
+				l.Add(s.Kind, s.Kind+":"+s.Value, s.Value, fmt.Sprintf("%s header %s", source, k))
+			}
+		}
+	}
+
+	if len(body) > maxSecretScan {
+		body = body[:maxSecretScan]
+	}
+	for _, s := range findSecrets(body) {
+		l.Add(s.Kind, s.Kind+":"+s.Value, s.Value, source+" body")
+	}
+}
+
+type foundSecret struct {
+	Kind  string
+	Value string
+}
+
+// findSecrets returns the credentials that appear in the given data.
+func findSecrets(data []byte) []foundSecret {
+	ret := make([]foundSecret, 0)
+	for _, p := range secretPatterns {
+		for _, m := range p.Re.FindAllSubmatch(data, -1) {
+			v := m[0]
+			if len(m) > 1 {
+				v = m[1]
+			}
+			ret = append(ret, foundSecret{p.Kind, string(v)})
+		}
+	}
+
+	return ret
+}
@@ -0,0 +1,132 @@
+package proxyfs
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+
+	"bazil.org/fuse"
+)
+
+// errUnsafeResend is the error of a request a job didn't send because it
+// isn't safe to send again.
+var errUnsafeResend = errors.New("not sent, since it isn't safe to send again")
+
+// defaultResendSafe are the resend safety rules the proxy starts with, which
+// allow the methods that don't change anything on the server.
+const defaultResendSafe = "method=GET\nmethod=HEAD\nmethod=OPTIONS\n"
+
+// prepareResend returns a copy of a recorded request that can be sent again
+// using the proxy's transport.
+func prepareResend(req *http.Request) *http.Request {
+	ret := snapshotRequest(req)
+	ret.ContentLength = int64(bodyLen(&ret.Body))
+	ret.RequestURI = ""
+	return ret
+}
+
+// send sends a request upstream using the proxy's transport, without it going
+// through the scope, intercept queues or history.
+func (p *Proxy) send(req *http.Request) (*http.Response, error) {
+	return p.transportRoundTrip(req)
+}
+
+// resendRules is a list of match expressions selecting the requests that are
+// safe for the proxy to send again by itself, e.g. when benchmarking,
+// replaying or mirroring, because sending them twice can't change anything.
+// Each line of the file is an expression, and a request is safe if it matches
+// any of them, e.g.
+//
+//	method=GET
+//	method=PUT path~^/api/drafts/
+//
+// Blank lines and lines starting with '#' are ignored.
+type resendRules struct {
+	mu    sync.RWMutex
+	src   []byte
+	rules []*matchExpr
+}
+
+func newResendRules() *resendRules {
+	rules, _ := parseResendRules(defaultResendSafe)
+	return &resendRules{src: []byte(defaultResendSafe), rules: rules}
+}
+
+// Safe returns whether the given request is safe to send again.
+func (r *resendRules) Safe(req *http.Request) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, m := range r.rules {
+		if m.Match(req, nil) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseResendRules parses rules in the format described for resendRules.
+func parseResendRules(src string) ([]*matchExpr, error) {
+	ret := make([]*matchExpr, 0)
+	for _, line := range strings.Split(src, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		m, err := parseMatchExpr(line)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, m)
+	}
+
+	return ret, nil
+}
+
+func (r *resendRules) ValRead(ctx context.Context) ([]byte, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.src, nil
+}
+
+func (r *resendRules) ValWrite(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+	rules, err := parseResendRules(string(req.Data))
+	if err != nil {
+		return errInvalid
+	}
+
+	r.mu.Lock()
+	r.src = append([]byte(nil), req.Data...)
+	r.rules = rules
+	r.mu.Unlock()
+
+	resp.Size = len(req.Data)
+	return nil
+}
+
+func (r *resendRules) Size(ctx context.Context) (uint64, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return uint64(len(r.src)), nil
+}
+
+// mayResend returns whether the proxy may send a request again by itself:
+// either it's safe to, or unsafe requests have been allowed, for everything
+// through settings/resend-unsafe, or just for a job with override.
+func (p *Proxy) mayResend(req *http.Request, override bool) bool {
+	return override || p.Settings.Get().ResendUnsafe || p.ResendSafe.Safe(req)
+}
+
+// parseOverride parses a job's override of the resend safety rules, which is
+// "1" to send unsafe requests anyway, or "0".
+func parseOverride(data []byte) (bool, error) {
+	switch strings.TrimSpace(string(data)) {
+	case "0", "":
+		return false, nil
+	case "1":
+		return true, nil
+	}
+	return false, errInvalid
+}
@@ -0,0 +1,466 @@
+package proxyfs
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"bazil.org/fuse"
+	"github.com/danielthatcher/fusebox"
+)
+
+// sessionNameRegexp matches the names that can be given to sessions.
+var sessionNameRegexp = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// sessionCookie is a cookie held in a session's jar. A domain starting with
+// '.' also matches its subdomains.
+type sessionCookie struct {
+	Domain string
+	Path   string
+	Name   string
+	Value  string
+}
+
+// matches returns whether the cookie is sent with requests to the given URL.
+func (c sessionCookie) matches(u *url.URL) bool {
+	host := strings.ToLower(u.Hostname())
+	if strings.HasPrefix(c.Domain, ".") {
+		if host != c.Domain[1:] && !strings.HasSuffix(host, c.Domain) {
+			return false
+		}
+	} else if host != c.Domain {
+		return false
+	}
+
+	path := u.Path
+	if path == "" {
+		path = "/"
+	}
+	return path == c.Path || strings.HasPrefix(path, strings.TrimSuffix(c.Path, "/")+"/")
+}
+
+// sessionJar holds a session's cookies, which are set by the responses to its
+// requests and sent with them in place of the client's. Each line of the file
+// is a cookie, given as its domain, path and name=value, e.g.
+//
+//	.example.com / session=abc123
+//
+// so that cookies can be planted or removed by editing it.
+type sessionJar struct {
+	mu      sync.RWMutex
+	cookies []sessionCookie
+}
+
+// Cookies returns the cookies to send with a request to the given URL, those
+// with the longest paths first.
+func (j *sessionJar) Cookies(u *url.URL) []sessionCookie {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+	ret := make([]sessionCookie, 0)
+	for _, c := range j.cookies {
+		if c.matches(u) {
+			ret = append(ret, c)
+		}
+	}
+	sort.SliceStable(ret, func(i, k int) bool {
+		return len(ret[i].Path) > len(ret[k].Path)
+	})
+	return ret
+}
+
+// Update stores the cookies set by a response to one of the session's
+// requests, and removes those it expires. Cookies for domains other than the
+// request's are ignored.
+func (j *sessionJar) Update(resp *http.Response) {
+	if resp.Request == nil {
+		return
+	}
+	u := resp.Request.URL
+	host := strings.ToLower(u.Hostname())
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	for _, hc := range resp.Cookies() {
+		c := sessionCookie{Domain: host, Path: hc.Path, Name: hc.Name, Value: hc.Value}
+		if hc.Domain != "" {
+			c.Domain = "." + strings.TrimPrefix(strings.ToLower(hc.Domain), ".")
+			if !c.matches(&url.URL{Host: host, Path: "/"}) {
+				continue
+			}
+		}
+		if !strings.HasPrefix(c.Path, "/") {
+			c.Path = "/"
+			if i := strings.LastIndex(u.Path, "/"); i > 0 {
+				c.Path = u.Path[:i]
+			}
+		}
+
+		// Replace any cookie with the same domain, path and name
+		i := 0
+		for i < len(j.cookies) {
+			o := j.cookies[i]
+			if o.Domain == c.Domain && o.Path == c.Path && o.Name == c.Name {
+				break
+			}
+			i++
+		}
+		expired := hc.MaxAge < 0 || (!hc.Expires.IsZero() && hc.Expires.Before(time.Now()))
+		switch {
+		case expired && i < len(j.cookies):
+			j.cookies = append(j.cookies[:i], j.cookies[i+1:]...)
+		case expired:
+		case i < len(j.cookies):
+			j.cookies[i] = c
+		default:
+			j.cookies = append(j.cookies, c)
+		}
+	}
+}
+
+// parseSessionCookies parses cookies in the format described for sessionJar.
+func parseSessionCookies(src string) ([]sessionCookie, error) {
+	ret := make([]sessionCookie, 0)
+	for _, line := range strings.Split(src, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 3 || !strings.HasPrefix(fields[1], "/") {
+			return nil, fmt.Errorf("cookie %q isn't a domain, path and name=value", line)
+		}
+		kv := strings.SplitN(fields[2], "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("cookie %q has no name", line)
+		}
+		ret = append(ret, sessionCookie{Domain: strings.ToLower(fields[0]), Path: fields[1], Name: kv[0], Value: kv[1]})
+	}
+	return ret, nil
+}
+
+func (j *sessionJar) ValRead(ctx context.Context) ([]byte, error) {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+	ret := make([]byte, 0)
+	for _, c := range j.cookies {
+		ret = append(ret, fmt.Sprintf("%s %s %s=%s\n", c.Domain, c.Path, c.Name, c.Value)...)
+	}
+	return ret, nil
+}
+
+func (j *sessionJar) ValWrite(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+	cookies, err := parseSessionCookies(string(req.Data))
+	if err != nil {
+		return errInvalid
+	}
+
+	j.mu.Lock()
+	j.cookies = cookies
+	j.mu.Unlock()
+
+	resp.Size = len(req.Data)
+	return nil
+}
+
+func (j *sessionJar) Size(ctx context.Context) (uint64, error) {
+	data, _ := j.ValRead(ctx)
+	return uint64(len(data)), nil
+}
+
+// session is an identity that requests can be sent as, with its own cookie
+// jar and headers, so that several users can be exercised side by side
+// through one proxy.
+type session struct {
+	Jar *sessionJar
+
+	mu      sync.RWMutex
+	headers []byte
+}
+
+// Apply makes a request one of the session's: its cookies replace the
+// client's, and its headers are set, with references to variables expanded.
+func (s *session) Apply(r *http.Request, vars *varSet) {
+	r.Header.Del("Cookie")
+	for _, c := range s.Jar.Cookies(r.URL) {
+		r.AddCookie(&http.Cookie{Name: c.Name, Value: c.Value})
+	}
+
+	s.mu.RLock()
+	headers := s.headers
+	s.mu.RUnlock()
+	for k, v := range parseHeaderBlock(vars.Expand(headers)) {
+		r.Header[k] = v
+	}
+}
+
+// sessionHeadersFile exposes the headers a session sets on its requests, in
+// the format "Name: value", one per line.
+type sessionHeadersFile struct {
+	Session *session
+}
+
+func (f *sessionHeadersFile) ValRead(ctx context.Context) ([]byte, error) {
+	f.Session.mu.RLock()
+	defer f.Session.mu.RUnlock()
+	return f.Session.headers, nil
+}
+
+func (f *sessionHeadersFile) ValWrite(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+	if parseHeaderBlock(req.Data) == nil {
+		return errInvalid
+	}
+
+	f.Session.mu.Lock()
+	f.Session.headers = append([]byte(nil), req.Data...)
+	f.Session.mu.Unlock()
+
+	resp.Size = len(req.Data)
+	return nil
+}
+
+func (f *sessionHeadersFile) Size(ctx context.Context) (uint64, error) {
+	f.Session.mu.RLock()
+	defer f.Session.mu.RUnlock()
+	return uint64(len(f.Session.headers)), nil
+}
+
+// sessionRule assigns the requests matching its expression to a session.
+type sessionRule struct {
+	Name string
+	Expr *matchExpr
+}
+
+// sessionRules assign in scope requests to sessions. Each line of the file is
+// a rule, made up of the session's name and a match expression, e.g.
+//
+//	alice header:X-User=alice
+//	bob path~^/admin/
+//
+// Requests are sent as the session of the first rule they match, and as the
+// client sent them if they match none. Blank lines and lines starting with
+// '#' are ignored.
+type sessionRules struct {
+	mu    sync.RWMutex
+	src   []byte
+	rules []sessionRule
+}
+
+// Session returns the name of the session the given request is assigned to,
+// or an empty string if it isn't assigned to one.
+func (r *sessionRules) Session(req *http.Request) string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, rule := range r.rules {
+		if rule.Expr.Match(req, nil) {
+			return rule.Name
+		}
+	}
+	return ""
+}
+
+// parseSessionRules parses rules in the format described for sessionRules.
+func parseSessionRules(src string) ([]sessionRule, error) {
+	ret := make([]sessionRule, 0)
+	for _, line := range strings.Split(src, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		parts := strings.SplitN(line, " ", 2)
+		if !sessionNameRegexp.MatchString(parts[0]) || parts[0] == "rules" {
+			return nil, fmt.Errorf("invalid session name %q", parts[0])
+		}
+		expr := ""
+		if len(parts) == 2 {
+			expr = parts[1]
+		}
+		m, err := parseMatchExpr(expr)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, sessionRule{Name: parts[0], Expr: m})
+	}
+	return ret, nil
+}
+
+func (r *sessionRules) ValRead(ctx context.Context) ([]byte, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.src, nil
+}
+
+func (r *sessionRules) ValWrite(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+	rules, err := parseSessionRules(string(req.Data))
+	if err != nil {
+		return errInvalid
+	}
+
+	r.mu.Lock()
+	r.src = append([]byte(nil), req.Data...)
+	r.rules = rules
+	r.mu.Unlock()
+
+	resp.Size = len(req.Data)
+	return nil
+}
+
+func (r *sessionRules) Size(ctx context.Context) (uint64, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return uint64(len(r.src)), nil
+}
+
+// sessionSet holds the named sessions, and the rules assigning requests to
+// them. Sessions are created with mkdir, or when a request is first sent as
+// one.
+type sessionSet struct {
+	Rules *sessionRules
+
+	mu       sync.RWMutex
+	sessions map[string]*session
+}
+
+func newSessionSet() *sessionSet {
+	return &sessionSet{
+		Rules:    &sessionRules{},
+		sessions: make(map[string]*session),
+	}
+}
+
+// Get returns the named session, creating it if it doesn't exist, or nil if
+// no name is given.
+func (s *sessionSet) Get(name string) *session {
+	if name == "" {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ret, ok := s.sessions[name]
+	if !ok {
+		ret = &session{Jar: &sessionJar{}}
+		s.sessions[name] = ret
+	}
+	return ret
+}
+
+// Find returns the named session, or nil if there isn't one.
+func (s *sessionSet) Find(name string) *session {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.sessions[name]
+}
+
+func (s *sessionSet) GetNode(ctx context.Context, k string) (fusebox.VarNode, error) {
+	if k == "rules" {
+		return newHandleFile(s.Rules), nil
+	}
+
+	s.mu.RLock()
+	sess, ok := s.sessions[k]
+	s.mu.RUnlock()
+	if !ok {
+		return nil, fuse.ENOENT
+	}
+	ret, d := newNodeDir()
+	d.add("cookies", newHandleFile(sess.Jar))
+	d.add("headers", newHandleFile(&sessionHeadersFile{sess}))
+	return ret, nil
+}
+
+func (s *sessionSet) GetDirentType(ctx context.Context, k string) (fuse.DirentType, error) {
+	if k == "rules" {
+		return fuse.DT_File, nil
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if _, ok := s.sessions[k]; !ok {
+		return fuse.DT_Unknown, fuse.ENOENT
+	}
+	return fuse.DT_Dir, nil
+}
+
+func (s *sessionSet) GetKeys(ctx context.Context) []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	ret := make([]string, 0, len(s.sessions)+1)
+	for name := range s.sessions {
+		ret = append(ret, name)
+	}
+	sort.Strings(ret)
+	return append([]string{"rules"}, ret...)
+}
+
+// AddNode creates a new, empty session named by name, e.g. through mkdir.
+func (s *sessionSet) AddNode(name string, node interface{}) error {
+	if !sessionNameRegexp.MatchString(name) || name == "rules" {
+		return fuse.EPERM
+	}
+	s.Get(name)
+	return nil
+}
+
+func (s *sessionSet) RemoveNode(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.sessions[name]; !ok {
+		return fuse.ENOENT
+	}
+	delete(s.sessions, name)
+	return nil
+}
+
+// newSessionsDir returns the Dir holding the sessions.
+func newSessionsDir(s *sessionSet) *fusebox.Dir {
+	ret := fusebox.NewDir(s)
+	ret.Mode = os.ModeDir | 0777
+	ret.OpenFlags = fuse.OpenDirectIO
+	return ret
+}
+
+// sessionChoice is the session a queued request is sent as, which starts as
+// the one its rules assign and can be changed while the request waits. It's
+// empty for the client's own identity.
+type sessionChoice struct {
+	mu   sync.Mutex
+	name string
+}
+
+// Name returns the name of the chosen session.
+func (c *sessionChoice) Name() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.name
+}
+
+func (c *sessionChoice) ValRead(ctx context.Context) ([]byte, error) {
+	return []byte(c.Name()), nil
+}
+
+func (c *sessionChoice) ValWrite(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+	name := strings.TrimSpace(string(req.Data))
+	if name != "" && (!sessionNameRegexp.MatchString(name) || name == "rules") {
+		return errInvalid
+	}
+
+	c.mu.Lock()
+	c.name = name
+	c.mu.Unlock()
+
+	resp.Size = len(req.Data)
+	return nil
+}
+
+func (c *sessionChoice) Size(ctx context.Context) (uint64, error) {
+	return uint64(len(c.Name())), nil
+}
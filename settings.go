@@ -0,0 +1,256 @@
+package proxyfs
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"sync"
+	"time"
+
+	"bazil.org/fuse"
+	"github.com/danielthatcher/fusebox"
+)
+
+// settings holds the values configured through the /settings directory. They
+// are changed through the filesystem while the goroutines handling traffic
+// read them, so they're kept under a lock, and read with Get.
+type settings struct {
+	mu     sync.RWMutex
+	values settingValues
+}
+
+// settingValues are the values of the settings.
+type settingValues struct {
+	// The key used to re-sign edited JWTs. For HMAC algorithms this is the
+	// secret itself, and for RSA algorithms a PEM encoded private key.
+	JWTKey string
+
+	// Whether bodies written to decodedbody are re-compressed with gzip when
+	// the client supports it.
+	Recompress bool
+
+	// How the Accept-Encoding header of in scope requests is rewritten: "pass"
+	// leaves it alone, "strip" removes it, and "identity" replaces it with
+	// "identity" so that responses arrive uncompressed.
+	AcceptEncoding string
+
+	// How Range requests in scope are handled: "pass" sends them as they are,
+	// and "collapse" removes the Range and If-Range headers so that the full
+	// body is always returned.
+	Range string
+
+	// Whether conditional headers are removed from in scope requests, and
+	// responses marked as no-store, so that full responses are always seen
+	// rather than 304s.
+	StripCache bool
+
+	// Whether links to the target are rewritten to point at the proxy in
+	// reverse proxy mode.
+	RewriteLinks bool
+
+	// The number of intercepted items that can be queued before an alarm is
+	// raised, or 0 to disable the alarm. If AlarmAutoForward is set, raising
+	// the alarm also stops intercepting.
+	AlarmQueueDepth  int
+	AlarmAutoForward bool
+
+	// The largest body that can be written to a queued request or response,
+	// or 0 for no limit.
+	MaxBody int64
+
+	// Whether surrounding whitespace is trimmed from bodies written to queued
+	// requests and responses. By default, bodies are written byte for byte.
+	TrimWrites bool
+
+	// Which responses are stamped with Via and X-Proxied-By headers, so that
+	// it can be checked that traffic went through the proxy, and which have
+	// those headers removed before stamping, to hide upstream proxies. Each
+	// is "off", "scope" for in scope responses, or "all".
+	Mark         string
+	StripMarkers string
+
+	// How chunked bodies are passed on: "rechunk" lets them be chunked again
+	// as they're sent, and "preserve" sends in scope requests over
+	// connections of their own so that the chunks of responses are kept.
+	Chunks string
+
+	// The local address upstream connections are made from, or nil to use
+	// the default
+	BindOut net.IP
+
+	// How long history entries are kept before they're pruned, unless
+	// overridden for their host, or 0 to keep them forever
+	RetentionAge time.Duration
+
+	// What happens when the proxy hits an internal error: "open" stops
+	// intercepting and forwards everything queued, and "closed" drops
+	// everything queued and refuses in scope traffic until the error is
+	// cleared.
+	FailPolicy string
+
+	// Whether concurrent identical GET and HEAD requests are sent upstream
+	// once, with each getting a copy of the response.
+	Coalesce bool
+
+	// Whether requests that the resend safety rules don't allow are sent
+	// again anyway by benchmarks, CORS checks, replays, fuzzing and mirroring.
+	ResendUnsafe bool
+
+	// The most of a streamed response's body kept in the history, or 0 to
+	// keep all of it.
+	StreamCapture int64
+
+	// Whether intercepted HTTPS is served by the proxy's own HTTP server,
+	// rather than goproxy's, so that the frames of WebSockets opened over it
+	// can be seen. Other requests are handled by goproxy as before.
+	WebSocketTLS bool
+}
+
+// defaultSettings returns the settings used when the proxy starts.
+func defaultSettings() *settings {
+	return &settings{values: settingValues{
+		Recompress:     true,
+		AcceptEncoding: "identity",
+		Range:          "pass",
+		RewriteLinks:   true,
+		Mark:           "off",
+		StripMarkers:   "off",
+		Chunks:         "rechunk",
+		FailPolicy:     "open",
+		StreamCapture:  streamCaptureDefault,
+	}}
+}
+
+// Get returns the current values of the settings.
+func (s *settings) Get() settingValues {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.values
+}
+
+// Set changes the settings with fn, which is called with the lock held.
+func (s *settings) Set(fn func(v *settingValues)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fn(&s.values)
+}
+
+// MarshalJSON encodes the values of the settings, to be saved with a project.
+func (s *settings) MarshalJSON() ([]byte, error) {
+	v := s.Get()
+	return json.Marshal(&v)
+}
+
+// UnmarshalJSON sets the settings saved with a project.
+func (s *settings) UnmarshalJSON(data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return json.Unmarshal(data, &s.values)
+}
+
+// file returns a File exposing one of the settings through the given value
+// element, which points into s.values and is only used with the lock held.
+func (s *settings) file(e interface {
+	ValRead(ctx context.Context) ([]byte, error)
+	ValWrite(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error
+}) *handleFile {
+	return newValueFile(&settingValue{s, e})
+}
+
+// choice returns a File for one of the settings that must be one of the given
+// choices, as for file.
+func (s *settings) choice(val *string, choices ...string) *handleFile {
+	return s.file(&choiceFile{val, choices})
+}
+
+// settingValue is a value element for one of the settings, holding the
+// settings' lock while it's read or written.
+type settingValue struct {
+	settings *settings
+	value    interface {
+		ValRead(ctx context.Context) ([]byte, error)
+		ValWrite(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error
+	}
+}
+
+func (v *settingValue) ValRead(ctx context.Context) ([]byte, error) {
+	v.settings.mu.RLock()
+	defer v.settings.mu.RUnlock()
+	return v.value.ValRead(ctx)
+}
+
+func (v *settingValue) ValWrite(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+	v.settings.mu.Lock()
+	defer v.settings.mu.Unlock()
+	return v.value.ValWrite(ctx, req, resp)
+}
+
+// newSettingsDir returns the Dir exposing the proxy's settings.
+func newSettingsDir(p *Proxy) *fusebox.Dir {
+	s, v := p.Settings, &p.Settings.values
+	ret, d := newNodeDir()
+	d.add("highlight", newHandleFile(p.Highlight))
+	d.add("prefixes", newHandleFile(p.Prefixes))
+	d.add("jwt-key", s.file(&stringValue{&v.JWTKey}))
+	d.add("signing", newHandleFile(p.Signing))
+	d.add("digests", newHandleFile(p.Digests))
+	d.add("recompress", s.file(&boolValue{&v.Recompress}))
+	d.add("accept-encoding", s.choice(&v.AcceptEncoding, "pass", "strip", "identity"))
+	d.add("range", s.choice(&v.Range, "pass", "collapse"))
+	d.add("strip-cache", s.file(&boolValue{&v.StripCache}))
+	d.add("rewrite-links", s.file(&boolValue{&v.RewriteLinks}))
+	d.add("max-body", s.file(&int64Value{&v.MaxBody}))
+	d.add("trim-writes", s.file(&boolValue{&v.TrimWrites}))
+	d.add("offline", newHandleFile(p.Offline))
+	d.add("mark", s.choice(&v.Mark, "off", "scope", "all"))
+	d.add("strip-markers", s.choice(&v.StripMarkers, "off", "scope", "all"))
+	d.add("chunks", s.choice(&v.Chunks, "rechunk", "preserve"))
+	d.add("transport", newTransportDir(p))
+	d.add("retention", newRetentionDir(p))
+	d.add("redact", newHandleFile(p.Redaction))
+	d.add("fail-policy", s.choice(&v.FailPolicy, "open", "closed"))
+	d.add("routes", newHandleFile(p.Routes))
+	d.add("coalesce", s.file(&boolValue{&v.Coalesce}))
+	d.add("resend-safe", newHandleFile(p.ResendSafe))
+	d.add("resend-unsafe", s.file(&boolValue{&v.ResendUnsafe}))
+	d.add("dir-names", newHandleFile(p.DirNames))
+	d.add("stream-capture", s.file(&int64Value{&v.StreamCapture}))
+	d.add("websocket-tls", s.file(&boolValue{&v.WebSocketTLS}))
+
+	alarm, a := newNodeDir()
+	a.add("queue-depth", s.file(&intValue{&v.AlarmQueueDepth}))
+	a.add("autoforward", s.file(&boolValue{&v.AlarmAutoForward}))
+	d.add("alarm", alarm)
+
+	scope, sc := newNodeDir()
+	sc.add("include", newHandleFile(p.ScopeInclude))
+	sc.add("exclude", newHandleFile(p.ScopeExclude))
+	imp := newHandleFile(&scopeImportFile{Proxy: p})
+	imp.OpenFlags = fuse.OpenDirectIO
+	sc.add("import", imp)
+	sc.add("suggestions", newSuggestionsDir(p))
+	d.add("scope", scope)
+	return ret
+}
+
+// choiceFile is a string setting that can only take one of a fixed set of
+// values. Writing any other value fails.
+type choiceFile struct {
+	Val     *string
+	Choices []string
+}
+
+func (f *choiceFile) ValRead(ctx context.Context) ([]byte, error) {
+	return []byte(*f.Val), nil
+}
+
+func (f *choiceFile) ValWrite(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+	v := string(req.Data)
+	if !containsString(f.Choices, v) {
+		return errInvalid
+	}
+
+	*f.Val = v
+	resp.Size = len(req.Data)
+	return nil
+}
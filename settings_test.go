@@ -0,0 +1,63 @@
+package proxyfs
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"testing"
+
+	"bazil.org/fuse"
+)
+
+// TestSettingsConcurrent changes a setting through its file while requests
+// are normalised with it, which the race detector checks is safe.
+func TestSettingsConcurrent(t *testing.T) {
+	p := &Proxy{Settings: defaultSettings()}
+	s := p.Settings
+	f := &settingValue{s, &choiceFile{&s.values.AcceptEncoding, []string{"pass", "strip", "identity"}}}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 1000; i++ {
+			v := []string{"pass", "strip", "identity"}[i%3]
+			if err := f.ValWrite(context.Background(), &fuse.WriteRequest{Data: []byte(v)}, &fuse.WriteResponse{}); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	for i := 0; i < 1000; i++ {
+		r, _ := http.NewRequest("GET", "http://example.com/", nil)
+		r.Header.Set("Accept-Encoding", "gzip")
+		p.normaliseRequest(r)
+		if v := r.Header.Get("Accept-Encoding"); v != "gzip" && v != "" && v != "identity" {
+			t.Fatalf("Accept-Encoding rewritten to %q", v)
+		}
+	}
+	wg.Wait()
+}
+
+// TestSettingsJSON checks that settings are saved and loaded with a project as
+// their values.
+func TestSettingsJSON(t *testing.T) {
+	s := defaultSettings()
+	s.Set(func(v *settingValues) {
+		v.AcceptEncoding = "strip"
+		v.MaxBody = 1024
+	})
+	data, err := json.Marshal(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := defaultSettings()
+	if err := json.Unmarshal(data, loaded); err != nil {
+		t.Fatal(err)
+	}
+	if v := loaded.Get(); v.AcceptEncoding != "strip" || v.MaxBody != 1024 || !v.Recompress {
+		t.Errorf("loaded %+v from %s", v, data)
+	}
+}
@@ -0,0 +1,377 @@
+package proxyfs
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"github.com/pkg/sftp"
+)
+
+// sftpFS serves the filesystem's node tree over SFTP, driving the nodes the
+// same way the kernel does through FUSE. This lets the proxy be controlled
+// from another machine with sshfs, or any other SFTP client, tunnelled over
+// an existing SSH connection.
+type sftpFS struct {
+	root fs.Node
+}
+
+// ServeSFTP serves the filesystem over SFTP on the given connection, to a
+// client with the given role, until the client disconnects. Changes made by
+// the client are audited as having been made via the given name.
+func (p *Proxy) ServeSFTP(conn io.ReadWriteCloser, r role, via string) error {
+	root, err := newRoleFS(p, newAuditFS(p, via, false), r, nil, false).Root()
+	if err != nil {
+		return err
+	}
+
+	h := &sftpFS{root: root}
+	srv := sftp.NewRequestServer(conn, sftp.Handlers{FileGet: h, FilePut: h, FileCmd: h, FileList: h})
+	defer srv.Close()
+	if err := srv.Serve(); err != io.EOF {
+		return err
+	}
+	return nil
+}
+
+// ListenSFTP serves the filesystem over SFTP to every connection made to a
+// unix socket at the given path, with the given role. The socket is only
+// accessible to the user running the proxy.
+func (p *Proxy) ListenSFTP(socket string, r role) error {
+	// Replace the socket left behind by a previous run, but nothing else
+	if info, err := os.Lstat(socket); err == nil && info.Mode()&os.ModeSocket != 0 {
+		os.Remove(socket)
+	}
+
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	if err := os.Chmod(socket, 0600); err != nil {
+		return err
+	}
+	p.Readiness.Done("sftp")
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			if err := p.ServeSFTP(conn, r, "sftp:"+socket); err != nil {
+				p.emitEvent("sftp: %v", err)
+			}
+		}()
+	}
+}
+
+// RelaySFTP connects stdin and stdout to the SFTP socket at the given path.
+// It's run by sshfs on the remote machine in place of sftp-server, so that
+// only SSH is needed to reach the proxy.
+func RelaySFTP(socket string) error {
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	go func() {
+		io.Copy(conn, os.Stdin)
+		conn.(*net.UnixConn).CloseWrite()
+	}()
+	_, err = io.Copy(os.Stdout, conn)
+	return err
+}
+
+// sftpError converts errors from nodes to those understood by the SFTP
+// server.
+func sftpError(err error) error {
+	if e, ok := err.(fuse.ErrorNumber); ok {
+		return syscall.Errno(e.Errno())
+	}
+	return err
+}
+
+// lookup returns the node at the given path.
+func (s *sftpFS) lookup(ctx context.Context, p string) (fs.Node, error) {
+	node := s.root
+	for _, name := range strings.Split(path.Clean("/"+p), "/") {
+		if name == "" {
+			continue
+		}
+		dir, ok := node.(fs.NodeStringLookuper)
+		if !ok {
+			return nil, syscall.ENOTDIR
+		}
+
+		var err error
+		node, err = dir.Lookup(ctx, name)
+		if err != nil {
+			return nil, sftpError(err)
+		}
+		if node == nil {
+			return nil, os.ErrNotExist
+		}
+	}
+	return node, nil
+}
+
+// stat returns the FileInfo of the given node.
+func (s *sftpFS) stat(ctx context.Context, name string, node fs.Node) (os.FileInfo, error) {
+	info := &nodeInfo{name: name}
+	if err := node.Attr(ctx, &info.attr); err != nil {
+		return nil, sftpError(err)
+	}
+	return info, nil
+}
+
+// open opens the node at the given path, returning the handle to use.
+func (s *sftpFS) open(ctx context.Context, p string, flags fuse.OpenFlags) (fs.Node, fs.Handle, error) {
+	node, err := s.lookup(ctx, p)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if o, ok := node.(fs.NodeOpener); ok {
+		h, err := o.Open(ctx, &fuse.OpenRequest{Flags: flags}, &fuse.OpenResponse{})
+		if err != nil {
+			return nil, nil, sftpError(err)
+		}
+		return node, h, nil
+	}
+	return node, node, nil
+}
+
+func (s *sftpFS) Fileread(r *sftp.Request) (io.ReaderAt, error) {
+	ctx := r.Context()
+	_, h, err := s.open(ctx, r.Filepath, fuse.OpenReadOnly)
+	if err != nil {
+		return nil, err
+	}
+	return &nodeReader{ctx: ctx, handle: h}, nil
+}
+
+func (s *sftpFS) Filewrite(r *sftp.Request) (io.WriterAt, error) {
+	flags := fuse.OpenWriteOnly
+	if r.Pflags().Trunc {
+		flags |= fuse.OpenTruncate
+	}
+	if r.Pflags().Append {
+		flags |= fuse.OpenAppend
+	}
+
+	ctx := r.Context()
+	_, h, err := s.open(ctx, r.Filepath, flags)
+	if err != nil {
+		return nil, err
+	}
+	return &nodeWriter{ctx: ctx, handle: h}, nil
+}
+
+func (s *sftpFS) Filecmd(r *sftp.Request) error {
+	ctx := r.Context()
+	switch r.Method {
+	case "Setstat":
+		// Only truncation means anything to the nodes
+		if !r.AttrFlags().Size {
+			return nil
+		}
+		node, err := s.lookup(ctx, r.Filepath)
+		if err != nil {
+			return err
+		}
+		n, ok := node.(fs.NodeSetattrer)
+		if !ok {
+			return os.ErrPermission
+		}
+		req := &fuse.SetattrRequest{Valid: fuse.SetattrSize, Size: r.Attributes().Size}
+		return sftpError(n.Setattr(ctx, req, &fuse.SetattrResponse{}))
+
+	case "Mkdir":
+		parent, err := s.lookup(ctx, path.Dir(r.Filepath))
+		if err != nil {
+			return err
+		}
+		n, ok := parent.(fs.NodeMkdirer)
+		if !ok {
+			return os.ErrPermission
+		}
+		req := &fuse.MkdirRequest{Name: path.Base(r.Filepath), Mode: os.ModeDir | 0755}
+		_, err = n.Mkdir(ctx, req)
+		return sftpError(err)
+
+	case "Remove", "Rmdir":
+		parent, err := s.lookup(ctx, path.Dir(r.Filepath))
+		if err != nil {
+			return err
+		}
+		n, ok := parent.(fs.NodeRemover)
+		if !ok {
+			return os.ErrPermission
+		}
+		req := &fuse.RemoveRequest{Name: path.Base(r.Filepath), Dir: r.Method == "Rmdir"}
+		return sftpError(n.Remove(ctx, req))
+	}
+	return sftp.ErrSSHFxOpUnsupported
+}
+
+func (s *sftpFS) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
+	ctx := r.Context()
+	node, err := s.lookup(ctx, r.Filepath)
+	if err != nil {
+		return nil, err
+	}
+
+	switch r.Method {
+	case "Stat":
+		info, err := s.stat(ctx, path.Base(r.Filepath), node)
+		if err != nil {
+			return nil, err
+		}
+		return fileInfos{info}, nil
+
+	case "List":
+		dir, ok := node.(fs.HandleReadDirAller)
+		if !ok {
+			return nil, syscall.ENOTDIR
+		}
+		dirents, err := dir.ReadDirAll(ctx)
+		if err != nil {
+			return nil, sftpError(err)
+		}
+
+		// Entries can disappear between listing and lookup, e.g. when
+		// intercepted items are forwarded, so those are skipped
+		ret := make(fileInfos, 0, len(dirents))
+		for _, d := range dirents {
+			child, err := s.lookup(ctx, path.Join(r.Filepath, d.Name))
+			if err != nil {
+				continue
+			}
+			if info, err := s.stat(ctx, d.Name, child); err == nil {
+				ret = append(ret, info)
+			}
+		}
+		return ret, nil
+	}
+	return nil, sftp.ErrSSHFxOpUnsupported
+}
+
+// nodeInfo is the FileInfo of a node.
+type nodeInfo struct {
+	name string
+	attr fuse.Attr
+}
+
+func (i *nodeInfo) Name() string       { return i.name }
+func (i *nodeInfo) Size() int64        { return int64(i.attr.Size) }
+func (i *nodeInfo) Mode() os.FileMode  { return i.attr.Mode }
+func (i *nodeInfo) ModTime() time.Time { return i.attr.Mtime }
+func (i *nodeInfo) IsDir() bool        { return i.attr.Mode.IsDir() }
+func (i *nodeInfo) Sys() interface{}   { return nil }
+
+// fileInfos is a directory listing.
+type fileInfos []os.FileInfo
+
+func (f fileInfos) ListAt(ls []os.FileInfo, offset int64) (int, error) {
+	if offset >= int64(len(f)) {
+		return 0, io.EOF
+	}
+	n := copy(ls, f[offset:])
+	if n < len(ls) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// nodeReader reads from an open handle. Handles that can only be read in one
+// go are read once, and reads are served from that copy.
+type nodeReader struct {
+	ctx    context.Context
+	handle fs.Handle
+
+	mu   sync.Mutex
+	data []byte
+	read bool
+}
+
+func (r *nodeReader) ReadAt(p []byte, off int64) (int, error) {
+	var data []byte
+	if h, ok := r.handle.(fs.HandleReader); ok {
+		resp := &fuse.ReadResponse{}
+		if err := h.Read(r.ctx, &fuse.ReadRequest{Offset: off, Size: len(p)}, resp); err != nil {
+			return 0, sftpError(err)
+		}
+		data, off = resp.Data, 0
+	} else if h, ok := r.handle.(fs.HandleReadAller); ok {
+		r.mu.Lock()
+		if !r.read {
+			var err error
+			if r.data, err = h.ReadAll(r.ctx); err != nil {
+				r.mu.Unlock()
+				return 0, sftpError(err)
+			}
+			r.read = true
+		}
+		data = r.data
+		r.mu.Unlock()
+	} else {
+		return 0, os.ErrPermission
+	}
+
+	if off >= int64(len(data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (r *nodeReader) Close() error {
+	if h, ok := r.handle.(fs.HandleReleaser); ok {
+		return sftpError(h.Release(r.ctx, &fuse.ReleaseRequest{}))
+	}
+	return nil
+}
+
+// nodeWriter writes to an open handle, flushing it when closed so that any
+// error committing the value is returned to the client.
+type nodeWriter struct {
+	ctx    context.Context
+	handle fs.Handle
+}
+
+func (w *nodeWriter) WriteAt(p []byte, off int64) (int, error) {
+	h, ok := w.handle.(fs.HandleWriter)
+	if !ok {
+		return 0, os.ErrPermission
+	}
+
+	resp := &fuse.WriteResponse{}
+	if err := h.Write(w.ctx, &fuse.WriteRequest{Offset: off, Data: p}, resp); err != nil {
+		return 0, sftpError(err)
+	}
+	return resp.Size, nil
+}
+
+func (w *nodeWriter) Close() error {
+	var err error
+	if h, ok := w.handle.(fs.HandleFlusher); ok {
+		err = sftpError(h.Flush(w.ctx, &fuse.FlushRequest{}))
+	}
+	if h, ok := w.handle.(fs.HandleReleaser); ok {
+		h.Release(w.ctx, &fuse.ReleaseRequest{})
+	}
+	return err
+}
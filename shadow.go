@@ -0,0 +1,367 @@
+package proxyfs
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"bazil.org/fuse"
+	"github.com/danielthatcher/fusebox"
+)
+
+// maxShadowed is the number of mirrored exchanges remembered.
+const maxShadowed = 1000
+
+// shadowRule duplicates the requests matching its expression to another
+// upstream.
+type shadowRule struct {
+	Target *url.URL
+	Expr   *matchExpr
+}
+
+// shadowRules is a list of mirror rules that can be read and replaced as a
+// file. Each line of the file is a rule, made up of the base URL of the
+// upstream to mirror to followed by a match expression, e.g.
+//
+//	https://staging.example.com method=GET path~^/api/
+//
+// Blank lines and lines starting with '#' are ignored.
+type shadowRules struct {
+	mu    sync.RWMutex
+	src   []byte
+	rules []shadowRule
+}
+
+// Targets returns the upstreams the given request should be mirrored to.
+func (s *shadowRules) Targets(req *http.Request) []*url.URL {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	ret := make([]*url.URL, 0)
+	for _, r := range s.rules {
+		if r.Expr.Match(req, nil) {
+			ret = append(ret, r.Target)
+		}
+	}
+	return ret
+}
+
+// parseShadowRules parses rules in the format described for shadowRules.
+func parseShadowRules(src string) ([]shadowRule, error) {
+	ret := make([]shadowRule, 0)
+	for _, line := range strings.Split(src, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		parts := strings.SplitN(line, " ", 2)
+		u, err := parseUpstreamBase(parts[0])
+		if err != nil {
+			return nil, err
+		}
+
+		expr := ""
+		if len(parts) == 2 {
+			expr = parts[1]
+		}
+		m, err := parseMatchExpr(expr)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, shadowRule{Target: u, Expr: m})
+	}
+
+	return ret, nil
+}
+
+func (s *shadowRules) ValRead(ctx context.Context) ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.src, nil
+}
+
+func (s *shadowRules) ValWrite(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+	rules, err := parseShadowRules(string(req.Data))
+	if err != nil {
+		return errInvalid
+	}
+
+	s.mu.Lock()
+	s.src = append([]byte(nil), req.Data...)
+	s.rules = rules
+	s.mu.Unlock()
+
+	resp.Size = len(req.Data)
+	return nil
+}
+
+func (s *shadowRules) Size(ctx context.Context) (uint64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return uint64(len(s.src)), nil
+}
+
+// shadowExchange is a request mirrored to a shadow upstream, and what came
+// back, kept to compare with the exchange it was copied from.
+type shadowExchange struct {
+	ID    int
+	Entry *historyEntry
+	Req   *http.Request
+	Time  time.Time
+
+	mu      sync.RWMutex
+	resp    *http.Response
+	latency time.Duration
+	err     error
+	done    bool
+	diff    *shadowDiff
+}
+
+// finish records the outcome of sending the mirrored request.
+func (x *shadowExchange) finish(resp *http.Response, err error) {
+	var snap *http.Response
+	if err == nil {
+		snap = snapshotResponse(resp, x.Req)
+		resp.Body.Close()
+	}
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.resp = snap
+	x.latency = time.Since(x.Time)
+	x.err = err
+	x.done = true
+}
+
+// Response returns the shadow upstream's response, or nil if it hasn't
+// arrived or the request failed.
+func (x *shadowExchange) Response() *http.Response {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	return x.resp
+}
+
+// Result returns whether the mirrored request has finished, how long it
+// took, and the error it failed with, if any.
+func (x *shadowExchange) Result() (bool, time.Duration, error) {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	return x.done, x.latency, x.err
+}
+
+// Outcome returns how the shadow response compares with the primary one:
+// "pending" until both have arrived, "error" if the mirrored request failed,
+// and otherwise "same" if they have the same status and normalised body, or
+// "differs".
+func (x *shadowExchange) Outcome() string {
+	done, _, err := x.Result()
+	switch {
+	case !done:
+		return "pending"
+	case err != nil:
+		return "error"
+	}
+
+	d := x.Diff()
+	switch {
+	case d == nil:
+		return "pending"
+	case d.Differs():
+		return "differs"
+	}
+	return "same"
+}
+
+// Summary returns a single, tab separated line summarising the exchange: its
+// ID, the history entry it was copied from, the mirrored URL, the primary and
+// shadow statuses, and the outcome of comparing them.
+func (x *shadowExchange) Summary() string {
+	primary, shadow := "-", "-"
+	if resp := x.Entry.Response(); resp != nil {
+		primary = strconv.Itoa(resp.StatusCode)
+	}
+	if resp := x.Response(); resp != nil {
+		shadow = strconv.Itoa(resp.StatusCode)
+	}
+	return fmt.Sprintf("%d\t%d\t%s\t%s\t%s\t%s\n", x.ID, x.Entry.ID, x.Req.URL, primary, shadow, x.Outcome())
+}
+
+// Compare returns a report comparing the primary and shadow responses'
+// statuses, body lengths and body hashes.
+func (x *shadowExchange) Compare() []byte {
+	buf := new(bytes.Buffer)
+	line := func(name string, resp *http.Response) {
+		if resp == nil {
+			fmt.Fprintf(buf, "%s\t-\t-\t-\n", name)
+			return
+		}
+		fmt.Fprintf(buf, "%s\t%d\t%d\t%s\n", name, resp.StatusCode, bodyLen(&resp.Body), bodyHash(&resp.Body))
+	}
+	line("primary", x.Entry.Response())
+	line("shadow", x.Response())
+	fmt.Fprintf(buf, "outcome\t%s\n", x.Outcome())
+	return buf.Bytes()
+}
+
+// shadowSet is the mirror rules, and the most recent exchanges they've
+// mirrored.
+type shadowSet struct {
+	Rules *shadowRules
+
+	mu        sync.RWMutex
+	exchanges []*shadowExchange
+	next      int
+	modified  time.Time
+}
+
+func newShadowSet() *shadowSet {
+	return &shadowSet{Rules: &shadowRules{}}
+}
+
+// add adds an exchange, giving it the next ID, and forgets the oldest if
+// there are too many.
+func (s *shadowSet) add(x *shadowExchange) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	x.ID = s.next
+	s.next++
+	s.exchanges = append(s.exchanges, x)
+	if len(s.exchanges) > maxShadowed {
+		s.exchanges = append([]*shadowExchange(nil), s.exchanges[len(s.exchanges)-maxShadowed:]...)
+	}
+	s.modified = x.Time
+}
+
+// Get returns the exchange with the given ID, or nil if there's no such
+// exchange or it's been forgotten.
+func (s *shadowSet) Get(id int) *shadowExchange {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if len(s.exchanges) == 0 {
+		return nil
+	}
+	i := id - s.exchanges[0].ID
+	if i < 0 || i >= len(s.exchanges) {
+		return nil
+	}
+	return s.exchanges[i]
+}
+
+// Exchanges returns a copy of the list of exchanges.
+func (s *shadowSet) Exchanges() []*shadowExchange {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append([]*shadowExchange(nil), s.exchanges...)
+}
+
+// Stat returns the number of exchanges, and when the last one was mirrored.
+func (s *shadowSet) Stat() (int, time.Time) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.exchanges), s.modified
+}
+
+// mirrorRequest sends copies of the request of a history entry to the
+// upstreams of the mirror rules it matches, in the background. The copies
+// are sent straight upstream, and their responses are only recorded, so they
+// never affect the response the client gets. Requests that aren't safe to
+// send again aren't mirrored.
+func (p *Proxy) mirrorRequest(e *historyEntry) {
+	targets := p.Mirror.Rules.Targets(e.Req)
+	if len(targets) == 0 || !p.mayResend(e.Req, false) {
+		return
+	}
+	for _, target := range targets {
+		req := prepareResend(e.Req)
+		retarget(req, target)
+
+		x := &shadowExchange{Entry: e, Req: req, Time: time.Now()}
+		p.Mirror.add(x)
+		go func() {
+			defer p.recoverPanic("mirroring a request", nil)
+			resp, err := p.send(prepareResend(x.Req))
+			x.finish(resp, err)
+		}()
+	}
+}
+
+// newMirrorDir returns the Dir exposing the mirror rules and the exchanges
+// they've mirrored, with a directory per exchange named by its ID and an
+// index summarising them.
+func newMirrorDir(s *shadowSet) *fusebox.Dir {
+	keys := func() []string {
+		ret := []string{"rules", "index", "diffs"}
+		for _, x := range s.Exchanges() {
+			ret = append(ret, strconv.Itoa(x.ID))
+		}
+		return ret
+	}
+
+	node := func(k string) fusebox.VarNode {
+		switch k {
+		case "rules":
+			return newHandleFile(s.Rules)
+		case "index":
+			return newReadOnlyFile(func() []byte {
+				buf := new(bytes.Buffer)
+				for _, x := range s.Exchanges() {
+					buf.WriteString(x.Summary())
+				}
+				return buf.Bytes()
+			})
+		case "diffs":
+			return newShadowDiffsDir(s)
+		}
+
+		id, err := strconv.Atoi(k)
+		if err != nil {
+			return nil
+		}
+		x := s.Get(id)
+		if x == nil {
+			return nil
+		}
+		return newShadowExchangeDir(x)
+	}
+
+	return newFuncDir(keys, node)
+}
+
+// newShadowExchangeDir returns the read-only Dir exposing a single mirrored
+// exchange.
+func newShadowExchangeDir(x *shadowExchange) *fusebox.Dir {
+	ret, d := newNodeDir()
+	d.add("history", newReadOnlyFile(func() []byte { return []byte(strconv.Itoa(x.Entry.ID)) }))
+	d.add("time", newReadOnlyFile(func() []byte { return []byte(x.Time.Format(time.RFC3339Nano)) }))
+	d.add("req", freezeDir(newReqDir(newReqDirElement(x.Req, nil))))
+	if resp := x.Response(); resp != nil {
+		d.add("resp", freezeDir(newRespDir(newRespDirElement(resp, nil))))
+	}
+	d.add("duration", newReadOnlyFile(func() []byte {
+		if done, latency, _ := x.Result(); done {
+			return []byte(strconv.FormatInt(latency.Nanoseconds()/int64(time.Millisecond), 10))
+		}
+		return nil
+	}))
+	d.add("error", newReadOnlyFile(func() []byte {
+		if _, _, err := x.Result(); err != nil {
+			return []byte(err.Error())
+		}
+		return nil
+	}))
+	d.add("compare", newReadOnlyFile(x.Compare))
+	d.add("diff", newReadOnlyFile(func() []byte {
+		if diff := x.Diff(); diff != nil {
+			return diff.Report
+		}
+		return nil
+	}))
+	return ret
+}
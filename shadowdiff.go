@@ -0,0 +1,280 @@
+package proxyfs
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/danielthatcher/fusebox"
+)
+
+// shadowIgnoredHeaders are the headers left out of comparisons, since they
+// differ between any two responses, or only describe how the body was sent.
+var shadowIgnoredHeaders = []string{"Date", "Age", "Connection", "Keep-Alive", "Transfer-Encoding", "Content-Length"}
+
+// maxDiffCells limits the work done comparing bodies line by line, as the
+// product of the numbers of lines that differ. Larger bodies are only
+// reported as differing.
+const maxDiffCells = 4 << 20
+
+// shadowDiff is the differences between a primary response and its shadow.
+type shadowDiff struct {
+	Status  bool
+	Headers bool
+	Body    bool
+
+	// The report listing the differences
+	Report []byte
+}
+
+// Differs returns whether the responses differ in a way that matters, which is
+// in their statuses or normalised bodies. Headers often differ between
+// upstreams, so are only reported.
+func (d *shadowDiff) Differs() bool {
+	return d.Status || d.Body
+}
+
+// Diff returns the differences between the primary and shadow responses, or
+// nil until both have arrived. It's only worked out once.
+func (x *shadowExchange) Diff() *shadowDiff {
+	primary := x.Entry.Response()
+	shadow := x.Response()
+	if primary == nil || shadow == nil {
+		return nil
+	}
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if x.diff == nil {
+		x.diff = diffResponses(primary, shadow)
+	}
+	return x.diff
+}
+
+// diffResponses compares two responses' statuses, headers and normalised
+// bodies.
+func diffResponses(primary, shadow *http.Response) *shadowDiff {
+	ret := &shadowDiff{}
+	buf := new(bytes.Buffer)
+
+	if primary.StatusCode != shadow.StatusCode {
+		ret.Status = true
+		fmt.Fprintf(buf, "status\t%d\t%d\n", primary.StatusCode, shadow.StatusCode)
+	}
+
+	names := make([]string, 0)
+	for k := range primary.Header {
+		names = append(names, k)
+	}
+	for k := range shadow.Header {
+		if _, ok := primary.Header[k]; !ok {
+			names = append(names, k)
+		}
+	}
+	sort.Strings(names)
+	for _, k := range names {
+		if containsString(shadowIgnoredHeaders, k) {
+			continue
+		}
+		a, b := headerValue(primary.Header, k), headerValue(shadow.Header, k)
+		if a != b {
+			ret.Headers = true
+			fmt.Fprintf(buf, "header\t%s\t%s\t%s\n", k, a, b)
+		}
+	}
+
+	a, b := normaliseBody(primary), normaliseBody(shadow)
+	if !bytes.Equal(a, b) {
+		ret.Body = true
+		buf.WriteString("body\n--- primary\n+++ shadow\n")
+		buf.Write(diffLines(bodyLines(a), bodyLines(b)))
+	}
+
+	ret.Report = buf.Bytes()
+	return ret
+}
+
+// headerValue returns all the values of a header joined with commas, or "-"
+// if it's missing.
+func headerValue(h http.Header, k string) string {
+	v, ok := h[k]
+	if !ok {
+		return "-"
+	}
+	return strings.Join(v, ", ")
+}
+
+// normaliseBody returns the body of a response with its content encoding
+// removed, and in a form that doesn't change with formatting: JSON is
+// re-indented with its keys sorted, and other bodies have their line endings
+// and trailing whitespace normalised.
+func normaliseBody(resp *http.Response) []byte {
+	data := spoolBody(&resp.Body).Bytes()
+	if decoded, err := decodeBody(data, resp.Header.Get("Content-Encoding")); err == nil {
+		data = decoded
+	}
+
+	var v interface{}
+	if json.Unmarshal(data, &v) == nil {
+		if ret, err := json.MarshalIndent(v, "", "  "); err == nil {
+			return append(ret, '\n')
+		}
+	}
+
+	lines := bodyLines(data)
+	for i, l := range lines {
+		lines[i] = strings.TrimRight(l, " \t\r")
+	}
+	return []byte(strings.Join(lines, "\n"))
+}
+
+// bodyLines splits data into lines, without a trailing empty line.
+func bodyLines(data []byte) []string {
+	s := strings.TrimSuffix(string(data), "\n")
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, "\n")
+}
+
+// diffLines returns the lines that differ between a and b, as hunks of
+// removed lines, prefixed with "-", and added lines, prefixed with "+", each
+// headed by the line numbers they start at.
+func diffLines(a, b []string) []byte {
+	// Lines in common at either end don't need comparing
+	pre := 0
+	for pre < len(a) && pre < len(b) && a[pre] == b[pre] {
+		pre++
+	}
+	suf := 0
+	for suf < len(a)-pre && suf < len(b)-pre && a[len(a)-1-suf] == b[len(b)-1-suf] {
+		suf++
+	}
+	ma, mb := a[pre:len(a)-suf], b[pre:len(b)-suf]
+
+	buf := new(bytes.Buffer)
+	if len(ma)*len(mb) > maxDiffCells {
+		fmt.Fprintf(buf, "@@ %d lines of the primary and %d of the shadow differ, too many to compare\n", len(ma), len(mb))
+		return buf.Bytes()
+	}
+
+	// The length of the longest common subsequence of ma[i:] and mb[j:]
+	lcs := make([][]int, len(ma)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(mb)+1)
+	}
+	for i := len(ma) - 1; i >= 0; i-- {
+		for j := len(mb) - 1; j >= 0; j-- {
+			if ma[i] == mb[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	var removed, added []string
+	hunkA, hunkB := 0, 0
+	flush := func() {
+		if len(removed) == 0 && len(added) == 0 {
+			return
+		}
+		fmt.Fprintf(buf, "@@ -%d +%d\n", pre+hunkA+1, pre+hunkB+1)
+		for _, l := range removed {
+			buf.WriteString("-" + l + "\n")
+		}
+		for _, l := range added {
+			buf.WriteString("+" + l + "\n")
+		}
+		removed, added = nil, nil
+	}
+
+	i, j := 0, 0
+	for i < len(ma) || j < len(mb) {
+		switch {
+		case i < len(ma) && j < len(mb) && ma[i] == mb[j]:
+			flush()
+			i++
+			j++
+		case j == len(mb) || i < len(ma) && lcs[i+1][j] >= lcs[i][j+1]:
+			if len(removed) == 0 && len(added) == 0 {
+				hunkA, hunkB = i, j
+			}
+			removed = append(removed, ma[i])
+			i++
+		default:
+			if len(removed) == 0 && len(added) == 0 {
+				hunkA, hunkB = i, j
+			}
+			added = append(added, mb[j])
+			j++
+		}
+	}
+	flush()
+	return buf.Bytes()
+}
+
+// shadowSummary returns counts of the mirrored exchanges by outcome, and of
+// the differing ones by what differs.
+func shadowSummary(s *shadowSet) []byte {
+	counts := make(map[string]int)
+	for _, x := range s.Exchanges() {
+		counts[x.Outcome()]++
+		if d := x.Diff(); d != nil {
+			if d.Status {
+				counts["status"]++
+			}
+			if d.Headers {
+				counts["headers"]++
+			}
+			if d.Body {
+				counts["body"]++
+			}
+		}
+	}
+
+	buf := new(bytes.Buffer)
+	for _, k := range []string{"same", "differs", "error", "pending", "status", "headers", "body"} {
+		fmt.Fprintf(buf, "%s\t%d\n", k, counts[k])
+	}
+	return buf.Bytes()
+}
+
+// newShadowDiffsDir returns the Dir with a report for each mirrored exchange
+// whose responses differ, named by its ID, and a summary counting the
+// outcomes.
+func newShadowDiffsDir(s *shadowSet) *fusebox.Dir {
+	keys := func() []string {
+		ret := []string{"summary"}
+		for _, x := range s.Exchanges() {
+			if x.Outcome() == "differs" {
+				ret = append(ret, strconv.Itoa(x.ID))
+			}
+		}
+		return ret
+	}
+
+	node := func(k string) fusebox.VarNode {
+		if k == "summary" {
+			return newReadOnlyFile(func() []byte { return shadowSummary(s) })
+		}
+
+		id, err := strconv.Atoi(k)
+		if err != nil {
+			return nil
+		}
+		x := s.Get(id)
+		if x == nil || x.Outcome() != "differs" {
+			return nil
+		}
+		return newReadOnlyFile(func() []byte { return x.Diff().Report })
+	}
+
+	return newFuncDir(keys, node)
+}
@@ -0,0 +1,91 @@
+package proxyfs
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// SidecarSocket is where the filesystem is served over SFTP in sidecar mode
+// when FUSE isn't available and no other socket is given.
+const SidecarSocket = "/run/proxyfs/control.sock"
+
+// FuseAvailable returns whether the filesystem can be mounted with FUSE,
+// which isn't the case in most containers.
+func FuseAvailable() bool {
+	_, err := os.Stat("/dev/fuse")
+	return err == nil
+}
+
+// readiness tracks which of the parts of the proxy that have to be up before
+// it's ready, such as its listener and the filesystem, aren't up yet.
+type readiness struct {
+	mu      sync.Mutex
+	pending map[string]bool
+}
+
+func newReadiness() *readiness {
+	return &readiness{pending: make(map[string]bool)}
+}
+
+// Expect adds parts that have to be up before the proxy is ready.
+func (r *readiness) Expect(names ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, name := range names {
+		r.pending[name] = true
+	}
+}
+
+// Done marks a part as being up.
+func (r *readiness) Done(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.pending, name)
+}
+
+// Pending returns the parts that aren't up yet, or nothing once the proxy is
+// ready.
+func (r *readiness) Pending() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ret := make([]string, 0, len(r.pending))
+	for name := range r.pending {
+		ret = append(ret, name)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// ServeProbes serves liveness and readiness probes on the given address, for
+// running the proxy as a sidecar. /healthz succeeds while the proxy is
+// running and isn't degraded, and /readyz once everything expected is up, listing what isn't
+// otherwise.
+func (p *Proxy) ServeProbes(addr string) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		if reason := p.Health.Reason(); reason != "" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintf(w, "degraded since %s", reason)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if pending := p.Readiness.Pending(); len(pending) > 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintf(w, "waiting for %s\n", strings.Join(pending, ", "))
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+
+	l, err := listen(addr)
+	if err != nil {
+		return err
+	}
+	return http.Serve(l, mux)
+}
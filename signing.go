@@ -0,0 +1,303 @@
+package proxyfs
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"bazil.org/fuse"
+)
+
+// signingRule re-signs requests to hosts matching a pattern after they have
+// been intercepted, so that edits don't invalidate their signatures.
+type signingRule struct {
+	Host   *regexp.Regexp
+	Scheme string
+	Params map[string]string
+}
+
+// signingRules is the list of signing rules, exposed as a file. Each line is a
+// rule made up of a host regex, a scheme, and a list of key=value parameters,
+// with values URL encoded, e.g.
+//
+//	api\.example\.com$ aws4 access=AKIA... secret=... region=eu-west-1 service=execute-api
+//	example\.org$ hmac header=X-Signature alg=sha256 secret=s3cr3t message={method}%0A{path}%0A{body}
+//
+// The aws4 scheme implements AWS Signature Version 4, taking access, secret,
+// region, service and an optional session token. The hmac scheme sets header to
+// value (default "{sig}"), where {sig} is the HMAC of message (default
+// "{body}") using alg (sha1, sha256 or sha512) and secret, encoded as hex or
+// base64 according to encoding (default hex). Messages and values can refer to
+// {method}, {host}, {path}, {query}, {body}, {timestamp} (Unix time) and
+// {date} (RFC 1123).
+type signingRules struct {
+	mu    sync.RWMutex
+	src   []byte
+	rules []signingRule
+}
+
+// signingParams are the parameters required by each signing scheme.
+var signingParams = map[string][]string{
+	"aws4": {"access", "secret", "region", "service"},
+	"hmac": {"header", "secret"},
+}
+
+// parseSigningRules parses rules in the format described for signingRules.
+func parseSigningRules(src string) ([]signingRule, error) {
+	ret := make([]signingRule, 0)
+	for _, line := range strings.Split(src, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("invalid signing rule %q", line)
+		}
+
+		re, err := regexp.Compile(fields[0])
+		if err != nil {
+			return nil, err
+		}
+		rule := signingRule{Host: re, Scheme: fields[1], Params: make(map[string]string)}
+		required, ok := signingParams[rule.Scheme]
+		if !ok {
+			return nil, fmt.Errorf("unknown signing scheme %q", rule.Scheme)
+		}
+
+		for _, f := range fields[2:] {
+			parts := strings.SplitN(f, "=", 2)
+			if len(parts) != 2 {
+				return nil, fmt.Errorf("invalid signing parameter %q", f)
+			}
+			v, err := url.PathUnescape(parts[1])
+			if err != nil {
+				return nil, err
+			}
+			rule.Params[parts[0]] = v
+		}
+		for _, r := range required {
+			if rule.Params[r] == "" {
+				return nil, fmt.Errorf("signing scheme %s requires %s", rule.Scheme, r)
+			}
+		}
+
+		ret = append(ret, rule)
+	}
+
+	return ret, nil
+}
+
+// Sign signs the request using the first rule matching its host, if any.
+// References to variables in the rule's parameters are expanded first.
+func (s *signingRules) Sign(req *http.Request, vars *varSet) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, r := range s.rules {
+		if !r.Host.MatchString(req.URL.Host) {
+			continue
+		}
+
+		params := make(map[string]string, len(r.Params))
+		for k, v := range r.Params {
+			params[k] = vars.ExpandString(v)
+		}
+		switch r.Scheme {
+		case "aws4":
+			return signAWS4(req, params, time.Now().UTC())
+		case "hmac":
+			return signHMAC(req, params, time.Now().UTC())
+		}
+	}
+
+	return nil
+}
+
+func (s *signingRules) ValRead(ctx context.Context) ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.src, nil
+}
+
+func (s *signingRules) ValWrite(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+	rules, err := parseSigningRules(string(req.Data))
+	if err != nil {
+		return errInvalid
+	}
+
+	s.mu.Lock()
+	s.src = append([]byte(nil), req.Data...)
+	s.rules = rules
+	s.mu.Unlock()
+
+	resp.Size = len(req.Data)
+	return nil
+}
+
+func (s *signingRules) Size(ctx context.Context) (uint64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return uint64(len(s.src)), nil
+}
+
+// signHMAC signs the request with the hmac scheme described for signingRules.
+func signHMAC(req *http.Request, params map[string]string, now time.Time) error {
+	algs := map[string]func() hash.Hash{"sha1": sha1.New, "sha256": sha256.New, "sha512": sha512.New}
+	alg := params["alg"]
+	if alg == "" {
+		alg = "sha256"
+	}
+	h, ok := algs[alg]
+	if !ok {
+		return fmt.Errorf("unknown HMAC algorithm %q", alg)
+	}
+
+	body := peekBody(&req.Body)
+	replacer := strings.NewReplacer(
+		"{method}", req.Method,
+		"{host}", req.URL.Host,
+		"{path}", req.URL.EscapedPath(),
+		"{query}", req.URL.RawQuery,
+		"{body}", string(body),
+		"{timestamp}", strconv.FormatInt(now.Unix(), 10),
+		"{date}", now.Format(http.TimeFormat),
+	)
+
+	message := params["message"]
+	if message == "" {
+		message = "{body}"
+	}
+	mac := hmac.New(h, []byte(params["secret"]))
+	mac.Write([]byte(replacer.Replace(message)))
+
+	var sig string
+	switch params["encoding"] {
+	case "", "hex":
+		sig = hex.EncodeToString(mac.Sum(nil))
+	case "base64":
+		sig = base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	default:
+		return errors.New("unknown HMAC encoding")
+	}
+
+	value := params["value"]
+	if value == "" {
+		value = "{sig}"
+	}
+	value = strings.Replace(replacer.Replace(value), "{sig}", sig, -1)
+	req.Header.Set(params["header"], value)
+	return nil
+}
+
+// signAWS4 signs the request using AWS Signature Version 4.
+func signAWS4(req *http.Request, params map[string]string, now time.Time) error {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := sha256.Sum256(peekBody(&req.Body))
+	payload := hex.EncodeToString(payloadHash[:])
+
+	req.Header.Del("Authorization")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payload)
+	if params["token"] != "" {
+		req.Header.Set("X-Amz-Security-Token", params["token"])
+	}
+
+	// Sign the host and all content and amz headers
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	headers := map[string]string{"host": host}
+	for k, v := range req.Header {
+		lk := strings.ToLower(k)
+		if strings.HasPrefix(lk, "x-amz-") || lk == "content-type" || lk == "content-md5" {
+			headers[lk] = strings.Join(v, ",")
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	canonicalHeaders := new(strings.Builder)
+	for _, k := range names {
+		fmt.Fprintf(canonicalHeaders, "%s:%s\n", k, strings.TrimSpace(headers[k]))
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		awsCanonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payload,
+	}, "\n")
+
+	scope := strings.Join([]string{date, params["region"], params["service"], "aws4_request"}, "/")
+	crHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{"AWS4-HMAC-SHA256", amzDate, scope, hex.EncodeToString(crHash[:])}, "\n")
+
+	key := []byte("AWS4" + params["secret"])
+	for _, part := range []string{date, params["region"], params["service"], "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	sig := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		params["access"], scope, signedHeaders, sig))
+	return nil
+}
+
+// awsCanonicalQuery returns the query string sorted and encoded as required
+// by AWS Signature Version 4.
+func awsCanonicalQuery(q url.Values) string {
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	parts := make([]string, 0)
+	for _, k := range keys {
+		vals := append([]string(nil), q[k]...)
+		sort.Strings(vals)
+		for _, v := range vals {
+			parts = append(parts, awsEscape(k)+"="+awsEscape(v))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// awsEscape URI encodes s as required by AWS, which differs from
+// url.QueryEscape in its handling of spaces and '~'.
+func awsEscape(s string) string {
+	return strings.Replace(strings.Replace(url.QueryEscape(s), "+", "%20", -1), "%7E", "~", -1)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
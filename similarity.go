@@ -0,0 +1,95 @@
+package proxyfs
+
+import (
+	"context"
+	"fmt"
+	"math/bits"
+	"strconv"
+	"strings"
+
+	"bazil.org/fuse"
+)
+
+// similarity returns how similar the data with the given similarity hashes
+// is, from 0 to 100. Unrelated data has hashes differing in about half their
+// bits, so the score falls to 0 by then rather than resting around 50.
+func similarity(a, b uint64) int {
+	score := 100 - bits.OnesCount64(a^b)*100/32
+	if score < 0 {
+		return 0
+	}
+	return score
+}
+
+// bodySimilarity returns how similar two bodies are, from 0 to 100.
+func bodySimilarity(a, b []byte) int {
+	return similarity(simhash(a), simhash(b))
+}
+
+// similarityFile compares the response bodies of two history entries when
+// their IDs are written to it, e.g. "3 7". Reading the handle the IDs were
+// written through gives their score, from 0 for unrelated bodies to 100 for
+// much the same.
+type similarityFile struct {
+	Proxy *Proxy
+}
+
+// newSimilarityFile returns the File comparing the response bodies of history
+// entries. Reads aren't cached, as each handle has its own answer.
+func newSimilarityFile(p *Proxy) *handleFile {
+	ret := newHandleFile(&similarityFile{Proxy: p})
+	ret.OpenFlags = fuse.OpenDirectIO
+	return ret
+}
+
+// compare returns the similarity of the response bodies of the history
+// entries with the given IDs.
+func (f *similarityFile) compare(data string) (int, error) {
+	ids := strings.Fields(data)
+	if len(ids) != 2 {
+		return 0, fmt.Errorf("expected two IDs, got %d", len(ids))
+	}
+
+	bodies := make([][]byte, len(ids))
+	for i, s := range ids {
+		id, err := strconv.Atoi(s)
+		if err != nil {
+			return 0, err
+		}
+		e := f.Proxy.History.Get(id)
+		if e == nil {
+			return 0, fmt.Errorf("no history entry %d", id)
+		}
+		resp := e.Response()
+		if resp == nil {
+			return 0, fmt.Errorf("history entry %d has no response", id)
+		}
+		bodies[i] = peekBody(&resp.Body)
+	}
+	return bodySimilarity(bodies[0], bodies[1]), nil
+}
+
+// Query answers the IDs written through a handle with their score.
+func (f *similarityFile) Query(ctx context.Context, data []byte) ([]byte, error) {
+	score, err := f.compare(string(data))
+	if err != nil {
+		return nil, errInvalid
+	}
+	return []byte(fmt.Sprintf("%d\n", score)), nil
+}
+
+func (f *similarityFile) ValRead(ctx context.Context) ([]byte, error) {
+	return nil, nil
+}
+
+func (f *similarityFile) ValWrite(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+	if _, err := f.compare(string(req.Data)); err != nil {
+		return errInvalid
+	}
+	resp.Size = len(req.Data)
+	return nil
+}
+
+func (f *similarityFile) Size(ctx context.Context) (uint64, error) {
+	return 0, nil
+}
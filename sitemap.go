@@ -0,0 +1,155 @@
+package proxyfs
+
+import (
+	"bytes"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"bazil.org/fuse"
+	"github.com/danielthatcher/fusebox"
+)
+
+// sitemapEntry is a resource known to exist on a target, along with where it
+// was learned of.
+type sitemapEntry struct {
+	URL     string
+	Host    string
+	Status  int
+	Sources []string
+}
+
+// Summary returns a single, tab separated line summarising the entry.
+func (e *sitemapEntry) Summary() string {
+	status := "unvisited"
+	if e.Status != 0 {
+		status = strconv.Itoa(e.Status)
+	}
+
+	return fmt.Sprintf("%s\t%s\t%s\n", e.URL, status, strings.Join(e.Sources, ","))
+}
+
+// sitemap is the set of resources seen on each target, whether through the
+// proxy or found by jobs such as content discovery.
+type sitemap struct {
+	mu       sync.RWMutex
+	entries  map[string]*sitemapEntry
+	modified time.Time
+}
+
+func newSitemap() *sitemap {
+	return &sitemap{entries: make(map[string]*sitemapEntry)}
+}
+
+// Add records the resource at the given URL, ignoring its query, as having
+// been learned of from the given source. A status of 0 means the resource
+// hasn't been requested.
+func (s *sitemap) Add(u *url.URL, status int, source string) {
+	path := u.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	key := u.Scheme + "://" + u.Host + path
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.entries[key]
+	if !ok {
+		e = &sitemapEntry{URL: key, Host: u.Host}
+		s.entries[key] = e
+	}
+	if status != 0 {
+		e.Status = status
+	}
+	if !containsString(e.Sources, source) {
+		e.Sources = append(e.Sources, source)
+	}
+	s.modified = time.Now()
+}
+
+// Entries returns copies of the entries for the given host, or for every host
+// if it's empty, sorted by URL.
+func (s *sitemap) Entries(host string) []sitemapEntry {
+	s.mu.RLock()
+	ret := make([]sitemapEntry, 0, len(s.entries))
+	for _, e := range s.entries {
+		if host == "" || e.Host == host {
+			c := *e
+			c.Sources = append([]string(nil), e.Sources...)
+			ret = append(ret, c)
+		}
+	}
+	s.mu.RUnlock()
+
+	sort.Slice(ret, func(i, j int) bool { return ret[i].URL < ret[j].URL })
+	return ret
+}
+
+// Hosts returns the hosts in the sitemap, sorted.
+func (s *sitemap) Hosts() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	ret := make([]string, 0)
+	for _, e := range s.entries {
+		if !containsString(ret, e.Host) {
+			ret = append(ret, e.Host)
+		}
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// Stat returns the number of entries in the sitemap, and when it last changed.
+func (s *sitemap) Stat() (int, time.Time) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.entries), s.modified
+}
+
+// sitemapIndex returns the summary lines of the given entries.
+func sitemapIndex(entries []sitemapEntry) []byte {
+	buf := new(bytes.Buffer)
+	for _, e := range entries {
+		buf.WriteString(e.Summary())
+	}
+	return buf.Bytes()
+}
+
+// newSitemapDir returns a Dir with an index of the whole sitemap, a file for
+// ingesting advertised resources, and a directory for each host containing an
+// index of just that host's entries.
+func newSitemapDir(p *Proxy) *fusebox.Dir {
+	s := p.Sitemap
+	ingest := newHandleFile(&ingestFile{Proxy: p})
+	ingest.OpenFlags = fuse.OpenDirectIO
+
+	keys := func() []string {
+		return append([]string{"index", "ingest"}, s.Hosts()...)
+	}
+
+	node := func(k string) fusebox.VarNode {
+		switch k {
+		case "index":
+			return newReadOnlyFile(func() []byte {
+				return sitemapIndex(s.Entries(""))
+			})
+		case "ingest":
+			return ingest
+		}
+		if !containsString(s.Hosts(), k) {
+			return nil
+		}
+
+		ret, d := newNodeDir()
+		d.add("index", newReadOnlyFile(func() []byte {
+			return sitemapIndex(s.Entries(k))
+		}))
+		return ret
+	}
+
+	return newFuncDir(keys, node)
+}
@@ -0,0 +1,97 @@
+package proxyfs
+
+import (
+	"bytes"
+	"context"
+	"regexp"
+
+	"bazil.org/fuse"
+)
+
+// defaultSnippets are the snippets available when the proxy starts.
+var defaultSnippets = map[string]string{
+	"xss-basic":       "<script>alert(1)</script>",
+	"xss-img":         "\"><img src=x onerror=alert(1)>",
+	"xss-svg":         "<svg onload=alert(1)>",
+	"sqli-basic":      "' OR '1'='1' --",
+	"sqli-sleep":      "' AND SLEEP(5) --",
+	"ssti-basic":      "{{7*7}}${7*7}<%= 7*7 %>",
+	"traversal-basic": "../../../../../../etc/passwd",
+	"cmdi-basic":      ";id",
+	"xxe-basic":       "<?xml version=\"1.0\"?>\n<!DOCTYPE x [<!ENTITY xxe SYSTEM \"file:///etc/passwd\">]>\n<x>&xxe;</x>",
+}
+
+var (
+	// Names snippets can have
+	snippetNameRe = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+	// References to snippets inside a larger value
+	snippetRefRe = regexp.MustCompile(`@\{([A-Za-z0-9_.-]+)\}`)
+)
+
+// snippetSet holds reusable payloads that can be inserted into the headers
+// and bodies of queued requests and responses by name. Writing "@name" as a
+// whole value replaces it with the snippet, and "@{name}" inserts the snippet
+// within a larger value. References to snippets that don't exist are left
+// as they are.
+type snippetSet struct {
+	*valueSet
+}
+
+func newSnippetSet() *snippetSet {
+	ret := &snippetSet{newValueSet(snippetNameRe)}
+	for name, val := range defaultSnippets {
+		ret.Set(name, []byte(val))
+	}
+	return ret
+}
+
+// Expand replaces references to snippets in the given value with the
+// snippets. It can be called on a nil set, which expands nothing.
+func (s *snippetSet) Expand(data []byte) []byte {
+	if s == nil {
+		return data
+	}
+
+	trimmed := bytes.TrimSpace(data)
+	if bytes.HasPrefix(trimmed, []byte("@")) && snippetNameRe.Match(trimmed[1:]) {
+		if v, ok := s.Get(string(trimmed[1:])); ok {
+			return append([]byte(nil), v...)
+		}
+	}
+
+	return snippetRefRe.ReplaceAllFunc(data, func(ref []byte) []byte {
+		if v, ok := s.Get(string(ref[2 : len(ref)-1])); ok {
+			return v
+		}
+		return ref
+	})
+}
+
+// snippetValue expands references to snippets in values written to a single
+// value file before they're stored.
+type snippetValue struct {
+	value interface {
+		ValRead(ctx context.Context) ([]byte, error)
+		ValWrite(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error
+	}
+	snippets *snippetSet
+}
+
+func (v *snippetValue) ValRead(ctx context.Context) ([]byte, error) {
+	return v.value.ValRead(ctx)
+}
+
+func (v *snippetValue) AppendVal(ctx context.Context, buf *bytes.Buffer) error {
+	return appendValue(ctx, v.value, buf)
+}
+
+func (v *snippetValue) ValWrite(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+	expanded := *req
+	expanded.Data = v.snippets.Expand(req.Data)
+	if err := v.value.ValWrite(ctx, &expanded, resp); err != nil {
+		return err
+	}
+	resp.Size = len(req.Data)
+	return nil
+}
@@ -0,0 +1,205 @@
+package proxyfs
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"runtime"
+	"sync"
+)
+
+// spoolFileMin is the size above which bodies are spooled to a temporary file
+// rather than kept in memory.
+const spoolFileMin = 16 << 20
+
+// bodySpool holds a body once it has been read, so that the queued item, the
+// node exposing it, the history entry and the transport sending it on can all
+// read it without taking their own copies. The data never changes once the
+// spool is made: writing a new body makes a new spool. Small bodies are kept in
+// memory, and large ones in an unlinked temporary file, which is closed once
+// nothing refers to the spool.
+type bodySpool struct {
+	data []byte
+	file *os.File
+	size int64
+
+	sumOnce sync.Once
+	sum     [sha256.Size]byte
+}
+
+// newSpool returns a spool holding the given data, which mustn't be modified
+// afterwards.
+func newSpool(data []byte) *bodySpool {
+	return &bodySpool{data: data, size: int64(len(data))}
+}
+
+// readSpool reads r into a spool, spilling it to a temporary file if it's
+// larger than spoolFileMin. A body that can't be spilled is kept in memory.
+func readSpool(r io.Reader) (*bodySpool, error) {
+	w := new(spoolWriter)
+	_, err := io.Copy(w, r)
+	return w.Spool(), err
+}
+
+// spoolWriter makes a spool of what's written to it, keeping it in memory
+// until it's larger than spoolFileMin, and then moving it to a temporary file.
+// If no file can be made, everything is kept in memory.
+type spoolWriter struct {
+	buf  bytes.Buffer
+	file *os.File
+	size int64
+}
+
+func (w *spoolWriter) Write(p []byte) (int, error) {
+	if w.file == nil && int64(w.buf.Len()+len(p)) > spoolFileMin {
+		if f, err := ioutil.TempFile("", "proxyfs-body-"); err == nil {
+			os.Remove(f.Name())
+			if _, err := w.buf.WriteTo(f); err != nil {
+				f.Close()
+				return 0, err
+			}
+			w.file = f
+		}
+	}
+
+	var n int
+	var err error
+	if w.file != nil {
+		n, err = w.file.Write(p)
+	} else {
+		n, err = w.buf.Write(p)
+	}
+	w.size += int64(n)
+	return n, err
+}
+
+// Size returns the number of bytes written so far.
+func (w *spoolWriter) Size() int64 {
+	return w.size
+}
+
+// Spool returns the spool of what's been written. Nothing more can be written
+// afterwards.
+func (w *spoolWriter) Spool() *bodySpool {
+	if w.file == nil {
+		return newSpool(w.buf.Bytes())
+	}
+	ret := &bodySpool{file: w.file, size: w.size}
+	runtime.SetFinalizer(ret, func(s *bodySpool) {
+		s.file.Close()
+	})
+	return ret
+}
+
+// Size returns the length of the body.
+func (s *bodySpool) Size() int64 {
+	return s.size
+}
+
+// Bytes returns the body. Bodies in memory are returned as they are, and those
+// in a file are read into memory for the caller.
+func (s *bodySpool) Bytes() []byte {
+	if s.file == nil {
+		return s.data
+	}
+	ret := make([]byte, s.size)
+	n, _ := s.file.ReadAt(ret, 0)
+	return ret[:n]
+}
+
+// Head returns up to the first n bytes of the body, reading only that much of
+// a body in a file into memory.
+func (s *bodySpool) Head(n int64) []byte {
+	if n > s.size {
+		n = s.size
+	}
+	if s.file == nil {
+		return s.data[:n]
+	}
+	ret := make([]byte, n)
+	m, _ := s.file.ReadAt(ret, 0)
+	return ret[:m]
+}
+
+// Sum returns the SHA-256 hash of the body, which is only worked out once.
+func (s *bodySpool) Sum() [sha256.Size]byte {
+	s.sumOnce.Do(func() {
+		if s.file == nil {
+			s.sum = sha256.Sum256(s.data)
+			return
+		}
+		h := sha256.New()
+		io.Copy(h, io.NewSectionReader(s.file, 0, s.size))
+		copy(s.sum[:], h.Sum(nil))
+	})
+	return s.sum
+}
+
+// Reader returns a new reader of the whole body.
+func (s *bodySpool) Reader() *spoolReader {
+	ret := &spoolReader{spool: s}
+	ret.Rewind()
+	return ret
+}
+
+// spoolReader reads a spool. Closing it does nothing, as the spool may still
+// be read by others.
+type spoolReader struct {
+	*io.SectionReader
+	spool *bodySpool
+}
+
+func (r *spoolReader) Close() error {
+	return nil
+}
+
+// Rewind returns the reader to the start of the body.
+func (r *spoolReader) Rewind() {
+	if r.spool.file != nil {
+		r.SectionReader = io.NewSectionReader(r.spool.file, 0, r.spool.size)
+	} else {
+		r.SectionReader = io.NewSectionReader(bytes.NewReader(r.spool.data), 0, r.spool.size)
+	}
+}
+
+// Spool returns the spool being read.
+func (r *spoolReader) Spool() *bodySpool {
+	return r.spool
+}
+
+// spooled is a body that reads a spool.
+type spooled interface {
+	Spool() *bodySpool
+}
+
+// spoolBody returns the spool of the given body, reading it into one and
+// replacing the body with a reader of it if it isn't already spooled. Chunked
+// bodies are spooled with their decoded data.
+func spoolBody(body *io.ReadCloser) *bodySpool {
+	if *body == nil || *body == http.NoBody {
+		return newSpool(nil)
+	}
+	switch b := (*body).(type) {
+	case spooled:
+		return b.Spool()
+	case *chunkedBody:
+		return newSpool(b.Bytes())
+	}
+
+	ret, _ := readSpool(*body)
+	(*body).Close()
+	*body = ret.Reader()
+	return ret
+}
+
+// bodyLen returns the length of the given body, which is known without
+// reading it into memory once it's spooled.
+func bodyLen(body *io.ReadCloser) int {
+	if cb, ok := (*body).(*chunkedBody); ok {
+		return len(cb.Bytes())
+	}
+	return int(spoolBody(body).Size())
+}
@@ -0,0 +1,204 @@
+package proxyfs
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"strings"
+)
+
+// starttlsProtocol describes a line based protocol that can upgrade to TLS
+// part way through a connection with a STARTTLS command.
+type starttlsProtocol struct {
+	Name string
+
+	// Command returns whether a line from the client asks to start TLS, along
+	// with the tag the reply will have, if the protocol uses them.
+	Command func(line string) (string, bool)
+
+	// Reply returns whether a line from the server is the final reply to the
+	// STARTTLS command with the given tag, and if so whether TLS is starting.
+	Reply func(line, tag string) (ok bool, final bool)
+
+	// Auth returns the base64 encoded data in a line of an authentication
+	// exchange, if there is any, given whether the line is from the client.
+	// exchanging is set while the server is prompting for more data.
+	Auth func(line string, up bool, exchanging *bool) (string, bool)
+}
+
+// starttlsProtocols are the STARTTLS protocols that port forwards can be
+// told to speak, by name.
+var starttlsProtocols = map[string]*starttlsProtocol{
+	"smtp": {
+		Name: "smtp",
+		Command: func(line string) (string, bool) {
+			return "", strings.EqualFold(strings.TrimSpace(line), "STARTTLS")
+		},
+		Reply: func(line, tag string) (bool, bool) {
+			// Replies are continued by lines with a '-' after the code
+			if len(line) < 3 || (len(line) > 3 && line[3] == '-') {
+				return false, false
+			}
+			return strings.HasPrefix(line, "220"), true
+		},
+		Auth: func(line string, up bool, exchanging *bool) (string, bool) {
+			if !up {
+				if strings.HasPrefix(line, "334 ") {
+					*exchanging = true
+					return line[4:], true
+				}
+				*exchanging = false
+				return "", false
+			}
+			if *exchanging {
+				return line, true
+			}
+
+			// AUTH <mechanism> [initial response]
+			fields := strings.Fields(line)
+			if len(fields) == 3 && strings.EqualFold(fields[0], "AUTH") {
+				return fields[2], true
+			}
+			return "", false
+		},
+	},
+	"imap": {
+		Name: "imap",
+		Command: func(line string) (string, bool) {
+			fields := strings.Fields(line)
+			if len(fields) == 2 && strings.EqualFold(fields[1], "STARTTLS") {
+				return fields[0], true
+			}
+			return "", false
+		},
+		Reply: func(line, tag string) (bool, bool) {
+			fields := strings.Fields(line)
+			if len(fields) < 2 || fields[0] != tag {
+				return false, false
+			}
+			return strings.EqualFold(fields[1], "OK"), true
+		},
+		Auth: func(line string, up bool, exchanging *bool) (string, bool) {
+			if !up {
+				if strings.HasPrefix(line, "+ ") {
+					*exchanging = true
+					return line[2:], true
+				}
+				*exchanging = false
+				return "", false
+			}
+			if *exchanging {
+				return line, true
+			}
+
+			// <tag> AUTHENTICATE <mechanism> [initial response]
+			fields := strings.Fields(line)
+			if len(fields) == 4 && strings.EqualFold(fields[1], "AUTHENTICATE") {
+				return fields[3], true
+			}
+			return "", false
+		},
+	},
+}
+
+// checkStarttlsCommand looks for a STARTTLS command in data from the client,
+// returning a channel that's closed once the reply has been handled if there
+// is one.
+func (s *stream) checkStarttlsCommand(data []byte) chan struct{} {
+	if s.Protocol == nil {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.tlsFrom >= 0 || s.starttlsWait != nil {
+		return nil
+	}
+	for _, line := range splitLines(data) {
+		if tag, ok := s.Protocol.Command(line); ok {
+			s.starttlsTag = tag
+			s.starttlsWait = make(chan struct{})
+			return s.starttlsWait
+		}
+	}
+	return nil
+}
+
+// checkStarttlsReply looks for the reply to a STARTTLS command in data from
+// the server, which has already been passed on to the client, and upgrades
+// both sides of the stream to TLS if the server agreed. It returns false if
+// the upgrade failed, in which case the stream can't continue.
+func (s *stream) checkStarttlsReply(data []byte) bool {
+	s.mu.Lock()
+	wait, tag := s.starttlsWait, s.starttlsTag
+	s.mu.Unlock()
+	if wait == nil {
+		return true
+	}
+
+	for _, line := range splitLines(data) {
+		ok, final := s.Protocol.Reply(line, tag)
+		if !final {
+			continue
+		}
+		defer func() {
+			s.mu.Lock()
+			s.starttlsWait = nil
+			s.mu.Unlock()
+			close(wait)
+		}()
+		if !ok {
+			return true
+		}
+
+		client, server := s.ends(true)
+		client, server, err := s.upgrade(client, server)
+		if err != nil {
+			return false
+		}
+		s.mu.Lock()
+		s.client, s.server = client, server
+		s.tlsFrom = len(s.chunks)
+		s.mu.Unlock()
+		return true
+	}
+	return true
+}
+
+// Commands returns the lines sent each way over the stream, marked '>' for
+// client to target and '<' for target to client, with the point TLS started
+// marked. Base64 encoded data in authentication exchanges is shown decoded
+// after the line.
+func (s *stream) Commands() []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	buf := new(bytes.Buffer)
+	partial := map[bool][]byte{}
+	exchanging := false
+	for i, c := range s.chunks {
+		if i == s.tlsFrom {
+			buf.WriteString("-- starttls\n")
+		}
+		mark := "<"
+		if c.Up {
+			mark = ">"
+		}
+
+		// Lines can be split across chunks
+		data := append(partial[c.Up], c.Data...)
+		lines := bytes.Split(data, []byte("\n"))
+		partial[c.Up] = append([]byte(nil), lines[len(lines)-1]...)
+		for _, l := range lines[:len(lines)-1] {
+			line := strings.TrimRight(string(l), "\r")
+			fmt.Fprintf(buf, "%s %s", mark, line)
+			if enc, ok := s.Protocol.Auth(line, c.Up, &exchanging); ok {
+				if dec, err := base64.StdEncoding.DecodeString(enc); err == nil {
+					fmt.Fprintf(buf, "  [%q]", dec)
+				}
+			}
+			buf.WriteString("\n")
+		}
+	}
+	return buf.Bytes()
+}
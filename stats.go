@@ -0,0 +1,161 @@
+package proxyfs
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/danielthatcher/fusebox"
+)
+
+// sizeBuckets are the upper bounds of the buckets used for body size
+// histograms, with a final bucket for anything larger.
+var sizeBuckets = []int64{0, 1 << 10, 4 << 10, 16 << 10, 64 << 10, 256 << 10, 1 << 20, 4 << 20}
+
+// latencyBuckets are the upper bounds of the buckets used for latency
+// histograms, with a final bucket for anything slower.
+var latencyBuckets = []time.Duration{
+	10 * time.Millisecond, 50 * time.Millisecond, 100 * time.Millisecond, 250 * time.Millisecond,
+	500 * time.Millisecond, time.Second, 2500 * time.Millisecond, 5 * time.Second,
+}
+
+// sessionStats collects the sizes of bodies and the latency of upstream
+// responses for the session.
+type sessionStats struct {
+	mu        sync.Mutex
+	reqSizes  []int64
+	respSizes []int64
+	latencies []time.Duration
+}
+
+// RecordRequest records the body size of a request sent upstream.
+func (s *sessionStats) RecordRequest(size int) {
+	s.mu.Lock()
+	s.reqSizes = append(s.reqSizes, int64(size))
+	s.mu.Unlock()
+}
+
+// RecordResponse records the body size of a response, and the time taken to
+// receive it after its request was sent.
+func (s *sessionStats) RecordResponse(size int, latency time.Duration) {
+	s.mu.Lock()
+	s.respSizes = append(s.respSizes, int64(size))
+	s.latencies = append(s.latencies, latency)
+	s.mu.Unlock()
+}
+
+// Sizes returns the report of request and response body sizes.
+func (s *sessionStats) Sizes() []byte {
+	s.mu.Lock()
+	reqSizes := append([]int64(nil), s.reqSizes...)
+	respSizes := append([]int64(nil), s.respSizes...)
+	s.mu.Unlock()
+
+	buf := new(bytes.Buffer)
+	buf.WriteString("# request body sizes\n")
+	buf.Write(sizeReport(reqSizes))
+	buf.WriteString("\n# response body sizes\n")
+	buf.Write(sizeReport(respSizes))
+	return buf.Bytes()
+}
+
+// Latency returns the report of upstream latencies.
+func (s *sessionStats) Latency() []byte {
+	s.mu.Lock()
+	sorted := append([]time.Duration(nil), s.latencies...)
+	s.mu.Unlock()
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	counts := make([]int, len(latencyBuckets)+1)
+	for _, l := range sorted {
+		i := sort.Search(len(latencyBuckets), func(i int) bool { return l <= latencyBuckets[i] })
+		counts[i]++
+	}
+	labels := make([]string, len(counts))
+	for i, b := range latencyBuckets {
+		labels[i] = "<=" + b.String()
+	}
+	labels[len(labels)-1] = ">" + latencyBuckets[len(latencyBuckets)-1].String()
+
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, "count: %d\n", len(sorted))
+	buf.Write(latencySummary(sorted))
+	buf.Write(histogram(labels, counts))
+	return buf.Bytes()
+}
+
+// sizeReport returns a summary and histogram of the given sizes.
+func sizeReport(sizes []int64) []byte {
+	sort.Slice(sizes, func(i, j int) bool { return sizes[i] < sizes[j] })
+
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, "count: %d\n", len(sizes))
+	if len(sizes) > 0 {
+		var total int64
+		for _, s := range sizes {
+			total += s
+		}
+		fmt.Fprintf(buf, "min: %d\n", sizes[0])
+		fmt.Fprintf(buf, "mean: %d\n", total/int64(len(sizes)))
+		for _, q := range []int{50, 90, 95, 99} {
+			fmt.Fprintf(buf, "p%d: %d\n", q, sizes[percentileIndex(len(sizes), q)])
+		}
+		fmt.Fprintf(buf, "max: %d\n", sizes[len(sizes)-1])
+	}
+
+	counts := make([]int, len(sizeBuckets)+1)
+	for _, s := range sizes {
+		i := sort.Search(len(sizeBuckets), func(i int) bool { return s <= sizeBuckets[i] })
+		counts[i]++
+	}
+	labels := make([]string, len(counts))
+	for i, b := range sizeBuckets {
+		labels[i] = "<=" + formatSize(b)
+	}
+	labels[len(labels)-1] = ">" + formatSize(sizeBuckets[len(sizeBuckets)-1])
+	buf.Write(histogram(labels, counts))
+	return buf.Bytes()
+}
+
+// histogram returns a text histogram with a line per bucket, showing its count
+// and a bar scaled relative to the largest bucket.
+func histogram(labels []string, counts []int) []byte {
+	max := 0
+	for _, c := range counts {
+		if c > max {
+			max = c
+		}
+	}
+
+	buf := new(bytes.Buffer)
+	for i, c := range counts {
+		bar := 0
+		if max > 0 {
+			bar = c * 40 / max
+		}
+		fmt.Fprintf(buf, "%-10s %6d %s\n", labels[i], c, strings.Repeat("#", bar))
+	}
+	return buf.Bytes()
+}
+
+// formatSize returns a short human readable form of a byte count.
+func formatSize(n int64) string {
+	switch {
+	case n >= 1<<20 && n%(1<<20) == 0:
+		return fmt.Sprintf("%dMiB", n>>20)
+	case n >= 1<<10 && n%(1<<10) == 0:
+		return fmt.Sprintf("%dKiB", n>>10)
+	}
+	return fmt.Sprintf("%dB", n)
+}
+
+// newStatsDir returns the Dir exposing the session's statistics.
+func newStatsDir(s *sessionStats) *fusebox.Dir {
+	ret, d := newNodeDir()
+	d.add("sizes", newReadOnlyFile(s.Sizes))
+	d.add("latency", newReadOnlyFile(s.Latency))
+	return ret
+}
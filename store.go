@@ -0,0 +1,598 @@
+package proxyfs
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	_ "github.com/mattn/go-sqlite3"
+	bolt "go.etcd.io/bbolt"
+)
+
+// historyStore keeps the history and findings in an embedded database rather
+// than in memory, so that a session can grow beyond what fits in memory, and
+// survives the proxy being restarted. Entries are saved in the same form as
+// in a project, compressed if they're large and encrypted if the store has a
+// cipher, and are indexed by the fields in entryIndexFields.
+type historyStore interface {
+	// SaveEntry saves the entry with the given ID, replacing it if it has
+	// already been saved, along with the values it's indexed by.
+	SaveEntry(id int, e *savedEntry, index map[string]string) error
+
+	// LoadEntry loads the entry with the given ID.
+	LoadEntry(id int) (*savedEntry, error)
+
+	// DeleteEntry deletes the entry with the given ID, along with the values
+	// it's indexed by.
+	DeleteEntry(id int, index map[string]string) error
+
+	// EntryIDs returns the IDs of the entries saved, in order.
+	EntryIDs() ([]int, error)
+
+	// FindEntries returns the IDs of the entries with the given value of an
+	// indexed field, in order.
+	FindEntries(field, value string) ([]int, error)
+
+	// SaveFinding saves a finding in the given category, replacing it if
+	// it has already been saved.
+	SaveFinding(category string, f *finding) error
+
+	// LoadFindings calls fn with each saved finding, with the findings of
+	// each category in the order they were found.
+	LoadFindings(fn func(category string, f *finding)) error
+
+	// AppendAudit adds a record to the end of the audit log.
+	AppendAudit(r *auditRecord) error
+
+	// LoadAudit calls fn with each record of the audit log, in order.
+	LoadAudit(fn func(r *auditRecord)) error
+
+	Close() error
+}
+
+// entryIndexFields are the fields that entries are indexed by.
+var entryIndexFields = []string{"fingerprint", "method", "host"}
+
+// storeCompressMin is the size of request and response, together, from which
+// entries are compressed in a store.
+const storeCompressMin = 1024
+
+// zstdMagic starts every zstd frame, and so every compressed entry, which
+// can't be mistaken for JSON.
+var zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil)
+	zstdDecoder, _ = zstd.NewReader(nil)
+)
+
+// packEntry returns an entry as it's kept in a store, which is its JSON,
+// compressed with zstd if its request and response are large, and then
+// encrypted with the given cipher.
+func packEntry(c *storeCipher, e *savedEntry) ([]byte, error) {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return nil, err
+	}
+	if len(e.Request)+len(e.Response) >= storeCompressMin {
+		data = zstdEncoder.EncodeAll(data, nil)
+	}
+	return c.Seal(data), nil
+}
+
+// unpackEntry returns the entry kept in a store as the given data.
+func unpackEntry(c *storeCipher, data []byte) (*savedEntry, error) {
+	data, err := c.Open(data)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.HasPrefix(data, zstdMagic) {
+		var err error
+		if data, err = zstdDecoder.DecodeAll(data, nil); err != nil {
+			return nil, err
+		}
+	}
+
+	ret := new(savedEntry)
+	return ret, json.Unmarshal(data, ret)
+}
+
+// openStore opens the store described by spec, which is bolt:<path> or
+// sqlite:<path>, creating it if it doesn't exist. If a secret is given, what's
+// kept in the store is encrypted with a key derived from it.
+func openStore(spec string, secret []byte) (historyStore, error) {
+	i := strings.Index(spec, ":")
+	if i < 0 || spec[i+1:] == "" {
+		return nil, fmt.Errorf("invalid store %q: expected bolt:<path> or sqlite:<path>", spec)
+	}
+
+	kind, path := spec[:i], spec[i+1:]
+	switch kind {
+	case "bolt":
+		return openBoltStore(path, secret)
+	case "sqlite":
+		return openSQLiteStore(path, secret)
+	}
+	return nil, fmt.Errorf("unknown store %q: expected bolt or sqlite", kind)
+}
+
+// SetStore makes the proxy keep its history, findings and audit log in the
+// given store, taking up what's already saved in it.
+func (p *Proxy) SetStore(s historyStore) error {
+	if err := p.History.SetStore(s); err != nil {
+		return err
+	}
+	if err := p.Findings.SetStore(s); err != nil {
+		return err
+	}
+	return p.Audit.SetStore(s)
+}
+
+// savedFinding is a finding as it's kept in a store.
+type savedFinding struct {
+	Category string   `json:"category"`
+	Finding  *finding `json:"finding"`
+}
+
+// packFinding returns a finding as it's kept in a store, encrypted with the
+// given cipher.
+func packFinding(c *storeCipher, category string, f *finding) ([]byte, error) {
+	data, err := json.Marshal(&savedFinding{category, f})
+	if err != nil {
+		return nil, err
+	}
+	return c.Seal(data), nil
+}
+
+// unpackFinding returns the finding kept in a store as the given data, and
+// its category.
+func unpackFinding(c *storeCipher, data []byte) (string, *finding, error) {
+	data, err := c.Open(data)
+	if err != nil {
+		return "", nil, err
+	}
+	var saved savedFinding
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return "", nil, err
+	}
+	if saved.Finding == nil {
+		return "", nil, errors.New("saved finding is empty")
+	}
+	return saved.Category, saved.Finding, nil
+}
+
+// packAudit returns an audit record as it's kept in a store, encrypted with
+// the given cipher.
+func packAudit(c *storeCipher, r *auditRecord) ([]byte, error) {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return nil, err
+	}
+	return c.Seal(data), nil
+}
+
+// unpackAudit returns the audit record kept in a store as the given data.
+func unpackAudit(c *storeCipher, data []byte) (*auditRecord, error) {
+	data, err := c.Open(data)
+	if err != nil {
+		return nil, err
+	}
+	ret := &auditRecord{}
+	if err := json.Unmarshal(data, ret); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// boltStore is a historyStore in a Bolt database. Entries are kept in the
+// entries bucket keyed by ID, and the index bucket has a key for each indexed
+// value of each entry, made up of the field, value and ID. The audit bucket is
+// keyed by the bucket's sequence.
+type boltStore struct {
+	db     *bolt.DB
+	cipher *storeCipher
+}
+
+var (
+	boltEntries  = []byte("entries")
+	boltIndex    = []byte("index")
+	boltFindings = []byte("findings")
+	boltMeta     = []byte("meta")
+	boltAudit    = []byte("audit")
+)
+
+func openBoltStore(path string, secret []byte) (*boltStore, error) {
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{boltEntries, boltIndex, boltFindings, boltMeta, boltAudit} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	ret := &boltStore{db: db}
+	ids, err := ret.EntryIDs()
+	if err == nil {
+		ret.cipher, err = initStoreCipher(secret, len(ids) == 0, ret.getMeta, ret.putMeta)
+	}
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return ret, nil
+}
+
+func (s *boltStore) getMeta(key string) ([]byte, error) {
+	var ret []byte
+	err := s.db.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket(boltMeta).Get([]byte(key)); v != nil {
+			ret = append([]byte(nil), v...)
+		}
+		return nil
+	})
+	return ret, err
+}
+
+func (s *boltStore) putMeta(key string, val []byte) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltMeta).Put([]byte(key), val)
+	})
+}
+
+// boltID returns the key of an ID, which sorts in numerical order.
+func boltID(id int) []byte {
+	ret := make([]byte, 8)
+	binary.BigEndian.PutUint64(ret, uint64(id))
+	return ret
+}
+
+// boltIndexPrefix returns the prefix of the index keys for a field's value.
+func boltIndexPrefix(field, value string) []byte {
+	return []byte(field + "\x00" + value + "\x00")
+}
+
+func (s *boltStore) SaveEntry(id int, e *savedEntry, index map[string]string) error {
+	data, err := packEntry(s.cipher, e)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket(boltEntries).Put(boltID(id), data); err != nil {
+			return err
+		}
+		b := tx.Bucket(boltIndex)
+		for field, value := range index {
+			if err := b.Put(append(boltIndexPrefix(field, s.cipher.Index(value)), boltID(id)...), nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *boltStore) LoadEntry(id int) (*savedEntry, error) {
+	var ret *savedEntry
+	err := s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(boltEntries).Get(boltID(id))
+		if data == nil {
+			return fmt.Errorf("no entry %d", id)
+		}
+		var err error
+		ret, err = unpackEntry(s.cipher, data)
+		return err
+	})
+	return ret, err
+}
+
+func (s *boltStore) DeleteEntry(id int, index map[string]string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket(boltEntries).Delete(boltID(id)); err != nil {
+			return err
+		}
+		b := tx.Bucket(boltIndex)
+		for field, value := range index {
+			if err := b.Delete(append(boltIndexPrefix(field, s.cipher.Index(value)), boltID(id)...)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *boltStore) EntryIDs() ([]int, error) {
+	ret := make([]int, 0)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltEntries).ForEach(func(k, v []byte) error {
+			ret = append(ret, int(binary.BigEndian.Uint64(k)))
+			return nil
+		})
+	})
+	return ret, err
+}
+
+func (s *boltStore) FindEntries(field, value string) ([]int, error) {
+	ret := make([]int, 0)
+	prefix := boltIndexPrefix(field, s.cipher.Index(value))
+	err := s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(boltIndex).Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			ret = append(ret, int(binary.BigEndian.Uint64(k[len(prefix):])))
+		}
+		return nil
+	})
+	return ret, err
+}
+
+func (s *boltStore) SaveFinding(category string, f *finding) error {
+	data, err := packFinding(s.cipher, category, f)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		key := append([]byte(s.cipher.Index(category)+"\x00"), boltID(f.ID)...)
+		return tx.Bucket(boltFindings).Put(key, data)
+	})
+}
+
+func (s *boltStore) LoadFindings(fn func(category string, f *finding)) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltFindings).ForEach(func(k, v []byte) error {
+			category, f, err := unpackFinding(s.cipher, v)
+			if err != nil {
+				return err
+			}
+			fn(category, f)
+			return nil
+		})
+	})
+}
+
+func (s *boltStore) AppendAudit(r *auditRecord) error {
+	data, err := packAudit(s.cipher, r)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltAudit)
+		seq, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		return b.Put(boltID(int(seq)), data)
+	})
+}
+
+func (s *boltStore) LoadAudit(fn func(r *auditRecord)) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltAudit).ForEach(func(k, v []byte) error {
+			r, err := unpackAudit(s.cipher, v)
+			if err != nil {
+				return err
+			}
+			fn(r)
+			return nil
+		})
+	})
+}
+
+func (s *boltStore) Close() error {
+	return s.db.Close()
+}
+
+// sqliteStore is a historyStore in a SQLite database, with a column for each
+// indexed field.
+type sqliteStore struct {
+	db     *sql.DB
+	cipher *storeCipher
+}
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS entries (
+	id INTEGER PRIMARY KEY,
+	fingerprint TEXT,
+	method TEXT,
+	host TEXT,
+	data BLOB
+);
+CREATE INDEX IF NOT EXISTS entries_fingerprint ON entries (fingerprint);
+CREATE INDEX IF NOT EXISTS entries_method ON entries (method);
+CREATE INDEX IF NOT EXISTS entries_host ON entries (host);
+CREATE TABLE IF NOT EXISTS findings (
+	category TEXT,
+	id INTEGER,
+	data BLOB,
+	PRIMARY KEY (category, id)
+);
+CREATE TABLE IF NOT EXISTS audit (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	data BLOB
+);
+CREATE TABLE IF NOT EXISTS meta (
+	key TEXT PRIMARY KEY,
+	value BLOB
+);
+`
+
+func openSQLiteStore(path string, secret []byte) (*sqliteStore, error) {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	ret := &sqliteStore{db: db}
+	ids, err := ret.EntryIDs()
+	if err == nil {
+		ret.cipher, err = initStoreCipher(secret, len(ids) == 0, ret.getMeta, ret.putMeta)
+	}
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return ret, nil
+}
+
+func (s *sqliteStore) getMeta(key string) ([]byte, error) {
+	var ret []byte
+	err := s.db.QueryRow("SELECT value FROM meta WHERE key = ?", key).Scan(&ret)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return ret, err
+}
+
+func (s *sqliteStore) putMeta(key string, val []byte) error {
+	_, err := s.db.Exec("INSERT OR REPLACE INTO meta (key, value) VALUES (?, ?)", key, val)
+	return err
+}
+
+func (s *sqliteStore) SaveEntry(id int, e *savedEntry, index map[string]string) error {
+	data, err := packEntry(s.cipher, e)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.Exec("INSERT OR REPLACE INTO entries (id, fingerprint, method, host, data) VALUES (?, ?, ?, ?, ?)",
+		id, s.cipher.Index(index["fingerprint"]), s.cipher.Index(index["method"]), s.cipher.Index(index["host"]), data)
+	return err
+}
+
+func (s *sqliteStore) LoadEntry(id int) (*savedEntry, error) {
+	var data []byte
+	if err := s.db.QueryRow("SELECT data FROM entries WHERE id = ?", id).Scan(&data); err != nil {
+		return nil, err
+	}
+	return unpackEntry(s.cipher, data)
+}
+
+func (s *sqliteStore) DeleteEntry(id int, index map[string]string) error {
+	_, err := s.db.Exec("DELETE FROM entries WHERE id = ?", id)
+	return err
+}
+
+func (s *sqliteStore) EntryIDs() ([]int, error) {
+	rows, err := s.db.Query("SELECT id FROM entries ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ret := make([]int, 0)
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ret = append(ret, id)
+	}
+	return ret, rows.Err()
+}
+
+func (s *sqliteStore) FindEntries(field, value string) ([]int, error) {
+	if !containsString(entryIndexFields, field) {
+		return nil, fmt.Errorf("%s isn't indexed", field)
+	}
+
+	rows, err := s.db.Query("SELECT id FROM entries WHERE "+field+" = ? ORDER BY id", s.cipher.Index(value))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ret := make([]int, 0)
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ret = append(ret, id)
+	}
+	return ret, rows.Err()
+}
+
+func (s *sqliteStore) SaveFinding(category string, f *finding) error {
+	data, err := packFinding(s.cipher, category, f)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.Exec("INSERT OR REPLACE INTO findings (category, id, data) VALUES (?, ?, ?)", s.cipher.Index(category), f.ID, data)
+	return err
+}
+
+func (s *sqliteStore) LoadFindings(fn func(category string, f *finding)) error {
+	rows, err := s.db.Query("SELECT data FROM findings ORDER BY category, id")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var data []byte
+		if err := rows.Scan(&data); err != nil {
+			return err
+		}
+		category, f, err := unpackFinding(s.cipher, data)
+		if err != nil {
+			return err
+		}
+		fn(category, f)
+	}
+	return rows.Err()
+}
+
+func (s *sqliteStore) AppendAudit(r *auditRecord) error {
+	data, err := packAudit(s.cipher, r)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.Exec("INSERT INTO audit (data) VALUES (?)", data)
+	return err
+}
+
+func (s *sqliteStore) LoadAudit(fn func(r *auditRecord)) error {
+	rows, err := s.db.Query("SELECT data FROM audit ORDER BY id")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var data []byte
+		if err := rows.Scan(&data); err != nil {
+			return err
+		}
+		r, err := unpackAudit(s.cipher, data)
+		if err != nil {
+			return err
+		}
+		fn(r)
+	}
+	return rows.Err()
+}
+
+func (s *sqliteStore) Close() error {
+	return s.db.Close()
+}
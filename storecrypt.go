@@ -0,0 +1,123 @@
+package proxyfs
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// storeCipher encrypts what's kept in a store with AES-256-GCM, using a key
+// derived with scrypt from a passphrase or the contents of a key file. Indexed
+// values are replaced with their HMAC, so that they can still be looked up
+// without being readable. A nil storeCipher leaves everything as it is.
+type storeCipher struct {
+	aead cipher.AEAD
+	mac  []byte
+}
+
+// storeCipherCheck is encrypted and kept in a store when its encryption is
+// set up, so that a wrong passphrase is noticed when it's opened.
+var storeCipherCheck = []byte("proxyfs")
+
+func newStoreCipher(secret, salt []byte) (*storeCipher, error) {
+	key, err := scrypt.Key(secret, salt, 1<<15, 8, 1, 64)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key[:32])
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &storeCipher{aead: aead, mac: key[32:]}, nil
+}
+
+// initStoreCipher returns the cipher for a store given the secret it was
+// opened with, if any, using get and put to keep the salt and check value in
+// the store. Encryption is set up when a secret is first given, which must be
+// while the store is empty.
+func initStoreCipher(secret []byte, empty bool, get func(key string) ([]byte, error), put func(key string, val []byte) error) (*storeCipher, error) {
+	salt, err := get("salt")
+	if err != nil {
+		return nil, err
+	}
+
+	if secret == nil {
+		if salt != nil {
+			return nil, errors.New("the store is encrypted, and needs its passphrase or key file")
+		}
+		return nil, nil
+	}
+
+	if salt == nil {
+		if !empty {
+			return nil, errors.New("the store already has unencrypted entries")
+		}
+		salt = make([]byte, 16)
+		if _, err := rand.Read(salt); err != nil {
+			return nil, err
+		}
+		c, err := newStoreCipher(secret, salt)
+		if err != nil {
+			return nil, err
+		}
+		if err := put("salt", salt); err != nil {
+			return nil, err
+		}
+		return c, put("check", c.Seal(storeCipherCheck))
+	}
+
+	c, err := newStoreCipher(secret, salt)
+	if err != nil {
+		return nil, err
+	}
+	check, err := get("check")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := c.Open(check); err != nil {
+		return nil, errors.New("wrong passphrase or key file for the store")
+	}
+	return c, nil
+}
+
+// Seal encrypts the given data, with the nonce prepended.
+func (c *storeCipher) Seal(data []byte) []byte {
+	if c == nil {
+		return data
+	}
+	nonce := make([]byte, c.aead.NonceSize())
+	rand.Read(nonce)
+	return c.aead.Seal(nonce, nonce, data, nil)
+}
+
+// Open decrypts data encrypted by Seal.
+func (c *storeCipher) Open(data []byte) ([]byte, error) {
+	if c == nil {
+		return data, nil
+	}
+	n := c.aead.NonceSize()
+	if len(data) < n {
+		return nil, errors.New("encrypted data is too short")
+	}
+	return c.aead.Open(nil, data[:n], data[n:], nil)
+}
+
+// Index returns the value kept in a store's index for the given value.
+func (c *storeCipher) Index(value string) string {
+	if c == nil {
+		return value
+	}
+	m := hmac.New(sha256.New, c.mac)
+	m.Write([]byte(value))
+	return hex.EncodeToString(m.Sum(nil))
+}
@@ -0,0 +1,214 @@
+package proxyfs
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// streamCaptureDefault is the most of a streamed response's body kept in the
+// history by default, so that endless streams such as server-sent events
+// don't fill the disk.
+const streamCaptureDefault = 64 << 20
+
+// streamingBody passes a body on as it's read, rather than reading it all
+// first, keeping a copy of up to limit bytes of it (or all of it if limit is
+// 0). Once the body has been read to the end, or closed, done is called with
+// the copy and whether it was cut short, by the limit or by the body being
+// closed before its end, e.g. because the client disconnected. The body may
+// be closed while it's being read, so the copy is kept under mu.
+type streamingBody struct {
+	io.ReadCloser
+	limit int64
+	done  func(s *bodySpool, truncated bool)
+
+	mu        sync.Mutex
+	capture   *spoolWriter
+	truncated bool
+	complete  bool
+	finished  bool
+}
+
+func newStreamingBody(body io.ReadCloser, limit int64, done func(*bodySpool, bool)) *streamingBody {
+	return &streamingBody{ReadCloser: body, limit: limit, capture: new(spoolWriter), done: done}
+}
+
+func (b *streamingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.mu.Lock()
+	if n > 0 && !b.truncated && !b.finished {
+		keep := p[:n]
+		if b.limit > 0 && b.capture.Size()+int64(n) > b.limit {
+			keep = keep[:b.limit-b.capture.Size()]
+			b.truncated = true
+		}
+		if _, werr := b.capture.Write(keep); werr != nil {
+			b.truncated = true
+		}
+	}
+	if err == io.EOF {
+		b.complete = true
+	}
+	b.mu.Unlock()
+	if err != nil {
+		b.finish()
+	}
+	return n, err
+}
+
+func (b *streamingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.finish()
+	return err
+}
+
+// finish hands what was captured of the body to done, the first time it's
+// called. Nothing more is captured afterwards.
+func (b *streamingBody) finish() {
+	b.mu.Lock()
+	if b.finished {
+		b.mu.Unlock()
+		return
+	}
+	b.finished = true
+	s, truncated := b.capture.Spool(), b.truncated || !b.complete
+	b.mu.Unlock()
+	b.done(s, truncated)
+}
+
+// streams returns whether a body can be streamed on as it's read. A body that
+// has already been read, e.g. to be rewritten, is passed on as it is.
+func streams(body io.ReadCloser) bool {
+	if body == nil || body == http.NoBody {
+		return false
+	}
+	switch body.(type) {
+	case spooled, *chunkedBody:
+		return false
+	}
+	return true
+}
+
+// capturedBody is the body of a streamed request as recorded in the history.
+// It reads as empty until the request's body has been sent, and then as what
+// was captured of it.
+type capturedBody struct {
+	mu     sync.Mutex
+	reader *spoolReader
+}
+
+func newCapturedBody() *capturedBody {
+	return &capturedBody{reader: newSpool(nil).Reader()}
+}
+
+func (b *capturedBody) Read(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.reader.Read(p)
+}
+
+func (b *capturedBody) Close() error {
+	return nil
+}
+
+// Rewind returns the body to its start.
+func (b *capturedBody) Rewind() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.reader.Rewind()
+}
+
+// Spool returns the spool of what's been captured of the body so far.
+func (b *capturedBody) Spool() *bodySpool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.reader.Spool()
+}
+
+// set has the body read the given spool.
+func (b *capturedBody) set(s *bodySpool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.reader = s.Reader()
+}
+
+// streamRequest lets the body of a request that isn't held for interception
+// flow through to its target as the client sends it, as streamResponse does
+// for responses. The request is recorded in the history straight away with an
+// empty body, which is filled in once the body has been sent, at which point
+// the passive checks are run and the request is mirrored.
+func (p *Proxy) streamRequest(r *http.Request, client *clientInfo) *historyEntry {
+	captured := newCapturedBody()
+	e := p.History.RecordStreamed(r, captured, client)
+	e.AddLabels("streamed")
+
+	r.Body = newStreamingBody(r.Body, p.Settings.Get().StreamCapture, func(s *bodySpool, truncated bool) {
+		defer p.recoverPanic("recording a streamed request", nil)
+		e.SetRequestBody(captured, s)
+		if truncated {
+			e.AddLabels("truncated")
+		}
+		p.checkRequest(e)
+		p.mirrorRequest(e)
+		p.History.Touch()
+	})
+	return e
+}
+
+// streamResponse lets the body of a response that isn't held for interception
+// flow through to the client as it arrives, so that large downloads and
+// server-sent events aren't read into memory or held up. The response is
+// recorded in the history straight away without its body, and again with its
+// body once the body has finished, at which point the passive checks are run.
+// Bodies larger than settings/stream-capture, or cut short by the client
+// disconnecting, are recorded as far as they got, with the label "truncated".
+func (p *Proxy) streamResponse(e *historyEntry, r *http.Response, latency time.Duration) {
+	head := *r
+	head.Header = r.Header.Clone()
+	head.Body = http.NoBody
+	e.SetResponse(&head, latency)
+	e.AddLabels("streamed")
+	p.History.Touch()
+
+	r.Body = newStreamingBody(r.Body, p.Settings.Get().StreamCapture, func(s *bodySpool, truncated bool) {
+		defer p.recoverPanic("recording a streamed response", nil)
+		head.Body = s.Reader()
+		if truncated {
+			e.AddLabels("truncated")
+		}
+		p.recordResponse(e, &head, latency, "proxy")
+	})
+}
+
+// flushingWriter sends each write to the client as soon as it's made, so that
+// streamed bodies such as server-sent events arrive as the server sends them,
+// rather than when enough has been buffered.
+type flushingWriter struct {
+	http.ResponseWriter
+}
+
+func (w *flushingWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	w.Flush()
+	return n, err
+}
+
+func (w *flushingWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack takes over the connection, for WebSocket upgrades passed through to
+// their targets.
+func (w *flushingWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("connection can't be hijacked")
+	}
+	return h.Hijack()
+}
@@ -0,0 +1,615 @@
+package proxyfs
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"bazil.org/fuse"
+	"github.com/danielthatcher/fusebox"
+)
+
+// maxStreamRecord is the most data recorded for a single stream. Data beyond
+// it is still forwarded, and counted, but isn't kept.
+const maxStreamRecord = 16 << 20
+
+// streamForward is a port forward whose connections are intercepted as raw
+// streams, rather than as HTTP.
+type streamForward struct {
+	Listen string
+	Target string
+
+	// Whether the connections are TLS, in which case they're intercepted
+	// with a certificate for the target signed by the proxy's CA, and the
+	// connection to the target is also made over TLS.
+	TLS bool
+
+	// The STARTTLS protocol spoken over the connections, if any, which are
+	// intercepted in the same way as TLS connections once upgraded.
+	Protocol *starttlsProtocol
+}
+
+// parseStreamForward parses a port forward given as "listen=target", with
+// "/tls" appended for TLS, or the name of a STARTTLS protocol such as "/smtp",
+// e.g. "127.0.0.1:6380=redis.internal:6379" or ":8443=example.com:443/tls".
+func parseStreamForward(s string) (*streamForward, error) {
+	parts := strings.SplitN(s, "=", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("invalid forward %q: expected listen=target", s)
+	}
+
+	ret := &streamForward{Listen: parts[0], Target: parts[1]}
+	if i := strings.LastIndex(ret.Target, "/"); i >= 0 {
+		mode := ret.Target[i+1:]
+		ret.Target = ret.Target[:i]
+		if mode == "tls" {
+			ret.TLS = true
+		} else if ret.Protocol = starttlsProtocols[mode]; ret.Protocol == nil {
+			return nil, fmt.Errorf("invalid forward %q: unknown mode %q", s, mode)
+		}
+	}
+	for _, addr := range []string{ret.Listen, ret.Target} {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return nil, fmt.Errorf("invalid forward %q: %v", s, err)
+		}
+	}
+	return ret, nil
+}
+
+// streamChunk is a piece of data read from one side of a stream.
+type streamChunk struct {
+	Up   bool
+	Time time.Time
+	Data []byte
+}
+
+// stream is a single connection through a port forward.
+type stream struct {
+	ID       int
+	Client   string
+	Target   string
+	TLS      bool
+	Protocol *starttlsProtocol
+	Started  time.Time
+
+	// Used to release and discard the chunk being held while intercepting
+	Forward chan int
+	Drop    chan int
+
+	mu        sync.Mutex
+	chunks    []streamChunk
+	recorded  int
+	up        int64
+	down      int64
+	truncated bool
+	closed    bool
+	held      *streamChunk
+
+	// Only one chunk, from either direction, is held at a time
+	holdMu sync.Mutex
+
+	// While a STARTTLS command waits for its reply, the tag the reply is
+	// expected to have, and a channel that's closed once it's been handled.
+	// The index of the first chunk sent over TLS is recorded once upgraded.
+	starttlsTag  string
+	starttlsWait chan struct{}
+	tlsFrom      int
+
+	// Upgrades the connections to TLS for STARTTLS
+	upgrade func(client, server net.Conn) (net.Conn, net.Conn, error)
+
+	client net.Conn
+	server net.Conn
+	done   chan struct{}
+}
+
+// ends returns the connections data is read from and written to for the
+// given direction, which change if the stream is upgraded to TLS.
+func (s *stream) ends(up bool) (net.Conn, net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if up {
+		return s.client, s.server
+	}
+	return s.server, s.client
+}
+
+// record adds a chunk that has been passed on to the stream's record.
+func (s *stream) record(c streamChunk) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if c.Up {
+		s.up += int64(len(c.Data))
+	} else {
+		s.down += int64(len(c.Data))
+	}
+	if s.recorded+len(c.Data) > maxStreamRecord {
+		s.truncated = true
+		return
+	}
+	s.recorded += len(c.Data)
+	s.chunks = append(s.chunks, c)
+}
+
+// Close closes both sides of the stream.
+func (s *stream) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	s.closed = true
+	close(s.done)
+	s.client.Close()
+	s.server.Close()
+}
+
+// Closed returns whether the stream has been closed.
+func (s *stream) Closed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+// Data returns everything recorded from one side of the stream.
+func (s *stream) Data(up bool) []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	buf := new(bytes.Buffer)
+	for _, c := range s.chunks {
+		if c.Up == up {
+			buf.Write(c.Data)
+		}
+	}
+	return buf.Bytes()
+}
+
+// Hexdump returns a hex dump of each chunk recorded, in order, under a header
+// giving its direction ('>' for client to target, and '<' for target to
+// client), time and length.
+func (s *stream) Hexdump() []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	buf := new(bytes.Buffer)
+	for i, c := range s.chunks {
+		dir := "<"
+		if c.Up {
+			dir = ">"
+		}
+		if i == s.tlsFrom {
+			buf.WriteString("-- starttls\n")
+		}
+		fmt.Fprintf(buf, "%s %s %d bytes\n", dir, c.Time.Format(time.RFC3339Nano), len(c.Data))
+		buf.WriteString(hex.Dump(c.Data))
+	}
+	if s.truncated {
+		fmt.Fprintf(buf, "truncated after %d bytes\n", s.recorded)
+	}
+	return buf.Bytes()
+}
+
+// Summary returns a single, tab separated line summarising the stream.
+func (s *stream) Summary() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	state := "open"
+	if s.held != nil {
+		state = "held"
+	}
+	if s.closed {
+		state = "closed"
+	}
+	target := s.Target
+	if s.TLS {
+		target += "/tls"
+	} else if s.Protocol != nil {
+		target += "/" + s.Protocol.Name
+	}
+
+	return fmt.Sprintf("%d\t%s\t%s\t%s\t%d\t%d\n", s.ID, s.Client, target, state, s.up, s.down)
+}
+
+// pump copies data from one side of the stream to the other, holding each
+// chunk while intercepting is on, until either side closes.
+func (s *stream) pump(set *streamSet, up bool) {
+	defer s.Close()
+	buf := make([]byte, 32*1024)
+	for {
+		src, dst := s.ends(up)
+		n, err := src.Read(buf)
+		if n > 0 {
+			c := streamChunk{Up: up, Time: time.Now(), Data: append([]byte(nil), buf[:n]...)}
+			if set.Intercept && !s.hold(&c) {
+				continue
+			}
+
+			// A STARTTLS command is noted before it's sent, so that the
+			// reply isn't missed, and the client isn't read from again
+			// until the reply has been handled
+			var wait chan struct{}
+			if up {
+				wait = s.checkStarttlsCommand(c.Data)
+			}
+			if _, err := dst.Write(c.Data); err != nil {
+				return
+			}
+			s.record(c)
+
+			if wait != nil {
+				select {
+				case <-wait:
+				case <-s.done:
+					return
+				}
+			} else if !up && !s.checkStarttlsReply(c.Data) {
+				return
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// hold holds the chunk until it's forwarded or dropped, returning whether it
+// should be passed on. The chunk's data may be edited while it's held.
+func (s *stream) hold(c *streamChunk) bool {
+	s.holdMu.Lock()
+	defer s.holdMu.Unlock()
+
+	s.mu.Lock()
+	s.held = c
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.held = nil
+		s.mu.Unlock()
+	}()
+
+	select {
+	case <-s.Forward:
+		return true
+	case <-s.Drop:
+		return false
+	case <-s.done:
+		return false
+	}
+}
+
+// streamSet is the set of streams through every port forward.
+type streamSet struct {
+	// Whether chunks of data are held until forwarded
+	Intercept bool
+
+	mu       sync.RWMutex
+	streams  []*stream
+	modified time.Time
+}
+
+// add adds a new stream between the given connections. upgrade is used to
+// upgrade the connections to TLS if the forward's protocol uses STARTTLS.
+func (set *streamSet) add(client, server net.Conn, f *streamForward, upgrade func(client, server net.Conn) (net.Conn, net.Conn, error)) *stream {
+	s := &stream{
+		Client:   client.RemoteAddr().String(),
+		Target:   f.Target,
+		TLS:      f.TLS,
+		Protocol: f.Protocol,
+		Started:  time.Now(),
+		Forward:  make(chan int, 1),
+		Drop:     make(chan int, 1),
+		tlsFrom:  -1,
+		client:   client,
+		server:   server,
+		done:     make(chan struct{}),
+		upgrade:  upgrade,
+	}
+
+	set.mu.Lock()
+	s.ID = len(set.streams)
+	set.streams = append(set.streams, s)
+	set.modified = s.Started
+	set.mu.Unlock()
+
+	go s.pump(set, true)
+	go s.pump(set, false)
+	return s
+}
+
+// Get returns the stream with the given ID, or nil if there's no such stream.
+func (set *streamSet) Get(id int) *stream {
+	set.mu.RLock()
+	defer set.mu.RUnlock()
+	if id < 0 || id >= len(set.streams) {
+		return nil
+	}
+	return set.streams[id]
+}
+
+// Streams returns a copy of the list of streams.
+func (set *streamSet) Streams() []*stream {
+	set.mu.RLock()
+	defer set.mu.RUnlock()
+	return append([]*stream(nil), set.streams...)
+}
+
+// Stat returns the number of streams, and when the last one was opened.
+func (set *streamSet) Stat() (int, time.Time) {
+	set.mu.RLock()
+	defer set.mu.RUnlock()
+	return len(set.streams), set.modified
+}
+
+// dispatchIntercept releases every held chunk when intercepting is turned
+// off.
+func (set *streamSet) dispatchIntercept(change <-chan int) {
+	for range change {
+		if set.Intercept {
+			continue
+		}
+		for _, s := range set.Streams() {
+			release(s.Forward)
+		}
+	}
+}
+
+// ListenStreams accepts connections for the given port forward, passing each
+// on to its target as a stream that can be watched and intercepted.
+func (p *Proxy) ListenStreams(f *streamForward) error {
+	l, err := net.Listen("tcp", f.Listen)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			if err := p.openStream(conn, f); err != nil {
+				conn.Close()
+				p.emitEvent("stream to %s from %s: %v", f.Target, conn.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+// openStream connects to the target of the port forward, and starts passing
+// data between it and the client.
+func (p *Proxy) openStream(client net.Conn, f *streamForward) error {
+	host, _, _ := net.SplitHostPort(f.Target)
+	upgrade := func(client, server net.Conn) (net.Conn, net.Conn, error) {
+		return p.interceptTLS(host, client, server)
+	}
+
+	server, err := net.Dial("tcp", f.Target)
+	if err != nil {
+		return err
+	}
+	if f.TLS {
+		c, sv, err := upgrade(client, server)
+		if err != nil {
+			server.Close()
+			return err
+		}
+		client, server = c, sv
+	}
+	p.Streams.add(client, server, f, upgrade)
+	return nil
+}
+
+// interceptTLS starts TLS on both connections of a stream to the given host,
+// returning the new connections. The client is given a certificate signed by
+// the proxy's CA.
+func (p *Proxy) interceptTLS(host string, client, server net.Conn) (net.Conn, net.Conn, error) {
+	var upCfg *tls.Config
+	if p.Server.Tr.TLSClientConfig != nil {
+		upCfg = p.Server.Tr.TLSClientConfig.Clone()
+	} else {
+		upCfg = &tls.Config{InsecureSkipVerify: true}
+	}
+	upCfg.ServerName = host
+	tlsServer := tls.Client(server, upCfg)
+	if err := tlsServer.Handshake(); err != nil {
+		return nil, nil, err
+	}
+
+	cert, err := signHostCert(p.CA(), host)
+	if err != nil {
+		return nil, nil, err
+	}
+	cfg := &tls.Config{Certificates: []tls.Certificate{*cert}}
+	if p.KeyLog != nil {
+		cfg.KeyLogWriter = p.KeyLog
+	}
+	tlsClient := tls.Server(client, cfg)
+	if err := tlsClient.Handshake(); err != nil {
+		return nil, nil, err
+	}
+	return tlsClient, tlsServer, nil
+}
+
+// signHostCert returns a certificate for the given host, signed by the given
+// CA, for intercepting TLS streams.
+func signHostCert(ca tls.Certificate, host string) (*tls.Certificate, error) {
+	caCert := ca.Leaf
+	if caCert == nil {
+		var err error
+		if caCert, err = x509.ParseCertificate(ca.Certificate[0]); err != nil {
+			return nil, err
+		}
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(1, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		tmpl.IPAddresses = []net.IP{ip}
+	} else {
+		tmpl.DNSNames = []string{host}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, caCert, &key.PublicKey, ca.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{Certificate: [][]byte{der, ca.Certificate[0]}, PrivateKey: key}, nil
+}
+
+// newStreamsDir returns the Dir exposing the streams through port forwards,
+// with a directory per stream named by its ID, an index summarising them, and
+// the switch for intercepting them.
+func newStreamsDir(set *streamSet) *fusebox.Dir {
+	intercept := fusebox.NewBoolFile(&set.Intercept)
+	go set.dispatchIntercept(intercept.Change)
+
+	keys := func() []string {
+		n, _ := set.Stat()
+		ret := []string{"index", "intercept"}
+		for i := 0; i < n; i++ {
+			ret = append(ret, strconv.Itoa(i))
+		}
+		return ret
+	}
+
+	node := func(k string) fusebox.VarNode {
+		switch k {
+		case "index":
+			return newReadOnlyFile(func() []byte {
+				buf := new(bytes.Buffer)
+				for _, s := range set.Streams() {
+					buf.WriteString(s.Summary())
+				}
+				return buf.Bytes()
+			})
+		case "intercept":
+			return intercept
+		}
+
+		id, err := strconv.Atoi(k)
+		if err != nil {
+			return nil
+		}
+		s := set.Get(id)
+		if s == nil {
+			return nil
+		}
+		return newStreamDir(s)
+	}
+
+	return newFuncDir(keys, node)
+}
+
+// newStreamDir returns the Dir exposing a single stream.
+func newStreamDir(s *stream) *fusebox.Dir {
+	ret, d := newNodeDir()
+	d.add("up", newReadOnlyFile(func() []byte { return s.Data(true) }))
+	d.add("down", newReadOnlyFile(func() []byte { return s.Data(false) }))
+	d.add("hexdump", newReadOnlyFile(s.Hexdump))
+	d.add("summary", newReadOnlyFile(func() []byte { return []byte(s.Summary()) }))
+	if s.Protocol != nil {
+		d.add("commands", newReadOnlyFile(s.Commands))
+	}
+	d.add("held", newHandleFile(&heldChunkFile{s}))
+	d.add("direction", newReadOnlyFile(func() []byte {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		switch {
+		case s.held == nil:
+			return nil
+		case s.held.Up:
+			return []byte("up\n")
+		}
+		return []byte("down\n")
+	}))
+	d.add("forward", fusebox.NewChanFile(s.Forward))
+	d.add("drop", fusebox.NewChanFile(s.Drop))
+	d.add("close", newHandleFile(&streamCloseFile{s}))
+	return ret
+}
+
+// heldChunkFile exposes the data of the chunk being held on a stream, which
+// can be edited before it's forwarded. It's empty if nothing is held.
+type heldChunkFile struct {
+	Stream *stream
+}
+
+func (f *heldChunkFile) ValRead(ctx context.Context) ([]byte, error) {
+	f.Stream.mu.Lock()
+	defer f.Stream.mu.Unlock()
+	if f.Stream.held == nil {
+		return nil, nil
+	}
+	return f.Stream.held.Data, nil
+}
+
+func (f *heldChunkFile) ValWrite(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+	f.Stream.mu.Lock()
+	defer f.Stream.mu.Unlock()
+	if f.Stream.held == nil {
+		return errInvalid
+	}
+
+	f.Stream.held.Data = append([]byte(nil), req.Data...)
+	resp.Size = len(req.Data)
+	return nil
+}
+
+func (f *heldChunkFile) Size(ctx context.Context) (uint64, error) {
+	data, _ := f.ValRead(ctx)
+	return uint64(len(data)), nil
+}
+
+// streamCloseFile reads 1 if the stream is closed, and closes it when 1 is
+// written.
+type streamCloseFile struct {
+	Stream *stream
+}
+
+func (f *streamCloseFile) ValRead(ctx context.Context) ([]byte, error) {
+	if f.Stream.Closed() {
+		return []byte("1\n"), nil
+	}
+	return []byte("0\n"), nil
+}
+
+func (f *streamCloseFile) ValWrite(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+	if strings.TrimSpace(string(req.Data)) != "1" {
+		return errInvalid
+	}
+
+	f.Stream.Close()
+	resp.Size = len(req.Data)
+	return nil
+}
+
+func (f *streamCloseFile) Size(ctx context.Context) (uint64, error) {
+	return 2, nil
+}
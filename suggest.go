@@ -0,0 +1,114 @@
+package proxyfs
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"bazil.org/fuse"
+	"github.com/danielthatcher/fusebox"
+)
+
+// scopeSuggestions returns the hosts seen in out of scope traffic that are
+// still out of scope, most requested first.
+func (p *Proxy) scopeSuggestions() []observedHost {
+	ret := make([]observedHost, 0)
+	for _, h := range p.All.HostList() {
+		if !p.inScope(&url.URL{Scheme: "https", Host: h.Host, Path: "/"}) {
+			ret = append(ret, h)
+		}
+	}
+	return ret
+}
+
+// suggestionPattern returns the include rule that brings a host into scope, a
+// pattern matching any of its URLs.
+func suggestionPattern(host string) string {
+	return host
+}
+
+// acceptSuggestion adds an include rule for the given host. It fails if the
+// host would still be out of scope, because the scope regex doesn't match it
+// or it's excluded, since adding the rule would then only narrow the scope.
+func (p *Proxy) acceptSuggestion(host string) error {
+	u := &url.URL{Scheme: "https", Host: host, Path: "/"}
+	if !p.scopeRegexMatches(u) || p.ScopeExclude.Match(u) {
+		return errInvalid
+	}
+
+	p.ScopeInclude.Append([]string{suggestionPattern(host)})
+	p.emitEvent("scope: added %s to the include list", host)
+	return nil
+}
+
+// newSuggestionsDir returns a Dir with an index of the hosts suggested for the
+// scope, and a directory per host to accept it from.
+func newSuggestionsDir(p *Proxy) *fusebox.Dir {
+	keys := func() []string {
+		ret := []string{"index"}
+		for _, h := range p.scopeSuggestions() {
+			ret = append(ret, h.Host)
+		}
+		return ret
+	}
+
+	node := func(k string) fusebox.VarNode {
+		if k == "index" {
+			return newReadOnlyFile(func() []byte {
+				buf := new(bytes.Buffer)
+				for i, h := range p.scopeSuggestions() {
+					fmt.Fprintf(buf, "%d\t%s\t%d\n", i+1, h.Host, h.Count)
+				}
+				return buf.Bytes()
+			})
+		}
+
+		for _, h := range p.scopeSuggestions() {
+			if h.Host != k {
+				continue
+			}
+			ret, d := newNodeDir()
+			d.add("requests", newReadOnlyFile(func() []byte {
+				return []byte(strconv.Itoa(h.Count))
+			}))
+			accept := newHandleFile(&acceptFile{p, h.Host})
+			accept.OpenFlags = fuse.OpenDirectIO
+			d.add("accept", accept)
+			return ret
+		}
+		return nil
+	}
+
+	return newFuncDir(keys, node)
+}
+
+// acceptFile adds a suggested host to the scope when anything is written to
+// it. Reading it gives the include rule that would be added.
+type acceptFile struct {
+	Proxy *Proxy
+	Host  string
+}
+
+func (f *acceptFile) ValRead(ctx context.Context) ([]byte, error) {
+	return []byte(suggestionPattern(f.Host) + "\n"), nil
+}
+
+func (f *acceptFile) ValWrite(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+	if strings.TrimSpace(string(req.Data)) == "" {
+		return errInvalid
+	}
+	if err := f.Proxy.acceptSuggestion(f.Host); err != nil {
+		return err
+	}
+
+	resp.Size = len(req.Data)
+	return nil
+}
+
+func (f *acceptFile) Size(ctx context.Context) (uint64, error) {
+	data, _ := f.ValRead(ctx)
+	return uint64(len(data)), nil
+}
@@ -0,0 +1,168 @@
+package proxyfs
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"reflect"
+	"sync"
+	"time"
+
+	"bazil.org/fuse"
+	"github.com/danielthatcher/fusebox"
+)
+
+// fuseTraceMax is the number of the most recent operations kept for
+// debug/fuse.
+const fuseTraceMax = 1000
+
+// fuseOp is a FUSE operation, as it's traced.
+type fuseOp struct {
+	Time time.Time `json:"time"`
+
+	// The mountpoint the operation was made through
+	Via string `json:"via"`
+
+	Op      string `json:"op"`
+	ID      uint64 `json:"id"`
+	Node    uint64 `json:"node"`
+	UID     uint32 `json:"uid"`
+	PID     uint32 `json:"pid"`
+	Latency int64  `json:"latency_us"`
+	Error   string `json:"error,omitempty"`
+
+	// The request as it's logged by the FUSE library, e.g. with the name
+	// looked up or the offset read from
+	Request string `json:"request"`
+}
+
+// fuseTracer traces the operations the kernel makes on the filesystem, with
+// how long each takes to answer, for diagnosing tools that misbehave against
+// the virtual files. Each operation is written as a line of JSON when it's
+// answered, and the most recent are kept.
+type fuseTracer struct {
+	out io.Writer
+
+	mu      sync.Mutex
+	pending map[fuseOpKey]*fuseOp
+	recent  []*fuseOp
+}
+
+// fuseOpKey identifies a request, whose IDs are only unique to a mount.
+type fuseOpKey struct {
+	via string
+	id  uint64
+}
+
+func newFuseTracer(out io.Writer) *fuseTracer {
+	return &fuseTracer{out: out, pending: make(map[fuseOpKey]*fuseOp)}
+}
+
+// Debugger returns the function that traces the debug messages of the FUSE
+// server for the given mountpoint. Requests are held until their response,
+// which is when they're traced.
+func (t *fuseTracer) Debugger(via string) func(msg interface{}) {
+	return func(msg interface{}) {
+		v := reflect.ValueOf(msg)
+		if v.Kind() != reflect.Struct || !v.FieldByName("Op").IsValid() || !v.FieldByName("Request").IsValid() {
+			return
+		}
+		op := v.FieldByName("Op").String()
+
+		switch hdr := v.FieldByName("Request").Interface().(type) {
+		case *fuse.Header:
+			if hdr == nil {
+				return
+			}
+			t.start(&fuseOp{
+				Time:    time.Now(),
+				Via:     via,
+				Op:      op,
+				ID:      uint64(hdr.ID),
+				Node:    uint64(hdr.Node),
+				UID:     hdr.Uid,
+				PID:     hdr.Pid,
+				Request: fmt.Sprint(v.FieldByName("In").Interface()),
+			})
+		default:
+			r := reflect.ValueOf(hdr)
+			if r.Kind() != reflect.Struct || !r.FieldByName("ID").IsValid() {
+				return
+			}
+			errstr := v.FieldByName("Errno").String()
+			if e := v.FieldByName("Error").String(); e != "" {
+				errstr += ": " + e
+			}
+			t.finish(via, r.FieldByName("ID").Uint(), errstr)
+		}
+	}
+}
+
+// start holds a request until it's answered.
+func (t *fuseTracer) start(op *fuseOp) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	// Requests the kernel doesn't wait for, such as Forget, are never
+	// answered, so those left over are dropped eventually
+	if len(t.pending) >= fuseTraceMax {
+		t.pending = make(map[fuseOpKey]*fuseOp)
+	}
+	t.pending[fuseOpKey{op.Via, op.ID}] = op
+}
+
+// finish traces the request with the given ID, now it's been answered.
+func (t *fuseTracer) finish(via string, id uint64, errstr string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	key := fuseOpKey{via, id}
+	op, ok := t.pending[key]
+	if !ok {
+		return
+	}
+	delete(t.pending, key)
+	op.Latency = int64(time.Since(op.Time) / time.Microsecond)
+	op.Error = errstr
+
+	t.recent = append(t.recent, op)
+	if len(t.recent) > fuseTraceMax {
+		t.recent = t.recent[len(t.recent)-fuseTraceMax:]
+	}
+	if t.out != nil {
+		data, err := json.Marshal(op)
+		if err == nil {
+			_, err = t.out.Write(append(data, '\n'))
+		}
+		if err != nil {
+			log.Printf("Failed to write FUSE trace: %v\n", err)
+		}
+	}
+}
+
+// Bytes returns the most recent operations, a line of JSON each, or nothing
+// if tracing is off.
+func (t *fuseTracer) Bytes() []byte {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	buf := new(bytes.Buffer)
+	enc := json.NewEncoder(buf)
+	for _, op := range t.recent {
+		enc.Encode(op)
+	}
+	return buf.Bytes()
+}
+
+// newDebugDir returns a Dir for diagnosing the proxy, with the most recent
+// FUSE operations in fuse when tracing is on.
+func newDebugDir(p *Proxy) *fusebox.Dir {
+	ret, d := newNodeDir()
+	d.add("fuse", newReadOnlyFile(func() []byte {
+		return p.FuseTrace.Bytes()
+	}))
+	return ret
+}
@@ -0,0 +1,177 @@
+package proxyfs
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"bazil.org/fuse"
+	"github.com/danielthatcher/fusebox"
+)
+
+// hostTransport holds how the upstream connections to a host are made, e.g.
+// for targets that don't handle persistent connections properly.
+type hostTransport struct {
+	// Whether requests are sent as HTTP/1.0, over a new connection each
+	HTTP10 bool
+
+	// Whether connections are kept open to be reused after a request
+	KeepAlive bool
+
+	// The local address connections are made from, or nil to use the
+	// default
+	BindOut net.IP
+
+	// The path of a unix socket that connections are made to instead of the
+	// host, or empty to connect to the host
+	Unix string
+}
+
+// transportHosts holds the transport settings for each host that has them.
+type transportHosts struct {
+	mu    sync.RWMutex
+	hosts map[string]*hostTransport
+}
+
+func newTransportHosts() *transportHosts {
+	return &transportHosts{hosts: make(map[string]*hostTransport)}
+}
+
+// Lookup returns the transport settings for the host of the given URL, or nil
+// if there are none.
+func (s *transportHosts) Lookup(u *url.URL) *hostTransport {
+	return s.LookupHost(u.Hostname(), u.Port())
+}
+
+// LookupHost returns the transport settings for the given host and port, or
+// nil if there are none. Settings for the host and port are used over those
+// for the host alone.
+func (s *transportHosts) LookupHost(host, port string) *hostTransport {
+	host = strings.ToLower(host)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if port != "" {
+		if t, ok := s.hosts[net.JoinHostPort(host, port)]; ok {
+			return t
+		}
+	}
+	return s.hosts[host]
+}
+
+func (s *transportHosts) GetNode(ctx context.Context, k string) (fusebox.VarNode, error) {
+	s.mu.RLock()
+	t, ok := s.hosts[k]
+	s.mu.RUnlock()
+	if !ok {
+		return nil, fuse.ENOENT
+	}
+
+	ret, d := newNodeDir()
+	ret.Mode = os.ModeDir | 0755
+	d.add("http1.0", newBoolFile(&t.HTTP10))
+	d.add("keep-alive", newBoolFile(&t.KeepAlive))
+	d.add("bind-out", newIPFile(&t.BindOut))
+	d.add("unix", newStringFile(&t.Unix))
+	return ret, nil
+}
+
+func (s *transportHosts) GetDirentType(ctx context.Context, k string) (fuse.DirentType, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if _, ok := s.hosts[k]; !ok {
+		return fuse.DT_Unknown, fuse.ENOENT
+	}
+	return fuse.DT_Dir, nil
+}
+
+func (s *transportHosts) GetKeys(ctx context.Context) []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	ret := make([]string, 0, len(s.hosts))
+	for host := range s.hosts {
+		ret = append(ret, host)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// AddNode adds settings for the host given by name, e.g. through mkdir. They
+// start out the same as for any other host.
+func (s *transportHosts) AddNode(name string, node interface{}) error {
+	if name == "" || strings.ContainsAny(name, "/ ") || name != strings.ToLower(name) {
+		return fuse.EPERM
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.hosts[name]; !ok {
+		s.hosts[name] = &hostTransport{KeepAlive: true}
+	}
+	return nil
+}
+
+func (s *transportHosts) RemoveNode(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.hosts[name]; !ok {
+		return fuse.ENOENT
+	}
+	delete(s.hosts, name)
+	return nil
+}
+
+// newTransportDir returns the Dir holding the transport settings.
+func newTransportDir(p *Proxy) *fusebox.Dir {
+	hosts := fusebox.NewDir(p.Transport)
+	hosts.Mode = os.ModeDir | 0777
+	hosts.OpenFlags = fuse.OpenDirectIO
+
+	ret, d := newNodeDir()
+	d.add("bind-out", p.Settings.file(&ipValue{&p.Settings.values.BindOut}))
+	d.add("hosts", hosts)
+	return ret
+}
+
+// bindOut returns the local address to make connections to the given host and
+// port from, or nil to use the default.
+func (p *Proxy) bindOut(host, port string) net.IP {
+	if t := p.Transport.LookupHost(host, port); t != nil && t.BindOut != nil {
+		return t.BindOut
+	}
+	return p.Settings.Get().BindOut
+}
+
+// direct returns whether a request is sent straight to its target, rather
+// than through an upstream proxy.
+func (p *Proxy) direct(req *http.Request) bool {
+	if p.Server.Tr.Proxy == nil {
+		return true
+	}
+	u, _ := p.Server.Tr.Proxy(req)
+	return u == nil
+}
+
+// transportRoundTrip sends a request upstream using the proxy's transport,
+// applying the transport settings for its host. Requests can't be sent as
+// HTTP/1.0 through an upstream proxy, so they're only sent without keep-alive.
+func (p *Proxy) transportRoundTrip(req *http.Request) (*http.Response, error) {
+	t := p.Transport.Lookup(req.URL)
+	if t == nil {
+		return p.upstreamRoundTrip(req)
+	}
+	if t.HTTP10 && p.direct(req) {
+		return p.connRoundTrip(req, true)
+	}
+
+	if t.HTTP10 || !t.KeepAlive {
+		out := *req
+		out.Close = true
+		req = &out
+	}
+	return p.upstreamRoundTrip(req)
+}
@@ -0,0 +1,58 @@
+package proxyfs
+
+import (
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// unixPrefix marks addresses that are unix sockets rather than TCP addresses.
+const unixPrefix = "unix:"
+
+// Characters that can't appear in the host names given to unix sockets
+var unixHostRe = regexp.MustCompile(`[^a-z0-9.-]+`)
+
+// listen listens on the given address, which is a TCP address, or a path
+// prefixed with "unix:" for a unix socket. A stale socket left at the path
+// by an earlier run, which nothing is listening on, is removed first.
+func listen(addr string) (net.Listener, error) {
+	if !strings.HasPrefix(addr, unixPrefix) {
+		return net.Listen("tcp", addr)
+	}
+
+	path := strings.TrimPrefix(addr, unixPrefix)
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+		} else {
+			os.Remove(path)
+		}
+	}
+	return net.Listen("unix", path)
+}
+
+// unixHost returns the host name that stands for the unix socket at the given
+// path in URLs, which is based on the socket's file name.
+func unixHost(path string) string {
+	host := unixHostRe.ReplaceAllString(strings.ToLower(filepath.Base(path)), "-")
+	host = strings.Trim(host, ".-")
+	if host == "" {
+		host = "unix"
+	}
+	return host
+}
+
+// unixTarget returns the URL that stands for the unix socket at the given
+// path, such as /var/run/docker.sock, and has connections to its host made
+// to the socket.
+func (p *Proxy) unixTarget(path string) *url.URL {
+	host := unixHost(path)
+	p.Transport.AddNode(host, nil)
+	if t := p.Transport.LookupHost(host, ""); t != nil {
+		t.Unix = path
+	}
+	return &url.URL{Scheme: "http", Host: host}
+}
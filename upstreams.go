@@ -0,0 +1,254 @@
+package proxyfs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/danielthatcher/fusebox"
+)
+
+// upstreamCheckInterval is how often the upstream proxies are health checked.
+const upstreamCheckInterval = 10 * time.Second
+
+// upstreamCheckTimeout is how long a health check waits to connect to an
+// upstream proxy before marking it as down.
+const upstreamCheckTimeout = 5 * time.Second
+
+// upstreamProxy is an upstream proxy in the failover list, and the result of
+// its last health check.
+type upstreamProxy struct {
+	URL *url.URL
+
+	mu      sync.Mutex
+	down    bool
+	checked time.Time
+	latency time.Duration
+	err     error
+}
+
+// Up returns whether the upstream passed its last health check. Upstreams
+// are assumed to be up until they've been checked.
+func (u *upstreamProxy) Up() bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return !u.down
+}
+
+// set records the result of a health check, returning whether the upstream
+// went up or down.
+func (u *upstreamProxy) set(latency time.Duration, err error) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	changed := u.down != (err != nil)
+	u.down = err != nil
+	u.checked = time.Now()
+	u.latency = latency
+	u.err = err
+	return changed
+}
+
+// upstreamSet is the list of upstream proxies, in order of preference.
+// Requests go through the first upstream that's up, failing over to the next
+// when it goes down, and back again when it recovers.
+type upstreamSet struct {
+	mu     sync.Mutex
+	list   []*upstreamProxy
+	active *upstreamProxy
+}
+
+// Add adds an upstream proxy to the end of the list.
+func (s *upstreamSet) Add(u *url.URL) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.list = append(s.list, &upstreamProxy{URL: u})
+	if s.active == nil {
+		s.active = s.list[0]
+	}
+}
+
+// List returns a copy of the list of upstream proxies.
+func (s *upstreamSet) List() []*upstreamProxy {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*upstreamProxy(nil), s.list...)
+}
+
+// Active returns the upstream requests are currently sent through: the first
+// that's up, or the first of all if they're all down, so that requests fail
+// with its error. It returns nil if there are no upstreams.
+func (s *upstreamSet) Active() *upstreamProxy {
+	list := s.List()
+	for _, u := range list {
+		if u.Up() {
+			return u
+		}
+	}
+	if len(list) == 0 {
+		return nil
+	}
+	return list[0]
+}
+
+// Proxy returns the URL of the active upstream, for use as a transport's
+// Proxy function.
+func (s *upstreamSet) Proxy(req *http.Request) (*url.URL, error) {
+	if u := s.Active(); u != nil {
+		return u.URL, nil
+	}
+	return nil, nil
+}
+
+// reportUpstream records the result of a health check of an upstream, or of
+// a failure to connect to it, sending events when it goes up or down and when
+// requests fail over to another upstream.
+func (p *Proxy) reportUpstream(u *upstreamProxy, latency time.Duration, err error) {
+	s := p.Upstreams
+	if !u.set(latency, err) {
+		return
+	}
+	if err != nil {
+		p.emitEvent("upstream: %s is down: %v", u.URL, err)
+	} else {
+		p.emitEvent("upstream: %s is up", u.URL)
+	}
+
+	next := s.Active()
+	s.mu.Lock()
+	prev := s.active
+	s.active = next
+	s.mu.Unlock()
+	if next != prev {
+		p.emitEvent("upstream: switching from %s to %s", prev.URL, next.URL)
+	}
+}
+
+// checkUpstream checks that an upstream proxy can be connected to.
+func (p *Proxy) checkUpstream(u *upstreamProxy) {
+	ctx, cancel := context.WithTimeout(context.Background(), upstreamCheckTimeout)
+	defer cancel()
+
+	start := time.Now()
+	conn, err := p.dialContext(ctx, "tcp", upstreamAddr(u.URL))
+	if err == nil {
+		conn.Close()
+	}
+	p.reportUpstream(u, time.Since(start), err)
+}
+
+// checkUpstreams checks the health of every upstream proxy each interval.
+func (p *Proxy) checkUpstreams(interval time.Duration) {
+	defer p.recoverPanic("checking upstreams", func() {
+		go p.checkUpstreams(interval)
+	})
+	for range time.Tick(interval) {
+		var wg sync.WaitGroup
+		for _, u := range p.Upstreams.List() {
+			wg.Add(1)
+			go func(u *upstreamProxy) {
+				defer wg.Done()
+				p.checkUpstream(u)
+			}(u)
+		}
+		wg.Wait()
+	}
+}
+
+// upstreamAddr returns the host and port of an upstream proxy.
+func upstreamAddr(u *url.URL) string {
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+// proxyConnectError returns whether err is a failure to connect to an upstream
+// proxy, in which case nothing was sent.
+func proxyConnectError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "proxyconnect"
+}
+
+// upstreamRoundTrip sends a request using the proxy's transport. If it
+// couldn't connect to the active upstream proxy, that upstream is marked as
+// down, and the request is sent again through the next one, as long as its
+// body can be read again.
+func (p *Proxy) upstreamRoundTrip(req *http.Request) (*http.Response, error) {
+	u := p.Upstreams.Active()
+	if u == nil {
+		return p.Server.Tr.RoundTrip(req)
+	}
+
+	var spool *bodySpool
+	retryable := req.Body == nil || req.Body == http.NoBody
+	if s, ok := req.Body.(spooled); ok {
+		spool = s.Spool()
+		retryable = true
+	}
+
+	start := time.Now()
+	resp, err := p.Server.Tr.RoundTrip(req)
+	if err == nil || !proxyConnectError(err) {
+		return resp, err
+	}
+	p.reportUpstream(u, time.Since(start), err)
+	if next := p.Upstreams.Active(); next == u || !retryable {
+		return resp, err
+	}
+
+	retry := *req
+	if spool != nil {
+		retry.Body = spool.Reader()
+	}
+	return p.Server.Tr.RoundTrip(&retry)
+}
+
+// Status returns a tab separated line for each upstream proxy, in order of
+// preference, giving its URL, whether it's up or down, whether requests are
+// going through it, when it was last checked, how long connecting to it took
+// in milliseconds, and the error it failed with.
+func (s *upstreamSet) Status() []byte {
+	active := s.Active()
+	buf := new(bytes.Buffer)
+	for _, u := range s.List() {
+		u.mu.Lock()
+		state, checked, latency, err := "up", "-", "-", "-"
+		if u.down {
+			state = "down"
+		}
+		if !u.checked.IsZero() {
+			checked = u.checked.Format(time.RFC3339)
+			latency = strconv.FormatInt(u.latency.Nanoseconds()/int64(time.Millisecond), 10)
+		}
+		if u.err != nil {
+			err = u.err.Error()
+		}
+		u.mu.Unlock()
+
+		using := "-"
+		if u == active {
+			using = "active"
+		}
+		fmt.Fprintf(buf, "%s\t%s\t%s\t%s\t%s\t%s\n", u.URL, state, using, checked, latency, err)
+	}
+	return buf.Bytes()
+}
+
+// newUpstreamsDir returns the Dir exposing the state of the upstream
+// proxies.
+func newUpstreamsDir(s *upstreamSet) *fusebox.Dir {
+	ret, d := newNodeDir()
+	d.add("status", newReadOnlyFile(s.Status))
+	return ret
+}
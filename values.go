@@ -0,0 +1,324 @@
+package proxyfs
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"bazil.org/fuse"
+)
+
+// Files exposing single values, such as a request's method or a setting. These
+// are read with a trailing newline so that they work with line oriented tools,
+// and have surrounding whitespace trimmed when written.
+
+// newValueFile returns a handleFile for a single value element.
+func newValueFile(e interface {
+	ValRead(ctx context.Context) ([]byte, error)
+	ValWrite(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error
+}) *handleFile {
+	ret := newHandleFile(&valueElement{e})
+	ret.NewlineOnRead = true
+	ret.TrimWrites = true
+	ret.OpenFlags = fuse.OpenDirectIO
+	return ret
+}
+
+// valueElement adds a Size method to value elements, based on their value.
+type valueElement struct {
+	value interface {
+		ValRead(ctx context.Context) ([]byte, error)
+		ValWrite(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error
+	}
+}
+
+func (e *valueElement) ValRead(ctx context.Context) ([]byte, error) {
+	return e.value.ValRead(ctx)
+}
+
+func (e *valueElement) ValWrite(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+	return e.value.ValWrite(ctx, req, resp)
+}
+
+func (e *valueElement) AppendVal(ctx context.Context, buf *bytes.Buffer) error {
+	return appendValue(ctx, e.value, buf)
+}
+
+func (e *valueElement) Size(ctx context.Context) (uint64, error) {
+	buf := getBuffer(0)
+	defer putBuffer(buf)
+	err := appendValue(ctx, e.value, buf)
+	return uint64(buf.Len()), err
+}
+
+type stringValue struct {
+	Val *string
+}
+
+// Returns a new File exposing the given string.
+func newStringFile(s *string) *handleFile {
+	return newValueFile(&stringValue{s})
+}
+
+func (v *stringValue) ValRead(ctx context.Context) ([]byte, error) {
+	return []byte(*v.Val), nil
+}
+
+func (v *stringValue) AppendVal(ctx context.Context, buf *bytes.Buffer) error {
+	buf.WriteString(*v.Val)
+	return nil
+}
+
+func (v *stringValue) ValWrite(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+	*v.Val = string(req.Data)
+	resp.Size = len(req.Data)
+	return nil
+}
+
+type boolValue struct {
+	Val *bool
+}
+
+// Returns a new File exposing the given bool as '0' or '1'. Writes also accept
+// the forms understood by strconv.ParseBool, such as "true".
+func newBoolFile(b *bool) *handleFile {
+	return newValueFile(&boolValue{b})
+}
+
+func (v *boolValue) ValRead(ctx context.Context) ([]byte, error) {
+	if *v.Val {
+		return []byte("1"), nil
+	}
+	return []byte("0"), nil
+}
+
+func (v *boolValue) AppendVal(ctx context.Context, buf *bytes.Buffer) error {
+	if *v.Val {
+		buf.WriteByte('1')
+	} else {
+		buf.WriteByte('0')
+	}
+	return nil
+}
+
+func (v *boolValue) ValWrite(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+	b, err := strconv.ParseBool(string(req.Data))
+	if err != nil {
+		return errInvalid
+	}
+
+	*v.Val = b
+	resp.Size = len(req.Data)
+	return nil
+}
+
+// atomicFlag is a bool that's set through the filesystem while being read by the
+// goroutines handling traffic, so it's only accessed atomically.
+type atomicFlag struct {
+	v int32
+}
+
+// Get returns whether the flag is set.
+func (f *atomicFlag) Get() bool {
+	return atomic.LoadInt32(&f.v) != 0
+}
+
+// Set sets or clears the flag.
+func (f *atomicFlag) Set(b bool) {
+	var v int32
+	if b {
+		v = 1
+	}
+	atomic.StoreInt32(&f.v, v)
+}
+
+type flagValue struct {
+	Val    *atomicFlag
+	Change chan int
+}
+
+// Returns a new File exposing the given flag as '0' or '1', like newBoolFile.
+// Each write is signalled on change, which is only sent to if there isn't a
+// signal already waiting, so readers should check the flag's current value.
+func newFlagFile(f *atomicFlag, change chan int) *handleFile {
+	return newValueFile(&flagValue{Val: f, Change: change})
+}
+
+func (v *flagValue) ValRead(ctx context.Context) ([]byte, error) {
+	if v.Val.Get() {
+		return []byte("1"), nil
+	}
+	return []byte("0"), nil
+}
+
+func (v *flagValue) ValWrite(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+	b, err := strconv.ParseBool(string(req.Data))
+	if err != nil {
+		return errInvalid
+	}
+
+	v.Val.Set(b)
+	select {
+	case v.Change <- 1:
+	default:
+	}
+	resp.Size = len(req.Data)
+	return nil
+}
+
+type intValue struct {
+	Val *int
+}
+
+// Returns a new File exposing the given int.
+func newIntFile(i *int) *handleFile {
+	return newValueFile(&intValue{i})
+}
+
+func (v *intValue) ValRead(ctx context.Context) ([]byte, error) {
+	return []byte(strconv.Itoa(*v.Val)), nil
+}
+
+func (v *intValue) AppendVal(ctx context.Context, buf *bytes.Buffer) error {
+	var scratch [20]byte
+	buf.Write(strconv.AppendInt(scratch[:0], int64(*v.Val), 10))
+	return nil
+}
+
+func (v *intValue) ValWrite(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+	i, err := strconv.Atoi(string(req.Data))
+	if err != nil {
+		return errInvalid
+	}
+
+	*v.Val = i
+	resp.Size = len(req.Data)
+	return nil
+}
+
+type int64Value struct {
+	Val *int64
+}
+
+// Returns a new File exposing the given int64.
+func newInt64File(i *int64) *handleFile {
+	return newValueFile(&int64Value{i})
+}
+
+func (v *int64Value) ValRead(ctx context.Context) ([]byte, error) {
+	return []byte(strconv.FormatInt(*v.Val, 10)), nil
+}
+
+func (v *int64Value) AppendVal(ctx context.Context, buf *bytes.Buffer) error {
+	var scratch [20]byte
+	buf.Write(strconv.AppendInt(scratch[:0], *v.Val, 10))
+	return nil
+}
+
+func (v *int64Value) ValWrite(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+	i, err := strconv.ParseInt(string(req.Data), 10, 64)
+	if err != nil {
+		return errInvalid
+	}
+
+	*v.Val = i
+	resp.Size = len(req.Data)
+	return nil
+}
+
+type urlValue struct {
+	Val *url.URL
+}
+
+// Returns a new File exposing the given URL. Written URLs must be absolute.
+func newURLFile(u *url.URL) *handleFile {
+	return newValueFile(&urlValue{u})
+}
+
+func (v *urlValue) ValRead(ctx context.Context) ([]byte, error) {
+	return []byte(v.Val.String()), nil
+}
+
+func (v *urlValue) ValWrite(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+	u, err := url.Parse(string(req.Data))
+	if err != nil || !u.IsAbs() {
+		return errInvalid
+	}
+
+	*v.Val = *u
+	resp.Size = len(req.Data)
+	return nil
+}
+
+type ipValue struct {
+	Val *net.IP
+}
+
+// Returns a new File exposing the given IP address, which reads as empty if
+// it's unset. Writing an empty value unsets it.
+func newIPFile(ip *net.IP) *handleFile {
+	return newValueFile(&ipValue{ip})
+}
+
+func (v *ipValue) ValRead(ctx context.Context) ([]byte, error) {
+	if *v.Val == nil {
+		return nil, nil
+	}
+	return []byte(v.Val.String()), nil
+}
+
+func (v *ipValue) ValWrite(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+	var ip net.IP
+	if len(req.Data) > 0 {
+		if ip = net.ParseIP(string(req.Data)); ip == nil {
+			return errInvalid
+		}
+	}
+
+	*v.Val = ip
+	resp.Size = len(req.Data)
+	return nil
+}
+
+type durationValue struct {
+	Val *time.Duration
+}
+
+// Returns a new File exposing the given duration. Writes accept the forms
+// understood by parseDuration.
+func newDurationFile(d *time.Duration) *handleFile {
+	return newValueFile(&durationValue{d})
+}
+
+func (v *durationValue) ValRead(ctx context.Context) ([]byte, error) {
+	return []byte(v.Val.String()), nil
+}
+
+func (v *durationValue) ValWrite(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+	d, err := parseDuration(string(req.Data))
+	if err != nil || d < 0 {
+		return errInvalid
+	}
+
+	*v.Val = d
+	resp.Size = len(req.Data)
+	return nil
+}
+
+// parseDuration parses a duration as understood by time.ParseDuration, or a
+// whole number of days such as "30d".
+func parseDuration(s string) (time.Duration, error) {
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(s, "d"))
+		if err != nil {
+			return 0, err
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(s)
+}
@@ -0,0 +1,112 @@
+package proxyfs
+
+import (
+	"context"
+	"os"
+	"regexp"
+	"sort"
+	"sync"
+
+	"bazil.org/fuse"
+	"github.com/danielthatcher/fusebox"
+)
+
+// valueSet is a set of named values, such as snippets, that are exposed as a
+// directory per value containing a value file. Values are created with mkdir
+// and removed with rmdir.
+type valueSet struct {
+	mu     sync.RWMutex
+	values map[string]*[]byte
+
+	// The names values can have
+	names *regexp.Regexp
+}
+
+func newValueSet(names *regexp.Regexp) *valueSet {
+	return &valueSet{values: make(map[string]*[]byte), names: names}
+}
+
+// Get returns the named value.
+func (s *valueSet) Get(name string) ([]byte, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	v, ok := s.values[name]
+	if !ok {
+		return nil, false
+	}
+	return *v, true
+}
+
+// Set sets the named value, creating it if it doesn't exist.
+func (s *valueSet) Set(name string, val []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data := append([]byte(nil), val...)
+	s.values[name] = &data
+}
+
+func (s *valueSet) GetNode(ctx context.Context, k string) (fusebox.VarNode, error) {
+	s.mu.RLock()
+	v, ok := s.values[k]
+	s.mu.RUnlock()
+	if !ok {
+		return nil, fuse.ENOENT
+	}
+
+	ret, d := newNodeDir()
+	ret.Mode = os.ModeDir | 0755
+	d.add("value", newHandleFile(&jobFile{&s.mu, v, nil}))
+	return ret, nil
+}
+
+func (s *valueSet) GetDirentType(ctx context.Context, k string) (fuse.DirentType, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if _, ok := s.values[k]; !ok {
+		return fuse.DT_Unknown, fuse.ENOENT
+	}
+	return fuse.DT_Dir, nil
+}
+
+func (s *valueSet) GetKeys(ctx context.Context) []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	ret := make([]string, 0, len(s.values))
+	for name := range s.values {
+		ret = append(ret, name)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// AddNode creates a new, empty value with the given name, e.g. through mkdir.
+func (s *valueSet) AddNode(name string, node interface{}) error {
+	if !s.names.MatchString(name) {
+		return fuse.EPERM
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.values[name]; !ok {
+		s.values[name] = &[]byte{}
+	}
+	return nil
+}
+
+func (s *valueSet) RemoveNode(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.values[name]; !ok {
+		return fuse.ENOENT
+	}
+	delete(s.values, name)
+	return nil
+}
+
+// newValueSetDir returns the Dir holding a set of values.
+func newValueSetDir(s *valueSet) *fusebox.Dir {
+	ret := fusebox.NewDir(s)
+	ret.Mode = os.ModeDir | 0777
+	ret.OpenFlags = fuse.OpenDirectIO
+	return ret
+}
@@ -0,0 +1,59 @@
+package proxyfs
+
+import (
+	"os"
+	"regexp"
+)
+
+var (
+	// Names variables can have
+	varNameRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+	// References to variables
+	varRefRe = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+)
+
+// varSet holds named values, such as tokens and host names, that can be
+// referred to as ${NAME} in the configuration, so that they only need to be
+// changed in one place. Names that aren't set fall back to the proxy's
+// environment, and references to names that aren't set in either are left as
+// they are.
+type varSet struct {
+	*valueSet
+}
+
+func newVarSet() *varSet {
+	return &varSet{newValueSet(varNameRe)}
+}
+
+// Lookup returns the value of the named variable, from the set or the
+// environment.
+func (s *varSet) Lookup(name string) ([]byte, bool) {
+	if v, ok := s.Get(name); ok {
+		return v, true
+	}
+	if v, ok := os.LookupEnv(name); ok {
+		return []byte(v), true
+	}
+	return nil, false
+}
+
+// Expand replaces references to variables in the given data with their
+// values. It can be called on a nil set, which expands nothing.
+func (s *varSet) Expand(data []byte) []byte {
+	if s == nil {
+		return data
+	}
+
+	return varRefRe.ReplaceAllFunc(data, func(ref []byte) []byte {
+		if v, ok := s.Lookup(string(ref[2 : len(ref)-1])); ok {
+			return v
+		}
+		return ref
+	})
+}
+
+// ExpandString is Expand for strings.
+func (s *varSet) ExpandString(str string) string {
+	return string(s.Expand([]byte(str)))
+}
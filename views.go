@@ -0,0 +1,167 @@
+package proxyfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"bazil.org/fuse"
+	"github.com/danielthatcher/fusebox"
+)
+
+// prefixView is a named view of the history entries whose paths fall under
+// a prefix.
+type prefixView struct {
+	Name   string
+	Prefix string
+}
+
+// Match returns whether the given path is the view's prefix, or falls under
+// it. Prefixes match whole path segments, so /api/v2 doesn't match /api/v20,
+// unless the prefix ends with a '*'.
+func (v prefixView) Match(path string) bool {
+	if strings.HasSuffix(v.Prefix, "*") {
+		return strings.HasPrefix(path, strings.TrimSuffix(v.Prefix, "*"))
+	}
+	prefix := strings.TrimSuffix(v.Prefix, "/")
+	return path == prefix || strings.HasPrefix(path, prefix+"/")
+}
+
+// prefixViews is a list of path prefix views that can be read and replaced as
+// a file. Each line of the file is a view, made up of its name followed by
+// the path prefix it shows, e.g.
+//
+//	api-v2 /api/v2
+//
+// Blank lines and lines starting with '#' are ignored.
+type prefixViews struct {
+	mu    sync.RWMutex
+	src   []byte
+	views []prefixView
+}
+
+// Get returns the named view.
+func (s *prefixViews) Get(name string) (prefixView, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, v := range s.views {
+		if v.Name == name {
+			return v, true
+		}
+	}
+	return prefixView{}, false
+}
+
+// Names returns the names of the views.
+func (s *prefixViews) Names() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	ret := make([]string, 0, len(s.views))
+	for _, v := range s.views {
+		ret = append(ret, v.Name)
+	}
+	return ret
+}
+
+// parsePrefixViews parses views in the format described for prefixViews.
+func parsePrefixViews(src string) ([]prefixView, error) {
+	ret := make([]prefixView, 0)
+	for n, line := range strings.Split(src, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 || strings.Contains(fields[0], "/") || !strings.HasPrefix(fields[1], "/") {
+			return nil, fmt.Errorf("line %d: expected a name and a path starting with /", n+1)
+		}
+		for _, v := range ret {
+			if v.Name == fields[0] {
+				return nil, errors.New("duplicate view " + fields[0])
+			}
+		}
+		ret = append(ret, prefixView{Name: fields[0], Prefix: fields[1]})
+	}
+
+	return ret, nil
+}
+
+func (s *prefixViews) ValRead(ctx context.Context) ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.src, nil
+}
+
+func (s *prefixViews) ValWrite(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+	views, err := parsePrefixViews(string(req.Data))
+	if err != nil {
+		return errInvalid
+	}
+
+	s.mu.Lock()
+	s.src = append([]byte(nil), req.Data...)
+	s.views = views
+	s.mu.Unlock()
+
+	resp.Size = len(req.Data)
+	return nil
+}
+
+func (s *prefixViews) Size(ctx context.Context) (uint64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return uint64(len(s.src)), nil
+}
+
+// newByMethodDir returns a Dir with a directory for each request method in
+// the history, which in turn contains the entries with that method.
+func newByMethodDir(p *Proxy) *fusebox.Dir {
+	methods := func() map[string]bool {
+		ret := make(map[string]bool)
+		for _, e := range p.History.Entries() {
+			ret[e.Req.Method] = true
+		}
+		return ret
+	}
+
+	keys := func() []string {
+		ret := make([]string, 0)
+		for m := range methods() {
+			ret = append(ret, m)
+		}
+		sort.Strings(ret)
+		return ret
+	}
+
+	node := func(method string) fusebox.VarNode {
+		method = strings.ToUpper(method)
+		if !methods()[method] {
+			return nil
+		}
+		return newHistoryViewDir(p, func(e *historyEntry) bool {
+			return e.Req.Method == method
+		})
+	}
+
+	return newFuncDir(keys, node)
+}
+
+// newByPrefixDir returns a Dir with a directory for each configured path
+// prefix view, which in turn contains the entries under that prefix.
+func newByPrefixDir(p *Proxy) *fusebox.Dir {
+	node := func(name string) fusebox.VarNode {
+		v, ok := p.Prefixes.Get(name)
+		if !ok {
+			return nil
+		}
+		return newHistoryViewDir(p, func(e *historyEntry) bool {
+			return v.Match(e.Req.URL.Path)
+		})
+	}
+
+	return newFuncDir(p.Prefixes.Names, node)
+}
@@ -0,0 +1,696 @@
+package proxyfs
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"bazil.org/fuse"
+	"github.com/danielthatcher/fusebox"
+)
+
+// The most data recorded for a single WebSocket connection, and the largest
+// message that can be passed through. Messages sent once a connection has
+// recorded as much as it can are still forwarded, and listed, but their data
+// isn't kept once they've been sent.
+const (
+	maxWebSocketRecord  = 16 << 20
+	maxWebSocketMessage = 16 << 20
+)
+
+// WebSocket opcodes
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xa
+)
+
+// wsOpcodeName returns the name of a WebSocket opcode, as shown in the
+// filesystem.
+func wsOpcodeName(op byte) string {
+	switch op {
+	case wsText:
+		return "text"
+	case wsBinary:
+		return "binary"
+	case wsClose:
+		return "close"
+	case wsPing:
+		return "ping"
+	case wsPong:
+		return "pong"
+	}
+	return fmt.Sprintf("0x%x", op)
+}
+
+// isWebSocketUpgrade returns whether the request asks to upgrade the
+// connection to a WebSocket.
+func isWebSocketUpgrade(r *http.Request) bool {
+	return headerHasToken(r.Header, "Connection", "upgrade") && headerHasToken(r.Header, "Upgrade", "websocket")
+}
+
+// headerHasToken returns whether any of the comma separated values of the
+// given header is the given token, ignoring case.
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, v := range h[http.CanonicalHeaderKey(name)] {
+		for _, s := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(s), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// readWSFrame reads a single frame, returning whether it's the last of its
+// message, its opcode and its unmasked payload.
+func readWSFrame(r io.Reader) (bool, byte, []byte, error) {
+	var head [2]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return false, 0, nil, err
+	}
+	fin, op := head[0]&0x80 != 0, head[0]&0x0f
+	if head[0]&0x70 != 0 {
+		return false, 0, nil, errors.New("websocket frame uses an extension")
+	}
+
+	n := uint64(head[1] & 0x7f)
+	switch n {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		n = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		n = binary.BigEndian.Uint64(ext[:])
+	}
+	if n > maxWebSocketMessage {
+		return false, 0, nil, fmt.Errorf("websocket frame of %d bytes is too large", n)
+	}
+
+	var mask [4]byte
+	masked := head[1]&0x80 != 0
+	if masked {
+		if _, err := io.ReadFull(r, mask[:]); err != nil {
+			return false, 0, nil, err
+		}
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return false, 0, nil, err
+	}
+	if masked {
+		for i := range data {
+			data[i] ^= mask[i%4]
+		}
+	}
+	return fin, op, data, nil
+}
+
+// writeWSFrame writes a whole message as a single frame. Frames sent by
+// clients have to be masked.
+func writeWSFrame(w io.Writer, op byte, data []byte, mask bool) error {
+	buf := new(bytes.Buffer)
+	buf.WriteByte(0x80 | op)
+	var bit byte
+	if mask {
+		bit = 0x80
+	}
+	switch n := len(data); {
+	case n < 126:
+		buf.WriteByte(bit | byte(n))
+	case n <= 0xffff:
+		buf.WriteByte(bit | 126)
+		binary.Write(buf, binary.BigEndian, uint16(n))
+	default:
+		buf.WriteByte(bit | 127)
+		binary.Write(buf, binary.BigEndian, uint64(n))
+	}
+
+	if !mask {
+		buf.Write(data)
+	} else {
+		var key [4]byte
+		if _, err := rand.Read(key[:]); err != nil {
+			return err
+		}
+		buf.Write(key[:])
+		for i, b := range data {
+			buf.WriteByte(b ^ key[i%4])
+		}
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// wsFrame is a message or control frame sent over a WebSocket connection.
+// Messages sent in several frames are put back together, and sent on as a
+// single frame.
+type wsFrame struct {
+	ID     int
+	Up     bool
+	Time   time.Time
+	Opcode byte
+
+	// Used to release and discard the frame while it's held
+	Forward chan int
+	Drop    chan int
+
+	mu    sync.Mutex
+	data  []byte
+	state string
+}
+
+// Data returns the frame's data.
+func (f *wsFrame) Data() []byte {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.data
+}
+
+// State returns whether the frame is being sent, held, forwarded or dropped.
+func (f *wsFrame) State() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.state
+}
+
+// setState sets the frame's state.
+func (f *wsFrame) setState(state string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.state = state
+}
+
+// hold holds the frame until it's forwarded or dropped, or the connection
+// closes, returning whether it should be sent on. The frame's data may be
+// edited while it's held.
+func (f *wsFrame) hold(done <-chan struct{}) bool {
+	f.setState("held")
+	select {
+	case <-f.Forward:
+		return true
+	case <-f.Drop:
+	case <-done:
+	}
+	f.setState("dropped")
+	return false
+}
+
+// Summary returns a single, tab separated line summarising the frame.
+func (f *wsFrame) Summary() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	dir := "<"
+	if f.Up {
+		dir = ">"
+	}
+	return fmt.Sprintf("%d\t%s\t%s\t%s\t%s\t%d\n", f.ID, dir, f.Time.Format(time.RFC3339Nano), wsOpcodeName(f.Opcode), f.state, len(f.data))
+}
+
+// wsConn is a single WebSocket connection through the proxy.
+type wsConn struct {
+	ID      int
+	URL     string
+	Client  string
+	Started time.Time
+
+	// The history entry of the upgrade request
+	History int
+
+	mu       sync.Mutex
+	frames   []*wsFrame
+	recorded int
+	closed   bool
+
+	client    net.Conn
+	server    net.Conn
+	clientBuf *bufio.Reader
+	serverBuf *bufio.Reader
+	done      chan struct{}
+}
+
+// add adds a frame read from one side of the connection.
+func (c *wsConn) add(up bool, op byte, data []byte) *wsFrame {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	f := &wsFrame{
+		ID:      len(c.frames),
+		Up:      up,
+		Time:    time.Now(),
+		Opcode:  op,
+		Forward: make(chan int, 1),
+		Drop:    make(chan int, 1),
+		data:    data,
+		state:   "sending",
+	}
+	c.frames = append(c.frames, f)
+	return f
+}
+
+// sent marks a frame as forwarded, forgetting its data if the connection has
+// recorded as much as it can.
+func (c *wsConn) sent(f *wsFrame) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.state = "forwarded"
+	if c.recorded+len(f.data) > maxWebSocketRecord {
+		f.data = nil
+		return
+	}
+	c.recorded += len(f.data)
+}
+
+// Frame returns the frame with the given ID, or nil if there's no such frame.
+func (c *wsConn) Frame(id int) *wsFrame {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if id < 0 || id >= len(c.frames) {
+		return nil
+	}
+	return c.frames[id]
+}
+
+// Frames returns a copy of the list of frames.
+func (c *wsConn) Frames() []*wsFrame {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]*wsFrame(nil), c.frames...)
+}
+
+// Close closes both sides of the connection.
+func (c *wsConn) Close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return
+	}
+	c.closed = true
+	close(c.done)
+	c.client.Close()
+	c.server.Close()
+}
+
+// Closed returns whether the connection has been closed.
+func (c *wsConn) Closed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closed
+}
+
+// Summary returns a single, tab separated line summarising the connection.
+func (c *wsConn) Summary() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	state := "open"
+	if c.closed {
+		state = "closed"
+	}
+	return fmt.Sprintf("%d\t%s\t%s\t%s\t%d\n", c.ID, c.Client, c.URL, state, len(c.frames))
+}
+
+// pump passes frames from one side of the connection to the other until
+// either side closes. Messages are held while intercepting is on, while
+// control frames are always passed on straight away.
+func (c *wsConn) pump(set *wsSet, up bool) {
+	defer c.Close()
+	src, dst := c.serverBuf, c.client
+	if up {
+		src, dst = c.clientBuf, c.server
+	}
+
+	var msg []byte
+	var msgOp byte
+	for {
+		fin, op, data, err := readWSFrame(src)
+		if err != nil {
+			return
+		}
+
+		if op >= wsClose {
+			f := c.add(up, op, data)
+			if err := writeWSFrame(dst, op, data, up); err != nil {
+				return
+			}
+			c.sent(f)
+			continue
+		}
+		if op != wsContinuation {
+			msg, msgOp = nil, op
+		}
+		if len(msg)+len(data) > maxWebSocketMessage {
+			return
+		}
+		msg = append(msg, data...)
+		if !fin {
+			continue
+		}
+
+		f := c.add(up, msgOp, msg)
+		msg = nil
+		if set.Intercept && !f.hold(c.done) {
+			continue
+		}
+		if err := writeWSFrame(dst, f.Opcode, f.Data(), up); err != nil {
+			return
+		}
+		c.sent(f)
+	}
+}
+
+// wsSet is the set of WebSocket connections through the proxy.
+type wsSet struct {
+	// Whether messages are held until forwarded
+	Intercept bool
+
+	mu       sync.RWMutex
+	conns    []*wsConn
+	modified time.Time
+}
+
+// add adds a new connection, and starts passing frames between its sides.
+func (set *wsSet) add(c *wsConn) {
+	set.mu.Lock()
+	c.ID = len(set.conns)
+	set.conns = append(set.conns, c)
+	set.modified = c.Started
+	set.mu.Unlock()
+
+	go c.pump(set, true)
+	go c.pump(set, false)
+}
+
+// Get returns the connection with the given ID, or nil if there's no such
+// connection.
+func (set *wsSet) Get(id int) *wsConn {
+	set.mu.RLock()
+	defer set.mu.RUnlock()
+	if id < 0 || id >= len(set.conns) {
+		return nil
+	}
+	return set.conns[id]
+}
+
+// Conns returns a copy of the list of connections.
+func (set *wsSet) Conns() []*wsConn {
+	set.mu.RLock()
+	defer set.mu.RUnlock()
+	return append([]*wsConn(nil), set.conns...)
+}
+
+// Stat returns the number of connections, and when the last one was opened.
+func (set *wsSet) Stat() (int, time.Time) {
+	set.mu.RLock()
+	defer set.mu.RUnlock()
+	return len(set.conns), set.modified
+}
+
+// dispatchIntercept releases every held message when intercepting is turned
+// off.
+func (set *wsSet) dispatchIntercept(change <-chan int) {
+	for range change {
+		if set.Intercept {
+			continue
+		}
+		for _, c := range set.Conns() {
+			for _, f := range c.Frames() {
+				if f.State() == "held" {
+					release(f.Forward)
+				}
+			}
+		}
+	}
+}
+
+// interceptsWebSocket returns whether the proxy takes over the given request
+// as a WebSocket connection, which it does for upgrades in scope.
+func (p *Proxy) interceptsWebSocket(r *http.Request) bool {
+	return r.Method != "CONNECT" && r.URL.IsAbs() && isWebSocketUpgrade(r) && p.inScope(r.URL)
+}
+
+// serveWebSocket passes an upgrade request on to its server, and if the
+// server agrees, takes over the connection so that its frames can be watched
+// and intercepted. The upgrade is recorded in the history, but isn't held in
+// the queues. Compression is turned off, so that frames can be read.
+func (p *Proxy) serveWebSocket(w http.ResponseWriter, r *http.Request) {
+	sent := time.Now()
+	server, err := p.dialUpstream(r.Context(), r.URL)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	h := r.Header.Clone()
+	h.Del("Sec-WebSocket-Extensions")
+	h.Del("Proxy-Connection")
+	h.Del("Proxy-Authorization")
+	bw := bufio.NewWriter(server)
+	writeRequestHead(bw, r, "HTTP/1.1", h)
+	if err := bw.Flush(); err != nil {
+		server.Close()
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	serverBuf := bufio.NewReader(server)
+	resp, err := http.ReadResponse(serverBuf, r)
+	if err != nil {
+		server.Close()
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	client := lookupClient(r.RemoteAddr)
+	e := p.recordRequest(r, client)
+
+	// Servers that refuse the upgrade answer as they would any request
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		defer server.Close()
+		spoolBody(&resp.Body)
+		p.recordResponse(e, resp, time.Since(sent), "proxy")
+		for k, v := range resp.Header {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, resp.Body)
+		return
+	}
+	p.recordResponse(e, resp, time.Since(sent), "proxy")
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		server.Close()
+		return
+	}
+	conn, clientBuf, err := hj.Hijack()
+	if err != nil {
+		server.Close()
+		return
+	}
+	head := new(bytes.Buffer)
+	fmt.Fprintf(head, "HTTP/1.1 %s\r\n", resp.Status)
+	resp.Header.Write(head)
+	head.WriteString("\r\n")
+	if _, err := conn.Write(head.Bytes()); err != nil {
+		conn.Close()
+		server.Close()
+		return
+	}
+
+	p.WebSockets.add(&wsConn{
+		URL:       r.URL.String(),
+		Client:    r.RemoteAddr,
+		Started:   time.Now(),
+		History:   e.ID,
+		client:    conn,
+		server:    server,
+		clientBuf: clientBuf.Reader,
+		serverBuf: serverBuf,
+		done:      make(chan struct{}),
+	})
+}
+
+// newWebSocketsDir returns the Dir exposing the WebSocket connections through
+// the proxy, with a directory per connection named by its ID, an index
+// summarising them, and the switch for intercepting their messages.
+func newWebSocketsDir(set *wsSet) *fusebox.Dir {
+	intercept := fusebox.NewBoolFile(&set.Intercept)
+	go set.dispatchIntercept(intercept.Change)
+
+	keys := func() []string {
+		n, _ := set.Stat()
+		ret := []string{"index", "intercept"}
+		for i := 0; i < n; i++ {
+			ret = append(ret, strconv.Itoa(i))
+		}
+		return ret
+	}
+
+	node := func(k string) fusebox.VarNode {
+		switch k {
+		case "index":
+			return newReadOnlyFile(func() []byte {
+				buf := new(bytes.Buffer)
+				for _, c := range set.Conns() {
+					buf.WriteString(c.Summary())
+				}
+				return buf.Bytes()
+			})
+		case "intercept":
+			return intercept
+		}
+
+		id, err := strconv.Atoi(k)
+		if err != nil {
+			return nil
+		}
+		c := set.Get(id)
+		if c == nil {
+			return nil
+		}
+		return newWebSocketDir(c)
+	}
+
+	return newFuncDir(keys, node)
+}
+
+// newWebSocketDir returns the Dir exposing a single WebSocket connection.
+func newWebSocketDir(c *wsConn) *fusebox.Dir {
+	ret, d := newNodeDir()
+	d.add("url", newReadOnlyFile(func() []byte { return []byte(c.URL + "\n") }))
+	d.add("history", newReadOnlyFile(func() []byte { return []byte(strconv.Itoa(c.History) + "\n") }))
+	d.add("summary", newReadOnlyFile(func() []byte { return []byte(c.Summary()) }))
+	d.add("frames", newWebSocketFramesDir(c))
+	d.add("close", newHandleFile(&wsCloseFile{c}))
+	return ret
+}
+
+// newWebSocketFramesDir returns the Dir with a directory per frame sent over
+// a connection, and an index summarising them.
+func newWebSocketFramesDir(c *wsConn) *fusebox.Dir {
+	keys := func() []string {
+		frames := c.Frames()
+		ret := []string{"index"}
+		for _, f := range frames {
+			ret = append(ret, strconv.Itoa(f.ID))
+		}
+		return ret
+	}
+
+	node := func(k string) fusebox.VarNode {
+		if k == "index" {
+			return newReadOnlyFile(func() []byte {
+				buf := new(bytes.Buffer)
+				for _, f := range c.Frames() {
+					buf.WriteString(f.Summary())
+				}
+				return buf.Bytes()
+			})
+		}
+
+		id, err := strconv.Atoi(k)
+		if err != nil {
+			return nil
+		}
+		f := c.Frame(id)
+		if f == nil {
+			return nil
+		}
+		return newWebSocketFrameDir(f)
+	}
+
+	return newFuncDir(keys, node)
+}
+
+// newWebSocketFrameDir returns the Dir exposing a single frame.
+func newWebSocketFrameDir(f *wsFrame) *fusebox.Dir {
+	ret, d := newNodeDir()
+	data := newHandleFile(&wsFrameDataFile{f})
+	data.OpenFlags = fuse.OpenDirectIO
+	d.add("data", data)
+	d.add("direction", newReadOnlyFile(func() []byte {
+		if f.Up {
+			return []byte("up\n")
+		}
+		return []byte("down\n")
+	}))
+	d.add("type", newReadOnlyFile(func() []byte { return []byte(wsOpcodeName(f.Opcode) + "\n") }))
+	d.add("time", newReadOnlyFile(func() []byte { return []byte(f.Time.Format(time.RFC3339Nano) + "\n") }))
+	d.add("state", newReadOnlyFile(func() []byte { return []byte(f.State() + "\n") }))
+	d.add("forward", fusebox.NewChanFile(f.Forward))
+	d.add("drop", fusebox.NewChanFile(f.Drop))
+	return ret
+}
+
+// wsFrameDataFile exposes the data of a frame, which can be edited while the
+// frame is held.
+type wsFrameDataFile struct {
+	Frame *wsFrame
+}
+
+func (f *wsFrameDataFile) ValRead(ctx context.Context) ([]byte, error) {
+	return f.Frame.Data(), nil
+}
+
+func (f *wsFrameDataFile) ValWrite(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+	f.Frame.mu.Lock()
+	defer f.Frame.mu.Unlock()
+	if f.Frame.state != "held" {
+		return errInvalid
+	}
+
+	f.Frame.data = append([]byte(nil), req.Data...)
+	resp.Size = len(req.Data)
+	return nil
+}
+
+func (f *wsFrameDataFile) Size(ctx context.Context) (uint64, error) {
+	return uint64(len(f.Frame.Data())), nil
+}
+
+// wsCloseFile reads 1 if the connection is closed, and closes it when 1 is
+// written.
+type wsCloseFile struct {
+	Conn *wsConn
+}
+
+func (f *wsCloseFile) ValRead(ctx context.Context) ([]byte, error) {
+	if f.Conn.Closed() {
+		return []byte("1\n"), nil
+	}
+	return []byte("0\n"), nil
+}
+
+func (f *wsCloseFile) ValWrite(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+	if strings.TrimSpace(string(req.Data)) != "1" {
+		return errInvalid
+	}
+
+	f.Conn.Close()
+	resp.Size = len(req.Data)
+	return nil
+}
+
+func (f *wsCloseFile) Size(ctx context.Context) (uint64, error) {
+	return 2, nil
+}